@@ -34,6 +34,9 @@ echo "Completed go vet .."
 # Run our golang tests
 go test ./...
 
+# Ensure we still compile to WebAssembly
+GOOS=js GOARCH=wasm go build ./...
+
 # If that worked build our examples, to ensure they work
 # and that we've not broken compatibility
 for i in _examples/*; do
@@ -28,8 +28,8 @@ func main() {
 // After that it will return true.
 //
 // The reason this works is because we use the same evalfilter
-// instance each time we launch it, so variables set persist
-// between runs.
+// instance each time we launch it, and we've asked for variables
+// which are set to persist between runs.
 //
 
 if ( ! count ) {
@@ -55,7 +55,7 @@ if ( count >= 10 )  {
 // Otherwise we're done.
 //
 return false;
-`)
+`, evalfilter.WithPersistentState())
 
 	//
 	// Prepare the script
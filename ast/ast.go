@@ -41,6 +41,14 @@ type Program struct {
 	// Statements is the set of statements which the program is comprised
 	// of.
 	Statements []Statement
+
+	// Comments holds all of the comments in the program, in the order
+	// in which they appeared.
+	Comments []*Comment
+
+	// Doc holds the comments which document the program, which are
+	// those at the start of the script, if any.
+	Doc []*Comment
 }
 
 // TokenLiteral returns the literal token of our program.
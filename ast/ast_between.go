@@ -0,0 +1,41 @@
+package ast
+
+import (
+	"bytes"
+
+	"github.com/skx/evalfilter/v2/token"
+)
+
+// BetweenExpression holds a range-test, such as
+// `Port between 1024 and 65535`.
+type BetweenExpression struct {
+	// Token holds the `between` token.
+	Token token.Token
+
+	// Value is the value being tested.
+	Value Expression
+
+	// Low is the lower bound of the range, inclusive.
+	Low Expression
+
+	// High is the upper bound of the range, inclusive.
+	High Expression
+}
+
+func (be *BetweenExpression) expressionNode() {}
+
+// TokenLiteral returns the literal token.
+func (be *BetweenExpression) TokenLiteral() string { return be.Token.Literal }
+
+// String returns this object as a string.
+func (be *BetweenExpression) String() string {
+	var out bytes.Buffer
+	out.WriteString("(")
+	out.WriteString(be.Value.String())
+	out.WriteString(" between ")
+	out.WriteString(be.Low.String())
+	out.WriteString(" and ")
+	out.WriteString(be.High.String())
+	out.WriteString(")")
+	return out.String()
+}
@@ -0,0 +1,61 @@
+package ast
+
+import (
+	"strings"
+
+	"github.com/skx/evalfilter/v2/token"
+)
+
+// Comment holds a comment, either `// ...` or `/* ... */`.
+//
+// Comments aren't statements, so they're held by the Program rather
+// than amongst its statements, but those which document a rule, or the
+// script as a whole, are also attached to it.
+type Comment struct {
+	// Token holds the text of the comment, including the markers
+	// which delimit it, and the line upon which it started.
+	Token token.Token
+
+	// Trailing is true if the comment follows code on the same line.
+	Trailing bool
+}
+
+// EndLine returns the line upon which the comment ends.
+func (c *Comment) EndLine() int {
+	return c.Token.Line + strings.Count(c.Token.Literal, "\n")
+}
+
+// Text returns the text of the comment, without the markers which
+// delimit it.
+//
+// The lines of a `/* ... */` comment may begin with a `*`, which is
+// removed too.
+func (c *Comment) Text() string {
+	text := c.Token.Literal
+
+	if strings.HasPrefix(text, "//") {
+		return strings.TrimSpace(strings.TrimPrefix(text, "//"))
+	}
+
+	text = strings.TrimSuffix(strings.TrimPrefix(text, "/*"), "*/")
+
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "*" || strings.HasPrefix(line, "* ") {
+			line = strings.TrimSpace(line[1:])
+		}
+		lines = append(lines, line)
+	}
+	return strings.Trim(strings.Join(lines, "\n"), "\n")
+}
+
+// CommentText returns the text of the given comments, which are usually
+// a group of adjacent comments, one per line.
+func CommentText(comments []*Comment) string {
+	var lines []string
+	for _, c := range comments {
+		lines = append(lines, c.Text())
+	}
+	return strings.Trim(strings.Join(lines, "\n"), "\n")
+}
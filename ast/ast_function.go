@@ -0,0 +1,41 @@
+package ast
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/skx/evalfilter/v2/token"
+)
+
+// FunctionLiteral holds a lambda-expression, such as "x => x > 3".
+type FunctionLiteral struct {
+	// Token is the literal token.
+	Token token.Token
+
+	// Parameters holds the names of the function-arguments.
+	Parameters []*Identifier
+
+	// Body is the expression which is evaluated when the
+	// function is invoked.
+	Body Expression
+}
+
+func (fl *FunctionLiteral) expressionNode() {}
+
+// TokenLiteral returns the literal token.
+func (fl *FunctionLiteral) TokenLiteral() string { return fl.Token.Literal }
+
+// String returns this object as a string.
+func (fl *FunctionLiteral) String() string {
+	var out bytes.Buffer
+	params := make([]string, 0)
+	for _, p := range fl.Parameters {
+		params = append(params, p.String())
+	}
+	out.WriteString(strings.Join(params, ", "))
+	out.WriteString(" => ")
+	if fl.Body != nil {
+		out.WriteString(fl.Body.String())
+	}
+	return out.String()
+}
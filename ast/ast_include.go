@@ -0,0 +1,32 @@
+package ast
+
+import (
+	"bytes"
+
+	"github.com/skx/evalfilter/v2/token"
+)
+
+// IncludeStatement holds an include-statement, which is used to load
+// the contents of another script, such as `include "common.ef";`.
+type IncludeStatement struct {
+	// Token is the literal token.
+	Token token.Token
+
+	// Name is the name of the script to include, which is passed
+	// to the resolver the host application supplied.
+	Name string
+}
+
+func (is *IncludeStatement) statementNode() {}
+
+// TokenLiteral returns the literal token.
+func (is *IncludeStatement) TokenLiteral() string { return is.Token.Literal }
+
+// String returns this object as a string.
+func (is *IncludeStatement) String() string {
+	var out bytes.Buffer
+	out.WriteString(is.TokenLiteral() + " ")
+	out.WriteString("\"" + is.Name + "\"")
+	out.WriteString(";")
+	return out.String()
+}
@@ -0,0 +1,38 @@
+package ast
+
+import (
+	"bytes"
+
+	"github.com/skx/evalfilter/v2/token"
+)
+
+// LetStatement declares a variable which is local to the block
+// in which it is declared, such as "let x = y;".
+type LetStatement struct {
+	// Token is the literal token.
+	Token token.Token
+
+	// Name is the name of the variable being declared.
+	Name *Identifier
+
+	// Value is the initial value of the variable.
+	Value Expression
+}
+
+func (ls *LetStatement) statementNode() {}
+
+// TokenLiteral returns the literal token.
+func (ls *LetStatement) TokenLiteral() string { return ls.Token.Literal }
+
+// String returns this object as a string.
+func (ls *LetStatement) String() string {
+	var out bytes.Buffer
+	out.WriteString(ls.TokenLiteral() + " ")
+	out.WriteString(ls.Name.String())
+	out.WriteString(" = ")
+	if ls.Value != nil {
+		out.WriteString(ls.Value.String())
+	}
+	out.WriteString(";")
+	return out.String()
+}
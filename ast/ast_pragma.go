@@ -0,0 +1,31 @@
+package ast
+
+import (
+	"github.com/skx/evalfilter/v2/token"
+)
+
+// PragmaStatement holds a pragma, which describes the script rather than
+// being executed, such as `#pragma version 3`.
+type PragmaStatement struct {
+	// Token is the literal token.
+	Token token.Token
+
+	// Name is the name of the pragma.
+	Name string
+
+	// Value is the remainder of the line, which may be empty.
+	Value string
+}
+
+func (ps *PragmaStatement) statementNode() {}
+
+// TokenLiteral returns the literal token.
+func (ps *PragmaStatement) TokenLiteral() string { return ps.Token.Literal }
+
+// String returns this object as a string.
+func (ps *PragmaStatement) String() string {
+	if ps.Value == "" {
+		return "#pragma " + ps.Name + "\n"
+	}
+	return "#pragma " + ps.Name + " " + ps.Value + "\n"
+}
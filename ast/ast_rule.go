@@ -0,0 +1,40 @@
+package ast
+
+import (
+	"bytes"
+
+	"github.com/skx/evalfilter/v2/token"
+)
+
+// RuleStatement holds a named rule, such as `rule "ssh-brute" { .. }`.
+//
+// Rules are compiled separately from the main body of the script, so
+// that they may be tested independently.
+type RuleStatement struct {
+	// Token is the literal token.
+	Token token.Token
+
+	// Name is the name of the rule.
+	Name string
+
+	// Body is the set of statements executed to test the rule.
+	Body *BlockStatement
+
+	// Doc holds the comments which document the rule, which are
+	// those on the lines immediately before it, if any.
+	Doc []*Comment
+}
+
+func (rs *RuleStatement) statementNode() {}
+
+// TokenLiteral returns the literal token.
+func (rs *RuleStatement) TokenLiteral() string { return rs.Token.Literal }
+
+// String returns this object as a string.
+func (rs *RuleStatement) String() string {
+	var out bytes.Buffer
+	out.WriteString(rs.TokenLiteral() + " ")
+	out.WriteString("\"" + rs.Name + "\" ")
+	out.WriteString(rs.Body.String())
+	return out.String()
+}
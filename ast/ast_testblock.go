@@ -0,0 +1,36 @@
+package ast
+
+import (
+	"bytes"
+
+	"github.com/skx/evalfilter/v2/token"
+)
+
+// TestStatement holds a named test, such as `test "ssh-brute" { .. }`.
+//
+// Tests are compiled separately from the main body of the script, and
+// are only executed by evalfilter.TestScript.
+type TestStatement struct {
+	// Token is the literal token.
+	Token token.Token
+
+	// Name is the name of the test.
+	Name string
+
+	// Body is the set of statements executed to run the test.
+	Body *BlockStatement
+}
+
+func (ts *TestStatement) statementNode() {}
+
+// TokenLiteral returns the literal token.
+func (ts *TestStatement) TokenLiteral() string { return ts.Token.Literal }
+
+// String returns this object as a string.
+func (ts *TestStatement) String() string {
+	var out bytes.Buffer
+	out.WriteString(ts.TokenLiteral() + " ")
+	out.WriteString("\"" + ts.Name + "\" ")
+	out.WriteString(ts.Body.String())
+	return out.String()
+}
@@ -0,0 +1,109 @@
+package ast
+
+// Walk traverses the given node, and everything it contains, in the order
+// they appear in the script.
+//
+// The function is called for each node, and if it returns false the
+// nodes contained by that node are skipped.  Included scripts are not
+// loaded, so only the IncludeStatement itself is visited.
+func Walk(node Node, fn func(Node) bool) {
+
+	if node == nil || !fn(node) {
+		return
+	}
+
+	switch n := node.(type) {
+
+	case *Program:
+		for _, s := range n.Statements {
+			Walk(s, fn)
+		}
+
+	case *BlockStatement:
+		for _, s := range n.Statements {
+			Walk(s, fn)
+		}
+
+	case *ExpressionStatement:
+		walkExpression(n.Expression, fn)
+
+	case *ReturnStatement:
+		walkExpression(n.ReturnValue, fn)
+
+	case *LetStatement:
+		if n.Name != nil {
+			Walk(n.Name, fn)
+		}
+		walkExpression(n.Value, fn)
+
+	case *AssignStatement:
+		if n.Name != nil {
+			Walk(n.Name, fn)
+		}
+		walkExpression(n.Value, fn)
+
+	case *RuleStatement:
+		walkBlock(n.Body, fn)
+
+	case *TestStatement:
+		walkBlock(n.Body, fn)
+
+	case *IfExpression:
+		walkExpression(n.Condition, fn)
+		walkBlock(n.Consequence, fn)
+		walkBlock(n.Alternative, fn)
+
+	case *WhileStatement:
+		walkExpression(n.Condition, fn)
+		walkBlock(n.Body, fn)
+
+	case *PrefixExpression:
+		walkExpression(n.Right, fn)
+
+	case *InfixExpression:
+		walkExpression(n.Left, fn)
+		walkExpression(n.Right, fn)
+
+	case *BetweenExpression:
+		walkExpression(n.Value, fn)
+		walkExpression(n.Low, fn)
+		walkExpression(n.High, fn)
+
+	case *CallExpression:
+		walkExpression(n.Function, fn)
+		for _, a := range n.Arguments {
+			walkExpression(a, fn)
+		}
+
+	case *IndexExpression:
+		walkExpression(n.Left, fn)
+		walkExpression(n.Index, fn)
+
+	case *ArrayLiteral:
+		for _, el := range n.Elements {
+			walkExpression(el, fn)
+		}
+
+	case *FunctionLiteral:
+		for _, p := range n.Parameters {
+			Walk(p, fn)
+		}
+		walkExpression(n.Body, fn)
+	}
+}
+
+// walkExpression walks the given expression, if it is present.
+//
+// This avoids passing a nil expression to Walk as a non-nil Node.
+func walkExpression(expr Expression, fn func(Node) bool) {
+	if expr != nil {
+		Walk(expr, fn)
+	}
+}
+
+// walkBlock walks the given block, if it is present.
+func walkBlock(block *BlockStatement, fn func(Node) bool) {
+	if block != nil {
+		Walk(block, fn)
+	}
+}
@@ -0,0 +1,207 @@
+// batch.go contains code for running scripts against many objects.
+
+package evalfilter
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"runtime"
+	"sync"
+)
+
+// RunSlice runs the script against each member of the given slice, or
+// array, and returns the results in the same order.
+//
+// This is more efficient than calling Run for each object yourself, as
+// structures are passed by reference rather than copied, and only the
+// fields which the script uses are converted - the reflection required
+// to find those fields happens once for each type, rather than once for
+// each object.
+//
+// If running the script against any object fails we stop, and return
+// an error identifying the object.
+func (e *Eval) RunSlice(objs interface{}) ([]bool, error) {
+
+	val := reflect.ValueOf(objs)
+	if val.Kind() != reflect.Slice && val.Kind() != reflect.Array {
+		return nil, fmt.Errorf("RunSlice expects a slice, got %T", objs)
+	}
+
+	results := make([]bool, val.Len())
+
+	for i := range results {
+
+		ret, err := e.Run(element(val, i))
+		if err != nil {
+			return nil, fmt.Errorf("error running against object %d: %s", i, err.Error())
+		}
+		results[i] = ret
+	}
+
+	return results, nil
+}
+
+// RunParallel runs the script against each member of the given slice, or
+// array, and returns the results in the same order - as RunSlice does.
+//
+// The slice is divided between the given number of goroutines, each of
+// which has its own virtual machine, so any functions you've added must
+// be safe for concurrent use.  If workers is less than one we use one
+// goroutine per CPU.
+//
+// If running the script against any object fails an error is returned,
+// identifying the first object which failed.
+func (e *Eval) RunParallel(objs interface{}, workers int) ([]bool, error) {
+
+	if e.machine == nil {
+		return nil, fmt.Errorf("the script has not been prepared")
+	}
+
+	val := reflect.ValueOf(objs)
+	if val.Kind() != reflect.Slice && val.Kind() != reflect.Array {
+		return nil, fmt.Errorf("RunParallel expects a slice, got %T", objs)
+	}
+
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	if workers > val.Len() {
+		workers = val.Len()
+	}
+
+	results := make([]bool, val.Len())
+
+	// failed holds the index of the object each worker failed
+	// against, if any, and the error which occurred.
+	failed := make([]int, workers)
+	errs := make([]error, workers)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+
+		// Each worker handles a contiguous range of objects.
+		start := w * len(results) / workers
+		end := (w + 1) * len(results) / workers
+
+		worker := e.clone()
+
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for i := start; i < end; i++ {
+				ret, err := worker.Run(element(val, i))
+				if err != nil {
+					failed[w] = i
+					errs[w] = err
+					return
+				}
+				results[i] = ret
+			}
+		}(w)
+	}
+
+	wg.Wait()
+
+	// The ranges are in order, so the first failure we find is
+	// the first object which failed.
+	for w, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("error running against object %d: %s", failed[w], err.Error())
+		}
+	}
+
+	return results, nil
+}
+
+// element returns the member of the given slice, or array, at the given
+// index.  Structures are returned by reference, to avoid copying them.
+func element(val reflect.Value, i int) interface{} {
+	el := val.Index(i)
+	if el.Kind() == reflect.Struct && el.CanAddr() {
+		el = el.Addr()
+	}
+	return el.Interface()
+}
+
+// Pipe runs the script against each object received from the input
+// channel, and sends those for which the script returned true to the
+// output channel.  This allows an evaluator to be used as a filtering
+// stage within a pipeline.
+//
+// The objects are processed by a pool of workers, one per CPU, each of
+// which has its own virtual machine.  As a result objects may be sent
+// to the output channel in a different order to that in which they
+// were received, and any functions you've added must be safe for
+// concurrent use.
+//
+// Pipe returns once the input channel has been closed and every object
+// has been processed, or the context is cancelled.  If running the
+// script against any object fails the pipe stops, and the error is
+// returned.  The output channel is not closed.
+func (e *Eval) Pipe(ctx context.Context, in <-chan interface{}, out chan<- interface{}) error {
+
+	if e.machine == nil {
+		return fmt.Errorf("the script has not been prepared")
+	}
+
+	// Our workers stop when the caller cancels, or when one fails.
+	stop, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	workers := runtime.NumCPU()
+
+	// errs holds the errors our workers encountered, if any.
+	errs := make(chan error, workers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+
+		worker := e.clone()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				var obj interface{}
+				var ok bool
+
+				select {
+				case <-stop.Done():
+					return
+				case obj, ok = <-in:
+					if !ok {
+						return
+					}
+				}
+
+				ret, err := worker.Run(obj)
+				if err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+				if !ret {
+					continue
+				}
+
+				select {
+				case <-stop.Done():
+					return
+				case out <- obj:
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return err
+	default:
+	}
+	return ctx.Err()
+}
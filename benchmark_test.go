@@ -173,3 +173,181 @@ func Benchmark_evalfilter_trivial(b *testing.B) {
 		b.Fail()
 	}
 }
+
+// Benchmark_evalfilter_slice - This tests running against a slice of objects.
+func Benchmark_evalfilter_slice(b *testing.B) {
+
+	//
+	// Prepare the script
+	//
+	eval := New(`if ( (Origin == "MOW" || Country == "RU") && (Value >= 100 || Adults == 1) ) { return true; }  else { return false; }`)
+
+	//
+	// Ensure this compiled properly.
+	//
+	err := eval.Prepare()
+	if err != nil {
+		fmt.Printf("Failed to compile: %s\n", err.Error())
+		return
+	}
+
+	//
+	// Create the objects we'll test against.
+	//
+	type Input struct {
+		Origin  string
+		Country string
+		Value   int
+		Adults  int
+		Notes   []string
+		Extra   map[string]string
+	}
+
+	objects := make([]Input, 1000)
+	for i := range objects {
+		objects[i] = Input{Origin: "MOW", Country: "RU", Adults: 1, Value: i}
+	}
+
+	var ret []bool
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		ret, err = eval.RunSlice(objects)
+	}
+	b.StopTimer()
+
+	if err != nil {
+		b.Fatal(err)
+	}
+	if !ret[0] {
+		b.Fail()
+	}
+}
+
+// Benchmark_evalfilter_loop - This tests the allocations made by arithmetic.
+func Benchmark_evalfilter_loop(b *testing.B) {
+
+	//
+	// Prepare the script
+	//
+	eval := New(`i = 0; total = 0; while ( i < 100 ) { total += i % 7; i++; } return total > Min;`)
+
+	//
+	// Ensure this compiled properly.
+	//
+	err := eval.Prepare()
+	if err != nil {
+		fmt.Printf("Failed to compile: %s\n", err.Error())
+		return
+	}
+
+	params := make(map[string]interface{})
+	params["Min"] = 10
+
+	var ret bool
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		ret, err = eval.Run(params)
+	}
+	b.StopTimer()
+
+	if err != nil {
+		b.Fatal(err)
+	}
+	if !ret {
+		b.Fail()
+	}
+}
+
+func Benchmark_evalfilter_fused(b *testing.B) {
+
+	//
+	// Prepare the script, which uses the fused comparison
+	// instruction, but can't be evaluated natively.
+	//
+	eval := New(`
+if ( Origin == "MOBILE" ) { return false; }
+if ( Country == "Finland" ) { return len(Name) > 3; }
+if ( Count == 3 ) { return true; }
+return false;
+`)
+
+	//
+	// Ensure this compiled properly.
+	//
+	err := eval.Prepare()
+	if err != nil {
+		fmt.Printf("Failed to compile: %s\n", err.Error())
+		return
+	}
+
+	params := make(map[string]interface{})
+	params["Origin"] = "WEB"
+	params["Country"] = "UK"
+	params["Name"] = "Steve"
+	params["Count"] = 3
+
+	var ret bool
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		ret, err = eval.Run(params)
+	}
+	b.StopTimer()
+
+	if err != nil {
+		b.Fatal(err)
+	}
+	if !ret {
+		b.Fail()
+	}
+}
+
+// Benchmark_evalfilter_large - This is a test of a script with many
+// distinct instructions, which stresses the dispatch of each of them.
+func Benchmark_evalfilter_large(b *testing.B) {
+
+	//
+	// Prepare the script
+	//
+	script := ""
+	for i := 0; i < 100; i++ {
+		script += fmt.Sprintf("if ( Count * %d + Price / 2 - %d > 10000 || !Admin && Name != \"x%d\" ) { return false; }\n", i, i, i)
+	}
+	script += "return true;"
+
+	eval := New(script)
+
+	//
+	// Ensure this compiled properly.
+	//
+	err := eval.Prepare()
+	if err != nil {
+		fmt.Printf("Failed to compile: %s\n", err.Error())
+		return
+	}
+
+	params := make(map[string]interface{})
+	params["Count"] = 3
+	params["Price"] = 2.5
+	params["Admin"] = true
+	params["Name"] = "Steve"
+
+	var ret bool
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		ret, err = eval.Run(params)
+	}
+	b.StopTimer()
+
+	if err != nil {
+		b.Fatal(err)
+	}
+	if !ret {
+		b.Fail()
+	}
+}
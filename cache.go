@@ -0,0 +1,126 @@
+// cache.go contains a cache of compiled programs.
+
+package evalfilter
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+)
+
+// Cache holds a bounded number of compiled programs, keyed by a hash
+// of their source.
+//
+// This is useful for services which receive the same scripts over and
+// over again, as it avoids the need to parse and compile them each time.
+// When the cache is full the least-recently used program is discarded.
+//
+// A Cache is safe for concurrent use.  Each call returns an instance of
+// its own, which shares the compiled bytecode, functions, and variables,
+// of the cached program but has its own virtual machines, so that many
+// goroutines may run the same script at once.  As the environment is
+// shared you should avoid modifying it via the instances returned.
+type Cache struct {
+	// mutex protects our state.
+	mutex sync.Mutex
+
+	// size is the maximum number of programs we'll store.
+	size int
+
+	// options are applied to every program we compile.
+	options []Option
+
+	// order holds our entries, with the most recently used first.
+	order *list.List
+
+	// entries maps the hash of a script to its place in order.
+	entries map[string]*list.Element
+}
+
+// entry is the value stored in each element of our list.
+type entry struct {
+	// key is the hash of the script.
+	key string
+
+	// eval is the compiled program.
+	eval *Eval
+}
+
+// NewCache creates a cache which will hold up to size compiled programs.
+//
+// The supplied options are used when each program is created.
+func NewCache(size int, options ...Option) *Cache {
+	if size < 1 {
+		size = 1
+	}
+	return &Cache{
+		size:    size,
+		options: options,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// GetOrCompile returns the compiled form of the given script.
+//
+// If the script is not already present in the cache it is created and
+// prepared, then stored for future use.  Scripts which fail to compile
+// are not cached.
+//
+// The instance returned belongs to the caller, and may be run without
+// any further locking.  If variables persist between runs they do so
+// only within that instance.
+func (c *Cache) GetOrCompile(src string) (*Eval, error) {
+
+	sum := sha256.Sum256([]byte(src))
+	key := hex.EncodeToString(sum[:])
+
+	c.mutex.Lock()
+	if el, ok := c.entries[key]; ok {
+		c.order.MoveToFront(el)
+		c.mutex.Unlock()
+		return el.Value.(*entry).eval.clone(), nil
+	}
+	c.mutex.Unlock()
+
+	//
+	// Compile without holding the lock, so that a slow compilation
+	// doesn't block other callers.
+	//
+	e := New(src, c.options...)
+	err := e.Prepare()
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile script: %s", err.Error())
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	//
+	// Another caller might have compiled the same script while
+	// we were doing so; if so prefer their copy.
+	//
+	if el, ok := c.entries[key]; ok {
+		c.order.MoveToFront(el)
+		return el.Value.(*entry).eval.clone(), nil
+	}
+
+	c.entries[key] = c.order.PushFront(&entry{key: key, eval: e})
+
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*entry).key)
+	}
+
+	return e.clone(), nil
+}
+
+// Len returns the number of programs currently held in the cache.
+func (c *Cache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,302 @@
+// Command evalfilter-server exposes the evaluator over HTTP, so that
+// services which aren't written in golang can share exactly the same
+// filter semantics as those which are.
+//
+// It accepts JSON requests, via POST, at two endpoints:
+//
+//	/compile    {"script": "..."}
+//	/evaluate   {"script": "...", "event": {...}, "trace": true}
+//
+// /compile returns any `error` preparing the script, along with its
+// `warnings`, the names of its `rules`, and its `metadata`.
+//
+// /evaluate runs the script against the given event, returning the
+// `verdict`, any `error`, the `output` of any calls the script made to
+// `print`, and, if it was requested, a `trace` of each expression which
+// was evaluated along with its value.  The script is run once, so the
+// verdict and the trace always agree.  If the output was too large to
+// be kept in full `output_truncated` is true.
+//
+// The size of each request, the complexity of each script, the number of
+// instructions each run may execute, the size of its output, and the time
+// spent handling each request are limited by the command-line flags.  A
+// request may tighten the limits on its script, via its `limits` member,
+// but it may not loosen them.
+//
+// The limit on time is soft.  The virtual machine can't be interrupted,
+// so a script which is still running when its request times out
+// continues in the background until it finishes, or reaches the limit on
+// the number of steps; it is that limit which bounds the work each
+// request may cause.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/skx/evalfilter/v2"
+)
+
+// limits holds the limits on the complexity of a script, as they appear
+// in a request.
+type limits struct {
+	MaxInstructions int `json:"max_instructions"`
+	MaxConstants    int `json:"max_constants"`
+	MaxDepth        int `json:"max_depth"`
+	MaxRegexps      int `json:"max_regexps"`
+	MaxSteps        int `json:"max_steps"`
+}
+
+// request holds the members of a request, to either endpoint.
+type request struct {
+	Script string          `json:"script"`
+	Event  json.RawMessage `json:"event"`
+	Trace  bool            `json:"trace"`
+	Limits *limits         `json:"limits"`
+}
+
+// traceNode describes the evaluation of a single expression.
+type traceNode struct {
+	Expression string       `json:"expression"`
+	Value      string       `json:"value"`
+	Type       string       `json:"type"`
+	Children   []*traceNode `json:"children,omitempty"`
+}
+
+// server holds our configuration.
+type server struct {
+	// limits are the limits applied to every script.
+	limits evalfilter.Limits
+
+	// maxBody is the maximum size of a request, in bytes.
+	maxBody int64
+
+	// maxOutput is the maximum size of the output we keep from each
+	// run, in bytes.
+	maxOutput int
+
+	// timeout is the maximum time spent handling a request.
+	timeout time.Duration
+}
+
+// limitedBuffer holds the output of a script, discarding anything which
+// would take it beyond its limit.
+type limitedBuffer struct {
+	// buf holds the output we've kept.
+	buf bytes.Buffer
+
+	// limit is the maximum size of buf, or zero for no limit.
+	limit int
+
+	// truncated is true if any output was discarded.
+	truncated bool
+}
+
+// Write appends as much of the given output as we have room for, and
+// silently discards the remainder.
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buf.Len(); b.limit > 0 && len(p) > room {
+		b.buf.Write(p[:room])
+		b.truncated = true
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+// tighten returns the smaller of the two limits, where zero means there
+// is no limit.
+func tighten(limit int, requested int) int {
+	if requested > 0 && (limit == 0 || requested < limit) {
+		return requested
+	}
+	return limit
+}
+
+// evaluator creates an evaluator for the script of the given request,
+// and prepares it.
+func (s *server) evaluator(req *request) (*evalfilter.Eval, error) {
+
+	l := s.limits
+	if req.Limits != nil {
+		l.MaxInstructions = tighten(l.MaxInstructions, req.Limits.MaxInstructions)
+		l.MaxConstants = tighten(l.MaxConstants, req.Limits.MaxConstants)
+		l.MaxDepth = tighten(l.MaxDepth, req.Limits.MaxDepth)
+		l.MaxRegexps = tighten(l.MaxRegexps, req.Limits.MaxRegexps)
+		l.MaxSteps = tighten(l.MaxSteps, req.Limits.MaxSteps)
+	}
+
+	e := evalfilter.New(req.Script, evalfilter.WithLimits(l))
+	return e, e.Prepare()
+}
+
+// compile prepares the script of the given request, and describes it.
+func (s *server) compile(req *request) map[string]interface{} {
+
+	e, err := s.evaluator(req)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}
+	}
+
+	warnings := []string{}
+	for _, w := range e.Warnings() {
+		warnings = append(warnings, w.String())
+	}
+	rules := append([]string{}, e.Rules()...)
+
+	m := e.Metadata()
+	metadata := map[string]interface{}{
+		"name":           m.Name,
+		"version":        m.Version,
+		"require_fields": append([]string{}, m.RequireFields...),
+		"pragmas":        m.Pragmas,
+	}
+
+	return map[string]interface{}{"error": nil, "warnings": warnings, "rules": rules, "metadata": metadata}
+}
+
+// evaluate runs the script of the given request against its event, and
+// describes the result.
+func (s *server) evaluate(req *request) map[string]interface{} {
+
+	if len(req.Event) == 0 {
+		return map[string]interface{}{"verdict": false, "error": "the request has no event", "output": ""}
+	}
+
+	e, err := s.evaluator(req)
+	if err != nil {
+		return map[string]interface{}{"verdict": false, "error": err.Error(), "output": ""}
+	}
+
+	output := &limitedBuffer{limit: s.maxOutput}
+	e.SetOutput(output)
+
+	//
+	// If a trace was requested then the verdict comes from the run
+	// which is explained, rather than from running the script twice.
+	//
+	var ret bool
+	trace := []*traceNode{}
+	if req.Trace {
+		var x *evalfilter.Explanation
+		x, err = e.ExplainJSON(req.Event)
+		if x != nil {
+			ret = x.Result
+			for _, step := range x.Steps {
+				trace = append(trace, convert(step))
+			}
+		}
+	} else {
+		ret, err = e.RunJSON(req.Event)
+	}
+
+	res := map[string]interface{}{"verdict": ret, "error": nil, "output": output.buf.String()}
+	if err != nil {
+		res["error"] = err.Error()
+	}
+	if req.Trace {
+		res["trace"] = trace
+	}
+	if output.truncated {
+		res["output_truncated"] = true
+	}
+
+	return res
+}
+
+// convert converts the given node of an explanation to a node of our
+// trace.
+func convert(node *evalfilter.ExplainNode) *traceNode {
+	t := &traceNode{
+		Expression: node.Expression,
+		Value:      node.Value.Inspect(),
+		Type:       string(node.Value.Type()),
+	}
+	for _, child := range node.Children {
+		t.Children = append(t.Children, convert(child))
+	}
+	return t
+}
+
+// handler returns an HTTP handler which decodes the request, passes it
+// to the given function, and encodes its response.
+func (s *server) handler(fn func(req *request) map[string]interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			fail(w, http.StatusMethodNotAllowed, "only POST is supported")
+			return
+		}
+
+		var req request
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, s.maxBody))
+		if err := dec.Decode(&req); err != nil {
+			fail(w, http.StatusBadRequest, fmt.Sprintf("failed to decode request: %s", err))
+			return
+		}
+
+		done := make(chan map[string]interface{}, 1)
+		go func() {
+			done <- fn(&req)
+		}()
+
+		select {
+		case res := <-done:
+			reply(w, http.StatusOK, res)
+		case <-time.After(s.timeout):
+			fail(w, http.StatusServiceUnavailable, "timed out")
+		}
+	}
+}
+
+// fail sends an error response.
+func fail(w http.ResponseWriter, status int, message string) {
+	reply(w, status, map[string]interface{}{"error": message})
+}
+
+// reply sends the given response, as JSON.
+func reply(w http.ResponseWriter, status int, res map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Printf("failed to send response: %s", err)
+	}
+}
+
+func main() {
+
+	listen := flag.String("listen", "127.0.0.1:8080", "The address to listen upon.")
+	maxBody := flag.Int64("max-body", 1<<20, "The maximum size of a request, in bytes.")
+	maxOutput := flag.Int("max-output", 64<<10, "The maximum size of the output kept from each run, in bytes, or 0 for no limit.")
+	timeout := flag.Duration("timeout", 5*time.Second, "The maximum time spent handling a request, though a script may continue running in the background after it.")
+	maxInstructions := flag.Int("max-instructions", 10000, "The maximum number of instructions in a script, or 0 for no limit.")
+	maxConstants := flag.Int("max-constants", 1000, "The maximum number of constants in a script, or 0 for no limit.")
+	maxDepth := flag.Int("max-depth", 64, "The maximum nesting depth of a script, or 0 for no limit.")
+	maxRegexps := flag.Int("max-regexps", 100, "The maximum number of regular expressions in a script, or 0 for no limit.")
+	maxSteps := flag.Int("max-steps", 1000000, "The maximum number of instructions a script may execute, or 0 for no limit.")
+	flag.Parse()
+
+	s := &server{
+		limits: evalfilter.Limits{
+			MaxInstructions: *maxInstructions,
+			MaxConstants:    *maxConstants,
+			MaxDepth:        *maxDepth,
+			MaxRegexps:      *maxRegexps,
+			MaxSteps:        *maxSteps,
+		},
+		maxBody:   *maxBody,
+		maxOutput: *maxOutput,
+		timeout:   *timeout,
+	}
+
+	http.HandleFunc("/compile", s.handler(s.compile))
+	http.HandleFunc("/evaluate", s.handler(s.evaluate))
+
+	log.Printf("listening on %s", *listen)
+	log.Fatal(http.ListenAndServe(*listen, nil))
+}
@@ -0,0 +1,96 @@
+//go:build js && wasm
+// +build js,wasm
+
+// Command evalfilter-wasm exposes the evaluator to JavaScript, when it
+// is compiled to WebAssembly, so that applications which manage rules
+// can validate, and preview, them in the browser with exactly the same
+// semantics as the server which runs them.
+//
+// It defines a global `evalfilter` object, which has two functions:
+//
+//	evalfilter.compile(script)
+//	evalfilter.run(script, json)
+//
+// compile returns an object whose `error` member is null if the script
+// is valid, along with its `warnings`, and the names of its `rules`.
+//
+// run executes the script against the given JSON document, returning an
+// object holding the `result`, any `error`, and the `output` of any calls
+// the script made to `print`.
+package main
+
+import (
+	"bytes"
+	"syscall/js"
+
+	"github.com/skx/evalfilter/v2"
+)
+
+// compile prepares the given script, and describes the result.
+func compile(script string) map[string]interface{} {
+
+	e := evalfilter.New(script)
+	if err := e.Prepare(); err != nil {
+		return map[string]interface{}{"error": err.Error()}
+	}
+
+	warnings := []interface{}{}
+	for _, w := range e.Warnings() {
+		warnings = append(warnings, w.String())
+	}
+	rules := []interface{}{}
+	for _, name := range e.Rules() {
+		rules = append(rules, name)
+	}
+
+	return map[string]interface{}{"error": nil, "warnings": warnings, "rules": rules}
+}
+
+// run executes the given script against the given JSON document, and
+// describes the result.
+func run(script string, document string) map[string]interface{} {
+
+	var output bytes.Buffer
+
+	e := evalfilter.New(script)
+	e.SetOutput(&output)
+	if err := e.Prepare(); err != nil {
+		return map[string]interface{}{"result": false, "error": err.Error(), "output": ""}
+	}
+
+	ret, err := e.RunJSON([]byte(document))
+	if err != nil {
+		return map[string]interface{}{"result": false, "error": err.Error(), "output": output.String()}
+	}
+	return map[string]interface{}{"result": ret, "error": nil, "output": output.String()}
+}
+
+// wrap converts the given function to one which may be called from
+// JavaScript with the given number of string arguments.
+func wrap(args int, fn func(args []string) map[string]interface{}) js.Func {
+	return js.FuncOf(func(this js.Value, values []js.Value) interface{} {
+		if len(values) != args {
+			return map[string]interface{}{"error": "wrong number of arguments"}
+		}
+		var strs []string
+		for _, v := range values {
+			strs = append(strs, v.String())
+		}
+		return fn(strs)
+	})
+}
+
+func main() {
+
+	js.Global().Set("evalfilter", map[string]interface{}{
+		"compile": wrap(1, func(args []string) map[string]interface{} {
+			return compile(args[0])
+		}),
+		"run": wrap(2, func(args []string) map[string]interface{} {
+			return run(args[0], args[1])
+		}),
+	})
+
+	// Our functions must remain available, so we never exit.
+	select {}
+}
@@ -50,7 +50,7 @@ func (p *bytecodeCmd) Run(file string) {
 	//
 	// Create the evaluator.
 	//
-	eval := evalfilter.New(string(dat))
+	eval := evalfilter.New(string(dat), evalfilter.WithIncludeResolver(includeFrom(file)))
 
 	var flags []byte
 	if p.raw {
@@ -0,0 +1,26 @@
+//
+// Support for `include` statements.
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+)
+
+//
+// includeFrom returns a resolver which loads included scripts from
+// the filesystem, relative to the directory containing the given file.
+//
+func includeFrom(file string) func(name string) (string, error) {
+	dir := filepath.Dir(file)
+
+	return func(name string) (string, error) {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(dir, name)
+		}
+		dat, err := ioutil.ReadFile(name)
+		return string(dat), err
+	}
+}
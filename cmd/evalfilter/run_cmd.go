@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -47,7 +46,7 @@ func (p *runCmd) SetFlags(f *flag.FlagSet) {
 //
 func (p *runCmd) Run(file string) {
 
-	obj := make(map[string]interface{})
+	obj := []byte("{}")
 	//
 	// If we have a JSON file then populate our object.
 	//
@@ -61,15 +60,7 @@ func (p *runCmd) Run(file string) {
 			fmt.Printf("Error reading file %s - %s\n", p.jsonFile, err.Error())
 			return
 		}
-
-		//
-		// Parse the JSON
-		//
-		err = json.Unmarshal(dat, &obj)
-		if err != nil {
-			fmt.Printf("Error parsing JSON %s\n", err.Error())
-			return
-		}
+		obj = dat
 	}
 
 	//
@@ -84,7 +75,7 @@ func (p *runCmd) Run(file string) {
 	//
 	// Create the evaluator.
 	//
-	eval := evalfilter.New(string(dat))
+	eval := evalfilter.New(string(dat), evalfilter.WithIncludeResolver(includeFrom(file)))
 
 	//
 	// Flags to pass to the preperation function.
@@ -102,11 +93,14 @@ func (p *runCmd) Run(file string) {
 		fmt.Printf("Error compiling:%s\n", err.Error())
 		return
 	}
+	for _, w := range eval.Warnings() {
+		fmt.Printf("Warning: %s\n", w)
+	}
 
 	//
 	// Run the script.
 	//
-	ret, err := eval.Run(obj)
+	ret, err := eval.RunJSON(obj)
 	if err != nil {
 		fmt.Printf("Failed to run script: %s\n", err.Error())
 		return
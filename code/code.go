@@ -49,6 +49,87 @@ const (
 	// Store a literal array
 	OpArray
 
+	// Create a function from a lambda-expression.
+	//
+	// The 16-bit argument is the offset of the function-constant,
+	// which is bound to the current scope and pushed upon the stack.
+	OpClosure
+
+	// Install an error-handler.
+	//
+	// If an error occurs before the matching OpEndTry is executed then
+	// the stack is restored, and execution continues at the 16-bit
+	// offset given as the argument.
+	OpTry
+
+	// Advance the iterator on the top of the stack, leaving it in
+	// place, and push the key and value of its next member.
+	//
+	// If the iterator has no more members then nothing is pushed,
+	// and execution continues at the 16-bit offset given as the
+	// argument instead.
+	OpIterNext
+
+	// Record that a statement, or branch, of the script has been
+	// reached, for coverage reports.
+	//
+	// The 16-bit argument is the index of the counter to increment.
+	// This is only generated if coverage was requested.
+	OpCover
+
+	// Record the value on the top of the stack, without removing it,
+	// for explaining the result of a script.
+	//
+	// The 16-bit argument identifies the expression which produced
+	// the value.  This is only generated by Explain.
+	OpTrace
+
+	// Pop a value from the stack, and push TRUE if it has the type
+	// tested for by the type-predicate in the function slot at the
+	// 16-bit offset, otherwise push FALSE.  If the host application
+	// has replaced the function since, it is called instead.
+	//
+	// This is used in place of calls to our type-predicates, such
+	// as `is_int`, when the compiler can resolve them.
+	OpIsType
+
+	// Test that the value on the top of the stack is a boolean, and
+	// leave it in place, or fail with an error if it isn't.
+	//
+	// The 16-bit argument is the line of the return statement which
+	// produced the value, which is included in the error.  This is
+	// only generated when the host requires a boolean verdict.
+	OpRequireBool
+
+	// Call one of our built-in functions, by slot.
+	//
+	// This is used in place of OpConstant and OpCall when the compiler
+	// can resolve the name of the function ahead of time.  It takes
+	// two 16-bit arguments; the slot of the function in the environment
+	// and the number of items to pop off the stack to pass to it.
+	//
+	// Once complete push the result of the call back to the stack.
+	OpCallBuiltin
+
+	// Pop two values from the stack, and push the result of applying
+	// an infix operator which was added by the host application.
+	//
+	// The 16-bit argument is the slot of the operator, in the table
+	// of operators held by the environment.
+	OpCustomOp
+
+	// Lookup a field, compare it with a constant, and jump if they are
+	// not equal.
+	//
+	// This is a "superinstruction" which the optimizer substitutes for
+	// the sequence OpLookup, OpConstant, OpEqual, OpJumpIfFalse, which
+	// is generated for conditions such as `if ( Name == "Steve" )`.
+	//
+	// Unlike our other opcodes it takes three 16-bit arguments; the
+	// offset of the name to lookup, the offset of the constant to
+	// compare against, and the offset to jump to.
+	OpLookupConstantEqual
+
 	//
 	// NOTE:  This is a fake opcode.
 	//
@@ -62,6 +143,18 @@ const (
 	// Set a variable by name
 	OpSet
 
+	// Declare a variable, by name, in the current scope.
+	OpLet
+
+	// Create a new scope, for variables declared via `let`.
+	OpEnterScope
+
+	// Discard the current scope, and return to the enclosing one.
+	OpLeaveScope
+
+	// Remove the error-handler installed by the most recent OpTry.
+	OpEndTry
+
 	// Push a TRUE value onto the stack.
 	OpTrue
 
@@ -78,8 +171,15 @@ const (
 	OpMul
 
 	// Pop two values from the stack, divide them, and push the result.
+	//
+	// Integers are promoted to floats first, unless the machine was
+	// configured to divide them as integers.
 	OpDiv
 
+	// Pop two values from the stack, divide them, and push the result
+	// without its fractional part.
+	OpIntDiv
+
 	// Pop two values from the stack, run a modulus op, push the result.
 	OpMod
 
@@ -129,6 +229,14 @@ const (
 	// regexp in the second push TRUE, else push FALSE.
 	OpNotMatches
 
+	// Pop two values from the stack, if the first matches the regexp
+	// in the second, ignoring case, push TRUE, else push FALSE.
+	OpIMatches
+
+	// Pop two values from the stack, if the first does not match the
+	// regexp in the second, ignoring case, push TRUE, else push FALSE.
+	OpNotIMatches
+
 	// Pop two values from the stack.  If both are TRUE push TRUE,
 	// otherwise push FALSE.
 	OpAnd
@@ -137,9 +245,55 @@ const (
 	// otherwise push FALSE.
 	OpOr
 
+	// Pop two values from the stack.  If exactly one of them is TRUE
+	// push TRUE, otherwise push FALSE.
+	OpXor
+
+	// Pop two integers from the stack, push the bitwise AND of them.
+	OpBitAnd
+
+	// Pop two integers from the stack, push the bitwise OR of them.
+	OpBitOr
+
+	// Pop two integers from the stack, push the bitwise exclusive-or
+	// of them.
+	OpBitXor
+
+	// Pop two integers from the stack, shift the first left by the
+	// number of bits given in the second, and push the result.
+	OpShiftLeft
+
+	// Pop two integers from the stack, shift the first right by the
+	// number of bits given in the second, and push the result.
+	OpShiftRight
+
+	// Pop an integer from the stack, push back the bitwise complement.
+	OpBitNot
+
 	// Array index operaton
 	OpArrayIndex
 
+	// Pop three values from the stack, the upper bound, the lower
+	// bound, and the value to test.  Push TRUE if the value is within
+	// the bounds, inclusive, otherwise push FALSE.
+	OpBetween
+
+	// Pop two values from the stack, a collection and a value, and
+	// push TRUE if the value is a member of the collection, otherwise
+	// push FALSE.
+	OpIn
+
+	// Pop a value from the stack, and push an iterator over its
+	// members.  Arrays, strings, and hashes may be iterated over.
+	OpIterNew
+
+	// Pop an iterator from the stack, once the iteration is complete.
+	OpIterDone
+
+	// Pop two values from the stack, a value and a name, and record the
+	// value as evidence with that name, then push the value back.
+	OpCapture
+
 	//
 	// NOTE:  This is a fake opcode.
 	//
@@ -153,10 +307,17 @@ const (
 // All opcodes are a single byte, but some require a mandatory argument.
 //
 // This function returns the total expected length of the opcode and
-// any required argument.  Note that at the moment all opcodes require
-// either zero or one arguments (where the argument is a two-byte
-// 16-bit integer).  This might change in the future.
+// any required arguments.  Note that all arguments are two-byte 16-bit
+// integers, and that most opcodes require either zero or one of them.
+// The exceptions are OpCallBuiltin which requires two, and
+// OpLookupConstantEqual which requires three.
 func Length(op Opcode) int {
+	switch op {
+	case OpCallBuiltin:
+		return 5
+	case OpLookupConstantEqual:
+		return 7
+	}
 	if op < OpCodeSingleArg {
 		return 3
 	}
@@ -186,6 +347,14 @@ func String(op Opcode) string {
 		return "OpNop"
 	case OpSet:
 		return "OpSet"
+	case OpLet:
+		return "OpLet"
+	case OpEnterScope:
+		return "OpEnterScope"
+	case OpLeaveScope:
+		return "OpLeaveScope"
+	case OpEndTry:
+		return "OpEndTry"
 	case OpTrue:
 		return "OpTrue"
 	case OpFalse:
@@ -198,6 +367,8 @@ func String(op Opcode) string {
 		return "OpMul"
 	case OpDiv:
 		return "OpDiv"
+	case OpIntDiv:
+		return "OpIntDiv"
 	case OpMod:
 		return "OpMod"
 	case OpPower:
@@ -226,14 +397,62 @@ func String(op Opcode) string {
 		return "OpMatches"
 	case OpNotMatches:
 		return "OpNotMatches"
+	case OpIMatches:
+		return "OpIMatches"
+	case OpNotIMatches:
+		return "OpNotIMatches"
 	case OpAnd:
 		return "OpAnd"
 	case OpOr:
 		return "OpOr"
+	case OpXor:
+		return "OpXor"
+	case OpBitAnd:
+		return "OpBitAnd"
+	case OpBitOr:
+		return "OpBitOr"
+	case OpBitXor:
+		return "OpBitXor"
+	case OpShiftLeft:
+		return "OpShiftLeft"
+	case OpShiftRight:
+		return "OpShiftRight"
+	case OpBitNot:
+		return "OpBitNot"
 	case OpArray:
 		return "OpArray"
+	case OpClosure:
+		return "OpClosure"
+	case OpTry:
+		return "OpTry"
+	case OpIterNext:
+		return "OpIterNext"
+	case OpIterNew:
+		return "OpIterNew"
+	case OpIterDone:
+		return "OpIterDone"
+	case OpCapture:
+		return "OpCapture"
+	case OpCover:
+		return "OpCover"
+	case OpTrace:
+		return "OpTrace"
+	case OpIsType:
+		return "OpIsType"
+	case OpRequireBool:
+		return "OpRequireBool"
+	case OpCallBuiltin:
+		return "OpCallBuiltin"
+	case OpCustomOp:
+		return "OpCustomOp"
+	case OpLookupConstantEqual:
+		return "OpLookupConstantEqual"
 	case OpArrayIndex:
 		return "OpArrayIndex"
+	case OpIn:
+		return "OpIn"
+	case OpBetween:
+		return "OpBetween"
 	default:
 		return "OpUnknown"
 	}
@@ -18,7 +18,15 @@ func TestOpcodes(t *testing.T) {
 		}
 
 		// Opcode length
-		if i < OpCodeSingleArg {
+		if i == OpCallBuiltin {
+			if Length(i) != 5 {
+				t.Fatalf("Invalid length of opcode %s", x)
+			}
+		} else if i == OpLookupConstantEqual {
+			if Length(i) != 7 {
+				t.Fatalf("Invalid length of opcode %s", x)
+			}
+		} else if i < OpCodeSingleArg {
 			if Length(i) != 3 {
 				t.Fatalf("Invalid length of opcode %s", x)
 			}
@@ -0,0 +1,179 @@
+// coverage.go contains code for reporting which parts of a script have
+// been executed.
+
+package evalfilter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/skx/evalfilter/v2/ast"
+	"github.com/skx/evalfilter/v2/code"
+)
+
+// CoveragePoint is a statement, or a branch, of a script which has been
+// instrumented for coverage reporting.
+type CoveragePoint struct {
+	// Source is the name of the included script which contains the
+	// point, or empty if the point is in the main script.
+	Source string
+
+	// Rule is the name of the rule which contains the point, or
+	// empty if the point isn't within a rule.
+	Rule string
+
+	// Line is the line of the source upon which the point begins.
+	Line int
+
+	// Kind describes the point; "statement" for a statement, "then"
+	// or "else" for the branches of an if-statement, and "loop" for
+	// the body of a while-loop.
+	//
+	// Every if-statement has an "else" branch, even if it has no
+	// else-block, which is taken when its condition is false.
+	Kind string
+
+	// Count is the number of times the point was reached.
+	Count uint64
+}
+
+// CoverageReport holds the result of coverage reporting.
+//
+// It is returned by the Coverage method, and covers every run of the
+// script since it was prepared, or since the coverage was last reset.
+type CoverageReport struct {
+	// Points holds each of the instrumented points of the script,
+	// in the order they were compiled.
+	Points []CoveragePoint
+}
+
+// Statements returns the number of statements which have been executed,
+// and the total number of statements.
+func (c CoverageReport) Statements() (int, int) {
+	return c.count(func(p CoveragePoint) bool { return p.Kind == "statement" })
+}
+
+// Branches returns the number of branches which have been taken, and the
+// total number of branches.
+func (c CoverageReport) Branches() (int, int) {
+	return c.count(func(p CoveragePoint) bool { return p.Kind != "statement" })
+}
+
+// count returns the number of matching points which have been reached,
+// and the total number of matching points.
+func (c CoverageReport) count(match func(CoveragePoint) bool) (int, int) {
+	covered := 0
+	total := 0
+	for _, p := range c.Points {
+		if match(p) {
+			total++
+			if p.Count > 0 {
+				covered++
+			}
+		}
+	}
+	return covered, total
+}
+
+// String returns a human-readable summary of the report, listing any
+// statements and branches which have not been reached.
+func (c CoverageReport) String() string {
+	var out strings.Builder
+
+	covered, total := c.Statements()
+	fmt.Fprintf(&out, "statements: %d/%d\n", covered, total)
+	covered, total = c.Branches()
+	fmt.Fprintf(&out, "branches: %d/%d\n", covered, total)
+
+	var missed []CoveragePoint
+	for _, p := range c.Points {
+		if p.Count == 0 {
+			missed = append(missed, p)
+		}
+	}
+	sort.SliceStable(missed, func(i, j int) bool {
+		if missed[i].Source != missed[j].Source {
+			return missed[i].Source < missed[j].Source
+		}
+		return missed[i].Line < missed[j].Line
+	})
+
+	for _, p := range missed {
+		where := fmt.Sprintf("line %d %s", p.Line, p.Kind)
+		if p.Source != "" {
+			where = p.Source + " " + where
+		}
+		if p.Rule != "" {
+			where += " (rule " + p.Rule + ")"
+		}
+		fmt.Fprintf(&out, "not reached: %s\n", where)
+	}
+
+	return out.String()
+}
+
+// WithCoverage causes the script to be instrumented, so that the
+// statements and branches which each run reaches are counted.  The
+// results are available via the Coverage method.
+//
+// Instrumented scripts are always executed by the virtual machine, so
+// they will run more slowly.
+func WithCoverage() Option {
+	return func(e *Eval) {
+		e.coverage = true
+	}
+}
+
+// Coverage returns a report of the statements and branches which have
+// been reached by the runs of the script, including those made via
+// RunAll, RunSlice, and RunParallel.
+//
+// The report is empty unless the evaluator was created with the
+// WithCoverage option.
+func (e *Eval) Coverage() CoverageReport {
+	report := CoverageReport{Points: make([]CoveragePoint, len(e.coverPoints))}
+	for i, p := range e.coverPoints {
+		report.Points[i] = p
+		if i < len(e.coverCounts) {
+			report.Points[i].Count = atomic.LoadUint64(&e.coverCounts[i])
+		}
+	}
+	return report
+}
+
+// ResetCoverage discards the counts of the statements and branches which
+// have been reached.
+func (e *Eval) ResetCoverage() {
+	for i := range e.coverCounts {
+		atomic.StoreUint64(&e.coverCounts[i], 0)
+	}
+}
+
+// cover emits an instruction to count the number of times the given
+// point is reached, if coverage was requested.
+func (e *Eval) cover(kind string, line int) {
+	if !e.coverage || e.coverSkip {
+		return
+	}
+	e.emit(code.OpCover, len(e.coverPoints))
+	e.coverPoints = append(e.coverPoints, CoveragePoint{Source: e.coverSource, Rule: e.coverRule, Line: line, Kind: kind})
+}
+
+// statementLine returns the line upon which the given statement begins.
+func statementLine(stmt ast.Statement) int {
+	switch s := stmt.(type) {
+	case *ast.ExpressionStatement:
+		return s.Token.Line
+	case *ast.ReturnStatement:
+		return s.Token.Line
+	case *ast.LetStatement:
+		return s.Token.Line
+	case *ast.IncludeStatement:
+		return s.Token.Line
+	case *ast.BlockStatement:
+		return s.Token.Line
+	}
+	return 0
+}
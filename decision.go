@@ -0,0 +1,256 @@
+// decision.go contains code for compiling decision tables, which allow
+// rules to be written as rows of a spreadsheet rather than as scripts.
+
+package evalfilter
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/skx/evalfilter/v2/token"
+)
+
+// decisionColumns holds the names of the columns a decision table must
+// contain.
+var decisionColumns = []string{"field", "operator", "value", "action"}
+
+// decisionNumber matches the values which are compared as numbers.
+var decisionNumber = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?$`)
+
+// decisionOperators holds the operators which may be used in a decision
+// table.
+var decisionOperators = map[string]bool{
+	"==":      true,
+	"!=":      true,
+	"<":       true,
+	"<=":      true,
+	">":       true,
+	">=":      true,
+	"~=":      true,
+	"!~":      true,
+	"~*":      true,
+	"!~*":     true,
+	"in":      true,
+	"between": true,
+}
+
+// DecisionTable converts a decision table, in CSV format, into a script
+// which defines a named rule for each of its actions.
+//
+// The first row names the columns, which must include "field",
+// "operator", "value", and "action", in any order.  Other columns, such
+// as a description, are ignored, as are lines beginning with `#`.
+//
+// Each row compares a field against a value:
+//
+//	field,operator,value,action
+//	Country,in,"UK, FR",europe
+//	Age,>=,18,
+//	Country,==,US,america
+//
+// A row without an action must also match for the row above it to do so,
+// which allows several conditions to be combined, and rows which have the
+// same action are alternatives.  So the table above defines the rule
+// "europe", which matches adults in the UK or France, and "america".
+//
+// The operators are the usual comparisons, the regular expression
+// operators, `in`, whose value is a comma-separated list, and `between`,
+// whose value is a comma-separated pair.  Values which are numbers, or
+// booleans, are compared as such, unless they're quoted, and anything
+// else is compared as a string.
+func DecisionTable(r io.Reader) (string, error) {
+
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return "", fmt.Errorf("the decision table is empty")
+	}
+	if err != nil {
+		return "", err
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range decisionColumns {
+		if _, ok := columns[name]; !ok {
+			return "", fmt.Errorf("the decision table has no %s column", name)
+		}
+	}
+
+	//
+	// The conditions of each action, in the order they first appear,
+	// each of which is a list of comparisons.
+	//
+	var actions []string
+	conditions := make(map[string][][]string)
+
+	action := ""
+	for n := 1; ; n++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		cell := func(name string) string {
+			if columns[name] < len(row) {
+				return strings.TrimSpace(row[columns[name]])
+			}
+			return ""
+		}
+
+		cond, err := decisionCondition(cell("field"), cell("operator"), cell("value"))
+		if err != nil {
+			return "", fmt.Errorf("condition %d: %s", n, err)
+		}
+
+		if name := cell("action"); name != "" {
+			action = name
+			if _, found := conditions[action]; !found {
+				actions = append(actions, action)
+			}
+			conditions[action] = append(conditions[action], []string{cond})
+			continue
+		}
+
+		if action == "" {
+			return "", fmt.Errorf("the first condition has no action")
+		}
+		last := len(conditions[action]) - 1
+		conditions[action][last] = append(conditions[action][last], cond)
+	}
+
+	if len(actions) == 0 {
+		return "", fmt.Errorf("the decision table has no conditions")
+	}
+
+	var script strings.Builder
+	for _, name := range actions {
+		var alternatives []string
+		for _, c := range conditions[name] {
+			alternatives = append(alternatives, "( "+strings.Join(c, " && ")+" )")
+		}
+		fmt.Fprintf(&script, "rule %s {\n    return %s;\n}\n\n", decisionString(name), strings.Join(alternatives, " || "))
+	}
+	return script.String(), nil
+}
+
+// NewDecisionTable creates an evaluator for the rules of the given
+// decision table, which are described by DecisionTable.  The evaluator
+// has been prepared, and the actions which apply to an object are the
+// names of the rules returned by RunAll.
+func NewDecisionTable(r io.Reader, options ...Option) (*Eval, error) {
+
+	script, err := DecisionTable(r)
+	if err != nil {
+		return nil, err
+	}
+
+	e := New(script, options...)
+	if err := e.Prepare(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// decisionCondition returns the comparison of the given field with the
+// given value.
+func decisionCondition(field string, op string, value string) (string, error) {
+
+	if !decisionField(field) {
+		return "", fmt.Errorf("invalid field '%s'", field)
+	}
+
+	op = strings.ToLower(op)
+	if !decisionOperators[op] {
+		return "", fmt.Errorf("invalid operator '%s'", op)
+	}
+
+	switch op {
+
+	case "in":
+		var values []string
+		for _, v := range strings.Split(value, ",") {
+			values = append(values, decisionValue(strings.TrimSpace(v)))
+		}
+		return fmt.Sprintf("%s in [ %s ]", field, strings.Join(values, ", ")), nil
+
+	case "between":
+		bounds := strings.Split(value, ",")
+		if len(bounds) != 2 {
+			return "", fmt.Errorf("between requires two values, not '%s'", value)
+		}
+		return fmt.Sprintf("%s between %s and %s", field,
+			decisionValue(strings.TrimSpace(bounds[0])),
+			decisionValue(strings.TrimSpace(bounds[1]))), nil
+	}
+
+	return fmt.Sprintf("%s %s %s", field, op, decisionValue(value)), nil
+}
+
+// decisionField returns true if the given name is a valid field, which
+// may refer to a nested field via periods.
+func decisionField(name string) bool {
+
+	for _, part := range strings.Split(name, ".") {
+		if part == "" || token.LookupIdentifier(part) != token.IDENT {
+			return false
+		}
+		for i, ch := range part {
+			if unicode.IsLetter(ch) || ch == '$' || ch == '_' {
+				continue
+			}
+			if i > 0 && unicode.IsDigit(ch) {
+				continue
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// decisionValue returns the literal for the given value.
+func decisionValue(value string) string {
+
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		return decisionString(value[1 : len(value)-1])
+	}
+
+	if value == "true" || value == "false" {
+		return value
+	}
+	if decisionNumber.MatchString(value) {
+		if strings.Contains(value, ".") {
+			return value
+		}
+		if _, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return value
+		}
+	}
+
+	return decisionString(value)
+}
+
+// decisionString returns the string literal for the given value, using
+// only those escapes which our lexer understands.
+func decisionString(value string) string {
+	return `"` + strings.NewReplacer(
+		`\`, `\\`,
+		`"`, `\"`,
+		"\n", `\n`,
+		"\r", `\r`,
+		"\t", `\t`).Replace(value) + `"`
+}
@@ -0,0 +1,130 @@
+// determinism.go contains code for finding out whether a script always
+// returns the same result for the same object.
+
+package evalfilter
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/skx/evalfilter/v2/ast"
+	"github.com/skx/evalfilter/v2/lexer"
+	"github.com/skx/evalfilter/v2/parser"
+)
+
+// NonDeterministic holds the names of the functions whose results might
+// differ between runs, even if the object is the same, such as those
+// which read the environment, or the state of a Store.
+//
+// Host applications which add functions of their own may add them to
+// this list, or pass their names to Nondeterminism.
+var NonDeterministic = []string{
+	"asn",
+	"counter_incr",
+	"country",
+	"getenv",
+	"hostname",
+	"lookup",
+	"now",
+	"random",
+	"state_get",
+	"state_set",
+}
+
+// NondeterministicCall describes a call to a function whose result might
+// differ between runs.
+type NondeterministicCall struct {
+	// Function is the name of the function.
+	Function string
+
+	// Line is the line of the script upon which it was called.
+	Line int
+
+	// Source is the name of the included script which made the
+	// call, or the empty string for the script itself.
+	Source string
+}
+
+// String returns a human-readable description of the call.
+func (c NondeterministicCall) String() string {
+	if c.Source != "" {
+		return fmt.Sprintf("%s:%d: %s", c.Source, c.Line, c.Function)
+	}
+	return fmt.Sprintf("line %d: %s", c.Line, c.Function)
+}
+
+// Nondeterminism reports each call the script makes to a function whose
+// result might differ between runs, given the same object, which allows
+// platforms to require that filters are deterministic where results must
+// be reproducible.
+//
+// The functions listed in NonDeterministic are reported, along with any
+// others which are named.  Scripts which are included are examined too,
+// but the bodies of tests are not, as they're never run against objects.
+//
+// A script is deterministic if the result is empty.
+func (e *Eval) Nondeterminism(functions ...string) ([]NondeterministicCall, error) {
+
+	names := make(map[string]bool)
+	for _, n := range append(NonDeterministic, functions...) {
+		names[n] = true
+	}
+
+	var calls []NondeterministicCall
+	err := e.nondeterminism(e.Script, "", names, make(map[string]bool), &calls)
+	return calls, err
+}
+
+// nondeterminism appends the calls to the named functions, which are
+// made by the given script, to calls.
+func (e *Eval) nondeterminism(script string, source string, names map[string]bool, including map[string]bool, calls *[]NondeterministicCall) error {
+
+	p := parser.New(lexer.New(script), e.parserOptions...)
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		return fmt.Errorf("\nErrors parsing script:\n" +
+			strings.Join(p.Errors(), "\n"))
+	}
+
+	var err error
+	ast.Walk(program, func(node ast.Node) bool {
+
+		switch n := node.(type) {
+
+		case *ast.TestStatement:
+			return false
+
+		case *ast.CallExpression:
+			name := n.Function.String()
+			if names[name] {
+				*calls = append(*calls, NondeterministicCall{Function: name, Line: n.Token.Line, Source: source})
+			}
+
+		case *ast.IncludeStatement:
+			if err != nil {
+				break
+			}
+			if e.includeResolver == nil {
+				err = fmt.Errorf("cannot include %s: no include resolver has been configured", n.Name)
+				break
+			}
+			if including[n.Name] {
+				err = fmt.Errorf("include loop detected: %s", n.Name)
+				break
+			}
+
+			src, rerr := e.includeResolver(n.Name)
+			if rerr != nil {
+				err = fmt.Errorf("failed to include %s: %s", n.Name, rerr.Error())
+				break
+			}
+
+			including[n.Name] = true
+			err = e.nondeterminism(src, n.Name, names, including, calls)
+			delete(including, n.Name)
+		}
+		return true
+	})
+
+	return err
+}
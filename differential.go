@@ -0,0 +1,122 @@
+// differential.go contains a harness which runs a script in each of the
+// ways in which we might execute it, and reports where they disagree.
+
+package evalfilter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// executionPath describes one of the ways in which a script is run.
+type executionPath struct {
+	// name identifies the path in the divergences we report.
+	name string
+
+	// flags are passed to Prepare.
+	flags []byte
+
+	// vm is true if the virtual machine must be used, even if the
+	// script could be evaluated natively.
+	vm bool
+}
+
+// executionPaths holds the ways in which a script may be run: natively,
+// if the script is simple enough, via the optimized bytecode, and via
+// the bytecode as it was first compiled.
+//
+// The last of these is the simplest, so it's the one the others are
+// compared against.
+var executionPaths = []executionPath{
+	{name: "native"},
+	{name: "optimized", vm: true},
+	{name: "unoptimized", flags: []byte{NoOptimize}, vm: true},
+}
+
+// pathResult holds the outcome of running a script, on one of our paths.
+type pathResult struct {
+	ret bool
+	err error
+}
+
+// String describes the outcome.
+func (r pathResult) String() string {
+	if r.err != nil {
+		return fmt.Sprintf("error %q", r.err.Error())
+	}
+	return fmt.Sprintf("%t", r.ret)
+}
+
+// agrees returns true if the outcomes are the same, which is the case if
+// they returned the same result, or both raised an error.  As in Shadow,
+// the text of the errors isn't compared.
+func (r pathResult) agrees(other pathResult) bool {
+	return (r.err == nil) == (other.err == nil) && (r.err != nil || r.ret == other.ret)
+}
+
+// differential prepares the given script, with the given options, in
+// each of our executionPaths, then runs it against each of the objects,
+// in turn, and returns a description of each divergence.
+//
+// A script which only some paths can prepare diverges too, but one which
+// none can prepare is an error.  Runs which exceed the limit on steps are
+// ignored, as the unoptimized bytecode executes more instructions.
+func differential(script string, options []Option, objects ...interface{}) ([]string, error) {
+
+	var evals []*Eval
+	var prepared []error
+	failed := 0
+	for _, path := range executionPaths {
+		e := New(script, options...)
+		err := e.Prepare(path.flags)
+		if err != nil {
+			failed++
+		}
+		if path.vm {
+			e.fast = nil
+		}
+		evals = append(evals, e)
+		prepared = append(prepared, err)
+	}
+
+	last := len(executionPaths) - 1
+	if failed == len(executionPaths) {
+		return nil, prepared[last]
+	}
+
+	var divergences []string
+	if failed > 0 {
+		for i, path := range executionPaths[:last] {
+			if (prepared[i] == nil) != (prepared[last] == nil) {
+				divergences = append(divergences, fmt.Sprintf("preparing: %s: %v, %s: %v",
+					path.name, prepared[i], executionPaths[last].name, prepared[last]))
+			}
+		}
+		return divergences, nil
+	}
+
+	for n, obj := range objects {
+
+		var results []pathResult
+		limited := false
+		for _, e := range evals {
+			ret, err := e.Run(obj)
+			if err != nil && strings.Contains(err.Error(), "limit on steps") {
+				limited = true
+			}
+			results = append(results, pathResult{ret: ret, err: err})
+		}
+		if limited {
+			continue
+		}
+
+		for i, path := range executionPaths[:last] {
+			if !results[i].agrees(results[last]) {
+				divergences = append(divergences, fmt.Sprintf("object %d: %s: %s, %s: %s",
+					n, path.name, results[i], executionPaths[last].name, results[last]))
+			}
+		}
+	}
+
+	return divergences, nil
+}
@@ -4,34 +4,78 @@ package environment
 
 import (
 	"fmt"
-	"regexp"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"unicode/utf8"
 
 	"github.com/skx/evalfilter/v2/object"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
 )
 
-// regCache is a cache of compiled regular expression objects.
-// These may persist between runs because a regular expression object
-// is essentially constant.
-var regCache map[string]*regexp.Regexp
+// fnAssert is the implementation of the `assert` function.
+//
+// It raises an error, with the given message, if the value isn't
+// true-like.
+func fnAssert(args []object.Object) object.Object {
+
+	// We expect one argument, and an optional message
+	if len(args) != 1 && len(args) != 2 {
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("assert expects one or two arguments, got %d", len(args))}
+	}
+
+	if args[0].True() {
+		return object.NewBoolean(true)
+	}
 
-// init ensures that our regexp cache is populated
-func init() {
-	regCache = make(map[string]*regexp.Regexp)
+	msg := "assertion failed"
+	if len(args) == 2 {
+		msg = args[1].Inspect()
+	}
+	return &object.Error{Kind: object.AssertionError, Message: msg}
+}
+
+// fnContains is the implementation of the `contains` function.
+//
+// For arrays it returns true if the array contains the given value, and
+// for sets if the set contains it, otherwise the values are compared as
+// strings.
+func fnContains(args []object.Object) object.Object {
+
+	// We expect two arguments
+	if len(args) != 2 {
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("contains expects two arguments, got %d", len(args))}
+	}
+
+	// array is handled differently
+	switch arg := args[0].(type) {
+	case *object.Array:
+		for _, el := range arg.Elements {
+			if object.Equal(args[1], el) {
+				return object.NewBoolean(true)
+			}
+		}
+		return object.NewBoolean(false)
+	case *object.Set:
+		return object.NewBoolean(arg.Contains(args[1]))
+	}
+
+	return object.NewBoolean(strings.Contains(args[0].Inspect(), args[1].Inspect()))
 }
 
 // fnFloat is the implementation of the `float` function.
 //
 // It converts an object to a float, if it can.
 //
-// On failure it returns Null
+// On failure it returns the optional second argument, if present,
+// otherwise an error.
 func fnFloat(args []object.Object) object.Object {
 
-	// We expect one argument
-	if len(args) != 1 {
-		return &object.Null{}
+	// We expect one argument, and an optional default
+	if len(args) != 1 && len(args) != 2 {
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("float expects one or two arguments, got %d", len(args))}
 	}
 
 	// Stringify
@@ -39,22 +83,83 @@ func fnFloat(args []object.Object) object.Object {
 
 	i, err := strconv.ParseFloat(str, 64)
 	if err != nil {
-		return &object.Null{}
+		if len(args) == 2 {
+			return args[1]
+		}
+		return &object.Error{Kind: object.ConversionError, Message: fmt.Sprintf("cannot convert %q to a float", str)}
 	}
 
 	return &object.Float{Value: i}
 }
 
+// fnFold is the implementation of our `fold` function.
+//
+// It returns the case-folded form of a string, which is suitable for
+// comparing strings without regard to case.  Unlike `lower` this
+// handles characters such as "ß", which folds to "ss".
+func fnFold(args []object.Object) object.Object {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("fold expects one argument, got %d", len(args))}
+	}
+
+	// A caser isn't safe for concurrent use, so we create one each time.
+	return &object.String{Value: cases.Fold().String(args[0].Inspect())}
+}
+
+// fnGlob is the implementation of our `glob` function.
+//
+// It matches a string against a shell-style wildcard pattern, as
+// implemented by path.Match, which is simpler than using a regular
+// expression when the pattern contains characters such as ".".
+func fnGlob(args []object.Object) object.Object {
+
+	// We expect two arguments
+	if len(args) != 2 {
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("glob expects two arguments, got %d", len(args))}
+	}
+
+	matched, err := path.Match(args[1].Inspect(), args[0].Inspect())
+	if err != nil {
+		return &object.Error{Kind: object.ValueError, Message: fmt.Sprintf("invalid glob pattern %s: %s", args[1].Inspect(), err.Error())}
+	}
+	return object.NewBoolean(matched)
+}
+
+// fnHasKey is the implementation of our `has_key` function.
+//
+// It returns true if the hash has a member with the given name.
+func fnHasKey(args []object.Object) object.Object {
+
+	// We expect two arguments
+	if len(args) != 2 {
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("has_key expects two arguments, got %d", len(args))}
+	}
+
+	hash, e := hashArg("has_key", args[0])
+	if e != nil {
+		return e
+	}
+
+	key, ok := object.HashKey(args[1])
+	if ok {
+		_, ok = hash.Pairs[key]
+	}
+	return object.NewBoolean(ok)
+}
+
 // fnInt is the implementation of the `int` function.
 //
 // It converts an object to an integer, if it can.
 //
-// On failure it returns Null
+// On failure it returns the optional second argument, if present,
+// otherwise an error.
 func fnInt(args []object.Object) object.Object {
 
-	// We expect one argument
-	if len(args) != 1 {
-		return &object.Null{}
+	// We expect one argument, and an optional default
+	if len(args) != 1 && len(args) != 2 {
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("int expects one or two arguments, got %d", len(args))}
 	}
 
 	// Stringify
@@ -62,10 +167,86 @@ func fnInt(args []object.Object) object.Object {
 
 	i, err := strconv.ParseInt(str, 10, 64)
 	if err != nil {
-		return &object.Null{}
+		if len(args) == 2 {
+			return args[1]
+		}
+		return &object.Error{Kind: object.ConversionError, Message: fmt.Sprintf("cannot convert %q to an integer", str)}
+	}
+
+	return object.NewInteger(i)
+}
+
+// fnIsArray is the implementation of our `is_array` function.
+func fnIsArray(args []object.Object) object.Object {
+	return isType("is_array", object.ARRAY, args)
+}
+
+// fnIsBool is the implementation of our `is_bool` function.
+func fnIsBool(args []object.Object) object.Object {
+	return isType("is_bool", object.BOOLEAN, args)
+}
+
+// fnIsFloat is the implementation of our `is_float` function.
+func fnIsFloat(args []object.Object) object.Object {
+	return isType("is_float", object.FLOAT, args)
+}
+
+// fnIsInt is the implementation of our `is_int` function.
+func fnIsInt(args []object.Object) object.Object {
+	return isType("is_int", object.INTEGER, args)
+}
+
+// fnIsString is the implementation of our `is_string` function.
+func fnIsString(args []object.Object) object.Object {
+	return isType("is_string", object.STRING, args)
+}
+
+// typePredicates maps the names of our type-predicates to the type each
+// one tests for.
+var typePredicates = map[string]object.Type{
+	"is_array":  object.ARRAY,
+	"is_bool":   object.BOOLEAN,
+	"is_float":  object.FLOAT,
+	"is_int":    object.INTEGER,
+	"is_string": object.STRING,
+}
+
+// isType returns true if the single argument, which was supplied to
+// one of our type-predicates, has the given type.
+//
+// Calls to these functions are usually compiled to OpIsType, so this
+// is only used if they're invoked by other means.
+func isType(name string, typ object.Type, args []object.Object) object.Object {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("%s expects one argument, got %d", name, len(args))}
 	}
 
-	return &object.Integer{Value: i}
+	return object.NewBoolean(args[0].Type() == typ)
+}
+
+// fnKeys is the implementation of our `keys` function.
+//
+// It returns an array of the names of the members of a hash, sorted so
+// that the result is stable.
+func fnKeys(args []object.Object) object.Object {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("keys expects one argument, got %d", len(args))}
+	}
+
+	hash, e := hashArg("keys", args[0])
+	if e != nil {
+		return e
+	}
+
+	res := make([]object.Object, 0, len(hash.Pairs))
+	for _, k := range sortedKeys(hash) {
+		res = append(res, &object.String{Value: k})
+	}
+	return &object.Array{Elements: res}
 }
 
 // fnLen is the implementation of our `len` function.
@@ -84,13 +265,17 @@ func fnLen(args []object.Object) object.Object {
 
 	// We expect one argument
 	if len(args) != 1 {
-		return &object.Null{}
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("len expects one argument, got %d", len(args))}
 	}
 
 	// array is handled differently
 	switch arg := args[0].(type) {
 	case *object.Array:
-		return &object.Integer{Value: int64(len(arg.Elements))}
+		return object.NewInteger(int64(len(arg.Elements)))
+	case *object.Hash:
+		return object.NewInteger(int64(len(arg.Pairs)))
+	case *object.Set:
+		return object.NewInteger(int64(len(arg.Members)))
 	}
 
 	// Stringify
@@ -98,7 +283,7 @@ func fnLen(args []object.Object) object.Object {
 	sum := utf8.RuneCountInString(str)
 
 	// return
-	return &object.Integer{Value: int64(sum)}
+	return object.NewInteger(int64(sum))
 }
 
 // fnLower is the implementation of our `lower` function.
@@ -109,7 +294,7 @@ func fnLower(args []object.Object) object.Object {
 
 	// We expect one argument
 	if len(args) != 1 {
-		return &object.Null{}
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("lower expects one argument, got %d", len(args))}
 	}
 
 	// Stringify and lower-case
@@ -121,32 +306,22 @@ func fnLower(args []object.Object) object.Object {
 }
 
 // fnMatch is the implementation of our regex `match` function.
-func fnMatch(args []object.Object) object.Object {
+//
+// Regular expressions which weren't compiled by the compiler are stored
+// in the given cache.
+func fnMatch(cache *regexpCache, args []object.Object) object.Object {
 
 	// We expect two arguments
 	if len(args) != 2 {
-		return &object.Boolean{Value: false}
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("match expects two arguments, got %d", len(args))}
 	}
 
 	str := args[0].Inspect()
-	reg := args[1].Inspect()
-
-	// Look for the compiled regular-expression object in our cache.
-	r, ok := regCache[reg]
-	if !ok {
-
-		// OK it wasn't found, so compile it.
-		var err error
-		r, err = regexp.Compile(reg)
-
-		// Ensure it compiled
-		if err != nil {
-			fmt.Printf("Invalid regular expression %s %s", reg, err.Error())
-			return &object.Boolean{Value: false}
-		}
 
-		// store in the cache for next time
-		regCache[reg] = r
+	// Get the compiled regular-expression object.
+	r, err := compileRegexp(cache, args[1])
+	if err != nil {
+		return &object.Error{Kind: object.ValueError, Message: fmt.Sprintf("invalid regular expression %s: %s", args[1].Inspect(), err.Error())}
 	}
 
 	// Split the input by newline.
@@ -157,21 +332,179 @@ func fnMatch(args []object.Object) object.Object {
 
 		// Test if it matched
 		if r.MatchString(s) {
-			return &object.Boolean{Value: true}
+			return object.NewBoolean(true)
+		}
+	}
+	return object.NewBoolean(false)
+}
+
+// normalForms holds the forms which our `normalize` function supports.
+var normalForms = map[string]norm.Form{
+	"NFC":  norm.NFC,
+	"NFD":  norm.NFD,
+	"NFKC": norm.NFKC,
+	"NFKD": norm.NFKD,
+}
+
+// fnMerge is the implementation of our `merge` function.
+//
+// It returns a new hash containing the members of each of the given
+// hashes.  If a name appears in more than one hash the last value wins.
+func fnMerge(args []object.Object) object.Object {
+
+	// We expect at least two arguments
+	if len(args) < 2 {
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("merge expects at least two arguments, got %d", len(args))}
+	}
+
+	res := &object.Hash{Pairs: make(map[string]object.Object)}
+	for _, arg := range args {
+		hash, e := hashArg("merge", arg)
+		if e != nil {
+			return e
+		}
+		for k, v := range hash.Pairs {
+			res.Pairs[k] = v
+		}
+	}
+	return res
+}
+
+// fnNormalize is the implementation of our `normalize` function.
+//
+// It returns the unicode normalization of a string, which allows text
+// that is written with different combinations of characters, such as an
+// "é" written as "e" followed by a combining accent, to be compared.
+//
+// The form defaults to NFC, but may be given as an optional second
+// argument.
+func fnNormalize(args []object.Object) object.Object {
+
+	// We expect one argument, and an optional form
+	if len(args) != 1 && len(args) != 2 {
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("normalize expects one or two arguments, got %d", len(args))}
+	}
+
+	form := norm.NFC
+	if len(args) == 2 {
+		var ok bool
+		form, ok = normalForms[strings.ToUpper(args[1].Inspect())]
+		if !ok {
+			return &object.Error{Kind: object.ValueError, Message: fmt.Sprintf("unknown normalization form %s", args[1].Inspect())}
+		}
+	}
+
+	return &object.String{Value: form.String(args[0].Inspect())}
+}
+
+// fnParseKV is the implementation of our `parse_kv` function.
+//
+// It splits a string of key/value pairs, such as "k1=v1;k2=v2", into a
+// hash.  The separator between pairs defaults to ";", and the separator
+// between each key and its value defaults to "=".
+//
+// Whitespace around keys and values is removed, empty pairs are ignored,
+// and a key without a value is given an empty value.  If a key appears
+// more than once the last value wins.
+func fnParseKV(args []object.Object) object.Object {
+
+	// We expect one argument, and optional separators
+	if len(args) < 1 || len(args) > 3 {
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("parse_kv expects between one and three arguments, got %d", len(args))}
+	}
+
+	sep := ";"
+	if len(args) > 1 {
+		sep = args[1].Inspect()
+	}
+	eq := "="
+	if len(args) > 2 {
+		eq = args[2].Inspect()
+	}
+	if sep == "" || eq == "" {
+		return &object.Error{Kind: object.ValueError, Message: "parse_kv separators must not be empty"}
+	}
+
+	hash := &object.Hash{Pairs: make(map[string]object.Object)}
+	for _, pair := range strings.Split(args[0].Inspect(), sep) {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		kv := strings.SplitN(pair, eq, 2)
+		val := ""
+		if len(kv) == 2 {
+			val = strings.TrimSpace(kv[1])
 		}
+		hash.Pairs[strings.TrimSpace(kv[0])] = &object.String{Value: val}
 	}
-	return &object.Boolean{Value: false}
+	return hash
+}
+
+// maxPadWidth is the largest width to which lpad, and rpad, will pad
+// a string.
+const maxPadWidth = 1 << 16
+
+// fnLPad is the implementation of our `lpad` function.
+func fnLPad(args []object.Object) object.Object {
+	return pad("lpad", true, args)
+}
+
+// fnRPad is the implementation of our `rpad` function.
+func fnRPad(args []object.Object) object.Object {
+	return pad("rpad", false, args)
+}
+
+// pad implements lpad, and rpad, which pad a string to the given width,
+// in characters, by adding copies of the padding string to its start,
+// or end.  The padding defaults to a space, and strings which are
+// already wide enough are returned unchanged.
+func pad(name string, left bool, args []object.Object) object.Object {
+
+	// We expect two arguments, and an optional padding string
+	if len(args) < 2 || len(args) > 3 {
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("%s expects two or three arguments, got %d", name, len(args))}
+	}
+
+	width, ok := args[1].(*object.Integer)
+	if !ok {
+		return &object.Error{Kind: object.TypeError, Message: fmt.Sprintf("%s expects an integer width, got %s", name, args[1].Type())}
+	}
+	if width.Value > maxPadWidth {
+		return &object.Error{Kind: object.ValueError, Message: fmt.Sprintf("%s width %d is larger than %d", name, width.Value, maxPadWidth)}
+	}
+
+	padding := " "
+	if len(args) > 2 {
+		padding = args[2].Inspect()
+	}
+	if padding == "" {
+		return &object.Error{Kind: object.ValueError, Message: fmt.Sprintf("%s padding must not be empty", name)}
+	}
+
+	str := args[0].Inspect()
+	n := int(width.Value) - utf8.RuneCountInString(str)
+	if n <= 0 {
+		return &object.String{Value: str}
+	}
+
+	chars := []rune(strings.Repeat(padding, n/utf8.RuneCountInString(padding)+1))
+	fill := string(chars[:n])
+	if left {
+		return &object.String{Value: fill + str}
+	}
+	return &object.String{Value: str + fill}
 }
 
 // fnString is the implementation of our `string` function.
-func fnString(args []object.Object) object.Object {
+func fnString(env *Environment, args []object.Object) object.Object {
 
 	// We expect one argument
 	if len(args) != 1 {
-		return &object.Null{}
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("string expects one argument, got %d", len(args))}
 	}
 
-	str := args[0].Inspect()
+	str := env.inspect(args[0])
 	return &object.String{Value: str}
 }
 
@@ -189,7 +522,7 @@ func fnType(args []object.Object) object.Object {
 
 	// We expect one argument
 	if len(args) != 1 {
-		return &object.Null{}
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("type expects one argument, got %d", len(args))}
 	}
 
 	// Get the arg
@@ -203,12 +536,131 @@ func fnType(args []object.Object) object.Object {
 	return &object.String{Value: val}
 }
 
-// fnPrint is the implementation of our `print` function.
-func fnPrint(args []object.Object) object.Object {
-	for _, e := range args {
-		fmt.Printf("%s", e.Inspect())
+// fnSprintf is the implementation of our `sprintf` function.
+//
+// It returns a string built from a format-string, and arguments, in the
+// same way as golang's fmt.Sprintf.  Only the verbs %s, %d, %f, and %v
+// are supported, along with "%%" for a literal percent sign.
+func fnSprintf(env *Environment, args []object.Object) object.Object {
+	str, err := format(env, "sprintf", args)
+	if err != nil {
+		return err
+	}
+	return &object.String{Value: str}
+}
+
+// maxFormatWidth is the largest width, or precision, which may be used
+// in a format-string, so that a script can't create huge strings.
+const maxFormatWidth = 64
+
+// format builds a string from the format-string, and arguments, given
+// to the named function.
+//
+// Each directive is validated, and its argument converted to a native
+// value, before it is handed to fmt.Sprintf.  So a script can only use
+// the subset of formatting we support.
+func format(env *Environment, name string, args []object.Object) (string, *object.Error) {
+
+	// We expect at least the format-string
+	if len(args) < 1 {
+		return "", &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("%s expects at least one argument, got %d", name, len(args))}
+	}
+
+	src := args[0].Inspect()
+	args = args[1:]
+
+	var out strings.Builder
+
+	i := 0
+	for i < len(src) {
+
+		if src[i] != '%' {
+			out.WriteByte(src[i])
+			i++
+			continue
+		}
+
+		// Find the end of the directive, which is the verb.
+		start := i
+		i++
+		for i < len(src) && strings.IndexByte("-+ 0", src[i]) >= 0 {
+			i++
+		}
+		width, end := formatNumber(src, i)
+		precision := 0
+		if end < len(src) && src[end] == '.' {
+			precision, end = formatNumber(src, end+1)
+		}
+		i = end
+		if i >= len(src) {
+			return "", &object.Error{Kind: object.ValueError, Message: fmt.Sprintf("%s format ends with an incomplete directive %q", name, src[start:])}
+		}
+		if width > maxFormatWidth || precision > maxFormatWidth {
+			return "", &object.Error{Kind: object.ValueError, Message: fmt.Sprintf("%s directive %q is wider than %d", name, src[start:i+1], maxFormatWidth)}
+		}
+
+		verb := src[i]
+		spec := src[start : i+1]
+		i++
+
+		if verb == '%' {
+			out.WriteByte('%')
+			continue
+		}
+		if strings.IndexByte("sdfv", verb) < 0 {
+			return "", &object.Error{Kind: object.ValueError, Message: fmt.Sprintf("%s doesn't support the directive %q", name, spec)}
+		}
+
+		if len(args) == 0 {
+			return "", &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("%s has no argument for the directive %q", name, spec)}
+		}
+		arg := args[0]
+		args = args[1:]
+
+		var val interface{}
+		switch verb {
+		case 'd':
+			n, ok := arg.(*object.Integer)
+			if !ok {
+				return "", &object.Error{Kind: object.TypeError, Message: fmt.Sprintf("%s directive %q expects an integer, got %s", name, spec, arg.Type())}
+			}
+			val = n.Value
+		case 'f':
+			switch n := arg.(type) {
+			case *object.Integer:
+				val = float64(n.Value)
+			case *object.Float:
+				val = n.Value
+			default:
+				return "", &object.Error{Kind: object.TypeError, Message: fmt.Sprintf("%s directive %q expects a number, got %s", name, spec, arg.Type())}
+			}
+		default:
+			val = env.inspect(arg)
+			spec = spec[:len(spec)-1] + "s"
+		}
+
+		out.WriteString(fmt.Sprintf(spec, val))
+	}
+
+	if len(args) != 0 {
+		return "", &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("%s was given %d more argument(s) than its format uses", name, len(args))}
+	}
+
+	return out.String(), nil
+}
+
+// formatNumber parses the digits found at the given offset of a
+// format-string, returning their value and the offset which follows
+// them.
+func formatNumber(src string, i int) (int, int) {
+	n := 0
+	for i < len(src) && src[i] >= '0' && src[i] <= '9' {
+		if n <= maxFormatWidth {
+			n = n*10 + int(src[i]-'0')
+		}
+		i++
 	}
-	return &object.Integer{Value: 0}
+	return n, i
 }
 
 // fnUpper is the implementation of our `upper` function.
@@ -218,7 +670,7 @@ func fnPrint(args []object.Object) object.Object {
 func fnUpper(args []object.Object) object.Object {
 	// We expect one argument
 	if len(args) != 1 {
-		return &object.Null{}
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("upper expects one argument, got %d", len(args))}
 	}
 
 	// Stringify and upper-case
@@ -228,3 +680,146 @@ func fnUpper(args []object.Object) object.Object {
 	// Return
 	return &object.String{Value: arg}
 }
+
+// fnValues is the implementation of our `values` function.
+//
+// It returns an array of the values of the members of a hash, in the
+// same order as the names returned by `keys`.
+func fnValues(args []object.Object) object.Object {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("values expects one argument, got %d", len(args))}
+	}
+
+	hash, e := hashArg("values", args[0])
+	if e != nil {
+		return e
+	}
+
+	res := make([]object.Object, 0, len(hash.Pairs))
+	for _, k := range sortedKeys(hash) {
+		res = append(res, hash.Pairs[k])
+	}
+	return &object.Array{Elements: res}
+}
+
+// hashArg returns the given argument, which was supplied to one of our
+// hash functions, as a hash.
+func hashArg(name string, arg object.Object) (*object.Hash, *object.Error) {
+	hash, ok := arg.(*object.Hash)
+	if !ok {
+		return nil, &object.Error{Kind: object.TypeError, Message: fmt.Sprintf("%s expects a hash, got %s", name, arg.Type())}
+	}
+	return hash, nil
+}
+
+// sortedKeys returns the names of the members of the hash, in order.
+func sortedKeys(hash *object.Hash) []string {
+	keys := make([]string, 0, len(hash.Pairs))
+	for k := range hash.Pairs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// callable returns the array and function which were supplied to one of
+// our higher-order functions, such as `filter`.
+func callable(name string, args []object.Object) (*object.Array, *object.Function, *object.Error) {
+
+	// We expect two arguments
+	if len(args) != 2 {
+		return nil, nil, &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("%s expects two arguments, got %d", name, len(args))}
+	}
+
+	arr, ok := args[0].(*object.Array)
+	if !ok {
+		return nil, nil, &object.Error{Kind: object.TypeError, Message: fmt.Sprintf("%s expects an array, got %s", name, args[0].Type())}
+	}
+
+	fn, ok := args[1].(*object.Function)
+	if !ok || fn.Call == nil {
+		return nil, nil, &object.Error{Kind: object.TypeError, Message: fmt.Sprintf("%s expects a function, got %s", name, args[1].Type())}
+	}
+
+	return arr, fn, nil
+}
+
+// errorObject converts an error raised by a function to an object,
+// preserving the kind of any error which was raised by another function.
+func errorObject(err error) *object.Error {
+	if e, ok := err.(*object.Error); ok {
+		return e
+	}
+	return &object.Error{Message: err.Error()}
+}
+
+// fnFilter is the implementation of our `filter` function.
+//
+// It returns an array of those elements for which the function
+// returns a true-like value.
+func fnFilter(args []object.Object) object.Object {
+
+	arr, fn, e := callable("filter", args)
+	if e != nil {
+		return e
+	}
+
+	res := make([]object.Object, 0)
+	for _, el := range arr.Elements {
+		ret, err := fn.Call([]object.Object{el})
+		if err != nil {
+			return errorObject(err)
+		}
+		if ret.True() {
+			res = append(res, el)
+		}
+	}
+	return &object.Array{Elements: res}
+}
+
+// fnFind is the implementation of our `find` function.
+//
+// It returns the first element for which the function returns a
+// true-like value, or Null if there is no such element.
+func fnFind(args []object.Object) object.Object {
+
+	arr, fn, e := callable("find", args)
+	if e != nil {
+		return e
+	}
+
+	for _, el := range arr.Elements {
+		ret, err := fn.Call([]object.Object{el})
+		if err != nil {
+			return errorObject(err)
+		}
+		if ret.True() {
+			return el
+		}
+	}
+	return object.NewNull()
+}
+
+// fnMap is the implementation of our `map` function.
+//
+// It returns an array containing the result of applying the function
+// to each element.
+func fnMap(args []object.Object) object.Object {
+
+	arr, fn, e := callable("map", args)
+	if e != nil {
+		return e
+	}
+
+	res := make([]object.Object, len(arr.Elements))
+	for i, el := range arr.Elements {
+		ret, err := fn.Call([]object.Object{el})
+		if err != nil {
+			return errorObject(err)
+		}
+		res[i] = ret
+	}
+	return &object.Array{Elements: res}
+}
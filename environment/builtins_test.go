@@ -1,11 +1,54 @@
 package environment
 
 import (
+	"bytes"
+	"context"
+	"math"
+	"sort"
 	"testing"
 
 	"github.com/skx/evalfilter/v2/object"
 )
 
+// Test contains.
+func TestContains(t *testing.T) {
+
+	type TestCase struct {
+		Haystack object.Object
+		Needle   object.Object
+		Result   bool
+	}
+
+	arr := &object.Array{Elements: []object.Object{
+		&object.String{Value: "steve"},
+		&object.Integer{Value: 3},
+	}}
+
+	tests := []TestCase{
+		{Haystack: &object.String{Value: "bobby"}, Needle: &object.String{Value: "bob"}, Result: true},
+		{Haystack: &object.String{Value: "steve"}, Needle: &object.String{Value: "bob"}, Result: false},
+		{Haystack: &object.Integer{Value: 1234}, Needle: &object.Integer{Value: 23}, Result: true},
+		{Haystack: arr, Needle: &object.String{Value: "steve"}, Result: true},
+		{Haystack: arr, Needle: &object.Integer{Value: 3}, Result: true},
+		{Haystack: arr, Needle: &object.String{Value: "3"}, Result: false},
+		{Haystack: arr, Needle: &object.String{Value: "ste"}, Result: false},
+	}
+
+	for _, test := range tests {
+
+		x := fnContains([]object.Object{test.Haystack, test.Needle})
+		if x.(*object.Boolean).Value != test.Result {
+			t.Errorf("Invalid result for contains(%s, %s)", test.Haystack.Inspect(), test.Needle.Inspect())
+		}
+	}
+
+	// ensure that the wrong number of arguments is handled
+	out := fnContains([]object.Object{arr})
+	if out.Type() != object.ERROR {
+		t.Errorf("Invalid result for one arg:%s", out.Type())
+	}
+}
+
 // Test float-conversion.
 func TestFloat(t *testing.T) {
 
@@ -15,11 +58,11 @@ func TestFloat(t *testing.T) {
 	}
 
 	tests := []TestCase{
-		{Input: &object.String{Value: "π"}, Result: &object.Null{}},
-		{Input: &object.String{Value: "Steve"}, Result: &object.Null{}},
+		{Input: &object.String{Value: "π"}, Result: &object.Error{}},
+		{Input: &object.String{Value: "Steve"}, Result: &object.Error{}},
 		{Input: &object.Integer{Value: 3}, Result: &object.Float{Value: 3}},
 		{Input: &object.String{Value: "3.21"}, Result: &object.Float{Value: 3.21}},
-		{Input: &object.Boolean{Value: true}, Result: &object.Null{}},
+		{Input: &object.Boolean{Value: true}, Result: &object.Error{}},
 	}
 
 	// For each test
@@ -39,7 +82,7 @@ func TestFloat(t *testing.T) {
 			if x.(*object.Float).Value != test.Result.(*object.Float).Value {
 				t.Errorf("invalid float result")
 			}
-		case *object.Null:
+		case *object.Error:
 		default:
 			t.Errorf("unknown type")
 		}
@@ -48,9 +91,24 @@ func TestFloat(t *testing.T) {
 	// ensure that zero arguments are handled
 	var tmp []object.Object
 	out := fnFloat(tmp)
-	if out.Type() != "NULL" {
+	if out.Type() != object.ERROR {
 		t.Errorf("Invalid result for no args:%s", out.Type())
 	}
+	if out.(*object.Error).Kind != object.ArgumentError {
+		t.Errorf("Invalid error kind for no args:%s", out.(*object.Error).Kind)
+	}
+
+	// ensure that a failed conversion is distinct
+	out = fnFloat([]object.Object{&object.String{Value: "Steve"}})
+	if out.(*object.Error).Kind != object.ConversionError {
+		t.Errorf("Invalid error kind for failed conversion:%s", out.(*object.Error).Kind)
+	}
+
+	// ensure that the default is returned on failure
+	out = fnFloat([]object.Object{&object.String{Value: "Steve"}, &object.Float{Value: 0.5}})
+	if out.Type() != object.FLOAT || out.(*object.Float).Value != 0.5 {
+		t.Errorf("Invalid result for default:%s", out.Inspect())
+	}
 }
 
 // Test integer-conversion.
@@ -62,11 +120,11 @@ func TestInt(t *testing.T) {
 	}
 
 	tests := []TestCase{
-		{Input: &object.String{Value: "π"}, Result: &object.Null{}},
-		{Input: &object.String{Value: "Steve"}, Result: &object.Null{}},
+		{Input: &object.String{Value: "π"}, Result: &object.Error{}},
+		{Input: &object.String{Value: "Steve"}, Result: &object.Error{}},
 		{Input: &object.Integer{Value: 3}, Result: &object.Integer{Value: 3}},
 		{Input: &object.String{Value: "3"}, Result: &object.Integer{Value: 3}},
-		{Input: &object.Boolean{Value: true}, Result: &object.Null{}},
+		{Input: &object.Boolean{Value: true}, Result: &object.Error{}},
 	}
 
 	// For each test
@@ -86,7 +144,7 @@ func TestInt(t *testing.T) {
 			if x.(*object.Integer).Value != test.Result.(*object.Integer).Value {
 				t.Errorf("Invalid integer result")
 			}
-		case *object.Null:
+		case *object.Error:
 		default:
 			t.Errorf("unknown type")
 		}
@@ -95,9 +153,30 @@ func TestInt(t *testing.T) {
 	// ensure that zero arguments are handled
 	var tmp []object.Object
 	out := fnInt(tmp)
-	if out.Type() != "NULL" {
+	if out.Type() != object.ERROR {
 		t.Errorf("Invalid result for no args:%s", out.Type())
 	}
+	if out.(*object.Error).Kind != object.ArgumentError {
+		t.Errorf("Invalid error kind for no args:%s", out.(*object.Error).Kind)
+	}
+
+	// ensure that a failed conversion is distinct
+	out = fnInt([]object.Object{&object.String{Value: "Steve"}})
+	if out.(*object.Error).Kind != object.ConversionError {
+		t.Errorf("Invalid error kind for failed conversion:%s", out.(*object.Error).Kind)
+	}
+
+	// ensure that the default is returned on failure
+	out = fnInt([]object.Object{&object.String{Value: "Steve"}, &object.Integer{Value: -1}})
+	if out.Type() != object.INTEGER || out.(*object.Integer).Value != -1 {
+		t.Errorf("Invalid result for default:%s", out.Inspect())
+	}
+
+	// ensure that the default is ignored on success
+	out = fnInt([]object.Object{&object.String{Value: "3"}, &object.Integer{Value: -1}})
+	if out.Type() != object.INTEGER || out.(*object.Integer).Value != 3 {
+		t.Errorf("Invalid result for default:%s", out.Inspect())
+	}
 }
 
 // Test string-conversion.
@@ -121,7 +200,7 @@ func TestString(t *testing.T) {
 		var args []object.Object
 		args = append(args, test.Input)
 
-		x := fnString(args)
+		x := fnString(New(), args)
 
 		if x.Type() != test.Result.Type() {
 			t.Errorf("Invalid type result for return")
@@ -132,7 +211,7 @@ func TestString(t *testing.T) {
 			if x.(*object.String).Value != test.Result.(*object.String).Value {
 				t.Errorf("Invalid string result")
 			}
-		case *object.Null:
+		case *object.Error:
 		default:
 			t.Errorf("unknown type")
 		}
@@ -140,8 +219,8 @@ func TestString(t *testing.T) {
 
 	// ensure that zero arguments are handled
 	var tmp []object.Object
-	out := fnString(tmp)
-	if out.Type() != "NULL" {
+	out := fnString(New(), tmp)
+	if out.Type() != object.ERROR {
 		t.Errorf("Invalid result for no args:%s", out.Type())
 	}
 }
@@ -187,7 +266,7 @@ func TestLen(t *testing.T) {
 	// Calling the function with no-arguments should return null
 	var args []object.Object
 	out := fnLen(args)
-	if out.Type() != object.NULL {
+	if out.Type() != object.ERROR {
 		t.Errorf("no arguments returns a weird result")
 	}
 }
@@ -224,7 +303,7 @@ func TestLower(t *testing.T) {
 	// Calling the function with no-arguments should return null
 	var args []object.Object
 	out := fnLower(args)
-	if out.Type() != object.NULL {
+	if out.Type() != object.ERROR {
 		t.Errorf("no arguments returns a weird result")
 	}
 }
@@ -249,9 +328,6 @@ func TestMatch(t *testing.T) {
 		{String: "Steve", Regexp: "^steve$", Result: false},
 		{String: "Steve", Regexp: "^steve$", Result: false},
 
-		// invalid regexp
-		{String: "Steve", Regexp: "+", Result: false},
-		{String: "Steve", Regexp: "+", Result: false},
 	}
 
 	for _, test := range tests {
@@ -261,7 +337,7 @@ func TestMatch(t *testing.T) {
 		args = append(args, &object.String{Value: test.String})
 		args = append(args, &object.String{Value: test.Regexp})
 
-		res := fnMatch(args)
+		res := fnMatch(newRegexpCache(regexpCacheSize), args)
 
 		if res.(*object.Boolean).Value != test.Result {
 			t.Errorf("Invalid result for %s =~ /%s/", test.String, test.Regexp)
@@ -269,10 +345,16 @@ func TestMatch(t *testing.T) {
 
 	}
 
-	// Calling the function with != 2 arguments should return false
+	// An invalid regular expression is an error.
+	out := fnMatch(newRegexpCache(regexpCacheSize), []object.Object{&object.String{Value: "Steve"}, &object.String{Value: "+"}})
+	if out.Type() != object.ERROR {
+		t.Errorf("invalid regexp returns a weird result")
+	}
+
+	// Calling the function with != 2 arguments is an error.
 	var args []object.Object
-	out := fnMatch(args)
-	if out.(*object.Boolean).Value != false {
+	out = fnMatch(newRegexpCache(regexpCacheSize), args)
+	if out.Type() != object.ERROR {
 		t.Errorf("no arguments returns a weird result")
 	}
 
@@ -339,7 +421,7 @@ func TestType(t *testing.T) {
 	// Calling the function with no-arguments should return null
 	var args []object.Object
 	out := fnType(args)
-	if out.Type() != object.NULL {
+	if out.Type() != object.ERROR {
 		t.Errorf("no arguments returns a weird result")
 	}
 
@@ -377,16 +459,750 @@ func TestUpper(t *testing.T) {
 	// Calling the function with no-arguments should return null
 	var args []object.Object
 	out := fnUpper(args)
-	if out.Type() != object.NULL {
+	if out.Type() != object.ERROR {
 		t.Errorf("no arguments returns a weird result")
 	}
 }
 
-// NOP-test
+// Test printing, to STDOUT and to a writer.
 func TestPrint(t *testing.T) {
+	env := New()
+
 	var args []object.Object
-	fnPrint(args)
+	fnPrint(env, args)
 
 	args = append(args, &object.String{Value: ""})
-	fnPrint(args)
+	fnPrint(env, args)
+
+	var out bytes.Buffer
+	NewEnclosed(env).SetOutput(&out)
+	fnPrint(env, []object.Object{&object.String{Value: "count "}, object.NewInteger(3)})
+	fnPrintf(env, []object.Object{&object.String{Value: " %d\n"}, object.NewInteger(4)})
+	if out.String() != "count 3 4\n" {
+		t.Errorf("unexpected output: %q", out.String())
+	}
+}
+
+// Test wildcard-matching
+func TestGlob(t *testing.T) {
+
+	type TestCase struct {
+		String  string
+		Pattern string
+		Result  bool
+	}
+
+	tests := []TestCase{
+		{String: "www.example.com", Pattern: "*.example.com", Result: true},
+		{String: "example.com", Pattern: "*.example.com", Result: false},
+		{String: "wwwXexample.com", Pattern: "www.example.com", Result: false},
+		{String: "main.c", Pattern: "*.[ch]", Result: true},
+		{String: "main.go", Pattern: "*.[ch]", Result: false},
+		{String: "steve", Pattern: "st?ve", Result: true},
+		{String: "a/b", Pattern: "*", Result: false},
+	}
+
+	for _, test := range tests {
+
+		res := fnGlob([]object.Object{&object.String{Value: test.String}, &object.String{Value: test.Pattern}})
+		if res.(*object.Boolean).Value != test.Result {
+			t.Errorf("Invalid result for glob(%s, %s)", test.String, test.Pattern)
+		}
+	}
+
+	// An invalid pattern is an error.
+	out := fnGlob([]object.Object{&object.String{Value: "steve"}, &object.String{Value: "[a"}})
+	if out.Type() != object.ERROR {
+		t.Errorf("invalid pattern returns a weird result")
+	}
+
+	// Calling the function with != 2 arguments is an error.
+	out = fnGlob([]object.Object{&object.String{Value: "steve"}})
+	if out.Type() != object.ERROR {
+		t.Errorf("one argument returns a weird result")
+	}
+}
+
+func TestFold(t *testing.T) {
+
+	tests := map[string]string{
+		"Steve":   "steve",
+		"STRASSE": "strasse",
+		"Straße":  "strasse",
+		"ΣΊΣΥΦΟΣ": "σίσυφοσ",
+	}
+
+	for input, expected := range tests {
+		out := fnFold([]object.Object{&object.String{Value: input}})
+		if out.Inspect() != expected {
+			t.Errorf("Invalid result for fold(%s): %s", input, out.Inspect())
+		}
+	}
+
+	// Calling the function with != 1 arguments is an error.
+	out := fnFold([]object.Object{})
+	if out.Type() != object.ERROR {
+		t.Errorf("no arguments returns a weird result")
+	}
+}
+
+func TestNormalize(t *testing.T) {
+
+	type TestCase struct {
+		Input  string
+		Form   string
+		Result string
+	}
+
+	tests := []TestCase{
+		{Input: "e\u0301", Result: "\u00e9"},
+		{Input: "\u00e9", Result: "\u00e9"},
+		{Input: "e\u0301", Form: "NFC", Result: "\u00e9"},
+		{Input: "\u00e9", Form: "NFD", Result: "e\u0301"},
+		{Input: "\ufb01", Form: "NFC", Result: "\ufb01"},
+		{Input: "\ufb01", Form: "nfkc", Result: "fi"},
+		{Input: "\ufb01", Form: "NFKD", Result: "fi"},
+	}
+
+	for _, test := range tests {
+
+		args := []object.Object{&object.String{Value: test.Input}}
+		if test.Form != "" {
+			args = append(args, &object.String{Value: test.Form})
+		}
+
+		out := fnNormalize(args)
+		if out.Inspect() != test.Result {
+			t.Errorf("Invalid result for normalize(%q, %s): %q", test.Input, test.Form, out.Inspect())
+		}
+	}
+
+	// An unknown form is an error.
+	out := fnNormalize([]object.Object{&object.String{Value: "steve"}, &object.String{Value: "NFX"}})
+	if out.Type() != object.ERROR {
+		t.Errorf("unknown form returns a weird result")
+	}
+
+	// Calling the function with the wrong number of arguments is an error.
+	out = fnNormalize([]object.Object{})
+	if out.Type() != object.ERROR {
+		t.Errorf("no arguments returns a weird result")
+	}
+}
+
+func TestSprintf(t *testing.T) {
+
+	type TestCase struct {
+		Args   []object.Object
+		Result string
+	}
+
+	tests := []TestCase{
+		{Args: []object.Object{&object.String{Value: "plain"}}, Result: "plain"},
+		{Args: []object.Object{&object.String{Value: "%s is %d"}, &object.String{Value: "Steve"}, object.NewInteger(3)}, Result: "Steve is 3"},
+		{Args: []object.Object{&object.String{Value: "%.2f%%"}, &object.Float{Value: 12.345}}, Result: "12.35%"},
+		{Args: []object.Object{&object.String{Value: "%f"}, object.NewInteger(2)}, Result: "2.000000"},
+		{Args: []object.Object{&object.String{Value: "[%5d|%-5s|%05d]"}, object.NewInteger(42), &object.String{Value: "ab"}, object.NewInteger(-7)}, Result: "[   42|ab   |-0007]"},
+		{Args: []object.Object{&object.String{Value: "%v %v %v"}, object.NewBoolean(true), &object.Float{Value: 1.5}, &object.Array{Elements: []object.Object{object.NewInteger(1)}}}, Result: "true 1.5 [1]"},
+		{Args: []object.Object{&object.String{Value: "%s"}, object.NewInteger(3)}, Result: "3"},
+		{Args: []object.Object{&object.String{Value: "%.3s"}, &object.String{Value: "Steve"}}, Result: "Ste"},
+	}
+
+	for _, test := range tests {
+		out := fnSprintf(New(), test.Args)
+		if out.Type() != object.STRING || out.Inspect() != test.Result {
+			t.Errorf("Invalid result for sprintf(%s): %s", test.Args[0].Inspect(), out.Inspect())
+		}
+	}
+
+	// Errors
+	errors := [][]object.Object{
+		{},
+		{&object.String{Value: "%d"}},
+		{&object.String{Value: "%d"}, &object.String{Value: "x"}},
+		{&object.String{Value: "%f"}, &object.String{Value: "x"}},
+		{&object.String{Value: "%x"}, object.NewInteger(3)},
+		{&object.String{Value: "%T"}, object.NewInteger(3)},
+		{&object.String{Value: "%5"}, object.NewInteger(3)},
+		{&object.String{Value: "%999999999999999999999d"}, object.NewInteger(3)},
+		{&object.String{Value: "%.100f"}, object.NewInteger(3)},
+		{&object.String{Value: "%s"}, object.NewInteger(3), object.NewInteger(4)},
+	}
+
+	for _, args := range errors {
+		out := fnSprintf(New(), args)
+		if out.Type() != object.ERROR {
+			t.Errorf("expected an error for sprintf(%v), got %s", args, out.Inspect())
+		}
+		if out := fnPrintf(New(), args); out.Type() != object.ERROR {
+			t.Errorf("expected an error for printf(%v), got %s", args, out.Inspect())
+		}
+	}
+}
+
+func TestLog(t *testing.T) {
+
+	env := New()
+
+	// Without a logger messages are discarded.
+	out := fnLog(env, []object.Object{&object.String{Value: "info"}, &object.String{Value: "hello"}})
+	if out.Type() == object.ERROR {
+		t.Errorf("unexpected error logging without a logger: %s", out.Inspect())
+	}
+
+	var level, message string
+	var values []object.Object
+	NewEnclosed(env).SetLogger(func(l string, m string, v []object.Object) {
+		level, message, values = l, m, v
+	})
+
+	out = fnLog(env, []object.Object{&object.String{Value: "WARN"}, &object.String{Value: "odd"}, object.NewInteger(3), object.NewBoolean(true)})
+	if out.Type() == object.ERROR {
+		t.Errorf("unexpected error logging: %s", out.Inspect())
+	}
+	if level != "warn" || message != "odd" || len(values) != 2 || values[0].Inspect() != "3" {
+		t.Errorf("unexpected message logged: %s %s %v", level, message, values)
+	}
+
+	// An unknown level is an error.
+	out = fnLog(env, []object.Object{&object.String{Value: "loud"}, &object.String{Value: "odd"}})
+	if out.Type() != object.ERROR {
+		t.Errorf("unknown level returns a weird result")
+	}
+
+	// Calling the function with < 2 arguments is an error.
+	out = fnLog(env, []object.Object{&object.String{Value: "info"}})
+	if out.Type() != object.ERROR {
+		t.Errorf("one argument returns a weird result")
+	}
+}
+
+func TestAssert(t *testing.T) {
+
+	out := fnAssert([]object.Object{object.NewBoolean(true), &object.String{Value: "oops"}})
+	if out.Type() != object.BOOLEAN {
+		t.Errorf("a true assertion returns a weird result")
+	}
+
+	out = fnAssert([]object.Object{object.NewInteger(0), &object.String{Value: "oops"}})
+	e, ok := out.(*object.Error)
+	if !ok || e.Kind != object.AssertionError || e.Message != "oops" {
+		t.Errorf("a false assertion returns a weird result")
+	}
+
+	out = fnAssert([]object.Object{object.NewBoolean(false)})
+	if out.Type() != object.ERROR || out.(*object.Error).Message != "assertion failed" {
+		t.Errorf("a false assertion returns a weird result")
+	}
+
+	// Calling the function with no arguments is an error.
+	out = fnAssert([]object.Object{})
+	if out.Type() != object.ERROR || out.(*object.Error).Kind != object.ArgumentError {
+		t.Errorf("no arguments returns a weird result")
+	}
+}
+
+func TestHashFunctions(t *testing.T) {
+
+	hash := &object.Hash{Pairs: map[string]object.Object{
+		"b": object.NewInteger(2),
+		"a": object.NewInteger(1),
+	}}
+
+	out := fnKeys([]object.Object{hash})
+	if out.Inspect() != "[a, b]" {
+		t.Errorf("unexpected keys: %s", out.Inspect())
+	}
+	out = fnValues([]object.Object{hash})
+	if out.Inspect() != "[1, 2]" {
+		t.Errorf("unexpected values: %s", out.Inspect())
+	}
+
+	out = fnHasKey([]object.Object{hash, &object.String{Value: "a"}})
+	if !out.True() {
+		t.Errorf("has_key didn't find a member")
+	}
+	out = fnHasKey([]object.Object{hash, &object.String{Value: "c"}})
+	if out.True() {
+		t.Errorf("has_key found a missing member")
+	}
+
+	other := &object.Hash{Pairs: map[string]object.Object{
+		"b": object.NewInteger(3),
+		"c": object.NewInteger(4),
+	}}
+	out = fnMerge([]object.Object{hash, other})
+	if out.Inspect() != "{a: 1, b: 3, c: 4}" {
+		t.Errorf("unexpected merge: %s", out.Inspect())
+	}
+	if len(hash.Pairs) != 2 {
+		t.Errorf("merge modified its argument")
+	}
+
+	// Errors
+	bad := []object.Object{
+		fnKeys([]object.Object{}),
+		fnKeys([]object.Object{object.NewInteger(3)}),
+		fnValues([]object.Object{&object.String{Value: "x"}}),
+		fnHasKey([]object.Object{hash}),
+		fnHasKey([]object.Object{&object.Array{}, object.NewInteger(0)}),
+		fnMerge([]object.Object{hash}),
+		fnMerge([]object.Object{hash, object.NewNull()}),
+	}
+	for i, out := range bad {
+		if out.Type() != object.ERROR {
+			t.Errorf("expected an error for case %d, got %s", i, out.Inspect())
+		}
+	}
+}
+
+func TestIsType(t *testing.T) {
+
+	tests := []struct {
+		Fun    func(args []object.Object) object.Object
+		Arg    object.Object
+		Result bool
+	}{
+		{fnIsArray, &object.Array{}, true},
+		{fnIsArray, &object.String{Value: "[]"}, false},
+		{fnIsBool, object.NewBoolean(false), true},
+		{fnIsBool, object.NewInteger(0), false},
+		{fnIsFloat, &object.Float{Value: 1}, true},
+		{fnIsFloat, object.NewInteger(1), false},
+		{fnIsInt, object.NewInteger(1), true},
+		{fnIsInt, &object.String{Value: "1"}, false},
+		{fnIsString, &object.String{Value: "1"}, true},
+		{fnIsString, object.NewNull(), false},
+	}
+
+	for i, test := range tests {
+		out := test.Fun([]object.Object{test.Arg})
+		if out.Type() != object.BOOLEAN || out.True() != test.Result {
+			t.Errorf("unexpected result for case %d: %s", i, out.Inspect())
+		}
+	}
+
+	// Calling a predicate with no arguments is an error.
+	out := fnIsInt([]object.Object{})
+	if out.Type() != object.ERROR {
+		t.Errorf("no arguments returns a weird result")
+	}
+}
+
+func TestDigest(t *testing.T) {
+
+	tests := []struct {
+		Fun    func(args []object.Object) object.Object
+		Result string
+	}{
+		{fnMD5, "900150983cd24fb0d6963f7d28e17f72"},
+		{fnSHA1, "a9993e364706816aba3e25717850c26c9cd0d89d"},
+		{fnSHA256, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{fnFNV, "e71fa2190541574b"},
+	}
+
+	for _, test := range tests {
+		out := test.Fun([]object.Object{&object.String{Value: "abc"}})
+		if out.Inspect() != test.Result {
+			t.Errorf("unexpected hash %s, expected %s", out.Inspect(), test.Result)
+		}
+
+		// Calling the function with no arguments is an error.
+		out = test.Fun([]object.Object{})
+		if out.Type() != object.ERROR {
+			t.Errorf("no arguments returns a weird result")
+		}
+	}
+
+	// Values are hashed as strings.
+	if fnMD5([]object.Object{object.NewInteger(3)}).Inspect() != fnMD5([]object.Object{&object.String{Value: "3"}}).Inspect() {
+		t.Errorf("integers should be hashed as strings")
+	}
+}
+
+func TestURL(t *testing.T) {
+
+	str := func(s string) object.Object { return &object.String{Value: s} }
+	full := str("https://user@Example.com:8443/a%20b/c?id=3&q=x+y#top")
+
+	tests := []struct {
+		Out    object.Object
+		Result string
+	}{
+		{fnURLHost([]object.Object{full}), "Example.com"},
+		{fnURLPath([]object.Object{full}), "/a b/c"},
+		{fnURLQuery([]object.Object{full, str("id")}), "3"},
+		{fnURLQuery([]object.Object{full, str("q")}), "x y"},
+		{fnURLQuery([]object.Object{full, str("missing")}), ""},
+		{fnURLHost([]object.Object{str("/index.html?page=2")}), ""},
+		{fnURLPath([]object.Object{str("/index.html?page=2")}), "/index.html"},
+		{fnURLQuery([]object.Object{str("/index.html?page=2"), str("page")}), "2"},
+	}
+
+	for i, test := range tests {
+		if test.Out.Type() != object.STRING || test.Out.Inspect() != test.Result {
+			t.Errorf("unexpected result for case %d: %s", i, test.Out.Inspect())
+		}
+	}
+
+	// Errors
+	bad := []object.Object{
+		fnURLHost([]object.Object{}),
+		fnURLPath([]object.Object{full, full}),
+		fnURLQuery([]object.Object{full}),
+		fnURLHost([]object.Object{str("http://[::1")}),
+		fnURLPath([]object.Object{str("%zz")}),
+		fnURLQuery([]object.Object{str("http://a b.com/"), str("id")}),
+	}
+	for i, out := range bad {
+		if out.Type() != object.ERROR {
+			t.Errorf("expected an error for case %d, got %s", i, out.Inspect())
+		}
+	}
+}
+
+func TestGeo(t *testing.T) {
+
+	num := func(f float64) object.Object { return &object.Float{Value: f} }
+	point := func(lat, lon float64) object.Object {
+		return &object.Array{Elements: []object.Object{num(lat), num(lon)}}
+	}
+
+	// London to Paris is about 344km.
+	out := fnGeoDistance([]object.Object{num(51.5074), num(-0.1278), num(48.8566), num(2.3522)})
+	f, ok := out.(*object.Float)
+	if !ok || f.Value < 340 || f.Value > 345 {
+		t.Errorf("unexpected distance %s", out.Inspect())
+	}
+	out = fnGeoDistance([]object.Object{object.NewInteger(10), num(20), num(10), object.NewInteger(20)})
+	if out.Inspect() != "0" {
+		t.Errorf("unexpected distance %s", out.Inspect())
+	}
+
+	// A concave polygon, shaped like a "U".
+	shape := &object.Array{Elements: []object.Object{
+		point(0, 0), point(0, 3), point(3, 3), point(3, 2), point(1, 2), point(1, 1), point(3, 1), point(3, 0),
+	}}
+
+	tests := []struct {
+		Lat    float64
+		Lon    float64
+		Result bool
+	}{
+		{0.5, 0.5, true},
+		{2.5, 0.5, true},
+		{2.5, 2.5, true},
+		{2, 1.5, false},
+		{-1, 1, false},
+		{4, 1, false},
+	}
+	for _, test := range tests {
+		out := fnGeoIn([]object.Object{num(test.Lat), num(test.Lon), shape})
+		b, ok := out.(*object.Boolean)
+		if !ok || b.Value != test.Result {
+			t.Errorf("unexpected result for %v,%v: %s", test.Lat, test.Lon, out.Inspect())
+		}
+	}
+
+	// Errors
+	bad := []object.Object{
+		fnGeoDistance([]object.Object{num(1), num(2), num(3)}),
+		fnGeoDistance([]object.Object{num(1), num(2), num(3), &object.String{Value: "4"}}),
+		fnGeoDistance([]object.Object{num(91), num(2), num(3), num(4)}),
+		fnGeoDistance([]object.Object{num(1), num(-181), num(3), num(4)}),
+		fnGeoIn([]object.Object{num(1), num(2)}),
+		fnGeoIn([]object.Object{num(1), num(2), num(3)}),
+		fnGeoIn([]object.Object{num(1), num(2), &object.Array{Elements: []object.Object{point(0, 0), point(1, 1)}}}),
+		fnGeoIn([]object.Object{num(1), num(2), &object.Array{Elements: []object.Object{point(0, 0), point(1, 1), num(3)}}}),
+		fnGeoIn([]object.Object{num(1), num(2), &object.Array{Elements: []object.Object{point(0, 0), point(1, 1), point(100, 1)}}}),
+	}
+	for i, out := range bad {
+		if out.Type() != object.ERROR {
+			t.Errorf("expected an error for case %d, got %s", i, out.Inspect())
+		}
+	}
+}
+
+func TestParseKV(t *testing.T) {
+
+	str := func(s string) object.Object { return &object.String{Value: s} }
+
+	tests := []struct {
+		Args   []object.Object
+		Result string
+	}{
+		{[]object.Object{str("k1=v1;k2=v2")}, "{k1: v1, k2: v2}"},
+		{[]object.Object{str(" k1 = v 1 ; ;flag; k1=again;")}, "{flag: , k1: again}"},
+		{[]object.Object{str("a:1, b:x=y"), str(","), str(":")}, "{a: 1, b: x=y}"},
+		{[]object.Object{str("a=1&b=2"), str("&")}, "{a: 1, b: 2}"},
+		{[]object.Object{str("")}, "{}"},
+	}
+
+	for _, test := range tests {
+		out := fnParseKV(test.Args)
+		if out.Type() != object.HASH || out.Inspect() != test.Result {
+			t.Errorf("unexpected result %s, expected %s", out.Inspect(), test.Result)
+		}
+	}
+
+	// Errors
+	bad := []object.Object{
+		fnParseKV([]object.Object{}),
+		fnParseKV([]object.Object{str("a"), str(";"), str("="), str("x")}),
+		fnParseKV([]object.Object{str("a=1"), str("")}),
+		fnParseKV([]object.Object{str("a=1"), str(";"), str("")}),
+	}
+	for i, out := range bad {
+		if out.Type() != object.ERROR {
+			t.Errorf("expected an error for case %d, got %s", i, out.Inspect())
+		}
+	}
+}
+
+// Test padding strings.
+func TestPad(t *testing.T) {
+
+	str := func(s string) object.Object {
+		return &object.String{Value: s}
+	}
+
+	tests := []struct {
+		Func   func([]object.Object) object.Object
+		Args   []object.Object
+		Result string
+		Error  bool
+	}{
+		{Func: fnLPad, Args: []object.Object{str("7"), object.NewInteger(3), str("0")}, Result: "007"},
+		{Func: fnRPad, Args: []object.Object{str("ab"), object.NewInteger(5)}, Result: "ab   "},
+		{Func: fnLPad, Args: []object.Object{object.NewInteger(42), object.NewInteger(4)}, Result: "  42"},
+		{Func: fnRPad, Args: []object.Object{str("π"), object.NewInteger(4), str("-=")}, Result: "π-=-"},
+		{Func: fnLPad, Args: []object.Object{str("héllo"), object.NewInteger(5)}, Result: "héllo"},
+		{Func: fnLPad, Args: []object.Object{str("long"), object.NewInteger(-1)}, Result: "long"},
+		{Func: fnLPad, Args: []object.Object{str("x")}, Error: true},
+		{Func: fnRPad, Args: []object.Object{str("x"), str("3")}, Error: true},
+		{Func: fnRPad, Args: []object.Object{str("x"), object.NewInteger(3), str("")}, Error: true},
+		{Func: fnLPad, Args: []object.Object{str("x"), object.NewInteger(maxPadWidth + 1)}, Error: true},
+	}
+
+	for _, test := range tests {
+		out := test.Func(test.Args)
+		if test.Error {
+			if out.Type() != object.ERROR {
+				t.Errorf("expected an error for %v, got %s", test.Args, out.Inspect())
+			}
+			continue
+		}
+		if out.Type() != object.STRING || out.Inspect() != test.Result {
+			t.Errorf("unexpected result for %v: '%s'", test.Args, out.Inspect())
+		}
+	}
+}
+
+func TestRound(t *testing.T) {
+
+	num := func(f float64) object.Object { return &object.Float{Value: f} }
+	digits := func(n int64) object.Object { return object.NewInteger(n) }
+	tenth, fifth := 0.1, 0.2
+
+	tests := []struct {
+		Args  []object.Object
+		Round string
+		Fixed string
+	}{
+		{[]object.Object{num(2.5)}, "3", "3"},
+		{[]object.Object{num(-2.5)}, "-3", "-3"},
+		{[]object.Object{num(1.005), digits(2)}, "1.01", "1.01"},
+		{[]object.Object{num(tenth + fifth), digits(2)}, "0.3", "0.30"},
+		{[]object.Object{num(9.996), digits(2)}, "10", "10.00"},
+		{[]object.Object{num(-0.001), digits(2)}, "0", "0.00"},
+		{[]object.Object{num(1e21), digits(1)}, "1000000000000000000000", "1000000000000000000000.0"},
+		{[]object.Object{num(1e-7), digits(8)}, "0.0000001", "0.00000010"},
+		{[]object.Object{digits(7), digits(3)}, "7", "7.000"},
+	}
+
+	for _, test := range tests {
+		out := fnRound(test.Args)
+		if out.Type() != object.FLOAT || out.Inspect() != test.Round {
+			t.Errorf("unexpected round of %s: %s, expected %s", test.Args[0].Inspect(), out.Inspect(), test.Round)
+		}
+		out = fnToFixed(test.Args)
+		if out.Type() != object.STRING || out.Inspect() != test.Fixed {
+			t.Errorf("unexpected to_fixed of %s: %s, expected %s", test.Args[0].Inspect(), out.Inspect(), test.Fixed)
+		}
+	}
+
+	// Errors
+	bad := [][]object.Object{
+		{},
+		{num(1), digits(1), digits(1)},
+		{&object.String{Value: "1.5"}},
+		{num(1), num(1)},
+		{num(1), digits(-1)},
+		{num(1), digits(65)},
+	}
+	for i, args := range bad {
+		if fnRound(args).Type() != object.ERROR || fnToFixed(args).Type() != object.ERROR {
+			t.Errorf("expected an error for case %d", i)
+		}
+	}
+
+	// The precision applies when floats are converted to strings.
+	env := New()
+	sum := num(tenth + fifth)
+	if fnString(env, []object.Object{sum}).Inspect() != "0.30000000000000004" {
+		t.Errorf("unexpected default precision")
+	}
+	env.SetFloatPrecision(10)
+	var out bytes.Buffer
+	env.SetOutput(&out)
+	fnPrint(env, []object.Object{sum, &object.String{Value: " "}, num(-0.00000000001), &object.String{Value: " "}, digits(3)})
+	fnPrintf(env, []object.Object{&object.String{Value: " %v %.3f"}, sum, sum})
+	if out.String() != "0.3 0 3 0.3 0.300" {
+		t.Errorf("unexpected output: %q", out.String())
+	}
+	if fnString(env, []object.Object{num(2.25)}).Inspect() != "2.25" || fnSprintf(env, []object.Object{&object.String{Value: "%s"}, sum}).Inspect() != "0.3" {
+		t.Errorf("unexpected conversion with a precision")
+	}
+}
+
+func TestIsNaN(t *testing.T) {
+
+	tests := []struct {
+		Input object.Object
+		NaN   bool
+		Inf   bool
+	}{
+		{&object.Float{Value: math.NaN()}, true, false},
+		{&object.Float{Value: math.Inf(1)}, false, true},
+		{&object.Float{Value: math.Inf(-1)}, false, true},
+		{&object.Float{Value: 1.5}, false, false},
+		{object.NewInteger(3), false, false},
+		{&object.String{Value: "NaN"}, false, false},
+	}
+
+	for _, test := range tests {
+		nan := fnIsNaN([]object.Object{test.Input})
+		inf := fnIsInf([]object.Object{test.Input})
+		if nan.(*object.Boolean).Value != test.NaN || inf.(*object.Boolean).Value != test.Inf {
+			t.Errorf("unexpected result for %s: %s %s", test.Input.Inspect(), nan.Inspect(), inf.Inspect())
+		}
+	}
+
+	// Calling the functions with the wrong number of arguments is an error.
+	if fnIsNaN([]object.Object{}).Type() != object.ERROR || fnIsInf([]object.Object{object.NewInteger(1), object.NewInteger(2)}).Type() != object.ERROR {
+		t.Errorf("expected an error")
+	}
+}
+
+// testFields holds the fields given to functions in our tests.
+type testFields map[string]object.Object
+
+// Field returns the value of the named field.
+func (f testFields) Field(name string) object.Object {
+	if val, ok := f[name]; ok {
+		return val
+	}
+	return object.NewNull()
+}
+
+// FieldNames returns the names of the fields, in sorted order.
+func (f testFields) FieldNames() []string {
+	var names []string
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestField(t *testing.T) {
+
+	call := NewCallInfo(context.Background(), nil, testFields{
+		"user_eu": &object.String{Value: "steve"},
+	})
+
+	out := fnField(call, []object.Object{&object.String{Value: "user_eu"}})
+	if out.Inspect() != "steve" {
+		t.Fatalf("unexpected result: %v", out)
+	}
+	out = fnField(call, []object.Object{&object.String{Value: "user_us"}})
+	if out.Type() != object.NULL {
+		t.Fatalf("expected null for a missing field, got %v", out)
+	}
+	out = fnField(call, []object.Object{&object.String{Value: "user_us"}, &object.String{Value: "nobody"}})
+	if out.Inspect() != "nobody" {
+		t.Fatalf("expected the default for a missing field, got %v", out)
+	}
+
+	// A CallInfo without a way to look up fields finds none.
+	out = fnField(&CallInfo{}, []object.Object{&object.String{Value: "user_eu"}})
+	if out.Type() != object.NULL {
+		t.Fatalf("expected null, got %v", out)
+	}
+
+	// Errors
+	errors := [][]object.Object{
+		{},
+		{&object.String{Value: "a"}, &object.String{Value: "b"}, &object.String{Value: "c"}},
+		{&object.Integer{Value: 3}},
+	}
+	for _, args := range errors {
+		out = fnField(call, args)
+		if out.Type() != object.ERROR {
+			t.Fatalf("expected an error for %v, got %v", args, out)
+		}
+	}
+}
+
+func TestFields(t *testing.T) {
+
+	call := NewCallInfo(context.Background(), nil, testFields{
+		"Name":       &object.String{Value: "steve"},
+		"debug_info": &object.String{Value: "x"},
+	})
+
+	out := fnFields(call, nil)
+	if out.Inspect() != "[Name, debug_info]" {
+		t.Fatalf("unexpected result: %v", out.Inspect())
+	}
+
+	// A CallInfo without a way to look up fields finds none.
+	out = fnFields(&CallInfo{}, nil)
+	if out.Inspect() != "[]" {
+		t.Fatalf("unexpected result: %v", out.Inspect())
+	}
+
+	out = fnFields(call, []object.Object{&object.String{Value: "a"}})
+	if out.Type() != object.ERROR {
+		t.Fatalf("expected an error, got %v", out)
+	}
+}
+
+func TestTypePredicate(t *testing.T) {
+
+	env := New()
+
+	n, ok := env.FunctionSlot("is_int")
+	if !ok {
+		t.Fatalf("failed to find is_int")
+	}
+	typ, ok := NewEnclosed(env).TypePredicate(n)
+	if !ok || typ != object.INTEGER {
+		t.Fatalf("unexpected type-predicate: %v %v", typ, ok)
+	}
+
+	// Other functions aren't type-predicates.
+	l, _ := env.FunctionSlot("len")
+	if _, ok = env.TypePredicate(l); ok {
+		t.Fatalf("len isn't a type-predicate")
+	}
+	if _, ok = env.TypePredicate(-1); ok {
+		t.Fatalf("a missing slot isn't a type-predicate")
+	}
+
+	// Nor are those which have been replaced.
+	env.SetFunction("is_int", fnIsString)
+	if _, ok = env.TypePredicate(n); ok {
+		t.Fatalf("a replaced function isn't a type-predicate")
+	}
 }
@@ -0,0 +1,131 @@
+// call.go contains the description of the run of a script, which is
+// passed to the functions which ask for it, such as our `field`, and
+// `fields`, functions.
+
+package environment
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/skx/evalfilter/v2/object"
+)
+
+// CallInfo describes the run of a script during which a function is
+// called.
+//
+// Functions which are registered with the signature
+//
+//	func(call *CallInfo, args []object.Object) object.Object
+//
+// are passed a CallInfo, along with their arguments, which allows them to
+// access data which is specific to the run, such as the identity of the
+// user whose request is being filtered, or the object it is running
+// against, rather than only that which was available when they were
+// registered.
+type CallInfo struct {
+	// Context is the context the script was run with, via RunContext,
+	// or context.Background() if it was run without one.
+	//
+	// Request-scoped data may be passed to functions via the values
+	// of the context.
+	Context context.Context
+
+	// Object is the object the script is running against, which is
+	// nil if the script was given its fields via RunFields.
+	Object interface{}
+
+	// fields gives access to the fields of the object.
+	fields Fields
+}
+
+// Fields gives access to the fields of the object a script is running
+// against, which are converted as they're needed.
+type Fields interface {
+	// Field returns the value of the named field, or Null if there
+	// is no such field.
+	Field(name string) object.Object
+
+	// FieldNames returns the names of all the fields, in sorted order.
+	FieldNames() []string
+}
+
+// NewCallInfo creates a CallInfo, for a run with the given context and
+// object, whose fields are accessed via the given Fields.
+//
+// This is used by the virtual machine, and is only useful to those who
+// wish to call functions which accept a CallInfo themselves.
+func NewCallInfo(ctx context.Context, obj interface{}, fields Fields) *CallInfo {
+	return &CallInfo{Context: ctx, Object: obj, fields: fields}
+}
+
+// Field returns the value of the named field of the object the script is
+// running against, or Null if there is no such field.
+//
+// The field is converted in the same way as it is when the script refers
+// to it, and only once per run, however often it is used.  Unlike such
+// a reference the variables the script has set are ignored, so this
+// allows functions to access fields whose names are computed at run-time.
+func (c *CallInfo) Field(name string) object.Object {
+	if c.fields == nil {
+		return object.NewNull()
+	}
+	return c.fields.Field(name)
+}
+
+// FieldNames returns the names of all the fields of the object the script
+// is running against, in sorted order.
+//
+// All the fields are converted, so this is more expensive than accessing
+// fields individually.  Objects which supply their own fields, via
+// GetField, can't list them, so only the fields which could be found
+// via reflection are returned for those.
+func (c *CallInfo) FieldNames() []string {
+	if c.fields == nil {
+		return nil
+	}
+	return c.fields.FieldNames()
+}
+
+// fnField is the implementation of our `field` function, which returns
+// the value of the field with the given name, or the optional default if
+// there is no such field.
+//
+// This allows scripts to access fields whose names are computed at
+// run-time, such as `field("user_" + Region)`.
+func fnField(call *CallInfo, args []object.Object) object.Object {
+
+	// We expect one argument, and an optional default
+	if len(args) != 1 && len(args) != 2 {
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("field expects one or two arguments, got %d", len(args))}
+	}
+	if args[0].Type() != object.STRING {
+		return &object.Error{Kind: object.TypeError, Message: fmt.Sprintf("field expects a STRING name, got %s", args[0].Type())}
+	}
+
+	val := call.Field(args[0].Inspect())
+	if val.Type() == object.NULL && len(args) == 2 {
+		return args[1]
+	}
+	return val
+}
+
+// fnFields is the implementation of our `fields` function, which returns
+// the names of all the fields of the object, in sorted order.
+//
+// This allows scripts to test the fields generically, such as rejecting
+// objects with any field whose name begins with `debug_`.
+func fnFields(call *CallInfo, args []object.Object) object.Object {
+
+	// We expect no arguments
+	if len(args) != 0 {
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("fields expects no arguments, got %d", len(args))}
+	}
+
+	names := call.FieldNames()
+	res := make([]object.Object, 0, len(names))
+	for _, name := range names {
+		res = append(res, &object.String{Value: name})
+	}
+	return &object.Array{Elements: res}
+}
@@ -0,0 +1,56 @@
+// digest.go contains the implementation of our hashing functions, such
+// as `sha256`.
+
+package environment
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/fnv"
+
+	"github.com/skx/evalfilter/v2/object"
+)
+
+// fnFNV is the implementation of our `fnv` function, which returns the
+// 64-bit FNV-1a hash of its argument.
+//
+// This isn't cryptographically secure, but it is fast, which makes it
+// useful for sampling.
+func fnFNV(args []object.Object) object.Object {
+	return digest("fnv", fnv.New64a(), args)
+}
+
+// fnMD5 is the implementation of our `md5` function.
+func fnMD5(args []object.Object) object.Object {
+	return digest("md5", md5.New(), args)
+}
+
+// fnSHA1 is the implementation of our `sha1` function.
+func fnSHA1(args []object.Object) object.Object {
+	return digest("sha1", sha1.New(), args)
+}
+
+// fnSHA256 is the implementation of our `sha256` function.
+func fnSHA256(args []object.Object) object.Object {
+	return digest("sha256", sha256.New(), args)
+}
+
+// digest returns the hash of the single argument, which was supplied to
+// one of our hashing functions, as a lower-case hex string.
+//
+// As with `len` the argument is converted to a string first, so that
+// `sha1(3)` is the same as `sha1("3")`.
+func digest(name string, h hash.Hash, args []object.Object) object.Object {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("%s expects one argument, got %d", name, len(args))}
+	}
+
+	h.Write([]byte(args[0].Inspect()))
+	return &object.String{Value: hex.EncodeToString(h.Sum(nil))}
+}
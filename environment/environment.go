@@ -2,6 +2,8 @@
 package environment
 
 import (
+	"io"
+
 	"github.com/skx/evalfilter/v2/object"
 )
 
@@ -10,9 +12,49 @@ type Environment struct {
 	// store holds variables set by the user-script.
 	store map[string]object.Object
 
-	// functions holds golang function pointers, as set by
-	// by the host-application.
-	functions map[string]interface{}
+	// functions holds the slot of each golang function, by name.
+	functions map[string]int
+
+	// slots holds golang function pointers, as set by the
+	// host-application, in the order they were first added.
+	//
+	// The compiler resolves calls to these functions to their
+	// slot, which avoids looking them up by name at run-time.
+	slots []slot
+
+	// operators holds the slot of each infix operator, added by the
+	// host-application, by name, and operatorSlots holds their
+	// implementations in the order they were first added.
+	operators     map[string]int
+	operatorSlots []slot
+
+	// outer holds the enclosing environment, if this is a nested
+	// scope created for a block which declares local variables.
+	outer *Environment
+
+	// regexps holds the regular expressions which have been compiled
+	// at run-time, by the `match` function, or the `~=` and `!~`
+	// operators.
+	//
+	// These may persist between runs because a regular expression
+	// object is essentially constant.
+	regexps *regexpCache
+
+	// logger receives the messages logged via the `log` function.
+	logger Logger
+
+	// output receives the output of the `print`, and `printf`,
+	// functions, if it isn't STDOUT.
+	output io.Writer
+
+	// floatDigits is the maximum number of decimal places used when
+	// floats are converted to strings, or -1 for as many as needed.
+	floatDigits int
+
+	// isolated is true if variables which are assigned, but which
+	// haven't been declared, are stored here rather than in the
+	// outermost environment.
+	isolated bool
 }
 
 // New creates a new environment, which is used for storing variable
@@ -23,36 +65,155 @@ func New() *Environment {
 	// Holder for objects.
 	str := make(map[string]object.Object)
 
-	// Holder for variables
-	fun := make(map[string]interface{})
+	// Holder for functions
+	fun := make(map[string]int)
 
 	// Create the environment object
-	env := &Environment{store: str, functions: fun}
+	env := &Environment{store: str, functions: fun, operators: make(map[string]int), regexps: newRegexpCache(regexpCacheSize), floatDigits: -1}
 
 	// Register our default functions.
+	env.SetFunction("assert", fnAssert)
 	env.SetFunction("len", fnLen)
+	env.SetFunction("log", func(args []object.Object) object.Object {
+		return fnLog(env, args)
+	})
 	env.SetFunction("lower", fnLower)
-	env.SetFunction("match", fnMatch)
-	env.SetFunction("print", fnPrint)
+	env.SetFunction("lpad", fnLPad)
+	env.SetFunction("rpad", fnRPad)
+	env.SetFunction("match", func(args []object.Object) object.Object {
+		return fnMatch(env.regexps, args)
+	})
+	env.SetFunction("print", func(args []object.Object) object.Object {
+		return fnPrint(env, args)
+	})
+	env.SetFunction("printf", func(args []object.Object) object.Object {
+		return fnPrintf(env, args)
+	})
+	env.SetFunction("sprintf", func(args []object.Object) object.Object {
+		return fnSprintf(env, args)
+	})
 	env.SetFunction("trim", fnTrim)
 	env.SetFunction("type", fnType)
 	env.SetFunction("upper", fnUpper)
-	env.SetFunction("string", fnString)
+	env.SetFunction("string", func(args []object.Object) object.Object {
+		return fnString(env, args)
+	})
 	env.SetFunction("int", fnInt)
 	env.SetFunction("float", fnFloat)
+	env.SetFunction("glob", fnGlob)
+	env.SetFunction("fold", fnFold)
+	env.SetFunction("normalize", fnNormalize)
+	env.SetFunction("contains", fnContains)
+	env.SetFunction("field", fnField)
+	env.SetFunction("fields", fnFields)
+	env.SetFunction("filter", fnFilter)
+	env.SetFunction("find", fnFind)
+	env.SetFunction("map", fnMap)
+	env.SetFunction("keys", fnKeys)
+	env.SetFunction("values", fnValues)
+	env.SetFunction("has_key", fnHasKey)
+	env.SetFunction("merge", fnMerge)
+	env.SetFunction("is_array", fnIsArray)
+	env.SetFunction("is_bool", fnIsBool)
+	env.SetFunction("is_float", fnIsFloat)
+	env.SetFunction("is_int", fnIsInt)
+	env.SetFunction("is_string", fnIsString)
+	env.SetFunction("md5", fnMD5)
+	env.SetFunction("sha1", fnSHA1)
+	env.SetFunction("sha256", fnSHA256)
+	env.SetFunction("fnv", fnFNV)
+	env.SetFunction("url_host", fnURLHost)
+	env.SetFunction("url_path", fnURLPath)
+	env.SetFunction("url_query", fnURLQuery)
+	env.SetFunction("parse_kv", fnParseKV)
+	env.SetFunction("geo_distance", fnGeoDistance)
+	env.SetFunction("geo_in", fnGeoIn)
+	env.SetFunction("round", fnRound)
+	env.SetFunction("to_fixed", fnToFixed)
+	env.SetFunction("is_nan", fnIsNaN)
+	env.SetFunction("is_inf", fnIsInf)
+
+	// Record that these are our own functions, until replaced.
+	for i := range env.slots {
+		env.slots[i].builtin = true
+		env.slots[i].predicate = typePredicates[env.slots[i].name]
+	}
 
 	// All done.
 	return env
 }
 
+// slot holds a function, and the name it was registered with.
+type slot struct {
+	name string
+	fun  interface{}
+
+	// builtin is true if the slot holds one of our default functions.
+	builtin bool
+
+	// predicate is the type tested for, if the slot holds one of our
+	// type-predicates.
+	predicate object.Type
+}
+
+// NewEnclosed creates a new environment, nested within the given one.
+//
+// Variables declared in the new environment, via Define, are not visible
+// to the outer one.  Variables which are not found in the new environment
+// are looked up in the outer environment.
+func NewEnclosed(outer *Environment) *Environment {
+	return &Environment{store: make(map[string]object.Object), outer: outer}
+}
+
+// NewIsolated creates a new environment, nested within the given one,
+// which is used to isolate the variables set by a single run of a script.
+//
+// Variables which are not found in the new environment are looked up in
+// the outer environment, but variables which are assigned are always
+// stored in the new environment - so the outer environment is never
+// modified.
+func NewIsolated(outer *Environment) *Environment {
+	return &Environment{store: make(map[string]object.Object), outer: outer, isolated: true}
+}
+
+// Outer returns the environment which encloses this one, or nil if
+// this is not a nested environment.
+func (e *Environment) Outer() *Environment {
+	return e.outer
+}
+
 // Get returns the value of a given variable, by name.
+//
+// If the variable isn't present we look in our enclosing environment.
 func (e *Environment) Get(name string) (object.Object, bool) {
 	obj, ok := e.store[name]
+	if !ok && e.outer != nil {
+		return e.outer.Get(name)
+	}
 	return obj, ok
 }
 
 // Set stores the value of a variable, by name.
+//
+// The variable is updated in the nearest environment which contains it,
+// if it hasn't been declared anywhere it is stored in the outermost
+// environment - or the nearest isolated environment, if there is one.
 func (e *Environment) Set(name string, val object.Object) object.Object {
+	env := e
+	for env.outer != nil && !env.isolated {
+		if _, ok := env.store[name]; ok {
+			break
+		}
+		env = env.outer
+	}
+	env.store[name] = val
+	return val
+}
+
+// Define stores the value of a variable, by name, in this environment
+// regardless of whether an enclosing environment contains a variable
+// of the same name.
+func (e *Environment) Define(name string, val object.Object) object.Object {
 	e.store[name] = val
 	return val
 }
@@ -60,7 +221,16 @@ func (e *Environment) Set(name string, val object.Object) object.Object {
 // SetFunction makes a (golang) function available to the scripting
 // environment.
 func (e *Environment) SetFunction(name string, fun interface{}) interface{} {
-	e.functions[name] = fun
+	if e.outer != nil {
+		return e.outer.SetFunction(name, fun)
+	}
+	if n, ok := e.functions[name]; ok {
+		e.slots[n].fun = fun
+		e.slots[n].builtin = false
+		return fun
+	}
+	e.functions[name] = len(e.slots)
+	e.slots = append(e.slots, slot{name: name, fun: fun})
 	return fun
 }
 
@@ -69,6 +239,106 @@ func (e *Environment) SetFunction(name string, fun interface{}) interface{} {
 // Functions retrieved are only those which have been previously added
 // via `SetFunction`.
 func (e *Environment) GetFunction(name string) (interface{}, bool) {
-	fun, ok := e.functions[name]
-	return fun, ok
+	if e.outer != nil {
+		return e.outer.GetFunction(name)
+	}
+	n, ok := e.functions[name]
+	if !ok {
+		return nil, false
+	}
+	return e.slots[n].fun, true
+}
+
+// FunctionSlot returns the slot which holds the function with the given
+// name, if it has been added via `SetFunction`.
+//
+// A function keeps its slot if it is replaced, so the slot may be used
+// to retrieve the function via `GetFunctionSlot` at any later point.
+func (e *Environment) FunctionSlot(name string) (int, bool) {
+	if e.outer != nil {
+		return e.outer.FunctionSlot(name)
+	}
+	n, ok := e.functions[name]
+	return n, ok
+}
+
+// IsBuiltin returns true if the function with the given name is one of
+// our default functions, which hasn't been replaced via `SetFunction`.
+func (e *Environment) IsBuiltin(name string) bool {
+	if e.outer != nil {
+		return e.outer.IsBuiltin(name)
+	}
+	n, ok := e.functions[name]
+	return ok && e.slots[n].builtin
+}
+
+// TypePredicate returns the type tested for by the function held in the
+// given slot, if it's one of our type-predicates, such as `is_int`, and
+// it hasn't been replaced.
+func (e *Environment) TypePredicate(n int) (object.Type, bool) {
+	if e.outer != nil {
+		return e.outer.TypePredicate(n)
+	}
+	if n < 0 || n >= len(e.slots) || !e.slots[n].builtin || e.slots[n].predicate == "" {
+		return "", false
+	}
+	return e.slots[n].predicate, true
+}
+
+// GetFunctionSlot returns the name of the function held in the given
+// slot, as well as the function itself.
+func (e *Environment) GetFunctionSlot(n int) (string, interface{}, bool) {
+	if e.outer != nil {
+		return e.outer.GetFunctionSlot(n)
+	}
+	if n < 0 || n >= len(e.slots) {
+		return "", nil, false
+	}
+	return e.slots[n].name, e.slots[n].fun, true
+}
+
+// SetOperator makes a (golang) function available to the scripting
+// environment as the implementation of the infix operator with the
+// given name, which is passed the values to the left, and the right,
+// of the operator.
+//
+// An operator keeps its slot if it is replaced, as functions do.
+func (e *Environment) SetOperator(name string, fun func(left, right object.Object) object.Object) {
+	if e.outer != nil {
+		e.outer.SetOperator(name, fun)
+		return
+	}
+
+	impl := func(args []object.Object) object.Object {
+		return fun(args[0], args[1])
+	}
+	if n, ok := e.operators[name]; ok {
+		e.operatorSlots[n].fun = impl
+		return
+	}
+	e.operators[name] = len(e.operatorSlots)
+	e.operatorSlots = append(e.operatorSlots, slot{name: name, fun: impl})
+}
+
+// OperatorSlot returns the slot which holds the infix operator with the
+// given name, if it has been added via `SetOperator`.
+func (e *Environment) OperatorSlot(name string) (int, bool) {
+	if e.outer != nil {
+		return e.outer.OperatorSlot(name)
+	}
+	n, ok := e.operators[name]
+	return n, ok
+}
+
+// GetOperatorSlot returns the name of the infix operator held in the
+// given slot, as well as its implementation, which is called in the
+// same way as a function, with the two values it operates upon.
+func (e *Environment) GetOperatorSlot(n int) (string, interface{}, bool) {
+	if e.outer != nil {
+		return e.outer.GetOperatorSlot(n)
+	}
+	if n < 0 || n >= len(e.operatorSlots) {
+		return "", nil, false
+	}
+	return e.operatorSlots[n].name, e.operatorSlots[n].fun, true
 }
@@ -56,3 +56,135 @@ func TestMissingSet(t *testing.T) {
 		t.Errorf("lookup of a missing value worked, bogus.")
 	}
 }
+
+func TestEnclosed(t *testing.T) {
+
+	env := New()
+	env.Set("global", &object.Integer{Value: 1})
+
+	inner := NewEnclosed(env)
+	inner.Define("local", &object.Integer{Value: 2})
+
+	// Both are visible from the inner scope.
+	for _, name := range []string{"global", "local"} {
+		if _, ok := inner.Get(name); !ok {
+			t.Errorf("failed to find %s in the inner scope", name)
+		}
+	}
+
+	// The local is not visible to the outer scope.
+	if _, ok := env.Get("local"); ok {
+		t.Errorf("local variable leaked to the outer scope")
+	}
+
+	// Setting an outer variable updates it in place.
+	inner.Set("global", &object.Integer{Value: 3})
+	out, _ := env.Get("global")
+	if out.(*object.Integer).Value != 3 {
+		t.Errorf("failed to update the outer variable")
+	}
+
+	// Setting an unknown variable stores it globally.
+	inner.Set("new", &object.Integer{Value: 4})
+	if _, ok := env.Get("new"); !ok {
+		t.Errorf("new variable wasn't stored globally")
+	}
+
+	// Functions are shared.
+	if _, ok := inner.GetFunction("print"); !ok {
+		t.Errorf("failed to find function from the inner scope")
+	}
+	if inner.Outer() != env {
+		t.Errorf("wrong outer environment")
+	}
+}
+
+// Test isolated environments don't modify the outer one.
+func TestIsolated(t *testing.T) {
+
+	env := New()
+	env.Set("global", &object.Integer{Value: 1})
+
+	run := NewIsolated(env)
+	block := NewEnclosed(run)
+
+	// Outer variables are visible.
+	if _, ok := block.Get("global"); !ok {
+		t.Errorf("failed to find global in the isolated scope")
+	}
+
+	// Updating them doesn't change the outer environment.
+	block.Set("global", &object.Integer{Value: 2})
+	out, _ := env.Get("global")
+	if out.(*object.Integer).Value != 1 {
+		t.Errorf("the outer variable was updated")
+	}
+	out, _ = run.Get("global")
+	if out.(*object.Integer).Value != 2 {
+		t.Errorf("the isolated variable wasn't updated")
+	}
+
+	// New variables are stored in the isolated scope.
+	block.Set("new", &object.Integer{Value: 3})
+	if _, ok := env.Get("new"); ok {
+		t.Errorf("new variable leaked to the outer scope")
+	}
+	if _, ok := run.Get("new"); !ok {
+		t.Errorf("new variable wasn't stored in the isolated scope")
+	}
+}
+
+// TestFunctionSlots tests that functions may be retrieved by slot.
+func TestFunctionSlots(t *testing.T) {
+
+	env := New()
+
+	n, ok := env.FunctionSlot("len")
+	if !ok {
+		t.Fatalf("Failed to find the slot of len")
+	}
+	name, fn, ok := env.GetFunctionSlot(n)
+	if !ok || name != "len" || fn == nil {
+		t.Fatalf("Failed to get the function in slot %d", n)
+	}
+
+	if !env.IsBuiltin("len") {
+		t.Fatalf("len should be a built-in function")
+	}
+
+	// Replacing a function keeps the slot.
+	env.SetFunction("len", fnUpper)
+	again, _ := env.FunctionSlot("len")
+	if again != n {
+		t.Fatalf("slot changed when replacing a function, %d != %d", again, n)
+	}
+	if env.IsBuiltin("len") {
+		t.Fatalf("a replaced function should not be a built-in function")
+	}
+
+	// Slots may be found from enclosed environments.
+	inner := NewEnclosed(env)
+	inner.SetFunction("custom", fnLower)
+	n, ok = inner.FunctionSlot("custom")
+	if !ok {
+		t.Fatalf("Failed to find the slot of custom")
+	}
+	name, _, ok = env.GetFunctionSlot(n)
+	if !ok || name != "custom" {
+		t.Fatalf("Failed to get the function in slot %d", n)
+	}
+	if inner.IsBuiltin("custom") || inner.IsBuiltin("missing") {
+		t.Fatalf("custom functions should not be built-in functions")
+	}
+
+	// Missing functions have no slot.
+	if _, ok = env.FunctionSlot("missing"); ok {
+		t.Fatalf("Found a slot for a missing function")
+	}
+	if _, _, ok = env.GetFunctionSlot(-1); ok {
+		t.Fatalf("Found a function in an invalid slot")
+	}
+	if _, _, ok = env.GetFunctionSlot(1000); ok {
+		t.Fatalf("Found a function in an invalid slot")
+	}
+}
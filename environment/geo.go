@@ -0,0 +1,124 @@
+// geo.go contains the implementation of our functions for testing the
+// locations of events, such as `geo_distance`.
+
+package environment
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/skx/evalfilter/v2/object"
+)
+
+// earthRadius is the mean radius of the earth, in kilometres.
+const earthRadius = 6371.0
+
+// fnGeoDistance is the implementation of our `geo_distance` function.
+//
+// It returns the great-circle distance, in kilometres, between the two
+// points given by their latitude and longitude, in degrees, via the
+// haversine formula.
+func fnGeoDistance(args []object.Object) object.Object {
+
+	// We expect four arguments
+	if len(args) != 4 {
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("geo_distance expects four arguments, got %d", len(args))}
+	}
+
+	lat1, lon1, e := geoPoint("geo_distance", args[0], args[1])
+	if e != nil {
+		return e
+	}
+	lat2, lon2, e := geoPoint("geo_distance", args[2], args[3])
+	if e != nil {
+		return e
+	}
+
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+
+	return &object.Float{Value: 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))}
+}
+
+// fnGeoIn is the implementation of our `geo_in` function.
+//
+// It returns true if the point given by its latitude and longitude lies
+// within the polygon, which is an array of at least three vertices, each
+// of which is an array of a latitude and a longitude.
+//
+// The polygon is treated as flat, which is accurate enough for the areas
+// used for geofencing, and it mustn't cross the antimeridian.
+func fnGeoIn(args []object.Object) object.Object {
+
+	// We expect three arguments
+	if len(args) != 3 {
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("geo_in expects three arguments, got %d", len(args))}
+	}
+
+	lat, lon, e := geoPoint("geo_in", args[0], args[1])
+	if e != nil {
+		return e
+	}
+
+	polygon, ok := args[2].(*object.Array)
+	if !ok {
+		return &object.Error{Kind: object.TypeError, Message: fmt.Sprintf("geo_in expects an array of vertices, got %s", args[2].Type())}
+	}
+	if len(polygon.Elements) < 3 {
+		return &object.Error{Kind: object.ValueError, Message: fmt.Sprintf("geo_in expects a polygon of at least three vertices, got %d", len(polygon.Elements))}
+	}
+
+	var lats, lons []float64
+	for _, v := range polygon.Elements {
+		vertex, ok := v.(*object.Array)
+		if !ok || len(vertex.Elements) != 2 {
+			return &object.Error{Kind: object.ValueError, Message: fmt.Sprintf("geo_in expects each vertex to be a latitude and a longitude, got %s", v.Inspect())}
+		}
+		vLat, vLon, e := geoPoint("geo_in", vertex.Elements[0], vertex.Elements[1])
+		if e != nil {
+			return e
+		}
+		lats = append(lats, vLat)
+		lons = append(lons, vLon)
+	}
+
+	//
+	// Cast a ray from the point, and count the number of edges
+	// it crosses; the point is inside if that is odd.
+	//
+	inside := false
+	for i, j := 0, len(lats)-1; i < len(lats); j, i = i, i+1 {
+		if (lats[i] > lat) != (lats[j] > lat) &&
+			lon < (lons[j]-lons[i])*(lat-lats[i])/(lats[j]-lats[i])+lons[i] {
+			inside = !inside
+		}
+	}
+
+	return object.NewBoolean(inside)
+}
+
+// geoPoint returns the latitude, and longitude, given to the named
+// function, after testing that they're numbers within range.
+func geoPoint(name string, lat object.Object, lon object.Object) (float64, float64, *object.Error) {
+
+	var out [2]float64
+	for i, arg := range []object.Object{lat, lon} {
+		switch v := arg.(type) {
+		case *object.Integer:
+			out[i] = float64(v.Value)
+		case *object.Float:
+			out[i] = v.Value
+		default:
+			return 0, 0, &object.Error{Kind: object.TypeError, Message: fmt.Sprintf("%s expects numeric coordinates, got %s", name, arg.Type())}
+		}
+	}
+
+	if math.IsNaN(out[0]) || math.Abs(out[0]) > 90 || math.IsNaN(out[1]) || math.Abs(out[1]) > 180 {
+		return 0, 0, &object.Error{Kind: object.ValueError, Message: fmt.Sprintf("%s expects a latitude within ±90, and a longitude within ±180, got %s, %s", name, lat.Inspect(), lon.Inspect())}
+	}
+	return out[0], out[1], nil
+}
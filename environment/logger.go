@@ -0,0 +1,59 @@
+// logger.go contains the implementation of our `log` function, which
+// passes messages to a logger supplied by the host application.
+
+package environment
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/skx/evalfilter/v2/object"
+)
+
+// Logger receives the messages a script logs via the `log` function.
+//
+// The level is one of "debug", "info", "warn", or "error", and the
+// values are any additional arguments the script supplied, such as
+// the fields which were being tested.
+type Logger func(level string, message string, values []object.Object)
+
+// logLevels holds the levels a script may log at.
+var logLevels = map[string]bool{
+	"debug": true,
+	"info":  true,
+	"warn":  true,
+	"error": true,
+}
+
+// SetLogger sets the logger which receives the messages a script logs.
+//
+// If there is no logger then messages are discarded.
+func (e *Environment) SetLogger(logger Logger) {
+	if e.outer != nil {
+		e.outer.SetLogger(logger)
+		return
+	}
+	e.logger = logger
+}
+
+// fnLog is the implementation of our `log` function.
+//
+// It is called with a level, a message, and optionally some values,
+// and passes them to the logger of the given environment.
+func fnLog(env *Environment, args []object.Object) object.Object {
+
+	// We expect at least a level and a message
+	if len(args) < 2 {
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("log expects at least two arguments, got %d", len(args))}
+	}
+
+	level := strings.ToLower(args[0].Inspect())
+	if !logLevels[level] {
+		return &object.Error{Kind: object.ValueError, Message: fmt.Sprintf("unknown log level %s", args[0].Inspect())}
+	}
+
+	if env.logger != nil {
+		env.logger(level, args[1].Inspect(), args[2:])
+	}
+	return object.NewInteger(0)
+}
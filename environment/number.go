@@ -0,0 +1,215 @@
+// number.go contains the implementation of our functions for rounding,
+// and formatting, floating-point numbers, such as `round`.
+
+package environment
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/skx/evalfilter/v2/object"
+)
+
+// maxDigits is the largest number of decimal places which may be given
+// to `round`, and `to_fixed`, or to SetFloatPrecision.
+const maxDigits = 64
+
+// SetFloatPrecision sets the maximum number of decimal places used when
+// the `string`, `print`, `printf`, and `sprintf` functions convert a
+// float to a string, with any trailing zeros removed.
+//
+// A negative precision, which is the default, uses the fewest digits
+// which represent the float exactly, so that 0.1 + 0.2 is printed as
+// "0.30000000000000004", whereas a precision of 10 prints "0.3".
+func (e *Environment) SetFloatPrecision(digits int) {
+	if e.outer != nil {
+		e.outer.SetFloatPrecision(digits)
+		return
+	}
+	if digits > maxDigits {
+		digits = maxDigits
+	}
+	e.floatDigits = digits
+}
+
+// inspect returns the string-representation of the given object, as the
+// `string` function would, which differs from its Inspect method only if
+// it's a float and a precision has been set.
+func (e *Environment) inspect(obj object.Object) string {
+	if e.outer != nil {
+		return e.outer.inspect(obj)
+	}
+
+	f, ok := obj.(*object.Float)
+	if !ok || e.floatDigits < 0 {
+		return obj.Inspect()
+	}
+
+	str := roundDecimal(f.Value, e.floatDigits)
+	if strings.Contains(str, ".") {
+		str = strings.TrimRight(strings.TrimRight(str, "0"), ".")
+	}
+	if str == "-0" {
+		str = "0"
+	}
+	return str
+}
+
+// fnRound is the implementation of our `round` function.
+//
+// It returns the given number rounded to the given number of decimal
+// places, or to an integer-valued float if there are none.
+func fnRound(args []object.Object) object.Object {
+
+	val, digits, e := roundArgs("round", args)
+	if e != nil {
+		return e
+	}
+
+	if math.IsNaN(val) || math.IsInf(val, 0) {
+		return &object.Float{Value: val}
+	}
+
+	out, err := strconv.ParseFloat(roundDecimal(val, digits), 64)
+	if err != nil {
+		return &object.Error{Kind: object.ValueError, Message: fmt.Sprintf("round failed: %s", err.Error())}
+	}
+	return &object.Float{Value: out}
+}
+
+// fnToFixed is the implementation of our `to_fixed` function.
+//
+// It returns the given number as a string, rounded to exactly the given
+// number of decimal places, and never in scientific notation, which is
+// useful for comparing, or displaying, amounts such as prices.
+func fnToFixed(args []object.Object) object.Object {
+
+	val, digits, e := roundArgs("to_fixed", args)
+	if e != nil {
+		return e
+	}
+
+	if math.IsNaN(val) || math.IsInf(val, 0) {
+		return &object.String{Value: (&object.Float{Value: val}).Inspect()}
+	}
+	return &object.String{Value: roundDecimal(val, digits)}
+}
+
+// roundArgs returns the number, and the number of decimal places, given
+// to the named function, where the latter is optional and defaults to
+// zero.
+func roundArgs(name string, args []object.Object) (float64, int, *object.Error) {
+
+	// We expect one argument, and optional digits
+	if len(args) != 1 && len(args) != 2 {
+		return 0, 0, &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("%s expects one or two arguments, got %d", name, len(args))}
+	}
+
+	var val float64
+	switch n := args[0].(type) {
+	case *object.Integer:
+		val = float64(n.Value)
+	case *object.Float:
+		val = n.Value
+	default:
+		return 0, 0, &object.Error{Kind: object.TypeError, Message: fmt.Sprintf("%s expects a number, got %s", name, args[0].Type())}
+	}
+
+	digits := int64(0)
+	if len(args) == 2 {
+		n, ok := args[1].(*object.Integer)
+		if !ok {
+			return 0, 0, &object.Error{Kind: object.TypeError, Message: fmt.Sprintf("%s expects an integer number of digits, got %s", name, args[1].Type())}
+		}
+		digits = n.Value
+	}
+	if digits < 0 || digits > maxDigits {
+		return 0, 0, &object.Error{Kind: object.ValueError, Message: fmt.Sprintf("%s expects between 0 and %d digits, got %d", name, maxDigits, digits)}
+	}
+
+	return val, int(digits), nil
+}
+
+// roundDecimal returns the given finite number as a string, with exactly
+// the given number of decimal places, rounding half away from zero.
+//
+// The rounding is applied to the shortest decimal representation of the
+// number, rather than its binary value, so that 1.005 is rounded to
+// 1.01, as a reader would expect, rather than to 1.00.
+func roundDecimal(val float64, digits int) string {
+
+	str := strconv.FormatFloat(math.Abs(val), 'f', -1, 64)
+
+	whole := str
+	frac := ""
+	if i := strings.IndexByte(str, '.'); i >= 0 {
+		whole = str[:i]
+		frac = str[i+1:]
+	}
+
+	up := false
+	if len(frac) > digits {
+		up = frac[digits] >= '5'
+		frac = frac[:digits]
+	}
+	frac += strings.Repeat("0", digits-len(frac))
+
+	//
+	// Round up by incrementing the digits we kept, from the last,
+	// carrying as we go.
+	//
+	kept := []byte(whole + frac)
+	for i := len(kept) - 1; up && i >= 0; i-- {
+		if kept[i] == '9' {
+			kept[i] = '0'
+			continue
+		}
+		kept[i]++
+		up = false
+	}
+	if up {
+		kept = append([]byte{'1'}, kept...)
+	}
+
+	out := string(kept[:len(kept)-digits])
+	if digits > 0 {
+		out += "." + string(kept[len(kept)-digits:])
+	}
+
+	if val < 0 && strings.Trim(out, "0.") != "" {
+		out = "-" + out
+	}
+	return out
+}
+
+// fnIsNaN is the implementation of our `is_nan` function.
+//
+// It returns true if the value is a float which is NaN, as produced by
+// `√-1`, for example.  Values which aren't floats are never NaN.
+func fnIsNaN(args []object.Object) object.Object {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("is_nan expects one argument, got %d", len(args))}
+	}
+
+	f, ok := args[0].(*object.Float)
+	return object.NewBoolean(ok && math.IsNaN(f.Value))
+}
+
+// fnIsInf is the implementation of our `is_inf` function.
+//
+// It returns true if the value is a float which is infinite, of either
+// sign, as produced by `10.0 ** 400`, for example.
+func fnIsInf(args []object.Object) object.Object {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("is_inf expects one argument, got %d", len(args))}
+	}
+
+	f, ok := args[0].(*object.Float)
+	return object.NewBoolean(ok && math.IsInf(f.Value, 0))
+}
@@ -0,0 +1,52 @@
+// output.go contains the implementation of our `print`, and `printf`,
+// functions, which write to an output supplied by the host application.
+
+package environment
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/skx/evalfilter/v2/object"
+)
+
+// SetOutput sets the writer which receives the output of the `print`,
+// and `printf`, functions.
+//
+// If there is no output then STDOUT is used.
+func (e *Environment) SetOutput(output io.Writer) {
+	if e.outer != nil {
+		e.outer.SetOutput(output)
+		return
+	}
+	e.output = output
+}
+
+// writer returns the writer which receives our output.
+func (e *Environment) writer() io.Writer {
+	if e.output != nil {
+		return e.output
+	}
+	return os.Stdout
+}
+
+// fnPrint is the implementation of our `print` function.
+func fnPrint(env *Environment, args []object.Object) object.Object {
+	for _, e := range args {
+		fmt.Fprintf(env.writer(), "%s", env.inspect(e))
+	}
+	return object.NewInteger(0)
+}
+
+// fnPrintf is the implementation of our `printf` function.
+//
+// It formats its arguments, as `sprintf` does, and prints the result.
+func fnPrintf(env *Environment, args []object.Object) object.Object {
+	str, err := format(env, "printf", args)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(env.writer(), str)
+	return object.NewInteger(0)
+}
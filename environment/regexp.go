@@ -0,0 +1,153 @@
+// regexp.go contains our cache of compiled regular expressions.
+
+package environment
+
+import (
+	"container/list"
+	"regexp"
+	"sync"
+
+	"github.com/skx/evalfilter/v2/object"
+)
+
+// regexpCacheSize is the maximum number of compiled regular expressions
+// we'll cache.
+//
+// Regular expression literals are compiled when a script is prepared, so
+// the cache is only used for regular expressions which are built at
+// run-time.  As those might be derived from the objects a script is run
+// against we must bound the number we store.
+const regexpCacheSize = 1024
+
+// regexpCache holds a bounded number of compiled regular expressions,
+// discarding the least-recently used when it is full.
+//
+// It is safe for concurrent use.
+type regexpCache struct {
+	// mutex protects our state.
+	mutex sync.Mutex
+
+	// size is the maximum number of entries we'll store.
+	size int
+
+	// order holds our entries, with the most recently used first.
+	order *list.List
+
+	// entries maps the source of a regular expression to its place
+	// in order.
+	entries map[string]*list.Element
+}
+
+// regexpEntry is the value stored in each element of our list.
+type regexpEntry struct {
+	// src is the source of the regular expression.
+	src string
+
+	// reg is the compiled regular expression.
+	reg *regexp.Regexp
+}
+
+// newRegexpCache creates a cache which will hold up to size entries.
+func newRegexpCache(size int) *regexpCache {
+	return &regexpCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// compile returns the compiled form of the given regular expression,
+// compiling and caching it if it isn't already present.
+func (c *regexpCache) compile(src string) (*regexp.Regexp, error) {
+
+	c.mutex.Lock()
+	if el, ok := c.entries[src]; ok {
+		c.order.MoveToFront(el)
+		c.mutex.Unlock()
+		return el.Value.(*regexpEntry).reg, nil
+	}
+	c.mutex.Unlock()
+
+	//
+	// Compile without holding the lock, so that a slow compilation
+	// doesn't block other callers.
+	//
+	reg, err := regexp.Compile(src)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if el, ok := c.entries[src]; ok {
+		c.order.MoveToFront(el)
+		return el.Value.(*regexpEntry).reg, nil
+	}
+
+	c.entries[src] = c.order.PushFront(&regexpEntry{src: src, reg: reg})
+
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*regexpEntry).src)
+	}
+
+	return reg, nil
+}
+
+// flush discards all the regular expressions held in the cache.
+func (c *regexpCache) flush() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.order.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+// len returns the number of regular expressions held in the cache.
+func (c *regexpCache) len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.order.Len()
+}
+
+// compileRegexp returns the compiled form of the given regular expression.
+//
+// Regular expression literals are compiled by the compiler, in which
+// case we use that, otherwise we look in the given cache.
+func compileRegexp(cache *regexpCache, obj object.Object) (*regexp.Regexp, error) {
+	if str, ok := obj.(*object.String); ok && str.Regexp != nil {
+		return str.Regexp, nil
+	}
+	return cache.compile(obj.Inspect())
+}
+
+// SeedRegexps compiles the given regular expressions, and stores them in
+// the cache used by the `match` function, and the `~=` and `!~`
+// operators.
+//
+// Regular expression literals are compiled when a script is prepared, so
+// this is only useful for regular expressions which a script builds at
+// run-time, for example from the values of variables.
+func (e *Environment) SeedRegexps(patterns ...string) error {
+	if e.outer != nil {
+		return e.outer.SeedRegexps(patterns...)
+	}
+	for _, src := range patterns {
+		_, err := e.regexps.compile(src)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FlushRegexps discards the regular expressions which have been cached.
+func (e *Environment) FlushRegexps() {
+	if e.outer != nil {
+		e.outer.FlushRegexps()
+		return
+	}
+	e.regexps.flush()
+}
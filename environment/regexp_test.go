@@ -0,0 +1,113 @@
+package environment
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"testing"
+
+	"github.com/skx/evalfilter/v2/object"
+)
+
+// TestRegexpCache tests that our cache is bounded.
+func TestRegexpCache(t *testing.T) {
+
+	c := newRegexpCache(2)
+
+	a, err := c.compile("^a$")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	again, _ := c.compile("^a$")
+	if a != again {
+		t.Fatalf("expected the cached regexp to be returned")
+	}
+
+	_, _ = c.compile("^b$")
+	_, _ = c.compile("^a$")
+	_, _ = c.compile("^c$")
+	if c.len() != 2 {
+		t.Fatalf("unexpected cache size: %d", c.len())
+	}
+
+	// "b" was the least recently used.
+	if _, ok := c.entries["^b$"]; ok {
+		t.Fatalf("expected ^b$ to be discarded")
+	}
+	if _, ok := c.entries["^a$"]; !ok {
+		t.Fatalf("expected ^a$ to be retained")
+	}
+
+	// Invalid expressions aren't cached.
+	if _, err = c.compile("+"); err == nil {
+		t.Fatalf("expected an error compiling an invalid regexp")
+	}
+	if c.len() != 2 {
+		t.Fatalf("unexpected cache size: %d", c.len())
+	}
+
+	// The cache may be used concurrently.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				src := fmt.Sprintf("^%d$", (i+j)%5)
+				r, err := c.compile(src)
+				if err != nil || r.String() != src {
+					t.Errorf("unexpected result compiling %s: %v %v", src, r, err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// TestCompiledRegexp tests that regexps compiled by the compiler are used.
+func TestCompiledRegexp(t *testing.T) {
+
+	// The compiled form is used in preference to the value.
+	str := &object.String{Value: "^steve$", Regexp: regexp.MustCompile("^Steve$")}
+
+	out := fnMatch(newRegexpCache(regexpCacheSize), []object.Object{&object.String{Value: "Steve"}, str})
+	if !out.True() {
+		t.Fatalf("the compiled regexp wasn't used")
+	}
+}
+
+// TestSeedRegexps tests that each environment has a cache of its own,
+// which may be seeded and flushed.
+func TestSeedRegexps(t *testing.T) {
+
+	a := New()
+	b := New()
+
+	err := NewIsolated(a).SeedRegexps("^a$", "^b$")
+	if err != nil {
+		t.Fatalf("unexpected error seeding: %s", err)
+	}
+	if a.regexps.len() != 2 {
+		t.Fatalf("unexpected cache size: %d", a.regexps.len())
+	}
+	if b.regexps.len() != 0 {
+		t.Fatalf("environments share a cache")
+	}
+
+	// Invalid expressions are reported.
+	if err = a.SeedRegexps("+"); err == nil {
+		t.Fatalf("expected an error seeding an invalid regexp")
+	}
+
+	// The `match` function uses the cache.
+	fn, _ := b.GetFunction("match")
+	out := fn.(func([]object.Object) object.Object)([]object.Object{&object.String{Value: "steve"}, &object.String{Value: "^s"}})
+	if !out.True() || b.regexps.len() != 1 {
+		t.Fatalf("match didn't use the cache of its environment")
+	}
+
+	NewEnclosed(a).FlushRegexps()
+	if a.regexps.len() != 0 {
+		t.Fatalf("unexpected cache size after flushing: %d", a.regexps.len())
+	}
+}
@@ -0,0 +1,73 @@
+// url.go contains the implementation of our functions for dissecting
+// URLs, such as `url_host`.
+
+package environment
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/skx/evalfilter/v2/object"
+)
+
+// fnURLHost is the implementation of our `url_host` function.
+//
+// It returns the host of the given URL, without any port.
+func fnURLHost(args []object.Object) object.Object {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("url_host expects one argument, got %d", len(args))}
+	}
+
+	u, e := parseURL(args[0])
+	if e != nil {
+		return e
+	}
+	return &object.String{Value: u.Hostname()}
+}
+
+// fnURLPath is the implementation of our `url_path` function.
+//
+// It returns the decoded path of the given URL.
+func fnURLPath(args []object.Object) object.Object {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("url_path expects one argument, got %d", len(args))}
+	}
+
+	u, e := parseURL(args[0])
+	if e != nil {
+		return e
+	}
+	return &object.String{Value: u.Path}
+}
+
+// fnURLQuery is the implementation of our `url_query` function.
+//
+// It returns the decoded value of the named query-parameter of the
+// given URL, or an empty string if there is no such parameter.
+func fnURLQuery(args []object.Object) object.Object {
+
+	// We expect two arguments
+	if len(args) != 2 {
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("url_query expects two arguments, got %d", len(args))}
+	}
+
+	u, e := parseURL(args[0])
+	if e != nil {
+		return e
+	}
+	return &object.String{Value: u.Query().Get(args[1].Inspect())}
+}
+
+// parseURL parses the given value as a URL, which may be absolute, or a
+// request-path such as "/index.html?page=2".
+func parseURL(arg object.Object) (*url.URL, *object.Error) {
+	u, err := url.Parse(arg.Inspect())
+	if err != nil {
+		return nil, &object.Error{Kind: object.ValueError, Message: fmt.Sprintf("invalid URL %s: %s", arg.Inspect(), err.Error())}
+	}
+	return u, nil
+}
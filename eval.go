@@ -8,8 +8,13 @@
 package evalfilter
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/skx/evalfilter/v2/ast"
@@ -18,12 +23,14 @@ import (
 	"github.com/skx/evalfilter/v2/lexer"
 	"github.com/skx/evalfilter/v2/object"
 	"github.com/skx/evalfilter/v2/parser"
+	"github.com/skx/evalfilter/v2/token"
 	"github.com/skx/evalfilter/v2/vm"
 )
 
 // Flags which can be optionally passed to Prepare.
 const (
-	// Don't run the optimizer when generating bytecode.
+	// Don't run the optimizer when generating bytecode, or
+	// evaluate simple scripts without the virtual machine.
 	NoOptimize byte = iota
 )
 
@@ -43,10 +50,245 @@ type Eval struct {
 
 	// the machine we drive
 	machine *vm.VM
+
+	// includeResolver is used to load the scripts referred to
+	// by `include` statements.
+	includeResolver func(name string) (string, error)
+
+	// including holds the names of the scripts we're currently
+	// including, which is used to detect include-loops.
+	including map[string]bool
+
+	// rules holds the named rules the script defined, if any.
+	rules []*rule
+
+	// pending holds the rules which have been parsed, but which
+	// have not yet been compiled.
+	pending []*ast.RuleStatement
+
+	// tests holds the named tests the script defined, if any, which
+	// are only run by TestScript.
+	tests []*rule
+
+	// pendingTests holds the tests which have been parsed, but which
+	// have not yet been compiled.
+	pendingTests []*ast.TestStatement
+
+	// persistent is true if variables set by the script should
+	// persist between runs.
+	persistent bool
+
+	// fast holds a specialised evaluator for the script, which is
+	// used in preference to the virtual machine, if the script is
+	// simple enough for one to be created.
+	fast *fastFilter
+
+	// assigned holds the names of the variables the script assigns,
+	// or declares, which might hold a lambda.  Calls to functions
+	// with these names are not resolved at compile-time.
+	assigned map[string]bool
+
+	// functions holds the lambdas the script assigned to variables,
+	// at its top-level, which the host may invoke via Call.
+	functions map[string]*object.Function
+
+	// coverage is true if the script should be instrumented for
+	// coverage reporting.
+	coverage bool
+
+	// coverPoints holds the statements and branches which have
+	// been instrumented, and coverCounts the number of times each
+	// was reached.
+	coverPoints []CoveragePoint
+	coverCounts []uint64
+
+	// coverSource and coverRule hold the name of the included
+	// script, and rule, which we're compiling, if any.
+	coverSource string
+	coverRule   string
+
+	// coverSkip is true if we're compiling code which shouldn't be
+	// instrumented, such as the body of a test.
+	coverSkip bool
+
+	// explaining is true if the value of each expression should be
+	// recorded, for Explain.  traceNodes holds those expressions,
+	// and tracing the ones we're currently compiling.
+	explaining bool
+	traceNodes []traceNode
+	tracing    []int
+
+	// explainer is the copy of the script which Explain runs.
+	explainer *Eval
+
+	// known holds the fields whose values are known ahead of time,
+	// if the script was created by Specialize.
+	known map[string]object.Object
+
+	// limits restricts the complexity of the script, and regexps
+	// counts the regular expressions it contains.
+	limits  Limits
+	regexps int
+
+	// constIndex holds the offset of each of our constants, by type
+	// and value, so that they may be found without a search.
+	constIndex map[string]int
+
+	// parserOptions holds the options given to the parser, for our
+	// script and those it includes.
+	parserOptions []parser.Option
+
+	// strict is true if conditions, and return values, must be
+	// booleans.
+	strict bool
+
+	// intDivision is true if `/` divides two integers as integers,
+	// as `~/` does, rather than as floats.
+	intDivision bool
+
+	// accessors supply the values of the fields the host names, in
+	// place of those we'd find via reflection.
+	accessors map[string]func(obj interface{}) interface{}
+
+	// warnings holds the probable mistakes found in the script,
+	// and those it includes, when it was prepared.
+	warnings []Warning
+
+	// doc holds the doc-comment of the script, if any.
+	doc string
+
+	// metadata holds the metadata the script declared via pragmas.
+	metadata Metadata
+
+	// tracer creates spans describing our work, if the host wishes
+	// to trace it, and scriptHash is the hash recorded upon them.
+	tracer     Tracer
+	scriptHash string
+}
+
+// rule holds the compiled form of a named rule, or test.
+type rule struct {
+	// name is the name of the rule.
+	name string
+
+	// instructions holds the bytecode for the body of the rule.
+	instructions code.Instructions
+
+	// machine is the virtual machine which executes the rule.
+	machine *vm.VM
+
+	// doc holds the doc-comment of the rule, if any.
+	doc string
+}
+
+// FieldProvider may be implemented by the objects you run scripts against,
+// to supply the values of fields without the use of reflection.
+//
+// This allows a host application to expose computed fields, or records
+// which are loaded on-demand from a database, for example.
+//
+// GetField is called each time a script refers to a field, and should
+// return false if the object has no field with the given name.  In that
+// case the field is looked up via reflection, as usual.
+type FieldProvider interface {
+	GetField(name string) (object.Object, bool)
+}
+
+// Option is a function which can be passed to New, to configure
+// the evaluator.
+type Option func(*Eval)
+
+// WithIncludeResolver allows the host application to supply a function
+// which will load the scripts referred to by `include` statements.
+//
+// The resolver is given the name used in the script, and should return
+// the contents of the script with that name.
+func WithIncludeResolver(resolver func(name string) (string, error)) Option {
+	return func(e *Eval) {
+		e.includeResolver = resolver
+	}
+}
+
+// WithPersistentState causes the variables set by a script to persist
+// between runs, rather than being discarded after each run.
+//
+// This allows a script to maintain state, such as a counter, across
+// the objects it is run against.
+func WithPersistentState() Option {
+	return func(e *Eval) {
+		e.persistent = true
+	}
+}
+
+// WithStrictBool requires the conditions of `if`, and `while`, the
+// operands of `&&` and `||`, and the value the script returns, to be
+// booleans.
+//
+// By default any value may be used as a condition, and non-empty strings,
+// and non-zero numbers, are true.  This catches scripts such as
+// `if ( Name ) { ... }`, which were intended to read `Name != ""`, by
+// making them fail with an error instead.  The error for a value which
+// is returned identifies the line of its `return` statement.
+func WithStrictBool() Option {
+	return func(e *Eval) {
+		e.strict = true
+	}
+}
+
+// WithIntegerDivision causes `/` to truncate the result of dividing two
+// integers, so that `5 / 2` is 2, as it was before integers were promoted
+// to floats, which is 2.5.
+//
+// Scripts may use `~/` to divide as integers regardless.
+func WithIntegerDivision() Option {
+	return func(e *Eval) {
+		e.intDivision = true
+	}
+}
+
+// WithAccessors allows the host to supply the values of the given fields
+// of the objects the script is run against, which is useful to expose
+// fields which are computed, or to give the unexported fields of a
+// structure names of their own.
+//
+// Each accessor is called with the object, and its result is converted in
+// the same way as a field would be.  Accessors take precedence over the
+// fields, and methods, of a structure, or the keys of a map, and their
+// fields are listed by `fields`.
+func WithAccessors(accessors map[string]func(obj interface{}) interface{}) Option {
+	return func(e *Eval) {
+		e.accessors = accessors
+	}
+}
+
+// WithSelectors allows the script to refer to fields via JSONPath-style
+// selectors, such as `$.request.headers["X-Forwarded-For"]`, which eases
+// the migration of filters from systems which use them.
+//
+// `$.name`, or `$["name"]`, is the field `name` of the object the script
+// is run against, and the remainder of the selector is the usual member
+// access, and indexing.
+func WithSelectors() Option {
+	return func(e *Eval) {
+		e.parserOptions = append(e.parserOptions, parser.WithSelectors())
+	}
+}
+
+// WithFloatPrecision limits the number of decimal places used when the
+// script converts a float to a string, via `string`, `print`, `printf`,
+// or `sprintf`, with any trailing zeros removed.
+//
+// By default as many digits are used as are needed to represent the
+// float exactly, so `string(0.1 + 0.2)` is "0.30000000000000004", which
+// surprises scripts which compare the result with "0.3".
+func WithFloatPrecision(digits int) Option {
+	return func(e *Eval) {
+		e.environment.SetFloatPrecision(digits)
+	}
 }
 
 // New creates a new instance of the evaluator.
-func New(script string) *Eval {
+func New(script string, options ...Option) *Eval {
 
 	//
 	// Create our object.
@@ -54,6 +296,15 @@ func New(script string) *Eval {
 	e := &Eval{
 		environment: environment.New(),
 		Script:      script,
+		including:   make(map[string]bool),
+		assigned:    make(map[string]bool),
+	}
+
+	//
+	// Apply any options.
+	//
+	for _, option := range options {
+		option(e)
 	}
 
 	//
@@ -67,7 +318,7 @@ func New(script string) *Eval {
 //
 // Internally this compilation process walks through the usual steps,
 // lexing, parsing, and bytecode-compilation.
-func (e *Eval) Prepare(flags ...[]byte) error {
+func (e *Eval) Prepare(flags ...[]byte) (err error) {
 
 	//
 	// Default to optimizing the bytecode.
@@ -85,6 +336,12 @@ func (e *Eval) Prepare(flags ...[]byte) error {
 		}
 	}
 
+	//
+	// Our constants might be shared with other scripts, in a Program,
+	// in which case we only process the lambdas we add.
+	//
+	base := len(e.constants)
+
 	//
 	// Create a lexer.
 	//
@@ -93,11 +350,12 @@ func (e *Eval) Prepare(flags ...[]byte) error {
 	//
 	// Create a parser using the lexer.
 	//
-	p := parser.New(l)
+	p := parser.New(l, e.parserOptions...)
 
 	//
 	// Parse the program into an AST.
 	//
+	parsing := e.span(SpanParse)
 	program := p.ParseProgram()
 
 	//
@@ -106,14 +364,57 @@ func (e *Eval) Prepare(flags ...[]byte) error {
 	// If so report that.
 	//
 	if len(p.Errors()) > 0 {
-		return fmt.Errorf("\nErrors parsing script:\n" +
+		err = fmt.Errorf("\nErrors parsing script:\n" +
 			strings.Join(p.Errors(), "\n"))
+		parsing.End(err)
+		return err
+	}
+	parsing.End(nil)
+
+	//
+	// Everything else is part of compiling the program.
+	//
+	compiling := e.span(SpanCompile)
+	defer func() {
+		if err == nil {
+			count := countInstructions(e.instructions)
+			for _, r := range e.rules {
+				count += countInstructions(r.instructions)
+			}
+			compiling.SetAttribute("instructions", count)
+			compiling.SetAttribute("constants", len(e.constants))
+			compiling.SetAttribute("rules", len(e.rules))
+			compiling.SetAttribute("native", e.fast != nil)
+		}
+		compiling.End(err)
+	}()
+
+	e.doc = ast.CommentText(program.Doc)
+
+	//
+	// Record the metadata the script declares.
+	//
+	metadata, err := programMetadata(program)
+	if err != nil {
+		return err
+	}
+	e.metadata = metadata
+
+	//
+	// Reject scripts which are too complex before compiling them.
+	//
+	e.regexps = 0
+	err = e.checkProgram(program)
+	if err != nil {
+		return err
 	}
+	e.warnings = nil
+	e.checkWarnings(program, "")
 
 	//
 	// Compile the program to bytecode
 	//
-	err := e.compile(program)
+	err = e.compile(program)
 
 	//
 	// If there were errors then return them.
@@ -122,6 +423,63 @@ func (e *Eval) Prepare(flags ...[]byte) error {
 		return err
 	}
 
+	//
+	// Compile any named rules, each of which gets its own bytecode.
+	//
+	for _, r := range e.pending {
+		err = e.compileRule(r)
+		if err != nil {
+			return err
+		}
+	}
+	e.pending = nil
+
+	//
+	// Compile any tests, in the same way.
+	//
+	for _, t := range e.pendingTests {
+		err = e.compileTest(t)
+		if err != nil {
+			return err
+		}
+	}
+	e.pendingTests = nil
+
+	//
+	// Now that we've seen all the variables the script assigns we
+	// can resolve calls to our built-in functions, in the main
+	// program, the rules, and the bodies of any lambdas.
+	//
+	e.resolveFunctions(e.instructions)
+	for _, r := range append(e.rules, e.tests...) {
+		e.resolveFunctions(r.instructions)
+	}
+	for _, c := range e.constants[base:] {
+		if fn, ok := c.(*object.Function); ok {
+			e.resolveFunctions(fn.Body)
+		}
+	}
+
+	//
+	// If the values of some fields are known we can substitute them
+	// now, along with the results of any operations upon them.
+	//
+	if e.known != nil {
+		main := e.instructions
+		for _, r := range e.rules {
+			e.instructions = r.instructions
+			e.specialize()
+		}
+		for _, c := range e.constants[base:] {
+			if fn, ok := c.(*object.Function); ok {
+				e.instructions = fn.Body
+				e.specialize()
+			}
+		}
+		e.instructions = main
+		e.specialize()
+	}
+
 	//
 	// Attempt to optimize the code, running multiple passes until no
 	// more changes are possible.
@@ -131,7 +489,38 @@ func (e *Eval) Prepare(flags ...[]byte) error {
 	//
 	if optimize {
 		e.optimize()
+
+		main := e.instructions
+		for _, r := range append(e.rules, e.tests...) {
+			e.instructions = r.instructions
+			e.optimize()
+			r.instructions = e.instructions
+		}
+		e.instructions = main
+	}
+
+	//
+	// Now we can test the size of the program we've generated.
+	//
+	err = e.checkSize()
+	if err != nil {
+		return err
+	}
+
+	//
+	// If the script is simple enough we can evaluate it without
+	// using the virtual machine, which is much faster.
+	//
+	// Instrumented scripts must be run by the virtual machine, as
+	// otherwise nothing would be counted.
+	//
+	// Accessors are only known to the virtual machine, so fields
+	// must be found by it too.
+	//
+	if optimize && !e.coverage && e.accessors == nil {
+		e.fast = newFastFilter(program, e.known, e.strict)
 	}
+	e.coverCounts = make([]uint64, len(e.coverPoints))
 
 	//
 	// Now we're done, construct a VM with the bytecode and constants
@@ -139,6 +528,11 @@ func (e *Eval) Prepare(flags ...[]byte) error {
 	// which we were given.
 	//
 	e.machine = vm.New(e.constants, e.instructions, e.environment)
+	e.configure(e.machine)
+	for _, r := range append(e.rules, e.tests...) {
+		r.machine = vm.New(e.constants, r.instructions, e.environment)
+		e.configure(r.machine)
+	}
 
 	//
 	// All done; no errors.
@@ -146,6 +540,65 @@ func (e *Eval) Prepare(flags ...[]byte) error {
 	return nil
 }
 
+// clone returns a copy of the evaluator, which shares our compiled
+// program, functions, and variables, but which has virtual machines of
+// its own - so that it may be run concurrently with us.
+//
+// If variables persist between runs then the copy stores those it sets
+// in an environment of its own, rather than in ours.
+func (e *Eval) clone() *Eval {
+
+	env := e.environment
+	if e.persistent {
+		env = environment.NewIsolated(e.environment)
+	}
+
+	c := &Eval{
+		Script:       e.Script,
+		environment:  env,
+		constants:    e.constants,
+		instructions: e.instructions,
+		persistent:   e.persistent,
+		functions:    e.functions,
+		coverage:     e.coverage,
+		coverPoints:  e.coverPoints,
+		coverCounts:  e.coverCounts,
+		strict:       e.strict,
+		intDivision:  e.intDivision,
+		accessors:    e.accessors,
+		limits:       e.limits,
+		doc:          e.doc,
+		metadata:     e.metadata,
+		tracer:       e.tracer,
+		scriptHash:   e.scriptHash,
+	}
+
+	if e.fast != nil {
+		c.fast = e.fast.copy()
+	}
+
+	c.machine = vm.New(c.constants, c.instructions, c.environment)
+	c.configure(c.machine)
+	for _, r := range e.rules {
+		m := vm.New(c.constants, r.instructions, c.environment)
+		c.configure(m)
+		c.rules = append(c.rules, &rule{name: r.name, instructions: r.instructions, machine: m, doc: r.doc})
+	}
+
+	return c
+}
+
+// configure applies our options to the given virtual machine, which is
+// one of those that run our script, its rules, or its tests.
+func (e *Eval) configure(m *vm.VM) {
+	m.SetPersistent(e.persistent)
+	m.SetCoverage(e.coverCounts)
+	m.SetStrict(e.strict)
+	m.SetIntegerDivision(e.intDivision)
+	m.SetAccessors(e.accessors)
+	m.SetMaxSteps(e.limits.MaxSteps)
+}
+
 // Bytecode returns our generated bytecode.
 func (e *Eval) Bytecode() code.Instructions {
 	return e.instructions
@@ -156,14 +609,57 @@ func (e *Eval) Bytecode() code.Instructions {
 // This is used by the `evalfilter` CLI-utility, but it might be useful
 // to consumers of our library.
 func (e *Eval) Dump() error {
+	return e.DumpTo(os.Stdout)
+}
+
+// DumpTo writes our bytecode to the given writer, in the same form as
+// Dump, which allows it to be displayed by applications without a
+// console - such as those compiled to WebAssembly.
+func (e *Eval) DumpTo(w io.Writer) error {
+
+	fmt.Fprintf(w, "Bytecode:\n")
+	e.dumpInstructions(w, e.instructions)
+
+	// Show the bytecode of each rule, if any are present.
+	for _, r := range e.rules {
+		fmt.Fprintf(w, "\nRule %s:\n", r.name)
+		e.dumpInstructions(w, r.instructions)
+	}
+
+	// Show the bytecode of each test, if any are present.
+	for _, t := range e.tests {
+		fmt.Fprintf(w, "\nTest %s:\n", t.name)
+		e.dumpInstructions(w, t.instructions)
+	}
+
+	// Show constants, if any are present.
+	if len(e.constants) > 0 {
+		fmt.Fprintf(w, "\n\nConstants:\n")
+		for i, n := range e.constants {
+
+			s := strings.ReplaceAll(n.Inspect(), "\n", "\\n")
+
+			fmt.Fprintf(w, "  %06d Type:%s Value:\"%s\"\n", i, n.Type(), s)
+
+			// Show the body of any functions.
+			if fn, ok := n.(*object.Function); ok {
+				e.dumpInstructions(w, fn.Body)
+			}
+		}
+	}
+
+	return nil
+}
+
+// dumpInstructions shows a human-readable version of the given bytecode.
+func (e *Eval) dumpInstructions(w io.Writer, instructions code.Instructions) {
 
 	i := 0
-	fmt.Printf("Bytecode:\n")
 
-	for i < len(e.instructions) {
+	for i < len(instructions) {
 
 		// opcode
-		op := e.instructions[i]
+		op := instructions[i]
 
 		// opcode length
 		opLen := code.Length(code.Opcode(op))
@@ -171,13 +667,13 @@ func (e *Eval) Dump() error {
 		// opcode as a string
 		str := code.String(code.Opcode(op))
 
-		fmt.Printf("  %06d\t%14s", i, str)
+		fmt.Fprintf(w, "  %06d\t%14s", i, str)
 
 		// show arg
 		if op < byte(code.OpCodeSingleArg) {
 
-			arg := binary.BigEndian.Uint16(e.instructions[i+1 : i+3])
-			fmt.Printf("\t%d", arg)
+			arg := binary.BigEndian.Uint16(instructions[i+1 : i+3])
+			fmt.Fprintf(w, "\t%d", arg)
 
 			//
 			// Show the values, as comments, to make the
@@ -188,33 +684,48 @@ func (e *Eval) Dump() error {
 				v := e.constants[arg]
 				s := strings.ReplaceAll(v.Inspect(), "\n", "\\n")
 
-				fmt.Printf("\t// load constant: \"%s\"", s)
+				fmt.Fprintf(w, "\t// load constant: \"%s\"", s)
 			}
 			if code.Opcode(op) == code.OpLookup {
-				fmt.Printf("\t// lookup field: %v", e.constants[arg])
+				fmt.Fprintf(w, "\t// lookup field: %s", e.constants[arg].Inspect())
 			}
 			if code.Opcode(op) == code.OpCall {
-				fmt.Printf("\t// call function with %d arg(s)", arg)
+				fmt.Fprintf(w, "\t// call function with %d arg(s)", arg)
 			}
-		}
+			if code.Opcode(op) == code.OpIsType {
+				name, _, _ := e.environment.GetFunctionSlot(int(arg))
+				fmt.Fprintf(w, "\t// test type via %s", name)
+			}
+			if code.Opcode(op) == code.OpRequireBool {
+				fmt.Fprintf(w, "\t// require a boolean, returned on line %d", arg)
+			}
+			if code.Opcode(op) == code.OpClosure {
+				fmt.Fprintf(w, "\t// create function: %s", e.constants[arg].Inspect())
+			}
+			if code.Opcode(op) == code.OpCustomOp {
+				name, _, _ := e.environment.GetOperatorSlot(int(arg))
+				fmt.Fprintf(w, "\t// operator %s", name)
+			}
+			if code.Opcode(op) == code.OpCallBuiltin {
+				args := binary.BigEndian.Uint16(instructions[i+3 : i+5])
+				name, _, _ := e.environment.GetFunctionSlot(int(arg))
 
-		fmt.Printf("\n")
+				fmt.Fprintf(w, " %d\t// call function %s with %d arg(s)", args, name, args)
+			}
+			if code.Opcode(op) == code.OpLookupConstantEqual {
+				val := binary.BigEndian.Uint16(instructions[i+3 : i+5])
+				dst := binary.BigEndian.Uint16(instructions[i+5 : i+7])
 
-		i += opLen
-	}
+				s := strings.ReplaceAll(e.constants[val].Inspect(), "\n", "\\n")
 
-	// Show constants, if any are present.
-	if len(e.constants) > 0 {
-		fmt.Printf("\n\nConstants:\n")
-		for i, n := range e.constants {
+				fmt.Fprintf(w, " %d %d\t// jump unless field %s equals \"%s\"", val, dst, e.constants[arg].Inspect(), s)
+			}
+		}
 
-			s := strings.ReplaceAll(n.Inspect(), "\n", "\\n")
+		fmt.Fprintf(w, "\n")
 
-			fmt.Printf("  %06d Type:%s Value:\"%s\"\n", i, n.Type(), s)
-		}
+		i += opLen
 	}
-
-	return nil
 }
 
 // Run takes the program which was passed in the constructor, and
@@ -222,11 +733,29 @@ func (e *Eval) Dump() error {
 //
 // The supplied object will be used for performing dynamic field-lookups, etc.
 func (e *Eval) Run(obj interface{}) (bool, error) {
+	if e.tracer != nil {
+		return e.traceRun(func() (bool, error) { return e.runContext(context.Background(), obj) })
+	}
+	return e.runContext(context.Background(), obj)
+}
+
+// runContext executes the program against the given object, with the
+// given context, for Run and RunContext.
+func (e *Eval) runContext(ctx context.Context, obj interface{}) (bool, error) {
+
+	//
+	// Use our specialised evaluator if we can.
+	//
+	if e.fast != nil {
+		if ret, ok := e.fast.run(obj, e.environment); ok {
+			return ret, nil
+		}
+	}
 
 	//
 	// Launch the program in the VM.
 	//
-	out, err := e.machine.Run(obj)
+	out, err := e.machine.RunContext(ctx, obj)
 
 	//
 	// Error executing?  Report that.
@@ -235,6 +764,57 @@ func (e *Eval) Run(obj interface{}) (bool, error) {
 		return false, err
 	}
 
+	return e.result(out)
+}
+
+// RunContext executes the program in the same way as Run, but passes the
+// given context to the functions which accept an environment.CallInfo.
+//
+// This allows the host to pass request-scoped data, such as the identity
+// of the user whose request is being filtered, to its functions via the
+// values of the context.  The context isn't tested while the script runs,
+// so cancelling it won't interrupt the script.
+func (e *Eval) RunContext(ctx context.Context, obj interface{}) (bool, error) {
+	if e.tracer != nil {
+		return e.traceRun(func() (bool, error) { return e.runContext(ctx, obj) })
+	}
+	return e.runContext(ctx, obj)
+}
+
+// RunFields executes the program in the same way as Run, but takes the
+// values of the fields from the given map, rather than from an object.
+//
+// This suits hosts which already hold their data as objects, such as
+// those which have adapted it from JSON, as no reflection is required,
+// and the map is used without being copied.
+func (e *Eval) RunFields(fields map[string]object.Object) (bool, error) {
+	if e.tracer != nil {
+		return e.traceRun(func() (bool, error) { return e.runFields(fields) })
+	}
+	return e.runFields(fields)
+}
+
+// runFields executes the program against the given fields, for RunFields.
+func (e *Eval) runFields(fields map[string]object.Object) (bool, error) {
+
+	if e.fast != nil {
+		if ret, ok := e.fast.run(fields, e.environment); ok {
+			return ret, nil
+		}
+	}
+
+	out, err := e.machine.RunFields(fields)
+	if err != nil {
+		return false, err
+	}
+
+	return e.result(out)
+}
+
+// result converts the value returned by a script to a boolean, or to an
+// error if the script returned one.
+func (e *Eval) result(out object.Object) (bool, error) {
+
 	//
 	// Is the return-value an error?  If so report that.
 	//
@@ -242,21 +822,249 @@ func (e *Eval) Run(obj interface{}) (bool, error) {
 		return false, fmt.Errorf("%s", out.Inspect())
 	}
 
+	//
+	// If we're strict then anything other than a boolean is an
+	// error too.
+	//
+	if e.strict && out.Type() != object.BOOLEAN {
+		return false, fmt.Errorf("the script must return a boolean, not %s", out.Type())
+	}
+
 	//
 	// Otherwise convert the result to a boolean, and return.
 	//
-	return out.True(), err
+	return out.True(), nil
+}
+
+// Rules returns the names of the rules defined by the script, in the
+// order in which they were defined.
+func (e *Eval) Rules() []string {
+	var names []string
+	for _, r := range e.rules {
+		names = append(names, r.name)
+	}
+	return names
+}
+
+// Doc returns the doc-comment of the script, which is the group of
+// comments at its start, without their markers.
+//
+// Comments which immediately precede a named rule document the rule
+// instead, so a script which begins with a rule should separate its own
+// doc-comment from the rule's by a blank line.
+func (e *Eval) Doc() string {
+	return e.doc
+}
+
+// RuleDoc returns the doc-comment of the named rule, which is the group
+// of comments on the lines immediately before it, without their markers.
+//
+// This allows rule-management tools to display the descriptions the
+// authors of rules have written.
+func (e *Eval) RuleDoc(name string) string {
+	for _, r := range e.rules {
+		if r.name == name {
+			return r.doc
+		}
+	}
+	return ""
+}
+
+// RunAll tests each of the named rules the script defined against
+// the given object, and returns the names of those which matched.
+//
+// A rule matches if it returns a true value; a rule which reaches the
+// end of its body without returning does not match.
+func (e *Eval) RunAll(obj interface{}) ([]string, error) {
+	var matched []string
+
+	for _, r := range e.rules {
+
+		out, err := r.machine.Run(obj)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %s", r.name, err.Error())
+		}
+		if out.Type() == object.ERROR {
+			return nil, fmt.Errorf("rule %s: %s", r.name, out.Inspect())
+		}
+		if e.strict && out.Type() != object.BOOLEAN {
+			return nil, fmt.Errorf("rule %s: the rule must return a boolean, not %s", r.name, out.Type())
+		}
+		if out.True() {
+			matched = append(matched, r.name)
+		}
+	}
+
+	return matched, nil
+}
 
+// Functions returns the names of the functions the script defined, by
+// assigning lambdas to variables at its top-level, in sorted order.
+func (e *Eval) Functions() []string {
+	var names []string
+	for name := range e.functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Call invokes the named function, which the script defined by assigning
+// a lambda to a variable at its top-level, against the given object with
+// the given arguments, and returns its result.
+//
+// This allows a single script to expose several behaviours to the host,
+// such as:
+//
+//	score  = weight => Severity * weight;
+//	urgent = limit => score(2) > limit;
+//	return Severity > 3;
+//
+// As with any lambda the function takes a single argument.  The script
+// itself isn't run, so the function may refer to the fields of the
+// object, to variables the host has set, and to the other functions the
+// script defined, but not to the other variables the script assigns.
+func (e *Eval) Call(name string, obj interface{}, args ...object.Object) (object.Object, error) {
+
+	out, err := e.machine.Call(name, e.functions, obj, args)
+	if err != nil {
+		return nil, err
+	}
+	if out.Type() == object.ERROR {
+		return nil, fmt.Errorf("%s", out.Inspect())
+	}
+	return out, nil
+}
+
+// Captures returns the values the most recent run of the script recorded
+// via `capture`, by name, or nil if there were none.
+//
+// This allows a script to report the evidence which caused it to match,
+// such as the value of a field, without changing the value it returns:
+//
+//	if ( capture("ip", SourceIP) in Blocked ) { return true; }
+//
+// If a name is captured more than once the last value is returned.  As
+// with Run this isn't safe for concurrent use.
+func (e *Eval) Captures() map[string]object.Object {
+	return e.machine.Captures()
 }
 
 // AddFunction exposes a golang function from your host application
 // to the scripting environment.
 //
 // Once a function has been added it may be used by the filter script.
+//
+// The function must have the signature
+//
+//	func(args []object.Object) object.Object
+//
+// or, if it needs to access data which is specific to each run, such as
+// the context given to RunContext,
+//
+//	func(call *environment.CallInfo, args []object.Object) object.Object
 func (e *Eval) AddFunction(name string, fun interface{}) {
 	e.environment.SetFunction(name, fun)
 }
 
+// AddOperator exposes a golang function from your host application to
+// the scripting environment as an infix operator, such as `inside` for
+// testing whether a point lies within a polygon, or `~>` for testing
+// whether a version lies within a range.
+//
+// The name of the operator is either a word, which may not be one of
+// our keywords, or a sequence of the symbols "~!@%^&*-+=<>|?:", which
+// may not be one of our own operators.  All such operators have the same
+// precedence as the comparison operators, and they must be added before
+// the script is prepared.
+//
+// The function is passed the values to the left, and the right, of the
+// operator, and it may return an error object to abort the script.
+func (e *Eval) AddOperator(name string, fun func(left, right object.Object) object.Object) error {
+	if !validOperator(name) {
+		return fmt.Errorf("invalid operator name %q", name)
+	}
+	e.environment.SetOperator(name, fun)
+	e.parserOptions = append(e.parserOptions, parser.WithOperators(name))
+	return nil
+}
+
+// validOperator returns true if the given name may be used for an
+// operator added via AddOperator.
+func validOperator(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	word := true
+	symbols := true
+	for i, c := range name {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			word = false
+		}
+		if !strings.ContainsRune("~!@%^&*-+=<>|?:", c) {
+			symbols = false
+		}
+	}
+
+	if word {
+		return token.LookupIdentifier(name) == token.IDENT
+	}
+	if !symbols {
+		return false
+	}
+
+	//
+	// If the lexer reads the name as one token then it's one of
+	// our own operators.
+	//
+	l := lexer.New(name)
+	tok := l.NextToken()
+	return tok.Type == token.ILLEGAL || tok.Literal != name
+}
+
+// SeedRegexps compiles the given regular expressions ahead of time, so
+// that they needn't be compiled when the script uses them.
+//
+// Regular expression literals are always compiled when the script is
+// prepared, so this is only useful for scripts which match against
+// values they build at run-time, such as "Name ~= Pattern".  Each
+// evaluator has a cache of its own, which is shared with its clones.
+func (e *Eval) SeedRegexps(patterns ...string) error {
+	return e.environment.SeedRegexps(patterns...)
+}
+
+// FlushRegexps discards the regular expressions which have been cached
+// by the evaluator.
+func (e *Eval) FlushRegexps() {
+	e.environment.FlushRegexps()
+}
+
+// SetLogger sets the function which receives the messages the script
+// logs via the `log` function, such as `log("warn", "odd value", Count)`.
+//
+// Unlike `print` this allows a script to emit diagnostics which the host
+// application can route to its own logging, along with the level of the
+// message and any values the script supplied.  Messages which are logged
+// without a logger having been set are discarded.
+//
+// The logger is shared by the copies of the evaluator which RunParallel
+// creates, so it may be called concurrently.
+func (e *Eval) SetLogger(logger func(level string, message string, values []object.Object)) {
+	e.environment.SetLogger(logger)
+}
+
+// SetOutput sets the writer which receives the output of the script's
+// calls to `print`, and `printf`, which is STDOUT by default.
+//
+// This suits applications which have no console, such as those compiled
+// to WebAssembly, or which capture the output of a script.  The output is
+// shared by the copies of the evaluator which RunParallel creates, so it
+// must be safe for concurrent use if that is used.
+func (e *Eval) SetOutput(output io.Writer) {
+	e.environment.SetOutput(output)
+}
+
 // SetVariable adds, or updates a variable which will be available
 // to the filter script.
 func (e *Eval) SetVariable(name string, value object.Object) {
@@ -266,35 +1074,93 @@ func (e *Eval) SetVariable(name string, value object.Object) {
 // GetVariable retrieves the contents of a variable which has been
 // set within a user-script.
 //
+// Unless the evaluator was created with WithPersistentState the
+// variables are those set by the most recent call to Run.
+//
 // If the variable hasn't been set then the null-value will be returned.
 func (e *Eval) GetVariable(name string) object.Object {
-	value, ok := e.environment.Get(name)
+	env := e.environment
+	if e.machine != nil && e.machine.Global() != nil {
+		env = e.machine.Global()
+	}
+	value, ok := env.Get(name)
 	if ok {
 		return value
 	}
-	return &object.Null{}
+	return object.NewNull()
 }
 
 // compile is core-code for converting the AST into a series of bytecodes.
 func (e *Eval) compile(node ast.Node) error {
 
+	//
+	// When explaining a script we record the value of each
+	// expression as it is evaluated.
+	//
+	if expr, ok := node.(ast.Expression); ok && e.explaining && traced(expr) {
+		return e.compileTraced(expr)
+	}
+	return e.compileNode(node)
+}
+
+// compileNode compiles the given node, for compile.
+func (e *Eval) compileNode(node ast.Node) error {
+
 	switch node := node.(type) {
 
 	case *ast.Program:
 		for _, s := range node.Statements {
+
+			// Rules are compiled separately, once the main
+			// program has been handled.
+			if r, ok := s.(*ast.RuleStatement); ok {
+				e.pending = append(e.pending, r)
+				continue
+			}
+			if t, ok := s.(*ast.TestStatement); ok {
+				e.pendingTests = append(e.pendingTests, t)
+				continue
+			}
+
+			// Pragmas describe the script, and generate no code.
+			if _, ok := s.(*ast.PragmaStatement); ok {
+				continue
+			}
+
+			e.cover("statement", statementLine(s))
 			err := e.compile(s)
 			if err != nil {
 				return err
 			}
+			e.defineFunction(s)
 		}
 
 	case *ast.BlockStatement:
+
+		//
+		// If the block declares local variables it gets a
+		// scope of its own, otherwise we avoid the overhead.
+		//
+		scoped := false
+		for _, s := range node.Statements {
+			if _, ok := s.(*ast.LetStatement); ok {
+				scoped = true
+			}
+		}
+
+		if scoped {
+			e.emit(code.OpEnterScope)
+		}
 		for _, s := range node.Statements {
+			e.cover("statement", statementLine(s))
 			err := e.compile(s)
 			if err != nil {
 				return err
 			}
 		}
+		if scoped {
+			e.emit(code.OpLeaveScope)
+		}
 
 	case *ast.BooleanLiteral:
 		if node.Value {
@@ -322,7 +1188,7 @@ func (e *Eval) compile(node ast.Node) error {
 			// Otherwise we emit it as a constant
 			// to our pool.
 			//
-			integer := &object.Integer{Value: node.Value}
+			integer := object.NewInteger(node.Value)
 			e.emit(code.OpConstant, e.addConstant(integer))
 		}
 
@@ -345,7 +1211,27 @@ func (e *Eval) compile(node ast.Node) error {
 
 		// The value + flags
 		reg := &object.String{Value: val}
-		e.emit(code.OpConstant, e.addConstant(reg))
+
+		// Compile it now, rather than each time it is used.
+		//
+		// If it is invalid we leave it alone, and the error
+		// is reported if it is used at run-time, which allows
+		// it to be caught.
+		r, err := regexp.Compile(val)
+		if err != nil {
+			e.emit(code.OpConstant, e.addConstant(reg))
+			break
+		}
+
+		//
+		// If an identical string is already present as a
+		// constant we replace it, so the compiled form is
+		// always available.
+		//
+		reg.Regexp = r
+		n := e.addConstant(reg)
+		e.constants[n] = reg
+		e.emit(code.OpConstant, n)
 
 	case *ast.ArrayLiteral:
 		for _, el := range node.Elements {
@@ -361,6 +1247,19 @@ func (e *Eval) compile(node ast.Node) error {
 		if err != nil {
 			return err
 		}
+
+		//
+		// If we must return a boolean then test the value here,
+		// so that the error identifies the statement, unless it
+		// can't be anything else.
+		//
+		if e.strict && !returnsBool(node.ReturnValue) {
+			line := node.Token.Line
+			if line > 0xFFFF {
+				line = 0
+			}
+			e.emit(code.OpRequireBool, line)
+		}
 		e.emit(code.OpReturn)
 
 	case *ast.ExpressionStatement:
@@ -375,7 +1274,17 @@ func (e *Eval) compile(node ast.Node) error {
 			return err
 		}
 
-		err = e.compile(node.Right)
+		//
+		// If a regular expression literal is matched without
+		// regard to case we compile it with the appropriate
+		// flag, so that it needn't be compiled at run-time.
+		//
+		right := node.Right
+		if reg, ok := right.(*ast.RegexpLiteral); ok && (node.Operator == "~*" || node.Operator == "!~*") {
+			right = &ast.RegexpLiteral{Token: reg.Token, Value: reg.Value, Flags: "i" + strings.ReplaceAll(reg.Flags, "i", "")}
+		}
+
+		err = e.compile(right)
 		if err != nil {
 			return err
 		}
@@ -391,6 +1300,8 @@ func (e *Eval) compile(node ast.Node) error {
 			e.emit(code.OpMul)
 		case "/":
 			e.emit(code.OpDiv)
+		case "~/":
+			e.emit(code.OpIntDiv)
 		case "%":
 			e.emit(code.OpMod)
 		case "**":
@@ -413,15 +1324,54 @@ func (e *Eval) compile(node ast.Node) error {
 			e.emit(code.OpMatches)
 		case "!~":
 			e.emit(code.OpNotMatches)
+		case "~*":
+			e.emit(code.OpIMatches)
+		case "!~*":
+			e.emit(code.OpNotIMatches)
+		case "in":
+			e.emit(code.OpIn)
 
 			// logical
 		case "&&":
 			e.emit(code.OpAnd)
 		case "||":
 			e.emit(code.OpOr)
+		case "^^":
+			e.emit(code.OpXor)
+
+			// bitwise
+		case "&":
+			e.emit(code.OpBitAnd)
+		case "|":
+			e.emit(code.OpBitOr)
+		case "^":
+			e.emit(code.OpBitXor)
+		case "<<":
+			e.emit(code.OpShiftLeft)
+		case ">>":
+			e.emit(code.OpShiftRight)
 		default:
-			return fmt.Errorf("unknown operator %s", node.Operator)
+			n, ok := e.environment.OperatorSlot(node.Operator)
+			if !ok {
+				return fmt.Errorf("unknown operator %s", node.Operator)
+			}
+			e.emit(code.OpCustomOp, n)
+		}
+
+	case *ast.BetweenExpression:
+		err := e.compile(node.Value)
+		if err != nil {
+			return err
+		}
+		err = e.compile(node.Low)
+		if err != nil {
+			return err
+		}
+		err = e.compile(node.High)
+		if err != nil {
+			return err
 		}
+		e.emit(code.OpBetween)
 
 	case *ast.PrefixExpression:
 		err := e.compile(node.Right)
@@ -436,6 +1386,8 @@ func (e *Eval) compile(node ast.Node) error {
 			e.emit(code.OpMinus)
 		case "√":
 			e.emit(code.OpRoot)
+		case "~":
+			e.emit(code.OpBitNot)
 		default:
 			return fmt.Errorf("unknown operator %s", node.Operator)
 		}
@@ -474,6 +1426,7 @@ func (e *Eval) compile(node ast.Node) error {
 		//
 		// Compile the code in block A
 		//
+		e.cover("then", node.Token.Line)
 		err = e.compile(node.Consequence)
 		if err != nil {
 			return err
@@ -498,7 +1451,11 @@ func (e *Eval) compile(node ast.Node) error {
 		// needed to jump over the first block if the condition
 		// was not true - and we've already handled that case.
 		//
-		if node.Alternative != nil {
+		// When coverage is enabled we need somewhere to count
+		// the condition being false, so an if-statement without
+		// an else-block gets an empty one.
+		//
+		if node.Alternative != nil || e.coverage && !e.coverSkip {
 
 			//
 			// Add a jump to the end of A - which will
@@ -520,9 +1477,12 @@ func (e *Eval) compile(node ast.Node) error {
 			//
 			// Compile the block
 			//
-			err := e.compile(node.Alternative)
-			if err != nil {
-				return err
+			e.cover("else", node.Token.Line)
+			if node.Alternative != nil {
+				err := e.compile(node.Alternative)
+				if err != nil {
+					return err
+				}
 			}
 
 			//
@@ -605,6 +1565,7 @@ func (e *Eval) compile(node ast.Node) error {
 		//
 		// Compile the code in the body
 		//
+		e.cover("loop", node.Token.Line)
 		err = e.compile(node.Body)
 		if err != nil {
 			return err
@@ -632,10 +1593,42 @@ func (e *Eval) compile(node ast.Node) error {
 		// Store the name
 		str := &object.String{Value: node.Name.String()}
 		e.emit(code.OpConstant, e.addConstant(str))
+		e.assigned[str.Value] = true
 
 		// And make it work.
 		e.emit(code.OpSet)
 
+	case *ast.LetStatement:
+
+		// Get the value
+		err := e.compile(node.Value)
+		if err != nil {
+			return err
+		}
+
+		// Store the name
+		str := &object.String{Value: node.Name.String()}
+		e.emit(code.OpConstant, e.addConstant(str))
+		e.assigned[str.Value] = true
+
+		// And declare it.
+		e.emit(code.OpLet)
+
+	case *ast.RuleStatement:
+		return fmt.Errorf("rule %s must be defined at the top-level of the script", node.Name)
+
+	case *ast.TestStatement:
+		return fmt.Errorf("test %s must be defined at the top-level of the script", node.Name)
+
+	case *ast.IncludeStatement:
+		source := e.coverSource
+		e.coverSource = node.Name
+		err := e.include(node.Name)
+		e.coverSource = source
+		if err != nil {
+			return err
+		}
+
 	case *ast.Identifier:
 		str := &object.String{Value: node.Value}
 		e.emit(code.OpLookup, e.addConstant(str))
@@ -656,6 +1649,18 @@ func (e *Eval) compile(node ast.Node) error {
 		//  "print"
 		//  call 2
 		//
+		// `catch` is not a real function, as it must
+		// handle errors raised by its first argument, and
+		// nor is `capture`, which records evidence with the
+		// run rather than the environment.
+		//
+		if node.Function.String() == "catch" {
+			return e.compileCatch(node)
+		}
+		if node.Function.String() == "capture" {
+			return e.compileCapture(node)
+		}
+
 		args := len(node.Arguments)
 		for _, a := range node.Arguments {
 
@@ -672,6 +1677,34 @@ func (e *Eval) compile(node ast.Node) error {
 		// then a call instruction with the number of args.
 		e.emit(code.OpCall, args)
 
+	case *ast.FunctionLiteral:
+
+		//
+		// The body of the function is compiled into its own
+		// series of instructions, which are stored in a constant.
+		//
+		// At run-time OpClosure binds that constant to the
+		// scope in which the lambda is evaluated.
+		//
+		main := e.instructions
+		e.instructions = nil
+
+		err := e.compile(node.Body)
+		if err != nil {
+			e.instructions = main
+			return err
+		}
+		e.emit(code.OpReturn)
+
+		fn := &object.Function{Source: node.String(), Body: e.instructions}
+		for _, p := range node.Parameters {
+			fn.Parameters = append(fn.Parameters, p.Value)
+			e.assigned[p.Value] = true
+		}
+
+		e.instructions = main
+		e.emit(code.OpClosure, e.addConstant(fn))
+
 	case *ast.IndexExpression:
 		err := e.compile(node.Left)
 		if err != nil {
@@ -691,29 +1724,354 @@ func (e *Eval) compile(node ast.Node) error {
 	return nil
 }
 
+// compileCatch compiles a call to `catch(expr, default)`, which evaluates
+// to the value of the expression, unless an error occurs while evaluating
+// it, in which case the result is the default value - or Null if there is
+// no default.
+//
+// This is implemented as:
+//
+//	OpTry handler
+//	expr
+//	OpEndTry
+//	OpJump end
+//	handler:
+//	default
+//	OpJump end
+//	end:
+//
+// The final jump is redundant, but it ensures that the optimizer
+// won't combine the default value with any following instructions.
+func (e *Eval) compileCatch(node *ast.CallExpression) error {
+
+	if len(node.Arguments) < 1 || len(node.Arguments) > 2 {
+		return fmt.Errorf("catch expects one or two arguments, got %d", len(node.Arguments))
+	}
+
+	try := e.emit(code.OpTry, 9999)
+
+	err := e.compile(node.Arguments[0])
+	if err != nil {
+		return err
+	}
+
+	e.emit(code.OpEndTry)
+	jumpEnd := e.emit(code.OpJump, 9999)
+
+	e.changeOperand(try, len(e.instructions))
+
+	if len(node.Arguments) == 2 {
+		err = e.compile(node.Arguments[1])
+		if err != nil {
+			return err
+		}
+	} else {
+		e.emit(code.OpConstant, e.addConstant(object.NewNull()))
+	}
+
+	jumpDefault := e.emit(code.OpJump, 9999)
+
+	e.changeOperand(jumpEnd, len(e.instructions))
+	e.changeOperand(jumpDefault, len(e.instructions))
+	return nil
+}
+
+// compileCapture compiles a call to `capture`, which records the value
+// of its second argument, with the name given by its first, and returns
+// the value.
+func (e *Eval) compileCapture(node *ast.CallExpression) error {
+
+	if len(node.Arguments) != 2 {
+		return fmt.Errorf("capture expects two arguments, got %d", len(node.Arguments))
+	}
+
+	for _, a := range node.Arguments {
+		err := e.compile(a)
+		if err != nil {
+			return err
+		}
+	}
+
+	e.emit(code.OpCapture)
+	return nil
+}
+
+// compileRule compiles the body of the given rule into a distinct
+// series of bytecode instructions.
+func (e *Eval) compileRule(r *ast.RuleStatement) error {
+
+	for _, existing := range e.rules {
+		if existing.name == r.Name {
+			return fmt.Errorf("rule %s is defined more than once", r.Name)
+		}
+	}
+
+	//
+	// A rule which doesn't return doesn't match.
+	//
+	e.coverRule = r.Name
+	defer func() { e.coverRule = "" }()
+
+	instructions, err := e.compileBody(r.Body, code.OpFalse)
+	if err != nil {
+		return err
+	}
+
+	e.rules = append(e.rules, &rule{name: r.Name, instructions: instructions, doc: ast.CommentText(r.Doc)})
+	return nil
+}
+
+// compileTest compiles the body of the given test into a distinct
+// series of bytecode instructions.
+func (e *Eval) compileTest(t *ast.TestStatement) error {
+
+	for _, existing := range e.tests {
+		if existing.name == t.Name {
+			return fmt.Errorf("test %s is defined more than once", t.Name)
+		}
+	}
+
+	//
+	// A test which doesn't return passes.
+	//
+	// Tests aren't part of the script under test, so they aren't
+	// instrumented.
+	e.coverSkip = true
+	defer func() { e.coverSkip = false }()
+
+	instructions, err := e.compileBody(t.Body, code.OpTrue)
+	if err != nil {
+		return err
+	}
+
+	e.tests = append(e.tests, &rule{name: t.Name, instructions: instructions})
+	return nil
+}
+
+// compileBody compiles the body of a rule, or test, returning the
+// bytecode.  If the body doesn't return a value the given opcode is
+// used to push one.
+func (e *Eval) compileBody(body *ast.BlockStatement, result code.Opcode) (code.Instructions, error) {
+
+	//
+	// Save the instructions of the main program, so that we can
+	// reuse our compiler for the body.
+	//
+	main := e.instructions
+	defer func() { e.instructions = main }()
+	e.instructions = nil
+
+	err := e.compile(body)
+	if err != nil {
+		return nil, err
+	}
+
+	e.emit(result)
+	e.emit(code.OpReturn)
+
+	return e.instructions, nil
+}
+
+// returnsBool returns true if the given expression always results in a
+// boolean, if it results in anything at all, so its value needn't be
+// tested when a boolean verdict is required.
+func returnsBool(expr ast.Expression) bool {
+	switch node := expr.(type) {
+	case *ast.BooleanLiteral, *ast.BetweenExpression:
+		return true
+	case *ast.PrefixExpression:
+		return node.Operator == "!"
+	case *ast.InfixExpression:
+		switch node.Operator {
+		case "==", "!=", "<", "<=", ">", ">=", "~=", "!~", "~*", "!~*", "in", "&&", "||":
+			return true
+		}
+	}
+	return false
+}
+
+// resolveFunctions resolves calls to our built-in functions to the slot
+// which holds the function, so that they needn't be looked up by name
+// at run-time.
+//
+// A call to a function is compiled as:
+//
+//	OpConstant name
+//	OpCall args
+//
+// If the name refers to a function which is available, and which no
+// variable could override, (as a variable holding a lambda takes
+// precedence over a function), we replace that, in-place, with:
+//
+//	OpCallBuiltin slot args
+//	OpNop
+//
+// Functions added after the script has been compiled are still found by
+// name, as before.
+//
+// Calls to our type-predicates, such as `is_int`, with a single argument
+// are replaced entirely, unless the host application has replaced the
+// function, with:
+//
+//	OpIsType slot
+//	OpNop
+//	OpNop
+//	OpNop
+//
+// If the host application replaces the function after the script has
+// been compiled then OpIsType calls it instead, so that it's never
+// ignored.
+func (e *Eval) resolveFunctions(instructions code.Instructions) {
+
+	ip := 0
+	ln := len(instructions)
+
+	for ip < ln {
+
+		op := code.Opcode(instructions[ip])
+		opLen := code.Length(op)
+
+		if op == code.OpConstant && ip+6 <= ln &&
+			code.Opcode(instructions[ip+3]) == code.OpCall {
+
+			name := e.constants[binary.BigEndian.Uint16(instructions[ip+1:ip+3])].Inspect()
+			n, ok := e.environment.FunctionSlot(name)
+
+			_, variable := e.environment.Get(name)
+
+			if ok && !e.assigned[name] && !variable && n <= 0xFFFF {
+				args := binary.BigEndian.Uint16(instructions[ip+4 : ip+6])
+
+				_, predicate := e.environment.TypePredicate(n)
+				if predicate && args == 1 {
+					instructions[ip] = byte(code.OpIsType)
+					binary.BigEndian.PutUint16(instructions[ip+1:ip+3], uint16(n))
+					instructions[ip+3] = byte(code.OpNop)
+					instructions[ip+4] = byte(code.OpNop)
+					instructions[ip+5] = byte(code.OpNop)
+
+					ip += 6
+					continue
+				}
+
+				instructions[ip] = byte(code.OpCallBuiltin)
+				binary.BigEndian.PutUint16(instructions[ip+1:ip+3], uint16(n))
+				binary.BigEndian.PutUint16(instructions[ip+3:ip+5], args)
+				instructions[ip+5] = byte(code.OpNop)
+
+				ip += 6
+				continue
+			}
+		}
+
+		ip += opLen
+	}
+}
+
+// defineFunction records the lambda the given top-level statement
+// assigns to a variable, if any, so that the host may invoke it via
+// Call.
+func (e *Eval) defineFunction(s ast.Statement) {
+
+	var name string
+	var value ast.Expression
+	switch s := s.(type) {
+	case *ast.ExpressionStatement:
+		if a, ok := s.Expression.(*ast.AssignStatement); ok {
+			name, value = a.Name.String(), a.Value
+		}
+	case *ast.LetStatement:
+		name, value = s.Name.String(), s.Value
+	}
+
+	lambda, ok := value.(*ast.FunctionLiteral)
+	if !ok {
+		return
+	}
+
+	//
+	// The lambda has been compiled to a constant, which we find
+	// by its source.
+	//
+	i, ok := e.constIndex[string(object.FUNCTION)+":"+lambda.String()]
+	if !ok {
+		return
+	}
+	if e.functions == nil {
+		e.functions = make(map[string]*object.Function)
+	}
+	e.functions[name] = e.constants[i].(*object.Function)
+}
+
+// include loads the named script, via the resolver the host application
+// supplied, and compiles it in place of the include-statement.
+func (e *Eval) include(name string) error {
+
+	if e.includeResolver == nil {
+		return fmt.Errorf("cannot include %s: no include resolver has been configured", name)
+	}
+
+	//
+	// Don't allow a script to include itself, even indirectly.
+	//
+	if e.including[name] {
+		return fmt.Errorf("include loop detected: %s", name)
+	}
+	e.including[name] = true
+	defer delete(e.including, name)
+
+	src, err := e.includeResolver(name)
+	if err != nil {
+		return fmt.Errorf("failed to include %s: %s", name, err.Error())
+	}
+
+	p := parser.New(lexer.New(src), e.parserOptions...)
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		return fmt.Errorf("\nErrors parsing included script %s:\n%s",
+			name, strings.Join(p.Errors(), "\n"))
+	}
+
+	err = e.checkProgram(program)
+	if err != nil {
+		return err
+	}
+	e.checkWarnings(program, name)
+
+	return e.compile(program)
+}
+
 // addConstant adds a constant to the pool
 func (e *Eval) addConstant(obj object.Object) int {
 
 	//
-	// Look to see if the constant is present already
+	// Look to see if the constant is present already, with the
+	// same type and value, in which case we return the offset.
 	//
-	for i, c := range e.constants {
-
-		//
-		// If the existing constant has the same
-		// type and value - then return the offset.
-		//
-		if c.Type() == obj.Type() &&
-			c.Inspect() == obj.Inspect() {
-			return i
+	// We index the constants by their type and value, as a Program
+	// might share thousands of them between its scripts.
+	//
+	if e.constIndex == nil {
+		e.constIndex = make(map[string]int, len(e.constants))
+		for i, c := range e.constants {
+			key := string(c.Type()) + ":" + c.Inspect()
+			if _, found := e.constIndex[key]; !found {
+				e.constIndex[key] = i
+			}
 		}
 	}
 
+	key := string(obj.Type()) + ":" + obj.Inspect()
+	if i, found := e.constIndex[key]; found {
+		return i
+	}
+
 	//
 	// Otherwise this is a distinct constant and should
 	// be added.
 	//
 	e.constants = append(e.constants, obj)
+	e.constIndex[key] = len(e.constants) - 1
 	return len(e.constants) - 1
 }
 
@@ -1,9 +1,25 @@
 package evalfilter
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/skx/evalfilter/v2/code"
+	"github.com/skx/evalfilter/v2/environment"
 	"github.com/skx/evalfilter/v2/object"
+	"github.com/skx/evalfilter/v2/vm"
 )
 
 // TestLess tests uses `>` and `>=`.
@@ -162,7 +178,7 @@ func TestEq(t *testing.T) {
 	}
 }
 
-// TestContains tests uses `~=` and `!~`.
+// TestContains tests uses `~=`, `!~`, `~*`, and `!~*`.
 func TestContains(t *testing.T) {
 
 	// Dummy structure to test field-access.
@@ -183,6 +199,13 @@ func TestContains(t *testing.T) {
 		{Input: `if ( Greeting ~= "Moi" ) { return true; } return false;`, Result: false},
 		{Input: `if ( Greeting !~ "Cake" ) { return true; } return false;`, Result: true},
 		{Input: `if ( Greeting ~= "Cake" ) { return true; } return false;`, Result: false},
+		{Input: `if ( Greeting ~= "WORLD" ) { return true; } return false;`, Result: false},
+		{Input: `if ( Greeting ~* "WORLD" ) { return true; } return false;`, Result: true},
+		{Input: `if ( Greeting ~* /^hello world$/ ) { return true; } return false;`, Result: true},
+		{Input: `if ( Greeting ~* /^hello world$/i ) { return true; } return false;`, Result: true},
+		{Input: `if ( Greeting !~* "CAKE" ) { return true; } return false;`, Result: true},
+		{Input: `if ( Greeting !~* /WORLD/ ) { return true; } return false;`, Result: false},
+		{Input: `r = "^HELLO"; if ( Greeting ~* r ) { return true; } return false;`, Result: true},
 	}
 
 	for _, tst := range tests {
@@ -364,11 +387,15 @@ func TestBool(t *testing.T) {
 	// Dummy structure to test field-access.
 	type Object struct {
 		Valid bool
+		Flags int
+		Name  string
 	}
 
 	// Instances of object
 	var object Object
 	object.Valid = true
+	object.Flags = 6
+	object.Name = "steve"
 
 	type Test struct {
 		Input  string
@@ -380,6 +407,13 @@ func TestBool(t *testing.T) {
 		{Input: `if ( Valid == true ) { return true; } return false;`, Result: true},
 		{Input: `if ( !Valid == false ) { return true; } return false;`, Result: true},
 		{Input: `if ( !!Valid ) { return true; } return false;`, Result: true},
+		{Input: `if ( Valid != false ) { return true; } return false;`, Result: true},
+		{Input: `if ( Valid ^^ false ) { return true; } return false;`, Result: true},
+		{Input: `if ( Valid ^^ true ) { return true; } return false;`, Result: false},
+		{Input: `if ( 1 == 1 ^^ 2 == 3 ) { return true; } return false;`, Result: true},
+		{Input: `if ( (1 == 1) ^^ (2 == 3) ) { return true; } return false;`, Result: true},
+		{Input: `if ( Flags == 6 ^^ Name == "x" ) { return true; } return false;`, Result: true},
+		{Input: `if ( Flags == 6 ^^ Name == "steve" ) { return true; } return false;`, Result: false},
 	}
 
 	for _, tst := range tests {
@@ -400,6 +434,22 @@ func TestBool(t *testing.T) {
 			t.Fatalf("Found unexpected result running script; got %v expected %v", ret, tst.Result)
 		}
 	}
+
+	// Booleans have no ordering.
+	for _, src := range []string{`return true < false;`, `return false >= true;`} {
+
+		obj := New(src)
+
+		p := obj.Prepare()
+		if p != nil {
+			t.Fatalf("Failed to compile")
+		}
+
+		_, err := obj.Run(object)
+		if err == nil {
+			t.Fatalf("expected an error comparing booleans: %s", src)
+		}
+	}
 }
 
 // TestVariable sets a variable.
@@ -493,6 +543,31 @@ func TestOperations(t *testing.T) {
 		{Input: `if ( 3.0 / 3 == 1.0 ) { return true; }`, Result: true},
 		{Input: `if ( 3.0 % 3 == 0 ) { return true; }`, Result: true},
 		{Input: `if ( 1.0 ** 3 == 1.0 ) { return true; }`, Result: true},
+
+		// prefixed integers
+		{Input: `if ( 0xFF == 255 ) { return true; }`, Result: true},
+		{Input: `if ( 0x1f == 31 ) { return true; }`, Result: true},
+		{Input: `if ( 0o755 == 493 ) { return true; }`, Result: true},
+		{Input: `if ( 0b1010 == 10 ) { return true; }`, Result: true},
+		{Input: `if ( 0X1F == 31 && 0O17 == 15 && 0B11 == 3 ) { return true; }`, Result: true},
+
+		// bitwise
+		{Input: `if ( 6 & 4 != 0 ) { return true; }`, Result: true},
+		{Input: `if ( 6 & 1 == 0 ) { return true; }`, Result: true},
+		{Input: `if ( 4 | 1 == 5 ) { return true; }`, Result: true},
+		{Input: `if ( (6 ^ 3) == 5 ) { return true; }`, Result: true},
+		{Input: `if ( 6 ^ 3 == 5 ) { return true; }`, Result: true},
+		{Input: `if ( 7 ^ 3 == 5 ) { return false; } return true;`, Result: true},
+		{Input: `if ( 1 | 6 ^ 3 & 1 == 7 ) { return true; }`, Result: true},
+		{Input: `if ( 1 << 4 == 16 ) { return true; }`, Result: true},
+		{Input: `if ( 256 >> 4 == 16 ) { return true; }`, Result: true},
+		{Input: `if ( ~0 == -1 ) { return true; }`, Result: true},
+		{Input: `if ( 1 << 2 + 1 == 8 ) { return true; }`, Result: true},
+
+		// float modulus
+		{Input: `if ( 5.5 % 2 == 1.5 ) { return true; }`, Result: true},
+		{Input: `if ( 7 % 2.5 == 2.0 ) { return true; }`, Result: true},
+		{Input: `if ( -5.5 % 2.0 == -1.5 ) { return true; }`, Result: true},
 	}
 
 	for _, tst := range tests {
@@ -841,3 +916,5479 @@ return false;
 	}
 
 }
+
+// TestIntegerOverflow ensures that integer maths which would wrap
+// around results in an error, rather than a silently-wrong answer.
+func TestIntegerOverflow(t *testing.T) {
+
+	tests := []string{
+		`return 9223372036854775807 + 1;`,
+		`return -9223372036854775807 - 2;`,
+		`return 4294967296 * 4294967296;`,
+		`return 2 ** 63;`,
+		`a = -9223372036854775807 - 1; return -a;`,
+		`a = -9223372036854775807 - 1; return a ~/ -1;`,
+		`return 1 << 63;`,
+		`return 1 << 64;`,
+		`return -1 << 100;`,
+		`return 3 << 62;`,
+		`return -2 << 63;`,
+	}
+
+	for _, src := range tests {
+
+		obj := New(src)
+
+		p := obj.Prepare()
+		if p != nil {
+			t.Fatalf("Failed to compile")
+		}
+
+		_, err := obj.Run(nil)
+		if err == nil {
+			t.Fatalf("expected overflow error running '%s'", src)
+		}
+		if !strings.Contains(err.Error(), "overflow") {
+			t.Fatalf("unexpected error running '%s': %s", src, err.Error())
+		}
+	}
+
+	// Results which are in range must still work.
+	obj := New(`if ( 2 ** 62 == 4611686018427387904 && 9223372036854775806 + 1 == 9223372036854775807 ) { return true; } return false;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile")
+	}
+	ret, err := obj.Run(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if !ret {
+		t.Fatalf("unexpected result")
+	}
+
+	// Shifts are checked at the boundaries.
+	shifts := []string{
+		`if ( 1 << 62 == 4611686018427387904 && -1 << 63 == -9223372036854775807 - 1 ) { return true; } return false;`,
+		`if ( 0 << 63 == 0 && 1 >> 64 == 0 && -1 >> 64 == -1 ) { return true; } return false;`,
+		`if ( 0 << 64 == 0 && 0 << 1000 == 0 ) { return true; } return false;`,
+	}
+	for _, src := range shifts {
+		obj = New(src)
+		if err = obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile")
+		}
+		ret, err = obj.Run(nil)
+		if err != nil {
+			t.Fatalf("unexpected error running '%s': %s", src, err.Error())
+		}
+		if !ret {
+			t.Fatalf("unexpected result running '%s'", src)
+		}
+	}
+}
+
+// TestBitwiseXor tests that `^` is the bitwise exclusive-or of integers,
+// binding as tightly as `&` and `|`, and that `^^` is the logical one.
+func TestBitwiseXor(t *testing.T) {
+
+	type Object struct {
+		Flags int
+		Valid bool
+	}
+
+	var object Object
+	object.Flags = 4
+	object.Valid = true
+
+	valid := []string{
+		`if ( Flags ^ 4 == 0 ) { return true; } return false;`,
+		`if ( Flags ^ 1 == 5 && Flags & 4 != 0 ) { return true; } return false;`,
+		`if ( Flags == 4 ^^ Valid ) { return false; } return true;`,
+	}
+
+	for _, src := range valid {
+
+		obj := New(src)
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile '%s': %s", src, err.Error())
+		}
+
+		ret, err := obj.Run(object)
+		if err != nil {
+			t.Fatalf("unexpected error running '%s': %s", src, err.Error())
+		}
+		if !ret {
+			t.Fatalf("unexpected result running '%s'", src)
+		}
+	}
+
+	// Mixing an integer with anything else is an error.
+	invalid := []string{
+		`return "a" ^ 0;`,
+		`return Flags ^ "4";`,
+		`return Flags ^ Valid;`,
+		`return 1.5 ^ 1;`,
+		`return true ^ false;`,
+	}
+
+	for _, src := range invalid {
+
+		obj := New(src)
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile '%s': %s", src, err.Error())
+		}
+
+		_, err := obj.Run(object)
+		if err == nil {
+			t.Fatalf("expected an error running '%s'", src)
+		}
+	}
+}
+
+// TestDivision tests that integers are promoted when divided with `/`,
+// unless integer division is requested, and that `~/` truncates.
+func TestDivision(t *testing.T) {
+
+	tests := []struct {
+		Input   string
+		Integer bool
+	}{
+		{Input: `return 5 / 2 == 2.5 && type(4 / 2) == "float";`},
+		{Input: `return Errors / Total * 100 == 25;`},
+		{Input: `return 7.5 / 2 == 3.75;`},
+		{Input: `return 5 ~/ 2 == 2 && -7 ~/ 2 == -3 && type(4 ~/ 2) == "integer";`},
+		{Input: `return 7.5 ~/ 2 == 3 && type(7.5 ~/ 2) == "float";`},
+		{Input: `return 5 / 2 == 2 && Errors / Total == 0;`, Integer: true},
+		{Input: `return 7.5 / 2 == 3.75 && 5 ~/ 2 == 2;`, Integer: true},
+		{Input: `x = 10; x /= 4; return x == 2.5;`},
+		{Input: `return len(map([3, 5], n => n / 2)) == 2 && map([3, 5], n => n / 2)[1] == 2.5;`},
+		{Input: `return map([3, 5], n => n / 2)[1] == 2;`, Integer: true},
+	}
+
+	for _, tst := range tests {
+		for _, flags := range [][]byte{nil, {NoOptimize}} {
+
+			var options []Option
+			if tst.Integer {
+				options = append(options, WithIntegerDivision())
+			}
+
+			obj := New(tst.Input, options...)
+			if err := obj.Prepare(flags); err != nil {
+				t.Fatalf("failed to compile '%s': %s", tst.Input, err)
+			}
+			ret, err := obj.Run(map[string]interface{}{"Errors": 1, "Total": 4})
+			if err != nil || !ret {
+				t.Fatalf("unexpected result for '%s': %v %v", tst.Input, ret, err)
+			}
+		}
+	}
+
+	// Programs divide in the same way as their template.
+	p := NewProgram(WithIntegerDivision())
+	if err := p.Add("half", `return Total / 3 == 1;`); err != nil {
+		t.Fatalf("failed to add: %s", err)
+	}
+	if ret, err := p.Run("half", map[string]interface{}{"Total": 4}); err != nil || !ret {
+		t.Fatalf("unexpected result: %v %v", ret, err)
+	}
+
+	// Division by zero is an error.
+	for _, src := range []string{`return Total / 0;`, `return Total ~/ 0;`, `return 1.5 ~/ 0;`} {
+		obj := New(src)
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("failed to compile '%s': %s", src, err)
+		}
+		if _, err := obj.Run(map[string]interface{}{"Total": 4}); err == nil || !strings.Contains(err.Error(), "division by zero") {
+			t.Fatalf("expected an error for '%s', got %v", src, err)
+		}
+	}
+}
+
+// TestNaN tests that NaN, and the infinities, may be produced and tested
+// for, but that comparing NaN is an error.
+func TestNaN(t *testing.T) {
+
+	tests := []string{
+		`return is_nan(√-1) && !is_nan(1.5) && !is_nan("NaN");`,
+		`return is_inf(10.0 ** 400) && is_inf(-(10.0 ** 400)) && !is_inf(Value);`,
+		`return 10.0 ** 400 > 10.0 ** 300 && -(10.0 ** 400) < 0;`,
+		`return string(√-1) == "NaN" && string(10.0 ** 400) == "+Inf";`,
+		`return catch(√-1 == 1, true);`,
+		`return !( √-1 in [1, 2] );`,
+	}
+	for _, src := range tests {
+		obj := New(src)
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("failed to compile '%s': %s", src, err)
+		}
+		ret, err := obj.Run(map[string]interface{}{"Value": 1.5})
+		if err != nil || !ret {
+			t.Fatalf("unexpected result for '%s': %v %v", src, ret, err)
+		}
+	}
+
+	errors := []string{
+		`return √-1 == √-1;`,
+		`return √-1 != 3;`,
+		`return Value < 1;`,
+		`return Value == 1.5;`,
+		`return 3 >= Value;`,
+		`return Value between 1 and 2;`,
+		`x = Value; return x > 0 || true;`,
+	}
+	for _, src := range errors {
+		obj := New(src)
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("failed to compile '%s': %s", src, err)
+		}
+		_, err := obj.Run(map[string]interface{}{"Value": math.NaN()})
+		if err == nil || !strings.Contains(err.Error(), "comparison involving NaN") {
+			t.Fatalf("expected an error for '%s', got %v", src, err)
+		}
+
+		// The ways in which scripts are run agree.
+		divergences, err := differential(src, nil, map[string]interface{}{"Value": math.NaN()})
+		if err != nil || len(divergences) > 0 {
+			t.Fatalf("unexpected divergences for '%s': %v %v", src, divergences, err)
+		}
+	}
+}
+
+// TestNaNOptimized tests that comparing NaN is an error whether, or not,
+// the comparison is fused into a single instruction by the optimizer.
+func TestNaNOptimized(t *testing.T) {
+
+	src := `if ( Value == 1.5 ) { return true; } return false;`
+
+	var msgs []string
+	for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+		obj := New(src)
+		if err := obj.Prepare(flags); err != nil {
+			t.Fatalf("failed to compile '%s': %s", src, err)
+		}
+
+		_, err := obj.Run(map[string]interface{}{"Value": math.NaN()})
+		if err == nil || !strings.Contains(err.Error(), "comparison involving NaN") {
+			t.Fatalf("expected an error for '%s' with flags %v, got %v", src, flags, err)
+		}
+		msgs = append(msgs, err.Error())
+	}
+
+	if msgs[0] != msgs[1] {
+		t.Fatalf("optimized and unoptimized errors differ: %q %q", msgs[0], msgs[1])
+	}
+}
+
+// TestCompoundAssignment tests the `+=`, `++`, etc, operators.
+func TestCompoundAssignment(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result bool
+	}
+
+	tests := []Test{
+		{Input: `a = 1; a += 2; return a == 3;`, Result: true},
+		{Input: `a = 10; a -= 2 * 2; return a == 6;`, Result: true},
+		{Input: `a = 3; a *= 3; return a == 9;`, Result: true},
+		{Input: `a = 9; a /= 3; return a == 3;`, Result: true},
+		{Input: `a = "steve"; a += " kemp"; return a == "steve kemp";`, Result: true},
+		{Input: `a = 1; a++; return a == 2;`, Result: true},
+		{Input: `a = 1; a--; return a == 0;`, Result: true},
+		{Input: `a = 1; ++a; ++a; return a == 3;`, Result: true},
+		{Input: `a = 1; --a; return a == 0;`, Result: true},
+		{Input: `i = 0; c = 0; while ( i < 10 ) { c += i; i++; } return c == 45;`, Result: true},
+		{Input: "a = 1; a--\nreturn a == 0;", Result: true},
+		{Input: `a = 1; if ( true ) { a++ } return a == 2;`, Result: true},
+
+		// Elsewhere a pair of signs is a subtraction of a negation.
+		{Input: `return 5--3 == 8;`, Result: true},
+		{Input: `a = 5; b = 3; return a--b == 8 && a == 5;`, Result: true},
+		{Input: `a = 5; return 10--a == 15 && --a == 5;`, Result: true},
+		{Input: `a = 5; b = -a--a; return b == 0 && a == 5;`, Result: true},
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst.Input)
+
+		p := obj.Prepare()
+		if p != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, p.Error())
+		}
+
+		ret, err := obj.Run(nil)
+		if err != nil {
+			t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+		}
+
+		if ret != tst.Result {
+			t.Fatalf("Found unexpected result running script: %s", tst.Input)
+		}
+	}
+
+	// Only variables may be updated.
+	for _, src := range []string{`3 += 4; return true;`, `3++; return true;`} {
+		obj := New(src)
+		if obj.Prepare() == nil {
+			t.Fatalf("expected error compiling '%s'", src)
+		}
+	}
+
+	// Errors report the line of the operator.
+	obj := New("a = 1;\n\nCount.x++;\nreturn true;")
+	err := obj.Prepare()
+	if err == nil || !strings.Contains(err.Error(), "around line 3") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// TestLet tests that variables declared via `let` are block-scoped.
+func TestLet(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result bool
+	}
+
+	tests := []Test{
+		{Input: `let a = 3; return a == 3;`, Result: true},
+		{Input: `if ( true ) { let a = 3; } if ( type(a) == "null" ) { return true; } return false;`, Result: true},
+		{Input: `a = 1; if ( true ) { let a = 3; a = 4; } return a == 1;`, Result: true},
+		{Input: `a = 1; if ( true ) { let b = 3; a = b; } return a == 3;`, Result: true},
+		{Input: `a = 1; if ( true ) { let a = 2; if ( true ) { let a = 3; } if ( a != 2 ) { return false; } } return a == 1;`, Result: true},
+		{Input: `i = 0; total = 0; while ( i < 3 ) { let x = i * 2; total += x; i++; } return total == 6;`, Result: true},
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst.Input)
+
+		p := obj.Prepare()
+		if p != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, p.Error())
+		}
+
+		ret, err := obj.Run(nil)
+		if err != nil {
+			t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+		}
+
+		if ret != tst.Result {
+			t.Fatalf("Found unexpected result running script: %s", tst.Input)
+		}
+	}
+
+	// Returning from within a scoped block must not leak the
+	// scope into the next run.
+	obj := New(`if ( true ) { let a = 1; return true; } return false;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile")
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := obj.Run(nil); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+	}
+	if obj.GetVariable("a").Type() != object.NULL {
+		t.Fatalf("local variable leaked")
+	}
+}
+
+// TestInclude tests that scripts may include other scripts.
+func TestInclude(t *testing.T) {
+
+	library := map[string]string{
+		"common.ef": `limit = 10; include "nested.ef";`,
+		"nested.ef": `name = "steve";`,
+		"loop.ef":   `include "loop.ef";`,
+		"broken.ef": `if ( `,
+	}
+
+	resolver := func(name string) (string, error) {
+		src, ok := library[name]
+		if !ok {
+			return "", fmt.Errorf("%s not found", name)
+		}
+		return src, nil
+	}
+
+	// Working include
+	obj := New(`include "common.ef"; if ( limit == 10 && name == "steve" ) { return true; } return false;`, WithIncludeResolver(resolver))
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+	ret, err := obj.Run(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if !ret {
+		t.Fatalf("unexpected result")
+	}
+
+	// Failing includes
+	errors := map[string]string{
+		`include "missing.ef"; return true;`: "not found",
+		`include "loop.ef"; return true;`:    "include loop",
+		`include "broken.ef"; return true;`:  "broken.ef",
+	}
+	for src, msg := range errors {
+		obj = New(src, WithIncludeResolver(resolver))
+		err = obj.Prepare()
+		if err == nil {
+			t.Fatalf("expected error compiling '%s'", src)
+		}
+		if !strings.Contains(err.Error(), msg) {
+			t.Fatalf("error '%s' didn't contain '%s'", err.Error(), msg)
+		}
+	}
+
+	// No resolver
+	obj = New(`include "common.ef"; return true;`)
+	if obj.Prepare() == nil {
+		t.Fatalf("expected an error with no resolver")
+	}
+}
+
+// TestRules tests named rules, and RunAll.
+func TestRules(t *testing.T) {
+
+	type Event struct {
+		Service string
+		Failed  int
+	}
+
+	src := `
+rule "ssh-brute" {
+   if ( Service == "ssh" && Failed > 5 ) { return true; }
+}
+
+rule "any-failure" {
+   return Failed > 0;
+}
+
+rule "never" {
+   return false;
+}
+
+return Service == "ssh";
+`
+	obj := New(src)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+
+	if strings.Join(obj.Rules(), ",") != "ssh-brute,any-failure,never" {
+		t.Fatalf("unexpected rules: %v", obj.Rules())
+	}
+
+	matched, err := obj.RunAll(Event{Service: "ssh", Failed: 10})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if strings.Join(matched, ",") != "ssh-brute,any-failure" {
+		t.Fatalf("unexpected matches: %v", matched)
+	}
+
+	matched, err = obj.RunAll(Event{Service: "http", Failed: 1})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if strings.Join(matched, ",") != "any-failure" {
+		t.Fatalf("unexpected matches: %v", matched)
+	}
+
+	// The main body is still available via Run
+	ret, err := obj.Run(Event{Service: "ssh"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if !ret {
+		t.Fatalf("unexpected result")
+	}
+
+	// Bogus rules
+	for _, src := range []string{
+		`rule "a" { return true; } rule "a" { return false; }`,
+		`if ( true ) { rule "a" { return true; } } return false;`,
+		`rule a { return true; }`,
+	} {
+		obj = New(src)
+		if obj.Prepare() == nil {
+			t.Fatalf("expected error compiling '%s'", src)
+		}
+	}
+}
+
+// TestLambda tests lambda-expressions, and the functions which use them.
+func TestLambda(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result bool
+	}
+
+	tests := []Test{
+		{Input: `return len(filter([1, 2, 3, 4, 5], x => x > 3)) == 2;`, Result: true},
+		{Input: `a = map([1, 2, 3], x => x * 2); return a[2] == 6;`, Result: true},
+		{Input: `return find(["a", "bb", "ccc"], s => len(s) == 2) == "bb";`, Result: true},
+		{Input: `return type(find([1, 2], x => x > 5)) == "null";`, Result: true},
+		{Input: `double = x => x * 2; return double(4) == 8;`, Result: true},
+		{Input: `min = 2; return len(filter([1, 2, 3], x => x >= min)) == 2;`, Result: true},
+		{Input: `if ( true ) { let min = 3; return len(filter([1, 2, 3], x => x >= min)) == 1; } return false;`, Result: true},
+		{Input: `return len(filter(Tags, t => t == Name)) == 1;`, Result: true},
+		{Input: `return len(filter([[1], [1, 2]], a => len(filter(a, x => x > 1)) > 0)) == 1;`, Result: true},
+		{Input: `x = 7; map([1, 2], x => x); return x == 7;`, Result: true},
+	}
+
+	type Input struct {
+		Name string
+		Tags []string
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst.Input)
+
+		p := obj.Prepare()
+		if p != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, p.Error())
+		}
+
+		ret, err := obj.Run(&Input{Name: "steve", Tags: []string{"kemp", "steve"}})
+		if err != nil {
+			t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+		}
+
+		if ret != tst.Result {
+			t.Fatalf("Found unexpected result running script: %s", tst.Input)
+		}
+	}
+
+	// Errors inside a lambda, and misuse of the functions, are reported.
+	errors := []string{
+		`return filter([1, 2], x => x / 0);`,
+		`return map([1, 2], 3);`,
+		`return find("steve", x => x);`,
+	}
+
+	for _, tst := range errors {
+
+		obj := New(tst)
+
+		p := obj.Prepare()
+		if p != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst, p.Error())
+		}
+
+		_, err := obj.Run(nil)
+		if err == nil {
+			t.Fatalf("Expected an error running '%s'", tst)
+		}
+	}
+}
+
+// TestMethodCalls tests that functions may be invoked as methods.
+func TestMethodCalls(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result bool
+	}
+
+	tests := []Test{
+		{Input: `return Name.lower() == "steve kemp";`, Result: true},
+		{Input: `return Name.lower().contains("steve");`, Result: true},
+		{Input: `return Name.contains("bob");`, Result: false},
+		{Input: `return "  x ".trim().upper() == "X";`, Result: true},
+		{Input: `return Tags.len() == 2;`, Result: true},
+		{Input: `return Tags.filter(t => t.upper() == "KEMP").len() == 1;`, Result: true},
+		{Input: `return Tags.contains("steve") && !Tags.contains("bob");`, Result: true},
+		{Input: `return Tags[0].len() + 1 == 6;`, Result: true},
+		{Input: `return ("a" + "b").upper() == "AB";`, Result: true},
+		{Input: `return Name.glob("Steve *") && !glob(Name, "*.example.com");`, Result: true},
+		{Input: `return sprintf("%s has %d tags", Name, Tags.len()) == "Steve Kemp has 2 tags";`, Result: true},
+		{Input: `return Name.sha256() == sha256("Steve Kemp") && sha256(Name)[0] < "8";`, Result: true},
+		{Input: `return md5(Name).len() == 32 && sha1(Name).len() == 40 && fnv(Name).len() == 16;`, Result: true},
+		{Input: `return url_host("https://example.com/x?id=3") == "example.com" && "/x?id=3".url_query("id") == "3";`, Result: true},
+		{Input: `return url_path("https://example.com/admin/login").glob("/admin/*");`, Result: true},
+		{Input: `return parse_kv("user=steve; role = admin").role == "admin" && has_key("a=1&b=2".parse_kv("&"), "b");`, Result: true},
+		{Input: `return "%.1f%%".sprintf(100 / 3.0) == "33.3%";`, Result: true},
+	}
+
+	type Input struct {
+		Name string
+		Tags []string
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst.Input)
+
+		p := obj.Prepare()
+		if p != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, p.Error())
+		}
+
+		ret, err := obj.Run(&Input{Name: "Steve Kemp", Tags: []string{"steve", "kemp"}})
+		if err != nil {
+			t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+		}
+
+		if ret != tst.Result {
+			t.Fatalf("Found unexpected result running script: %s", tst.Input)
+		}
+	}
+
+	// A method must be named.
+	obj := New(`return Name.3;`)
+	if obj.Prepare() == nil {
+		t.Fatalf("expected an error parsing a method without a name")
+	}
+}
+
+// TestStats tests the metadata we report for compiled programs.
+func TestStats(t *testing.T) {
+
+	obj := New(`if ( Count > 3 ) { return true; } return false;`)
+	if err := obj.Prepare([]byte{NoOptimize}); err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+
+	// OpLookup, OpPush, OpGreater, OpJumpIfFalse, OpTrue, OpReturn, OpFalse, OpReturn
+	s := obj.Stats()
+	if s.Instructions != 8 {
+		t.Fatalf("unexpected instruction count: %d", s.Instructions)
+	}
+	if s.Constants != 1 {
+		t.Fatalf("unexpected constant count: %d", s.Constants)
+	}
+	if s.MaxStackDepth != 2 {
+		t.Fatalf("unexpected stack depth: %d", s.MaxStackDepth)
+	}
+	if len(s.Hash) != 64 {
+		t.Fatalf("unexpected hash: %s", s.Hash)
+	}
+
+	// Whitespace and comments don't change the hash.
+	same := New(`// comment
+if (Count>3) {return true;}
+return false;`)
+	if err := same.Prepare([]byte{NoOptimize}); err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+	if same.Stats().Hash != s.Hash {
+		t.Fatalf("identical programs have different hashes")
+	}
+
+	// But different constants do.
+	other := New(`if ( Count > 4 ) { return true; } return false;`)
+	if err := other.Prepare([]byte{NoOptimize}); err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+	if other.Stats().Hash == s.Hash {
+		t.Fatalf("different programs have the same hash")
+	}
+
+	// Function-calls and rules are counted.
+	obj = New(`rule "a" { return len(1, 2, 3) == 3; } return true;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+	s = obj.Stats()
+	if s.MaxStackDepth != 3 {
+		t.Fatalf("unexpected stack depth: %d", s.MaxStackDepth)
+	}
+	if s.Instructions != 2+7 {
+		t.Fatalf("unexpected instruction count: %d", s.Instructions)
+	}
+}
+
+// TestCache tests our cache of compiled programs.
+func TestCache(t *testing.T) {
+
+	c := NewCache(2)
+
+	a, err := c.GetOrCompile(`return true;`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	// The same script returns the same program, in a new instance.
+	again, err := c.GetOrCompile(`return true;`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if &a.instructions[0] != &again.instructions[0] {
+		t.Fatalf("cached program was not reused")
+	}
+	if a == again || a.machine == again.machine {
+		t.Fatalf("cached program was shared between callers")
+	}
+
+	// Broken scripts are not cached.
+	_, err = c.GetOrCompile(`if ( `)
+	if err == nil {
+		t.Fatalf("expected an error compiling a broken script")
+	}
+	if c.Len() != 1 {
+		t.Fatalf("unexpected cache size: %d", c.Len())
+	}
+
+	// Fill the cache, using "return true" to keep it fresh.
+	_, _ = c.GetOrCompile(`return false;`)
+	_, _ = c.GetOrCompile(`return true;`)
+	_, _ = c.GetOrCompile(`return 1 == 1;`)
+	if c.Len() != 2 {
+		t.Fatalf("unexpected cache size: %d", c.Len())
+	}
+
+	// So "return true" survived, but "return false" didn't.
+	again, _ = c.GetOrCompile(`return true;`)
+	if &a.instructions[0] != &again.instructions[0] {
+		t.Fatalf("recently used program was evicted")
+	}
+	_, _ = c.GetOrCompile(`return false;`)
+	if c.Len() != 2 {
+		t.Fatalf("unexpected cache size: %d", c.Len())
+	}
+
+	ret, err := a.Run(nil)
+	if err != nil || !ret {
+		t.Fatalf("cached program failed to run")
+	}
+
+	// Options are applied to the programs we create.
+	c = NewCache(1, WithIncludeResolver(func(name string) (string, error) {
+		return `x = 3;`, nil
+	}))
+	e, err := c.GetOrCompile(`include "x"; return x == 3;`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	ret, err = e.Run(nil)
+	if err != nil || !ret {
+		t.Fatalf("cached program failed to run")
+	}
+}
+
+// TestCacheConcurrent tests that the programs returned by a cache may
+// be run from many goroutines at once; run it with "go test -race".
+func TestCacheConcurrent(t *testing.T) {
+
+	type Object struct {
+		Count int
+	}
+
+	c := NewCache(4)
+	src := `total = 0; i = 0; while ( i < Count ) { total += i; i++; } return total == Count * (Count - 1) / 2;`
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				e, err := c.GetOrCompile(src)
+				if err != nil {
+					errs <- err
+					return
+				}
+				ret, err := e.Run(Object{Count: g + i})
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !ret {
+					errs <- fmt.Errorf("unexpected result for %d", g+i)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if c.Len() != 1 {
+		t.Fatalf("unexpected cache size: %d", c.Len())
+	}
+}
+
+// TestRunFields tests running scripts against a map of objects.
+func TestRunFields(t *testing.T) {
+
+	fields := map[string]object.Object{
+		"Name":  &object.String{Value: "Steve"},
+		"Count": object.NewInteger(3),
+		"Address": &object.Hash{Pairs: map[string]object.Object{
+			"City": &object.String{Value: "Helsinki"},
+		}},
+		"Tags": &object.Array{Elements: []object.Object{&object.String{Value: "admin"}}},
+	}
+
+	tests := []struct {
+		Script string
+		Result bool
+	}{
+		// Simple enough to avoid the virtual machine.
+		{`return Count > 2;`, true},
+		{`return Name == "Bob";`, false},
+		// These use the virtual machine.
+		{`return Address.City == "Helsinki" && "admin" in Tags;`, true},
+		{`return len(Tags) == Count;`, false},
+		{`Count = 10; return Count == 10;`, true},
+		{`return !Missing;`, true},
+		{`return limit == 5;`, true},
+	}
+
+	for _, tst := range tests {
+
+		e := New(tst.Script)
+		e.SetVariable("limit", object.NewInteger(5))
+		if err := e.Prepare(); err != nil {
+			t.Fatalf("unexpected error preparing %s: %s", tst.Script, err)
+		}
+
+		ret, err := e.RunFields(fields)
+		if err != nil {
+			t.Fatalf("unexpected error running %s: %s", tst.Script, err)
+		}
+		if ret != tst.Result {
+			t.Fatalf("unexpected result running %s: %v", tst.Script, ret)
+		}
+	}
+
+	// The map is used as-is, and not modified.
+	if len(fields) != 4 || fields["Count"].Inspect() != "3" {
+		t.Fatalf("the fields were modified: %v", fields)
+	}
+
+	// An empty map is fine.
+	e := New(`return Name;`)
+	if err := e.Prepare(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if ret, err := e.RunFields(nil); err != nil || ret {
+		t.Fatalf("unexpected result: %v %v", ret, err)
+	}
+}
+
+// TestJSON tests running scripts against JSON documents.
+func TestJSON(t *testing.T) {
+
+	doc := []byte(`{
+  "Name": "steve",
+  "Age": 45,
+  "Height": 1.8,
+  "Admin": true,
+  "Missing": null,
+  "Address": { "City": "Helsinki", "Geo": { "Lat": 60.1 } },
+  "Tags": [ "kemp", 3, { "Name": "nested" } ]
+}`)
+
+	tests := []string{
+		`return Name == "steve";`,
+		`return Age == 45 && type(Age) == "integer";`,
+		`return Height > 1.5 && type(Height) == "float";`,
+		`return Admin;`,
+		`return !Missing && type(Missing) == "null";`,
+		`return Address.City == "Helsinki";`,
+		`return Address["City"] == "Helsinki";`,
+		`return Address.Geo.Lat > 60;`,
+		`return type(Address) == "hash" && len(Address) == 2;`,
+		`return !Address.Postcode && !Address.Postcode.Street;`,
+		`return len(Tags) == 3 && Tags[1] == 3;`,
+		`return Tags[2].Name == "nested";`,
+		`return Tags[2].Name.upper() == "NESTED";`,
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst)
+
+		p := obj.Prepare()
+		if p != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst, p.Error())
+		}
+
+		ret, err := obj.RunJSON(doc)
+		if err != nil {
+			t.Fatalf("Found unexpected error running test '%s' - %s\n", tst, err.Error())
+		}
+
+		if !ret {
+			t.Fatalf("Found unexpected result running script: %s", tst)
+		}
+	}
+
+	// Invalid documents, and non-objects, are errors.
+	obj := New(`return true;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+	for _, bad := range []string{`{`, `[1, 2]`, `3`} {
+		if _, err := obj.RunJSON([]byte(bad)); err == nil {
+			t.Fatalf("expected an error running against %s", bad)
+		}
+	}
+
+	// Indexing a hash by a number is an error.
+	obj = New(`return Address[1];`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+	if _, err := obj.RunJSON(doc); err == nil {
+		t.Fatalf("expected an error indexing a hash by number")
+	}
+}
+
+// TestNestedMap tests that nested maps and slices are reachable.
+func TestNestedMap(t *testing.T) {
+
+	input := map[string]interface{}{
+		"Name":   "Homer",
+		"Age":    uint8(39),
+		"Spouse": map[string]interface{}{"Name": "Marge", "Hair": []string{"blue"}},
+		"Children": []map[string]interface{}{
+			{"Name": "Bart", "Age": 10},
+			{"Name": "Lisa", "Age": 8},
+		},
+		"Pets":    []interface{}{map[string]interface{}{"Name": "Santa's Little Helper"}, nil, 3},
+		"Labels":  map[string]string{"job": "safety"},
+		"Grid":    [][]int{{1, 2}, {3, 4}},
+		"Nothing": nil,
+	}
+
+	tests := []string{
+		`return Spouse.Name == "Marge" && Spouse.Hair[0] == "blue";`,
+		`return len(Children) == 2 && Children[1].Name == "Lisa";`,
+		`return Children[0].Age + Children[1].Age == 18;`,
+		`return Pets[0].Name == "Santa's Little Helper" && type(Pets[1]) == "null" && Pets[2] == 3;`,
+		`return Labels.job == "safety";`,
+		`return Grid[1][0] == 3;`,
+		`return Age == 39;`,
+		`return type(Nothing) == "null";`,
+		`return len(filter(Children, c => c.Age > 9)) == 1;`,
+		`return string(keys(Spouse)) == "[Hair, Name]" && values(Labels)[0] == "safety";`,
+		`return has_key(Labels, "job") && !has_key(Labels, "age");`,
+		`return merge(Labels, Spouse).job == "safety" && merge(Labels, Spouse).Name == "Marge";`,
+		`return len(keys(Children[0])) == 2;`,
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst)
+
+		p := obj.Prepare()
+		if p != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst, p.Error())
+		}
+
+		ret, err := obj.Run(input)
+		if err != nil {
+			t.Fatalf("Found unexpected error running test '%s' - %s\n", tst, err.Error())
+		}
+
+		if !ret {
+			t.Fatalf("Found unexpected result running script: %s", tst)
+		}
+	}
+
+	// Map-typed structure fields are hashes too.
+	type Person struct {
+		Labels map[string]int
+	}
+	obj := New(`return Labels.age == 39;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+	ret, err := obj.Run(&Person{Labels: map[string]int{"age": 39}})
+	if err != nil || !ret {
+		t.Fatalf("failed to access map-typed field")
+	}
+
+	// Even when they're unexported.
+	type Private struct {
+		Name string
+		priv map[string]int
+	}
+	for _, tst := range []string{`return type(Missing) == "null";`, `return priv.age == 39 && Name == "x";`} {
+		obj = New(tst)
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst, err.Error())
+		}
+		ret, err = obj.Run(&Private{Name: "x", priv: map[string]int{"age": 39}})
+		if err != nil || !ret {
+			t.Fatalf("unexpected result running '%s': %v %v", tst, ret, err)
+		}
+	}
+}
+
+// Record is a FieldProvider, used by TestFieldProvider.
+type Record struct {
+	// Name is found via reflection.
+	Name string
+
+	// lookups counts the calls to GetField.
+	lookups int
+}
+
+// GetField supplies a computed field.
+func (r *Record) GetField(name string) (object.Object, bool) {
+	r.lookups++
+	switch name {
+	case "Upper":
+		return &object.String{Value: strings.ToUpper(r.Name)}, true
+	case "Name":
+		return &object.String{Value: "overridden"}, true
+	case "Empty":
+		return nil, true
+	}
+	return nil, false
+}
+
+// TestFieldProvider tests that objects may supply their own fields.
+func TestFieldProvider(t *testing.T) {
+
+	// Ensure the interface is satisfied.
+	var _ FieldProvider = &Record{}
+
+	tests := []string{
+		`return Upper == "STEVE";`,
+		`return Name == "overridden";`,
+		`return type(Empty) == "null";`,
+		`return type(Missing) == "null";`,
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst)
+
+		p := obj.Prepare()
+		if p != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst, p.Error())
+		}
+
+		r := &Record{Name: "steve"}
+		ret, err := obj.Run(r)
+		if err != nil {
+			t.Fatalf("Found unexpected error running test '%s' - %s\n", tst, err.Error())
+		}
+
+		if !ret {
+			t.Fatalf("Found unexpected result running script: %s", tst)
+		}
+		if r.lookups != 1 {
+			t.Fatalf("unexpected number of lookups: %d", r.lookups)
+		}
+	}
+}
+
+// TestNestedStruct tests that structure-typed fields, and slices of
+// structures, are converted to hashes.
+func TestNestedStruct(t *testing.T) {
+
+	type Item struct {
+		Name  string
+		Price float64
+		Tags  []string
+	}
+	type Address struct {
+		City string
+	}
+	type Order struct {
+		ID       int32
+		Address  Address
+		Items    []Item
+		Fixed    [2]Item
+		Counts   []int16
+		Empty    []Item
+		Location struct{ Lat float32 }
+	}
+
+	order := Order{
+		ID:      7,
+		Address: Address{City: "Helsinki"},
+		Items: []Item{
+			{Name: "book", Price: 12.5, Tags: []string{"paper"}},
+			{Name: "laptop", Price: 1200},
+		},
+		Fixed:    [2]Item{{Name: "first"}, {Name: "second"}},
+		Counts:   []int16{1, 2},
+		Location: struct{ Lat float32 }{Lat: 60},
+	}
+
+	tests := []string{
+		`return ID == 7;`,
+		`return Address.City == "Helsinki" && type(Address) == "hash";`,
+		`return Items[1].Price > 100 && Items[0].Tags[0] == "paper";`,
+		`return len(filter(Items, i => i.Price > 100)) == 1;`,
+		`return Fixed[1].Name == "second";`,
+		`return Counts[1] == 2;`,
+		`return len(Empty) == 0;`,
+		`return Location.Lat == 60;`,
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst)
+
+		p := obj.Prepare()
+		if p != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst, p.Error())
+		}
+
+		ret, err := obj.Run(order)
+		if err != nil {
+			t.Fatalf("Found unexpected error running test '%s' - %s\n", tst, err.Error())
+		}
+
+		if !ret {
+			t.Fatalf("Found unexpected result running script: %s", tst)
+		}
+	}
+}
+
+// Base is embedded in the structures used by TestPointersAndEmbedding.
+type Base struct {
+	ID   int
+	Kind string
+}
+
+// TestPointersAndEmbedding tests pointer, interface, and embedded fields.
+func TestPointersAndEmbedding(t *testing.T) {
+
+	type Owner struct {
+		Name string
+	}
+	type Node struct {
+		Base
+		*Owner
+		Kind    string
+		Parent  *Node
+		Count   *int
+		Missing *int
+		Value   interface{}
+		Nothing interface{}
+		Extra   interface{}
+	}
+
+	count := 3
+	root := &Node{Base: Base{ID: 1}, Kind: "root"}
+	child := &Node{
+		Base:   Base{ID: 2, Kind: "base"},
+		Owner:  &Owner{Name: "steve"},
+		Kind:   "child",
+		Parent: root,
+		Count:  &count,
+		Value:  "string",
+		Extra:  &Owner{Name: "kemp"},
+	}
+
+	// A loop.
+	root.Parent = child
+
+	tests := []string{
+		`return ID == 2;`,
+		`return Base.ID == 2 && Base.Kind == "base";`,
+		`return Kind == "child";`,
+		`return Name == "steve" && Owner.Name == "steve";`,
+		`return Parent.Kind == "root" && Parent.ID == 1;`,
+		`return type(Parent.Owner) == "null" && type(Parent.Name) == "null";`,
+		`return Parent.Parent.Kind == "child";`,
+		`return type(Parent.Parent.Parent) == "null";`,
+		`return Count == 3;`,
+		`return type(Missing) == "null";`,
+		`return Value == "string";`,
+		`return type(Nothing) == "null";`,
+		`return Extra.Name == "kemp";`,
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst)
+
+		p := obj.Prepare()
+		if p != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst, p.Error())
+		}
+
+		ret, err := obj.Run(child)
+		if err != nil {
+			t.Fatalf("Found unexpected error running test '%s' - %s\n", tst, err.Error())
+		}
+
+		if !ret {
+			t.Fatalf("Found unexpected result running script: %s", tst)
+		}
+	}
+}
+
+// TestCatch tests that errors may be handled via catch.
+func TestCatch(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result bool
+	}
+
+	tests := []Test{
+		{Input: `return catch(int("3"), 0) == 3;`, Result: true},
+		{Input: `return catch(int("steve"), -1) == -1;`, Result: true},
+		{Input: `return type(catch(int("steve"))) == "null";`, Result: true},
+		{Input: `return catch(1 / 0, 7) + 1 == 8;`, Result: true},
+		{Input: `return catch(1 + "steve", "bad") == "bad";`, Result: true},
+		{Input: `return catch(catch(1 / 0, 1 / 0), 3) == 3;`, Result: true},
+		{Input: `a = [1, 2]; return len(a) + catch(float("x"), 0.5) == 2.5;`, Result: true},
+		{Input: `return catch(Name ~= /+/, false) == false;`, Result: true},
+		{Input: `return len(catch(filter(Tags, t => t / 2), [])) == 0;`, Result: true},
+		{Input: `if ( true ) { let a = 1; x = catch(a / 0, 2); } return x == 2;`, Result: true},
+		{Input: `i = 0; total = 0; while ( i < 3 ) { total += catch(10 / i, 1); i++; } return total == 16;`, Result: true},
+		{Input: `return catch(int(Count), 0) == 3;`, Result: true},
+		{Input: `x = catch(int(Name)); return type(x) == "null";`, Result: true},
+		{Input: `return int(Name, 7) == 7 && int(Count, 7) == 3;`, Result: true},
+		{Input: `return float("x", 1.5) == 1.5;`, Result: true},
+	}
+
+	type Input struct {
+		Name  string
+		Count string
+		Tags  []string
+	}
+
+	for _, tst := range tests {
+
+		for _, flags := range [][]byte{nil, {NoOptimize}} {
+
+			obj := New(tst.Input)
+
+			p := obj.Prepare(flags)
+			if p != nil {
+				t.Fatalf("Failed to compile '%s': %s", tst.Input, p.Error())
+			}
+
+			for i := 0; i < 2; i++ {
+				ret, err := obj.Run(&Input{Name: "steve", Count: "3", Tags: []string{"a"}})
+				if err != nil {
+					t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+				}
+
+				if ret != tst.Result {
+					t.Fatalf("Found unexpected result running script: %s", tst.Input)
+				}
+			}
+		}
+	}
+
+	// Errors outside catch are still reported.
+	errors := []string{
+		`return int("steve") == 1;`,
+		`x = catch(1 / 0, 0); return 1 / 0;`,
+		`return catch(1, 2, 3);`,
+		`return catch();`,
+		`return int("1", 2, 3) == 1;`,
+	}
+	for _, tst := range errors {
+		obj := New(tst)
+		if obj.Prepare() != nil {
+			continue
+		}
+		if _, err := obj.Run(nil); err == nil {
+			t.Fatalf("expected an error running '%s'", tst)
+		}
+	}
+
+	// Errors raised by functions are returned with their kind.
+	obj := New(`return int("steve") == 1;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("unexpected error compiling: %s", err)
+	}
+	_, err := obj.Run(nil)
+	e, ok := err.(*object.Error)
+	if !ok {
+		t.Fatalf("expected an error-object, got %T", err)
+	}
+	if e.Kind != object.ConversionError {
+		t.Fatalf("unexpected error kind %s", e.Kind)
+	}
+}
+
+// TestPanic tests that panics are reported as errors.
+func TestPanic(t *testing.T) {
+
+	// A function which panics is reported.
+	obj := New(`return Boom() == 1;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("unexpected error compiling: %s", err)
+	}
+	obj.AddFunction("Boom", func(args []object.Object) object.Object {
+		panic("boom")
+	})
+	_, err := obj.Run(nil)
+	if err == nil {
+		t.Fatalf("expected an error from a panicking function")
+	}
+	if !strings.Contains(err.Error(), "panic calling function Boom: boom") {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// It may be caught, like any other error.
+	obj = New(`return catch(Boom(), 1) == 1;`)
+	if err = obj.Prepare(); err != nil {
+		t.Fatalf("unexpected error compiling: %s", err)
+	}
+	obj.AddFunction("Boom", func(args []object.Object) object.Object {
+		panic("boom")
+	})
+	ret, err := obj.Run(nil)
+	if err != nil || !ret {
+		t.Fatalf("expected catch to handle the panic, got %v %v", ret, err)
+	}
+
+	// A malformed program is reported, with the failing instruction.
+	bytecode := code.Instructions{
+		byte(code.OpPush), 0, 3,
+		byte(code.OpConstant), 0, 7,
+		byte(code.OpReturn),
+	}
+
+	machine := vm.New(nil, bytecode, environment.New())
+	_, err = machine.Run(nil)
+	if err == nil {
+		t.Fatalf("expected an error from a malformed program")
+	}
+	if !strings.Contains(err.Error(), "panic executing OpConstant at offset 3") {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !strings.Contains(err.Error(), "(stack: [3])") {
+		t.Fatalf("stack missing from error: %s", err)
+	}
+}
+
+// TestPersistentState tests that variables only persist between runs
+// when requested.
+func TestPersistentState(t *testing.T) {
+
+	script := `if ( ! count ) { count = 0; } count++; seen = Name; return count > 1;`
+
+	type Input struct {
+		Name string
+	}
+
+	// By default each run starts afresh.
+	obj := New(script)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	obj.SetVariable("count", &object.Integer{Value: 0})
+	for i := 0; i < 3; i++ {
+		ret, err := obj.Run(&Input{Name: fmt.Sprintf("run%d", i)})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if ret {
+			t.Fatalf("state persisted between runs")
+		}
+	}
+
+	// The variables set by the most recent run are available.
+	if obj.GetVariable("seen").Inspect() != "run2" {
+		t.Fatalf("unexpected variable: %s", obj.GetVariable("seen").Inspect())
+	}
+	if obj.GetVariable("count").Inspect() != "1" {
+		t.Fatalf("unexpected variable: %s", obj.GetVariable("count").Inspect())
+	}
+
+	// But the variables set by the host are untouched.
+	obj.SetVariable("count", &object.Integer{Value: 5})
+	ret, err := obj.Run(&Input{})
+	if err != nil || !ret {
+		t.Fatalf("host variable was not visible: %v %v", ret, err)
+	}
+
+	// State may be persisted explicitly.
+	obj = New(script, WithPersistentState())
+	if err = obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		ret, err = obj.Run(&Input{})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if ret != (i > 0) {
+			t.Fatalf("unexpected result for run %d", i)
+		}
+	}
+	if obj.GetVariable("count").Inspect() != "3" {
+		t.Fatalf("unexpected variable: %s", obj.GetVariable("count").Inspect())
+	}
+}
+
+// TestStore tests that state may be kept in a host-supplied store.
+func TestStore(t *testing.T) {
+
+	store := NewMemoryStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	// Allow three events per user, per minute.
+	script := `return counter_incr("login:" + User, 60) <= 3;`
+
+	type Input struct {
+		User string
+	}
+
+	obj := New(script, WithStore(store))
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		ret, err := obj.Run(&Input{User: "steve"})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if ret != (i < 3) {
+			t.Fatalf("unexpected result for event %d", i)
+		}
+	}
+
+	// Other users have their own counters.
+	ret, err := obj.Run(&Input{User: "bob"})
+	if err != nil || !ret {
+		t.Fatalf("unexpected result for another user: %v %v", ret, err)
+	}
+
+	// Once the window expires the counter restarts.
+	now = now.Add(time.Minute)
+	ret, err = obj.Run(&Input{User: "steve"})
+	if err != nil || !ret {
+		t.Fatalf("unexpected result after expiry: %v %v", ret, err)
+	}
+
+	// Values may be stored and retrieved, by another evaluator.
+	obj = New(`state_set("last", User); return true;`, WithStore(store))
+	if err = obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if _, err = obj.Run(&Input{User: "steve"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	tests := []string{
+		`return state_get("last") == "steve";`,
+		`return state_get("missing", 3) == 3;`,
+		`return type(state_get("missing")) == "null";`,
+		`state_set("short", 1, 0.5); return state_get("short") == 1;`,
+		`return catch(counter_incr("last"), -1) == -1;`,
+	}
+	for _, tst := range tests {
+		obj = New(tst, WithStore(store))
+		if err = obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst, err)
+		}
+		ret, err = obj.Run(nil)
+		if err != nil {
+			t.Fatalf("unexpected error running '%s': %s", tst, err)
+		}
+		if !ret {
+			t.Fatalf("unexpected result running '%s'", tst)
+		}
+	}
+
+	now = now.Add(time.Second)
+	if _, ok := store.Get("short"); ok {
+		t.Fatalf("value didn't expire")
+	}
+
+	// Invalid arguments are reported.
+	errors := []string{
+		`return state_get();`,
+		`return state_set("a");`,
+		`return counter_incr("a", "b");`,
+		`return counter_incr("a", -1);`,
+		`return counter_incr("a", √-1);`,
+		`return counter_incr("a", 10.0 ** 400);`,
+		`return state_set("a", 1, 1e10);`,
+	}
+	for _, tst := range errors {
+		obj = New(tst, WithStore(store))
+		if err = obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst, err)
+		}
+		if _, err = obj.Run(nil); err == nil {
+			t.Fatalf("expected an error running '%s'", tst)
+		}
+	}
+
+	// Failures of the store have a kind of their own.
+	obj = New(`return counter_incr("last");`, WithStore(store))
+	if err = obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	_, err = obj.Run(nil)
+	e, ok := err.(*object.Error)
+	if !ok || e.Kind != object.StoreError {
+		t.Fatalf("unexpected error from the store: %v", err)
+	}
+}
+
+// TestMemoryStoreSweep tests that expired keys which are never read again
+// are swept away, rather than accumulating.
+func TestMemoryStoreSweep(t *testing.T) {
+
+	store := NewMemoryStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	for i := 0; i < 5000; i++ {
+		if _, err := store.Incr(fmt.Sprintf("old:%d", i), 1, time.Second); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	// Once they've expired, writing new keys sweeps the old away.
+	now = now.Add(2 * time.Second)
+	for i := 0; i < 5000; i++ {
+		if err := store.Set(fmt.Sprintf("new:%d", i), object.NewInteger(1), time.Second); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if len(store.entries) >= 10000 {
+		t.Fatalf("expired entries were not swept: %d", len(store.entries))
+	}
+
+	// Live entries are kept.
+	for i := 0; i < 5000; i++ {
+		if _, ok := store.Get(fmt.Sprintf("new:%d", i)); !ok {
+			t.Fatalf("live entry new:%d was swept", i)
+		}
+	}
+}
+
+// TestHostAccess tests the functions which expose details of the host.
+func TestHostAccess(t *testing.T) {
+
+	os.Setenv("EVALFILTER_REGION", "eu-west-1")
+	defer os.Unsetenv("EVALFILTER_REGION")
+
+	host, err := os.Hostname()
+	if err != nil {
+		t.Skipf("failed to get the hostname: %s", err)
+	}
+
+	tests := []string{
+		`return getenv("EVALFILTER_REGION") == "eu-west-1";`,
+		`return getenv("EVALFILTER_MISSING") == "" && getenv("EVALFILTER_MISSING", 3) == 3;`,
+		`return hostname() == "` + host + `";`,
+	}
+	for _, tst := range tests {
+		obj := New(tst, WithHostAccess())
+		if err = obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst, err)
+		}
+		ret, err := obj.Run(nil)
+		if err != nil {
+			t.Fatalf("unexpected error running '%s': %s", tst, err)
+		}
+		if !ret {
+			t.Fatalf("unexpected result running '%s'", tst)
+		}
+	}
+
+	errors := []struct {
+		Input   string
+		Options []Option
+	}{
+		// The functions are unavailable by default.
+		{`return getenv("EVALFILTER_REGION") == "eu-west-1";`, nil},
+		{`return hostname() != "";`, nil},
+
+		// Access may be limited to the given variables.
+		{`return getenv("EVALFILTER_REGION") == "eu-west-1";`, []Option{WithHostAccess("REGION")}},
+
+		// Invalid arguments are reported.
+		{`return getenv() == "";`, []Option{WithHostAccess()}},
+		{`return hostname(1) == "";`, []Option{WithHostAccess()}},
+	}
+	for _, tst := range errors {
+		obj := New(tst.Input, tst.Options...)
+		if err = obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, err)
+		}
+		if _, err = obj.Run(nil); err == nil {
+			t.Fatalf("expected an error running '%s'", tst.Input)
+		}
+	}
+
+	obj := New(`return getenv("EVALFILTER_REGION") == "eu-west-1";`, WithHostAccess("EVALFILTER_REGION"))
+	if err = obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if ret, err := obj.Run(nil); err != nil || !ret {
+		t.Fatalf("unexpected result reading a permitted variable: %v %v", ret, err)
+	}
+}
+
+// TestLookup tests looking up values in tables supplied by the host.
+func TestLookup(t *testing.T) {
+
+	tables := NewMemoryLookup()
+	tables.AddSet("blocked_ips", []string{"10.0.0.1", "10.0.0.2"})
+	tables.AddTable("owners", map[string]string{"web1": "steve"})
+	err := tables.AddCSV("ports", strings.NewReader("22,ssh\n80,http\n8080\n"))
+	if err != nil {
+		t.Fatalf("unexpected error loading CSV: %s", err)
+	}
+
+	type Input struct {
+		SourceIP string
+		Host     string
+		Port     int
+	}
+	input := &Input{SourceIP: "10.0.0.2", Host: "web1", Port: 22}
+
+	tests := []string{
+		`return lookup("blocked_ips", SourceIP);`,
+		`return !lookup("blocked_ips", "127.0.0.1");`,
+		`return lookup("owners", Host) == "steve";`,
+		`return lookup("owners", "web2", "nobody") == "nobody";`,
+		`return type(lookup("owners", "web2")) == "null";`,
+		`return lookup("ports", Port) == "ssh" && lookup("ports", 8080) && !lookup("ports", 443);`,
+	}
+	for _, tst := range tests {
+		obj := New(tst, WithLookupProvider(tables))
+		if err = obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst, err)
+		}
+		ret, err := obj.Run(input)
+		if err != nil {
+			t.Fatalf("unexpected error running '%s': %s", tst, err)
+		}
+		if !ret {
+			t.Fatalf("unexpected result running '%s'", tst)
+		}
+	}
+
+	// Tables may be replaced.
+	obj := New(`return lookup("blocked_ips", SourceIP);`, WithLookupProvider(tables))
+	if err = obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	tables.AddSet("blocked_ips", []string{})
+	if ret, err := obj.Run(input); err != nil || ret {
+		t.Fatalf("unexpected result after replacing a table: %v %v", ret, err)
+	}
+
+	// Errors
+	errors := []string{
+		`return lookup("missing", SourceIP);`,
+		`return lookup("blocked_ips");`,
+		`return lookup();`,
+	}
+	for _, tst := range errors {
+		obj = New(tst, WithLookupProvider(tables))
+		if err = obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst, err)
+		}
+		if _, err = obj.Run(input); err == nil {
+			t.Fatalf("expected an error running '%s'", tst)
+		}
+	}
+
+	if err = tables.AddCSV("bad", strings.NewReader("\"unterminated\n")); err == nil {
+		t.Fatalf("expected an error loading invalid CSV")
+	}
+}
+
+// testGeoIP is a GeoIPProvider which knows a single network.
+type testGeoIP struct{}
+
+func (testGeoIP) Country(ip net.IP) (string, bool, error) {
+	if ip.Equal(net.ParseIP("192.0.2.66")) {
+		return "", false, fmt.Errorf("database unavailable")
+	}
+	_, network, _ := net.ParseCIDR("192.0.2.0/24")
+	return "gb", network.Contains(ip), nil
+}
+
+func (testGeoIP) ASN(ip net.IP) (int64, bool, error) {
+	_, network, _ := net.ParseCIDR("192.0.2.0/24")
+	return 64496, network.Contains(ip), nil
+}
+
+func TestGeoIP(t *testing.T) {
+
+	input := map[string]interface{}{"SourceIP": "192.0.2.1", "Other": "2001:db8::1"}
+
+	tests := []string{
+		`return country(SourceIP) == "GB";`,
+		`return country(SourceIP) in [ "GB", "IE" ];`,
+		`return asn(SourceIP) == 64496;`,
+		`return !country(Other) && !asn(Other);`,
+		`return type(country(Other)) == "null";`,
+	}
+	for _, tst := range tests {
+		obj := New(tst, WithGeoIPProvider(testGeoIP{}))
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst, err)
+		}
+		ret, err := obj.Run(input)
+		if err != nil {
+			t.Fatalf("unexpected error running '%s': %s", tst, err)
+		}
+		if !ret {
+			t.Fatalf("unexpected result running '%s'", tst)
+		}
+	}
+
+	// Errors
+	errors := []string{
+		`return country("192.0.2.66");`,
+		`return country("not an address");`,
+		`return asn();`,
+		`return asn(SourceIP, Other);`,
+	}
+	for _, tst := range errors {
+		obj := New(tst, WithGeoIPProvider(testGeoIP{}))
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst, err)
+		}
+		if _, err := obj.Run(input); err == nil {
+			t.Fatalf("expected an error running '%s'", tst)
+		}
+	}
+
+	// The functions are unavailable without a provider.
+	obj := New(`return country(SourceIP) == "GB";`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if _, err := obj.Run(input); err == nil {
+		t.Fatalf("expected an error without a provider")
+	}
+}
+
+// TestReloader tests replacing a script while it is in use.
+func TestReloader(t *testing.T) {
+
+	var mutex sync.Mutex
+	script := `return Count > 3;`
+	source := func() (string, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return script, nil
+	}
+	update := func(src string) {
+		mutex.Lock()
+		script = src
+		mutex.Unlock()
+	}
+
+	type Input struct {
+		Count int
+	}
+
+	r, err := NewReloader(source, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if ret, err := r.Run(Input{Count: 5}); err != nil || !ret {
+		t.Fatalf("unexpected result: %v %v", ret, err)
+	}
+
+	// Unchanged scripts aren't recompiled.
+	first := r.Current()
+	if changed, err := r.Reload(); changed || err != nil || r.Current() != first {
+		t.Fatalf("unexpected reload of an unchanged script: %v %v", changed, err)
+	}
+
+	// Changes are picked up, while the script is running.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 200; n++ {
+				if _, err := r.Run(Input{Count: n}); err != nil {
+					t.Errorf("unexpected error: %s", err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		update(fmt.Sprintf(`return Count > %d;`, i))
+		if _, err = r.Reload(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	wg.Wait()
+
+	if ret, err := r.Run(Input{Count: 9}); err != nil || ret {
+		t.Fatalf("unexpected result after reloading: %v %v", ret, err)
+	}
+
+	// Broken scripts are rejected, and the previous script remains.
+	update(`return Count >;`)
+	if changed, err := r.Reload(); changed || err == nil {
+		t.Fatalf("expected an error reloading a broken script")
+	}
+	if ret, err := r.Run(Input{Count: 10}); err != nil || !ret {
+		t.Fatalf("unexpected result after a failed reload: %v %v", ret, err)
+	}
+
+	// As are scripts which fail validation.
+	validate := func(e *Eval) error {
+		results, err := e.RunTests([]Input{{Count: 1}, {Count: 100}})
+		if err != nil {
+			return err
+		}
+		for _, res := range results {
+			if !res.Passed() {
+				return fmt.Errorf("test %s failed: %s", res.Name, res.Err)
+			}
+		}
+		return nil
+	}
+	update(`return Count > 50; test "matches" { assert(result == (Count > 50)); }`)
+	r, err = NewReloader(source, validate)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	update(`return Count > 500; test "matches" { assert(result == (Count > 50)); }`)
+	if _, err = r.Reload(); err == nil || !strings.Contains(err.Error(), "failed validation") {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+
+	// Watch reloads periodically, and reports errors.
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go r.Watch(ctx, time.Millisecond, func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	})
+	if err = <-errs; !strings.Contains(err.Error(), "failed validation") {
+		t.Fatalf("unexpected error from Watch: %s", err)
+	}
+	update(`return Count > 50;`)
+	for deadline := time.Now().Add(5 * time.Second); r.Current().Script != `return Count > 50;`; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Watch didn't reload the script")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	// Scripts may be loaded from files.
+	file, err := ioutil.TempFile("", "reload")
+	if err != nil {
+		t.Fatalf("failed to create a file: %s", err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`return Count == 3;`)
+	file.Close()
+
+	r, err = NewReloader(FileSource(file.Name()), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if ret, err := r.Run(Input{Count: 3}); err != nil || !ret {
+		t.Fatalf("unexpected result from a file: %v %v", ret, err)
+	}
+
+	// The initial script must be valid.
+	if _, err = NewReloader(FileSource("/does/not/exist"), nil); err == nil {
+		t.Fatalf("expected an error loading a missing file")
+	}
+}
+
+// TestShadow tests comparing an active script with a candidate.
+func TestShadow(t *testing.T) {
+
+	active := New(`return Count > 3;`)
+	candidate := New(`return Count > 5 || Name == "bob";`)
+	if _, err := NewShadow(active, candidate, 10); err == nil {
+		t.Fatalf("expected an error with unprepared scripts")
+	}
+	if err := active.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if err := candidate.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+
+	type Input struct {
+		Count int
+		Name  string
+	}
+
+	s, err := NewShadow(active, candidate, 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				in := Input{Count: i, Name: "steve"}
+				ret, err := s.Run(in)
+				if err != nil || ret != (i > 3) {
+					t.Errorf("unexpected result for %d: %v %v", i, ret, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Counts of 4 and 5 diverge, in each goroutine.
+	report := s.Report()
+	if report.Runs != 40 || report.Divergences != 8 || len(report.Samples) != 8 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	for _, d := range report.Samples {
+		if !d.Active || d.Candidate || (d.Object != `{"Count":4,"Name":"steve"}` && d.Object != `{"Count":5,"Name":"steve"}`) {
+			t.Fatalf("unexpected divergence: %+v", d)
+		}
+	}
+
+	// The number of samples is limited, and errors diverge.
+	s, _ = NewShadow(active, candidate, 2)
+	for i := 0; i < 10; i++ {
+		s.Run(Input{Count: 0, Name: "bob"})
+	}
+	report = s.Report()
+	if report.Runs != 10 || report.Divergences != 10 || len(report.Samples) != 2 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	// An error from only one script is a divergence.
+	always := New(`return true;`)
+	if err = always.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	s, _ = NewShadow(active, always, 2)
+	if _, err = s.Run(map[string]interface{}{"Count": "x"}); err == nil {
+		t.Fatalf("expected an error from the active script")
+	}
+	report = s.Report()
+	if report.Divergences != 1 || report.Samples[0].ActiveErr == nil || !report.Samples[0].Candidate {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	// Both scripts failing isn't a divergence.
+	s, _ = NewShadow(active, active, 2)
+	s.Run(map[string]interface{}{"Count": "x"})
+	if report = s.Report(); report.Runs != 1 || report.Divergences != 0 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+}
+
+// TestExplain tests explaining how a script reached its result.
+func TestExplain(t *testing.T) {
+
+	e := New(`
+if ( Count > 3 && Name == "steve" ) { return true; }
+n = 0;
+while ( n < 1 ) { n++; }
+return len(Name) > 2;
+`)
+	if _, err := e.Explain(nil); err == nil {
+		t.Fatalf("expected an error with an unprepared script")
+	}
+	if err := e.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+
+	type Input struct {
+		Count int
+		Name  string
+	}
+
+	x, err := e.Explain(Input{Count: 1, Name: "bob"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := `result: true
+  ((Count > 3) && (Name == "steve")) => false
+    (Count > 3) => false
+      Count => 1
+      3 => 3
+    (Name == "steve") => false
+      Name => bob
+      "steve" => steve
+  0 => 0
+  (n < 1) => true
+    n => 0
+    1 => 1
+  (n + 1) => 1
+    n => 0
+    1 => 1
+  (n < 1) => false
+    n => 1
+    1 => 1
+  (len(Name) > 2) => true
+    len(Name) => 3
+      Name => bob
+    2 => 2
+`
+	if x.String() != expected {
+		t.Fatalf("unexpected explanation:\n%s", x.String())
+	}
+	if !x.Result || len(x.Steps) != 6 || len(x.Steps[0].Children) != 2 {
+		t.Fatalf("unexpected explanation: %+v", x)
+	}
+
+	// Explaining doesn't change the result of running the script.
+	ret, err := e.Run(Input{Count: 4, Name: "steve"})
+	if err != nil || !ret {
+		t.Fatalf("unexpected result: %v %v", ret, err)
+	}
+	x, err = e.Explain(Input{Count: 4, Name: "steve"})
+	if err != nil || !x.Result || len(x.Steps) != 2 {
+		t.Fatalf("unexpected explanation: %v %v", x, err)
+	}
+
+	// Errors are returned along with what happened before them.
+	x, err = e.Explain(map[string]interface{}{"Count": "x"})
+	if err == nil || len(x.Steps) != 2 || x.Steps[0].Value.Inspect() != "x" {
+		t.Fatalf("expected an error, got %v", x)
+	}
+
+	// JSON documents may be explained too.
+	x, err = e.ExplainJSON([]byte(`{"Count": 4, "Name": "steve"}`))
+	if err != nil || !x.Result || len(x.Steps) != 2 {
+		t.Fatalf("unexpected explanation: %v %v", x, err)
+	}
+	if _, err = e.ExplainJSON([]byte(`[1, 2]`)); err == nil {
+		t.Fatalf("expected an error explaining a non-object")
+	}
+}
+
+// TestSpecialize tests specializing a script against known fields.
+func TestSpecialize(t *testing.T) {
+
+	e := New(`
+if ( Mode == "strict" ) {
+   return Count > Limit * 2 && Name ~= /^s/;
+}
+if ( Mode in [ "lax", "open" ] ) { return true; }
+return len(filter(Tags, t => t == Mode)) > 0;
+`)
+	if _, err := e.Specialize(nil); err == nil {
+		t.Fatalf("expected an error with an unprepared script")
+	}
+	if err := e.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+
+	type Input struct {
+		Count int
+		Name  string
+		Tags  []string
+	}
+
+	tests := []struct {
+		Fields map[string]object.Object
+		Input  Input
+		Result bool
+		Size   int
+	}{
+		// Only the strict branch remains.
+		{Fields: map[string]object.Object{"Mode": &object.String{Value: "strict"}, "Limit": object.NewInteger(3)},
+			Input: Input{Count: 7, Name: "steve"}, Result: true, Size: 16},
+		{Fields: map[string]object.Object{"Mode": &object.String{Value: "strict"}, "Limit": object.NewInteger(3)},
+			Input: Input{Count: 6, Name: "steve"}, Result: false, Size: 16},
+
+		// The whole script is folded away.
+		{Fields: map[string]object.Object{"$Mode": &object.String{Value: "lax"}},
+			Input: Input{}, Result: true, Size: 2},
+
+		// The lambda uses the known value too.
+		{Fields: map[string]object.Object{"Mode": &object.String{Value: "x"}},
+			Input: Input{Tags: []string{"x"}}, Result: true},
+		{Fields: map[string]object.Object{"Mode": &object.String{Value: "x"}},
+			Input: Input{Tags: []string{"y"}}, Result: false},
+	}
+
+	for _, tst := range tests {
+
+		s, err := e.Specialize(tst.Fields)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if tst.Size != 0 && len(s.Bytecode()) != tst.Size {
+			t.Fatalf("unexpected bytecode for %v: %v", tst.Fields, s.Bytecode())
+		}
+
+		ret, err := s.Run(tst.Input)
+		if err != nil || ret != tst.Result {
+			t.Fatalf("unexpected result for %v: %v %v", tst.Fields, ret, err)
+		}
+
+	}
+
+	// Fields which are updated aren't substituted, but still have
+	// the known values.
+	e = New(`Count = Count + 1; return Count == 4 && Name == "steve";`)
+	if err := e.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	s, err := e.Specialize(map[string]object.Object{"Count": object.NewInteger(3), "Name": &object.String{Value: "steve"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ret, err := s.Run(Input{Count: 10})
+	if err != nil || !ret {
+		t.Fatalf("unexpected result: %v %v", ret, err)
+	}
+
+	// Simple filters are still evaluated without the virtual machine.
+	e = New(`return Count > 3 && Tenant == "acme";`)
+	if err := e.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	s, err = e.Specialize(map[string]object.Object{"Tenant": &object.String{Value: "acme"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if s.fast == nil || len(s.fast.fields) != 1 {
+		t.Fatalf("expected a fast filter using one field")
+	}
+	ret, err = s.Run(Input{Count: 4})
+	if err != nil || !ret {
+		t.Fatalf("unexpected result: %v %v", ret, err)
+	}
+}
+
+// TestSQL tests translating scripts into SQL.
+func TestSQL(t *testing.T) {
+
+	tests := []struct {
+		Script  string
+		Options []Option
+		Where   string
+		Args    []interface{}
+		Error   string
+	}{
+		{Script: `return Count > 3 && Name == "steve";`,
+			Where: `("Count" > ? AND "Name" = ?)`, Args: []interface{}{int64(3), "steve"}},
+		{Script: `if ( 3.5 <= $Price || ! (Tag != "x") ) { return true; } return false;`,
+			Where: `("Price" >= ? OR NOT "Tag" <> ?)`, Args: []interface{}{3.5, "x"}},
+		{Script: `if ( Count between -1 and 10 ) { return false; } else { return true; }`,
+			Where: `NOT "Count" BETWEEN ? AND ?`, Args: []interface{}{int64(-1), int64(10)}},
+		{Script: `return Name in [ "a", "b" ] && Admin == true;`,
+			Where: `("Name" IN (?, ?) AND "Admin" = ?)`, Args: []interface{}{"a", "b", true}},
+		{Script: `return true;`, Where: "1 = 1"},
+		{Script: `if ( Name == "x" ) { return false; } return false;`, Where: "1 = 0"},
+		{Script: `return Name ~= /steve/;`, Error: "cannot translate"},
+		{Script: `return len(Name) > 3;`, Error: "cannot translate"},
+		{Script: `return Count > Other;`, Error: "cannot translate"},
+		{Script: `return Order == 3 || Group != "x";`,
+			Where: `("Order" = ? OR "Group" <> ?)`, Args: []interface{}{int64(3), "x"}},
+		{Script: `return $["x = 1 OR 1 = 1 --"] == 2;`, Options: []Option{WithSelectors()},
+			Where: `"x = 1 OR 1 = 1 --" = ?`, Args: []interface{}{int64(2)}},
+		{Script: `return $["a\" = 1 OR \"b"] in [1];`, Options: []Option{WithSelectors()},
+			Where: `"a"" = 1 OR ""b" IN (?)`, Args: []interface{}{int64(1)}},
+		{Script: `return $.Count > 3 && $["Name"] == "steve";`, Options: []Option{WithSelectors()},
+			Where: `("Count" > ? AND "Name" = ?)`, Args: []interface{}{int64(3), "steve"}},
+		{Script: `return $.Request.Method == "GET";`, Options: []Option{WithSelectors()},
+			Error: "cannot translate"},
+		{Script: `x = 3; return Count > x;`, Error: "not a simple filter"},
+		{Script: `return Count > ;`, Error: "Errors parsing script"},
+	}
+
+	for _, tst := range tests {
+
+		e := New(tst.Script, tst.Options...)
+		where, args, err := e.SQL()
+		if tst.Error != "" {
+			if err == nil || !strings.Contains(err.Error(), tst.Error) {
+				t.Fatalf("expected error '%s' for '%s', got %v", tst.Error, tst.Script, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error for '%s': %s", tst.Script, err)
+		}
+		if where != tst.Where || fmt.Sprintf("%#v", args) != fmt.Sprintf("%#v", tst.Args) {
+			t.Fatalf("unexpected translation of '%s': %s %#v", tst.Script, where, args)
+		}
+	}
+}
+
+// TestElasticsearch tests translating scripts into Elasticsearch queries.
+func TestElasticsearch(t *testing.T) {
+
+	tests := []struct {
+		Script  string
+		Options []Option
+		Query   string
+		Error   string
+	}{
+		{Script: `return Count > 3 && Name == "steve";`,
+			Query: `{"bool":{"filter":[{"range":{"Count":{"gt":3}}},{"term":{"Name":"steve"}}]}}`},
+		{Script: `if ( 3.5 <= $Price || Tag != "x" ) { return true; } return false;`,
+			Query: `{"bool":{"minimum_should_match":1,"should":[{"range":{"Price":{"gte":3.5}}},{"bool":{"must_not":[{"term":{"Tag":"x"}}]}}]}}`},
+		{Script: `if ( Count between 1 and 10 ) { return false; } else { return true; }`,
+			Query: `{"bool":{"must_not":[{"range":{"Count":{"gte":1,"lte":10}}}]}}`},
+		{Script: `return Name in [ "a", "b" ] && ! false;`,
+			Query: `{"bool":{"filter":[{"terms":{"Name":["a","b"]}},{"bool":{"must_not":[{"match_none":{}}]}}]}}`},
+		{Script: `return true;`, Query: `{"match_all":{}}`},
+		{Script: `return Name ~= /steve/;`, Error: "cannot translate"},
+		{Script: `print("x"); return true;`, Error: "not a simple filter"},
+		{Script: `return $["x\" OR 1"] == 2;`, Options: []Option{WithSelectors()},
+			Query: `{"term":{"x\" OR 1":2}}`},
+		{Script: `return $.Request.Method == "GET";`, Options: []Option{WithSelectors()},
+			Error: "cannot translate"},
+	}
+
+	for _, tst := range tests {
+
+		e := New(tst.Script, tst.Options...)
+		query, err := e.Elasticsearch()
+		if tst.Error != "" {
+			if err == nil || !strings.Contains(err.Error(), tst.Error) {
+				t.Fatalf("expected error '%s' for '%s', got %v", tst.Error, tst.Script, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error for '%s': %s", tst.Script, err)
+		}
+		out, err := json.Marshal(query)
+		if err != nil {
+			t.Fatalf("failed to encode query: %s", err)
+		}
+		if string(out) != tst.Query {
+			t.Fatalf("unexpected translation of '%s': %s", tst.Script, out)
+		}
+	}
+}
+
+// TestNondeterminism tests finding calls to non-deterministic functions.
+func TestNondeterminism(t *testing.T) {
+
+	library := map[string]string{
+		"env.ef":  `home = getenv("HOME");`,
+		"loop.ef": `include "loop.ef";`,
+	}
+	resolver := func(name string) (string, error) {
+		src, ok := library[name]
+		if !ok {
+			return "", fmt.Errorf("%s not found", name)
+		}
+		return src, nil
+	}
+
+	tests := []struct {
+		Script    string
+		Functions []string
+		Calls     string
+		Error     string
+	}{
+		{Script: `return Count > 3 && len(Name) > 2;`, Calls: "[]"},
+		{Script: `if ( Count > 3 ) {
+  return lookup("tenants", Name, false);
+}
+return len(filter(Tags, t => t == hostname())) > 0;`,
+			Calls: "[line 2: lookup line 4: hostname]"},
+		{Script: `include "env.ef"; return dice() > 3;`, Functions: []string{"dice"},
+			Calls: "[env.ef:1: getenv line 1: dice]"},
+		{Script: `test "t" { assert(random() > 0); } return true;`, Calls: "[]"},
+		{Script: `include "loop.ef"; return true;`, Error: "include loop"},
+		{Script: `include "missing.ef"; return true;`, Error: "not found"},
+		{Script: `return ( ;`, Error: "Errors parsing"},
+	}
+
+	for _, tst := range tests {
+
+		e := New(tst.Script, WithIncludeResolver(resolver))
+		calls, err := e.Nondeterminism(tst.Functions...)
+		if tst.Error != "" {
+			if err == nil || !strings.Contains(err.Error(), tst.Error) {
+				t.Fatalf("expected error '%s' for '%s', got %v", tst.Error, tst.Script, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error for '%s': %s", tst.Script, err)
+		}
+		if fmt.Sprintf("%v", calls) != tst.Calls {
+			t.Fatalf("unexpected calls for '%s': %v", tst.Script, calls)
+		}
+	}
+}
+
+// TestLimits tests rejecting scripts which are too complex.
+func TestLimits(t *testing.T) {
+
+	library := map[string]string{
+		"re.ef": `x = match("a", "b");`,
+	}
+	resolver := func(name string) (string, error) {
+		return library[name], nil
+	}
+
+	script := `
+include "re.ef";
+if ( Name ~= /^s/ && Count > 3 ) {
+   return len(filter(Tags, t => t ~= /x/)) > 0;
+}
+return false;
+`
+
+	tests := []struct {
+		Limits Limits
+		Error  string
+	}{
+		{Limits: Limits{}},
+		{Limits: Limits{MaxInstructions: 100, MaxConstants: 20, MaxDepth: 20, MaxRegexps: 3}},
+		{Limits: Limits{MaxRegexps: 2}, Error: "script exceeds the limit on regular expressions: 3 > 2"},
+		{Limits: Limits{MaxDepth: 6}, Error: "script exceeds the limit on nesting depth: 11 > 6"},
+		{Limits: Limits{MaxConstants: 5}, Error: "limit on constants"},
+		{Limits: Limits{MaxInstructions: 10}, Error: "limit on instructions"},
+	}
+
+	for _, tst := range tests {
+
+		e := New(script, WithIncludeResolver(resolver), WithLimits(tst.Limits))
+		err := e.Prepare()
+		if tst.Error == "" {
+			if err != nil {
+				t.Fatalf("unexpected error with %+v: %s", tst.Limits, err)
+			}
+			continue
+		}
+
+		if err == nil || !strings.Contains(err.Error(), tst.Error) {
+			t.Fatalf("expected error '%s' with %+v, got %v", tst.Error, tst.Limits, err)
+		}
+		if _, ok := err.(*LimitError); !ok {
+			t.Fatalf("expected a LimitError, got %T", err)
+		}
+	}
+}
+
+// TestMaxSteps tests limiting the work done by each run of a script.
+func TestMaxSteps(t *testing.T) {
+
+	tests := []struct {
+		Input string
+		Error bool
+	}{
+		{Input: `i = 0; while ( i < 10 ) { i++; } return i == 10;`},
+		{Input: `while ( true ) { } return true;`, Error: true},
+		{Input: `while ( true ) { x = catch( 1 / 0, 1 ); } return true;`, Error: true},
+		{Input: `g = x => g(x); return len(filter(Tags, t => g(t))) > 0;`, Error: true},
+		{Input: `f = x => f(x); return f(1);`, Error: true},
+		{Input: `s = "x" * 100000; return len(s) > 0;`, Error: true},
+		{Input: `s = "x" * 1000; return len(s) > 0;`},
+		{Input: `a = [0] * 100000; return len(a) > 0;`, Error: true},
+		{Input: `a = [0] * 1000; return len(a) > 0;`},
+		{Input: `s = "ab"; while ( true ) { s = s + s; } return true;`, Error: true},
+		{Input: `a = [0]; while ( true ) { a = a + a; } return true;`, Error: true},
+	}
+
+	for _, tst := range tests {
+
+		e := New(tst.Input, WithLimits(Limits{MaxSteps: 1000}))
+		if err := e.Prepare(); err != nil {
+			t.Fatalf("failed to compile '%s': %s", tst.Input, err)
+		}
+
+		// The limit applies to each run.
+		for i := 0; i < 2; i++ {
+			ret, err := e.Run(map[string]interface{}{"Tags": []string{"a"}})
+			if !tst.Error {
+				if err != nil || !ret {
+					t.Fatalf("unexpected result for '%s': %v %v", tst.Input, ret, err)
+				}
+				continue
+			}
+			if err == nil || !strings.Contains(err.Error(), "limit on steps: 1000") {
+				t.Fatalf("expected a step error for '%s', got %v", tst.Input, err)
+			}
+		}
+	}
+
+	// Concatenation can't be used to exhaust our memory, even if the
+	// steps aren't limited.
+	e := New(`s = "ab"; while ( true ) { s = s + s; } return true;`)
+	if err := e.Prepare(); err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+	if _, err := e.Run(nil); err == nil || !strings.Contains(err.Error(), "concatenated string is too large") {
+		t.Fatalf("expected a size error, got %v", err)
+	}
+}
+
+// TestFuzz tests the fuzzing entry-points.
+func TestFuzz(t *testing.T) {
+
+	tests := []struct {
+		Input   string
+		Compile int
+		Run     int
+	}{
+		{Input: `return Count == 3 && Nested.Values[1] == 2;`, Compile: 1, Run: 1},
+		{Input: `while ( true ) { } return true;`, Compile: 1, Run: 1},
+		{Input: `s = "ab"; while ( true ) { s = s + s; } return true;`, Compile: 1, Run: 1},
+		{Input: `print(Name); return random(10) > 5;`, Compile: 1, Run: 0},
+		{Input: `return (;`, Compile: 0, Run: 0},
+	}
+
+	for _, tst := range tests {
+		if c := FuzzCompile([]byte(tst.Input)); c != tst.Compile {
+			t.Fatalf("unexpected result compiling '%s': %d", tst.Input, c)
+		}
+		if r := FuzzCompileAndRun([]byte(tst.Input)); r != tst.Run {
+			t.Fatalf("unexpected result running '%s': %d", tst.Input, r)
+		}
+	}
+}
+
+// TestDifferential tests that the ways in which we execute scripts agree.
+func TestDifferential(t *testing.T) {
+
+	type Input struct {
+		Name  string
+		Count int
+		Price float64
+		Tags  []string
+	}
+
+	objects := []interface{}{
+		Input{Name: "Steve", Count: 3, Price: 1.5, Tags: []string{"a", "b"}},
+		&Input{Name: "", Count: -1},
+		map[string]interface{}{"Name": 3, "Count": "x"},
+		map[string]interface{}{},
+	}
+
+	scripts := []string{
+		`return Count == 3 && Name ~= /^s/i;`,
+		`if ( Price > 1 || Name == "" ) { return true; } return false;`,
+		`return Count between 0 and 5 && !( Name in [ "Steve", "Bob" ] );`,
+		`return 1 + 2 * 3 == 7 && "a" + "b" == "ab" && Count * 2 > 3;`,
+		`i = 0; while ( i < Count ) { i++; } return i > 2;`,
+		`return len(filter(Tags, t => t != "a")) == 1;`,
+		`return catch( int(Count) / 0, 0 ) == 0;`,
+		`return Name.upper() == "STEVE";`,
+	}
+
+	for _, script := range scripts {
+		divergences, err := differential(script, nil, objects...)
+		if err != nil {
+			t.Fatalf("failed to compile '%s': %s", script, err)
+		}
+		if len(divergences) > 0 {
+			t.Fatalf("the paths diverge for '%s':\n%s", script, strings.Join(divergences, "\n"))
+		}
+	}
+
+	// Scripts which can't be prepared are errors.
+	if _, err := differential(`return (;`, nil); err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	// Runs which exceed the limit on steps are ignored.
+	divergences, err := differential(`while ( true ) { } return true;`, []Option{WithLimits(Limits{MaxSteps: 100})}, objects...)
+	if err != nil || len(divergences) != 0 {
+		t.Fatalf("unexpected result: %v %v", divergences, err)
+	}
+
+	// Outcomes agree if they have the same result, or both failed.
+	a := pathResult{ret: true}
+	b := pathResult{err: fmt.Errorf("one")}
+	c := pathResult{ret: true, err: fmt.Errorf("two")}
+	if a.agrees(pathResult{}) || a.agrees(b) || !b.agrees(c) || !a.agrees(a) {
+		t.Fatalf("unexpected agreement")
+	}
+	if a.String() != "true" || b.String() != `error "one"` {
+		t.Fatalf("unexpected descriptions: %s %s", a, b)
+	}
+
+	// The fuzzing entry-point panics if the paths diverge.
+	if FuzzDifferential([]byte(scripts[0])) != 1 || FuzzDifferential([]byte(`return (;`)) != 0 {
+		t.Fatalf("unexpected results from FuzzDifferential")
+	}
+}
+
+// TestCustomOperators tests the infix operators added by the host.
+func TestCustomOperators(t *testing.T) {
+
+	// inside tests whether a point lies within a box.
+	inside := func(left, right object.Object) object.Object {
+		point, ok := left.(*object.Array)
+		box, ok2 := right.(*object.Array)
+		if !ok || !ok2 || len(point.Elements) != 2 || len(box.Elements) != 4 {
+			return &object.Error{Kind: object.TypeError, Message: "inside expects a point and a box"}
+		}
+		v := func(o object.Object) float64 {
+			n, _ := o.(*object.Integer)
+			if n == nil {
+				return 0
+			}
+			return float64(n.Value)
+		}
+		x, y := v(point.Elements[0]), v(point.Elements[1])
+		in := x >= v(box.Elements[0]) && y >= v(box.Elements[1]) && x <= v(box.Elements[2]) && y <= v(box.Elements[3])
+		return &object.Boolean{Value: in}
+	}
+
+	// ~> tests whether a version lies within a range, given as a prefix.
+	within := func(left, right object.Object) object.Object {
+		v, r := left.Inspect(), right.Inspect()
+		return &object.Boolean{Value: v == r || strings.HasPrefix(v, r+".")}
+	}
+
+	tests := []struct {
+		Input  string
+		Result bool
+		Error  bool
+	}{
+		{Input: `return Point inside [0, 0, 10, 10];`, Result: true},
+		{Input: `return [11, 5] inside [0, 0, 10, 10];`, Result: false},
+		{Input: `return Version ~> "1.2";`, Result: true},
+		{Input: `return Version ~> "1.3";`, Result: false},
+		{Input: `return Version ~> "1.2" && Point inside [0, 0, 10, 10];`, Result: true},
+		{Input: `return Version ~> "1.3" || Point inside [0, 0, 1, 1];`, Result: false},
+		{Input: `return ! ( Version ~> "1.3" );`, Result: true},
+		{Input: `inside_ = 3; return inside_ == 3;`, Result: true},
+		{Input: `return Version inside [0, 0, 1, 1];`, Error: true},
+	}
+
+	for _, tst := range tests {
+
+		for _, flags := range [][]byte{nil, {NoOptimize}} {
+			e := New(tst.Input)
+			if err := e.AddOperator("inside", inside); err != nil {
+				t.Fatalf("failed to add operator: %s", err)
+			}
+			if err := e.AddOperator("~>", within); err != nil {
+				t.Fatalf("failed to add operator: %s", err)
+			}
+			if err := e.Prepare(flags); err != nil {
+				t.Fatalf("failed to compile '%s': %s", tst.Input, err)
+			}
+
+			ret, err := e.Run(map[string]interface{}{"Point": []int{3, 4}, "Version": "1.2.7"})
+			if tst.Error {
+				if err == nil || !strings.Contains(err.Error(), "inside expects") {
+					t.Fatalf("expected an error for '%s', got %v", tst.Input, err)
+				}
+				continue
+			}
+			if err != nil || ret != tst.Result {
+				t.Fatalf("unexpected result for '%s': %v %v", tst.Input, ret, err)
+			}
+		}
+	}
+
+	// Operators which haven't been added aren't recognized.
+	if err := New(`return Version ~> "1.2";`).Prepare(); err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	// Names which clash with our own syntax are rejected.
+	e := New(`return true;`)
+	for _, name := range []string{"", "if", "in", "==", "**", "=>", "~", "a b", "1x", "~/", "~>"} {
+		err := e.AddOperator(name, within)
+		if name == "~>" {
+			if err != nil {
+				t.Fatalf("failed to add operator: %s", err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), "invalid operator name") {
+			t.Fatalf("expected an error for %q, got %v", name, err)
+		}
+	}
+
+	// The operators are shown in the bytecode.
+	if err := e.AddOperator("inside", inside); err != nil {
+		t.Fatalf("failed to add operator: %s", err)
+	}
+	e.Script = `return Point inside [0, 0, 10, 10];`
+	if err := e.Prepare(); err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+	var buf bytes.Buffer
+	if err := e.DumpTo(&buf); err != nil {
+		t.Fatalf("failed to dump: %s", err)
+	}
+	if !strings.Contains(buf.String(), "OpCustomOp\t1\t// operator inside") {
+		t.Fatalf("unexpected bytecode:\n%s", buf.String())
+	}
+
+	// Programs share their operators.
+	p := NewProgram()
+	if err := p.AddOperator("~>", within); err != nil {
+		t.Fatalf("failed to add operator: %s", err)
+	}
+	if err := p.Add("version", `return Version ~> "1";`); err != nil {
+		t.Fatalf("failed to add: %s", err)
+	}
+	if ret, err := p.Run("version", map[string]interface{}{"Version": "1.2.7"}); err != nil || !ret {
+		t.Fatalf("unexpected result: %v %v", ret, err)
+	}
+}
+
+// TestProgram tests running many scripts which share their constants.
+func TestProgram(t *testing.T) {
+
+	p := NewProgram(WithStore(NewMemoryStore()))
+	p.AddFunction("double", func(args []object.Object) object.Object {
+		return object.NewInteger(args[0].(*object.Integer).Value * 2)
+	})
+	p.SetVariable("limit", object.NewInteger(10))
+
+	// Many similar scripts, one for each tenant.
+	for i := 0; i < 200; i++ {
+		script := fmt.Sprintf(`
+if ( Tenant != "tenant-%d" ) { return false; }
+return double(Count) > limit && len(filter(Tags, t => t == "urgent")) > 0;
+`, i)
+		if err := p.Add(fmt.Sprintf("t%d", i), script); err != nil {
+			t.Fatalf("unexpected error adding script %d: %s", i, err)
+		}
+	}
+	if names := p.Names(); len(names) != 200 || names[0] != "t0" || names[199] != "t199" {
+		t.Fatalf("unexpected names: %v", names)
+	}
+
+	// The common constants, such as the lambda, are shared.
+	if len(p.constants) > 220 {
+		t.Fatalf("too many constants: %d", len(p.constants))
+	}
+
+	type Input struct {
+		Tenant string
+		Count  int
+		Tags   []string
+	}
+
+	tests := []struct {
+		Script string
+		Input  Input
+		Result bool
+	}{
+		{"t7", Input{Tenant: "tenant-7", Count: 6, Tags: []string{"urgent"}}, true},
+		{"t7", Input{Tenant: "tenant-7", Count: 5, Tags: []string{"urgent"}}, false},
+		{"t8", Input{Tenant: "tenant-7", Count: 6, Tags: []string{"urgent"}}, false},
+		{"t199", Input{Tenant: "tenant-199", Count: 6, Tags: []string{"urgent"}}, true},
+		{"t0", Input{Tenant: "tenant-0", Count: 60}, false},
+	}
+	for _, tst := range tests {
+		ret, err := p.Run(tst.Script, tst.Input)
+		if err != nil || ret != tst.Result {
+			t.Fatalf("unexpected result running %s against %v: %v %v", tst.Script, tst.Input, ret, err)
+		}
+	}
+
+	// Scripts added later may be run, and share the options.
+	if err := p.Add("simple", `return Count == 3;`); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := p.Add("state", `return counter_incr("x") == 1;`); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, name := range []string{"simple", "state"} {
+		if ret, err := p.Run(name, Input{Count: 3}); err != nil || !ret {
+			t.Fatalf("unexpected result running %s: %v %v", name, ret, err)
+		}
+	}
+
+	// Errors.
+	if err := p.Add("simple", `return true;`); err == nil {
+		t.Fatalf("expected an error adding a duplicate script")
+	}
+	if err := p.Add("broken", `return ( ;`); err == nil || !strings.Contains(err.Error(), "script broken") {
+		t.Fatalf("expected an error adding a broken script, got %v", err)
+	}
+	if err := p.Add("rules", `rule "r" { return true; } return true;`); err == nil {
+		t.Fatalf("expected an error adding a script with rules")
+	}
+	if _, err := p.Run("missing", nil); err == nil {
+		t.Fatalf("expected an error running a missing script")
+	}
+	if _, err := p.Run("t1", map[string]interface{}{"Tenant": "tenant-1", "Count": "x"}); err == nil || !strings.Contains(err.Error(), "script t1") {
+		t.Fatalf("expected an error running a script, got %v", err)
+	}
+
+	// Scripts which failed didn't break those which follow.
+	if err := p.Add("after", `return Tenant == "after";`); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if ret, err := p.Run("after", Input{Tenant: "after"}); err != nil || !ret {
+		t.Fatalf("unexpected result: %v %v", ret, err)
+	}
+}
+
+// TestDecisionTable tests compiling decision tables into rules.
+func TestDecisionTable(t *testing.T) {
+
+	table := `
+# Comments, and extra columns, are ignored.
+Field,Operator,Value,Action,Notes
+Country,in,"UK, FR",europe,
+Age,>=,18,,adults only
+Country,==,US,america,
+Name,~*,^steve,steve,
+Address.City,==,"""007""",bond,
+Score,between,"1.5, 10",scored,
+Score,>,100,scored,
+`
+
+	e, err := NewDecisionTable(strings.NewReader(table))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if rules := strings.Join(e.Rules(), ","); rules != "europe,america,steve,bond,scored" {
+		t.Fatalf("unexpected rules: %s", rules)
+	}
+
+	type Address struct {
+		City string
+	}
+	type Person struct {
+		Name    string
+		Country string
+		Age     int
+		Score   float64
+		Address Address
+	}
+
+	tests := []struct {
+		Input  Person
+		Result string
+	}{
+		{Person{Country: "UK", Age: 18}, "europe"},
+		{Person{Country: "FR", Age: 17}, ""},
+		{Person{Country: "US", Age: 17, Name: "Steve Kemp"}, "america,steve"},
+		{Person{Name: "bob", Score: 1.5}, "scored"},
+		{Person{Score: 101, Address: Address{City: "007"}}, "bond,scored"},
+		{Person{Score: 50}, ""},
+	}
+
+	for _, tst := range tests {
+		matched, err := e.RunAll(tst.Input)
+		if err != nil {
+			t.Fatalf("unexpected error running against %v: %s", tst.Input, err)
+		}
+		if strings.Join(matched, ",") != tst.Result {
+			t.Fatalf("unexpected result for %v: %v", tst.Input, matched)
+		}
+	}
+
+	// The script may be inspected.
+	script, err := DecisionTable(strings.NewReader(`field,operator,value,action
+Name,==,"a ""b"" \","x""y"`))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !strings.Contains(script, `rule "x\"y" {`) || !strings.Contains(script, `return ( Name == "a \"b\" \\" );`) {
+		t.Fatalf("unexpected script: %s", script)
+	}
+
+	errors := []struct {
+		Table string
+		Error string
+	}{
+		{"", "is empty"},
+		{"field,operator,value", "no action column"},
+		{"field,operator,value,action\n", "no conditions"},
+		{"field,operator,value,action\nAge,>,1,", "no action"},
+		{"field,operator,value,action\nAge,=,1,x", "invalid operator"},
+		{"field,operator,value,action\n1Age,>,1,x", "invalid field"},
+		{"field,operator,value,action\nif,>,1,x", "invalid field"},
+		{"field,operator,value,action\nAge,>,1,x\nAge,between,1,x", "condition 2: between requires two values"},
+		{"field,operator,value,action\n\"Age,>,1,x", "quote"},
+	}
+	for _, tst := range errors {
+		_, err := DecisionTable(strings.NewReader(tst.Table))
+		if err == nil || !strings.Contains(err.Error(), tst.Error) {
+			t.Fatalf("expected an error containing '%s' for %q, got %v", tst.Error, tst.Table, err)
+		}
+	}
+}
+
+// TestSelectors tests JSONPath-style selectors.
+func TestSelectors(t *testing.T) {
+
+	obj := map[string]interface{}{
+		"request": map[string]interface{}{
+			"method":  "GET",
+			"headers": map[string]interface{}{"X-Forwarded-For": "10.0.0.1"},
+		},
+		"tags":         []string{"a", "b"},
+		"Content-Type": "text/plain",
+	}
+
+	tests := []string{
+		`return $.request.headers["X-Forwarded-For"] == "10.0.0.1";`,
+		`return $["request"]["method"] == "GET";`,
+		`return $['request'].headers['X-Forwarded-For'] ~= /^10\./;`,
+		`return $["Content-Type"] == "text/plain" && $.tags[1] == "b";`,
+		`return $.request.method.lower() == "get" && len($.tags) == 2;`,
+		`return request.method == "GET";`,
+	}
+
+	for _, tst := range tests {
+
+		e := New(tst, WithSelectors())
+		if err := e.Prepare(); err != nil {
+			t.Fatalf("unexpected error preparing %s: %s", tst, err)
+		}
+		ret, err := e.Run(obj)
+		if err != nil || !ret {
+			t.Fatalf("unexpected result running %s: %v %v", tst, ret, err)
+		}
+	}
+
+	// Without the option a selector refers to the variable "$".
+	e := New(`return $.request.method == "GET";`)
+	if err := e.Prepare(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if ret, _ := e.Run(obj); ret {
+		t.Fatalf("unexpected match without selectors")
+	}
+
+	// Selectors may be used in included scripts, and translated.
+	e = New(`include "x"; return ok;`, WithSelectors(), WithIncludeResolver(func(name string) (string, error) {
+		return `ok = $.request.method == "GET";`, nil
+	}))
+	if err := e.Prepare(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if ret, err := e.Run(obj); err != nil || !ret {
+		t.Fatalf("unexpected result: %v %v", ret, err)
+	}
+	where, _, err := New(`return $.Count > 3;`, WithSelectors()).SQL()
+	if err != nil || where != `"Count" > ?` {
+		t.Fatalf("unexpected translation: %s %v", where, err)
+	}
+
+	broken := []string{
+		`return $;`,
+		`return $.;`,
+		`return $[1] == 2;`,
+		`return $["a" == 2;`,
+	}
+	for _, tst := range broken {
+		e := New(tst, WithSelectors())
+		if err := e.Prepare(); err == nil {
+			t.Fatalf("expected an error preparing %s", tst)
+		}
+	}
+}
+
+// TestRunSlice tests running a script against many objects.
+func TestRunSlice(t *testing.T) {
+
+	type Event struct {
+		Name  string
+		Count int
+		Tags  []string
+	}
+
+	events := []Event{
+		{Name: "steve", Count: 3},
+		{Name: "bob", Count: 30},
+		{Name: "kemp", Count: 300, Tags: []string{"urgent"}},
+	}
+
+	obj := New(`return Count > 10 && Name != "kemp" || len(Tags) > 0;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+
+	expected := []bool{false, true, true}
+
+	// Slices of structures, pointers, and maps are all supported.
+	maps := []map[string]interface{}{
+		{"Name": "steve", "Count": 3, "Tags": []string{}},
+		{"Name": "bob", "Count": 30, "Tags": []string{}},
+		{"Name": "kemp", "Count": 300, "Tags": []string{"urgent"}},
+	}
+	pointers := []*Event{&events[0], &events[1], &events[2]}
+
+	for _, input := range []interface{}{events, pointers, maps, [3]Event{events[0], events[1], events[2]}} {
+		out, err := obj.RunSlice(input)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(out) != len(expected) {
+			t.Fatalf("unexpected number of results: %d", len(out))
+		}
+		for i := range out {
+			if out[i] != expected[i] {
+				t.Fatalf("unexpected result for %T %d", input, i)
+			}
+		}
+	}
+
+	// Errors identify the object which failed.
+	obj = New(`return 10 / Count > 1;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	_, err := obj.RunSlice([]Event{{Count: 1}, {Count: 0}})
+	if err == nil || !strings.Contains(err.Error(), "object 1") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Only slices are supported.
+	if _, err = obj.RunSlice(events[0]); err == nil {
+		t.Fatalf("expected an error running against a structure")
+	}
+}
+
+// TestPipe tests filtering a channel of objects.
+func TestPipe(t *testing.T) {
+
+	type Event struct {
+		ID   int
+		Name string
+	}
+
+	obj := New(`return Name ~= /^s/ && ID % 2 == 0;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+
+	in := make(chan interface{})
+	out := make(chan interface{}, 100)
+
+	go func() {
+		for i := 0; i < 100; i++ {
+			name := "steve"
+			if i%3 == 0 {
+				name = "bob"
+			}
+			in <- &Event{ID: i, Name: name}
+		}
+		close(in)
+	}()
+
+	err := obj.Pipe(context.Background(), in, out)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	close(out)
+
+	var ids []int
+	for ev := range out {
+		ids = append(ids, ev.(*Event).ID)
+	}
+	sort.Ints(ids)
+
+	var expected []int
+	for i := 0; i < 100; i++ {
+		if i%2 == 0 && i%3 != 0 {
+			expected = append(expected, i)
+		}
+	}
+	if fmt.Sprintf("%v", ids) != fmt.Sprintf("%v", expected) {
+		t.Fatalf("unexpected events: %v", ids)
+	}
+
+	// Errors stop the pipe.
+	obj = New(`return 10 / ID > 1;`)
+	if err = obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	in = make(chan interface{}, 2)
+	in <- &Event{ID: 0}
+	in <- &Event{ID: 1}
+	close(in)
+	err = obj.Pipe(context.Background(), in, make(chan interface{}, 2))
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	// As does cancellation.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = obj.Pipe(ctx, make(chan interface{}), out)
+	if err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The script must be prepared.
+	if New(`return true;`).Pipe(context.Background(), in, out) == nil {
+		t.Fatalf("expected an error from an unprepared script")
+	}
+}
+
+// TestRunParallel tests running a script against many objects concurrently.
+func TestRunParallel(t *testing.T) {
+
+	type Event struct {
+		ID   int
+		Name string
+	}
+
+	events := make([]Event, 1000)
+	for i := range events {
+		events[i] = Event{ID: i, Name: fmt.Sprintf("event%d", i)}
+	}
+
+	obj := New(`return ID % 3 == 0 && Name ~= /^event/;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+
+	for _, workers := range []int{0, 1, 7, 5000} {
+		out, err := obj.RunParallel(events, workers)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(out) != len(events) {
+			t.Fatalf("unexpected number of results: %d", len(out))
+		}
+		for i := range out {
+			if out[i] != (i%3 == 0) {
+				t.Fatalf("unexpected result for %d with %d workers", i, workers)
+			}
+		}
+	}
+
+	// Empty slices are fine.
+	out, err := obj.RunParallel([]Event{}, 4)
+	if err != nil || len(out) != 0 {
+		t.Fatalf("unexpected result for an empty slice: %v %v", out, err)
+	}
+
+	// The first failure is reported.
+	obj = New(`return 10 / (ID % 100) > 1;`)
+	if err = obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	_, err = obj.RunParallel(events[1:], 4)
+	if err == nil || !strings.Contains(err.Error(), "object 99:") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Only slices are supported.
+	if _, err = obj.RunParallel(events[0], 4); err == nil {
+		t.Fatalf("expected an error running against a structure")
+	}
+	if _, err = New(`return true;`).RunParallel(events, 4); err == nil {
+		t.Fatalf("expected an error from an unprepared script")
+	}
+}
+
+// TestNative tests that simple scripts are evaluated natively, with the
+// same results as the virtual machine.
+func TestNative(t *testing.T) {
+
+	type Inner struct {
+		Level int
+	}
+	type Input struct {
+		Inner
+		Name   string
+		Count  int
+		Price  float64
+		Size   uint8
+		Admin  bool
+		Ptr    *int
+		Tags   []string
+		Any    interface{}
+		secret string
+	}
+
+	n := 7
+	objects := []interface{}{
+		&Input{Inner: Inner{Level: 2}, Name: "steve", Count: 3, Price: 1.5, Size: 9, Admin: true, Ptr: &n, Any: 3, secret: "x"},
+		Input{Name: "bob", Count: -1, Price: 3},
+		map[string]interface{}{"Name": "steve", "Count": 3, "Price": 1.5, "Admin": false, "Level": int8(2)},
+		map[string]object.Object{"Name": &object.String{Value: "steve"}, "Count": object.NewInteger(3)},
+		map[string]string{"Name": "steve"},
+		nil,
+	}
+
+	tests := []struct {
+		Input  string
+		Native bool
+	}{
+		{`return Count > 2;`, true},
+		{`return Count == 3 && Name == "steve";`, true},
+		{`return Count >= 3.0 || Price < 2;`, true},
+		{`return $Count != -1 && Price != -1.5;`, true},
+		{`return Name < "c" || Name >= "steve";`, true},
+		{`return Admin;`, true},
+		{`return !Admin;`, true},
+		{`return !Count;`, true},
+		{`return Admin == true && Admin != false;`, true},
+		{`return Admin < true;`, true},
+		{`return Name == 3;`, true},
+		{`return Count && Price;`, true},
+		{`return Name || Name;`, true},
+		{`return Level == 2 && Size > 8;`, true},
+		{`return Ptr == 7 && Any == 3;`, true},
+		{`return secret == "x";`, true},
+		{`return Missing == 3;`, true},
+		{`return Tags == 3;`, true},
+		{`if ( Count == 3 ) { return true; } return false;`, true},
+		{`if ( Count == 3 ) { return false; } else { return true; }`, true},
+		{`if ( Name == "bob" ) { return true; } return Count > 1;`, false},
+		{`return Count + 1 > 3;`, false},
+		{`return Name ~= /steve/;`, false},
+		{`x = 3; return Count == x;`, false},
+		{`return len(Name) > 3;`, false},
+		{`return Count between 1 and 5;`, true},
+		{`return Name between "a" and "t" && Price between 1 and 2.0;`, true},
+		{`return Admin between false and true;`, true},
+		{`return Count between 1 and Count + 1;`, false},
+		{`return 0 <= Count < 5 && 1.0 < Price <= 2;`, true},
+	}
+
+	for _, tst := range tests {
+
+		native := New(tst.Input)
+		if err := native.Prepare(); err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, err)
+		}
+		if native.Stats().Native != tst.Native {
+			t.Fatalf("unexpected native flag for '%s'", tst.Input)
+		}
+
+		bytecode := New(tst.Input)
+		if err := bytecode.Prepare([]byte{NoOptimize}); err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, err)
+		}
+		if bytecode.Stats().Native {
+			t.Fatalf("NoOptimize didn't disable native evaluation of '%s'", tst.Input)
+		}
+
+		for i, obj := range objects {
+			r1, e1 := native.Run(obj)
+			r2, e2 := bytecode.Run(obj)
+			if r1 != r2 || (e1 == nil) != (e2 == nil) {
+				t.Fatalf("different results running '%s' against object %d: %v %v, %v %v", tst.Input, i, r1, e1, r2, e2)
+			}
+		}
+	}
+
+	// Variables take precedence over fields.
+	obj := New(`return Count == 3;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	obj.SetVariable("Count", object.NewInteger(4))
+	ret, err := obj.Run(objects[0])
+	if err != nil || ret {
+		t.Fatalf("variable didn't take precedence: %v %v", ret, err)
+	}
+}
+
+// TestFused tests that the instructions the optimizer fuses together
+// behave in the same way as the instructions they replace.
+func TestFused(t *testing.T) {
+
+	type Input struct {
+		Name  string
+		Count int
+		Price float64
+		Admin bool
+	}
+
+	objects := []interface{}{
+		&Input{Name: "steve", Count: 3, Price: 3, Admin: true},
+		&Input{Name: "bob", Count: 4, Price: 1.5},
+		map[string]interface{}{"Name": 3, "Count": "3"},
+		nil,
+	}
+
+	tests := []struct {
+		Input string
+		Fused bool
+	}{
+		{`if ( Name == "steve" ) { return true; } return len(Name) > 3;`, true},
+		{`if ( Count == 3 ) { return true; } return len(Name) > 3;`, true},
+		{`if ( Price == 3 ) { return true; } return len(Name) > 3;`, true},
+		{`if ( Price == 1.5 ) { return true; } return len(Name) > 3;`, true},
+		{`if ( Admin == true ) { return true; } return len(Name) > 3;`, false},
+		{`if ( Count == 4 ) { Count = 5; } return Count == 5 || len(Name) > 4;`, true},
+		{`x = 0; while ( Count == 3 ) { x++; Count = x; } return x == 1;`, true},
+		{`if ( catch(Name == "steve", false) ) { return true; } return len(Name) > 3;`, false},
+		{`if ( Name != "steve" ) { return true; } return len(Name) > 3;`, false},
+	}
+
+	for _, tst := range tests {
+
+		fused := New(tst.Input)
+		if err := fused.Prepare(); err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, err)
+		}
+		found := false
+		ins := fused.Bytecode()
+		for ip := 0; ip < len(ins); ip += code.Length(code.Opcode(ins[ip])) {
+			if code.Opcode(ins[ip]) == code.OpLookupConstantEqual {
+				found = true
+			}
+		}
+		if found != tst.Fused {
+			t.Fatalf("unexpected fusing of '%s'", tst.Input)
+		}
+
+		plain := New(tst.Input)
+		if err := plain.Prepare([]byte{NoOptimize}); err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, err)
+		}
+
+		for i, obj := range objects {
+			r1, e1 := fused.Run(obj)
+			r2, e2 := plain.Run(obj)
+			if r1 != r2 || (e1 == nil) != (e2 == nil) {
+				t.Fatalf("different results running '%s' against object %d: %v %v, %v %v", tst.Input, i, r1, e1, r2, e2)
+			}
+		}
+	}
+}
+
+// TestJumpThreading tests that jumps go directly to their destination,
+// and that code which can't be reached is removed.
+func TestJumpThreading(t *testing.T) {
+
+	type Input struct {
+		Name  string
+		Count int
+	}
+
+	objects := []interface{}{
+		&Input{Name: "a", Count: 1},
+		&Input{Name: "b", Count: 2},
+		&Input{Name: "c", Count: 3},
+		&Input{Name: "d", Count: 5},
+		nil,
+	}
+
+	tests := []struct {
+		Input string
+		Jumps int
+	}{
+		{`if ( Name == "a" ) { return true; } else { if ( Name == "b" ) { return false; } else { return Count > 2; } }`, 0},
+		{`if ( Count > 1 ) { if ( Count > 2 ) { x = 1; } else { x = 2; } } else { x = 3; } return x == 2;`, 2},
+		{`if ( Count > 1 ) { if ( Count > 2 ) { x = 1; } } else { x = 3; } return x == 1;`, 1},
+		{`i = 0; while ( i < Count ) { if ( i > 2 ) { return true; } else { i++; } } return false;`, 1},
+		{`if ( Count > 1 ) { x = 1; } else { return false; } return x == 1;`, 1},
+	}
+
+	for _, tst := range tests {
+
+		threaded := New(tst.Input)
+		if err := threaded.Prepare(); err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, err)
+		}
+
+		// Count the unconditional jumps, none of which may go to
+		// another jump, or to a return.
+		jumps := 0
+		ins := threaded.Bytecode()
+		for ip := 0; ip < len(ins); ip += code.Length(code.Opcode(ins[ip])) {
+			if code.Opcode(ins[ip]) != code.OpJump {
+				continue
+			}
+			jumps++
+
+			dst := int(binary.BigEndian.Uint16(ins[ip+1 : ip+3]))
+			if dst < len(ins) && (code.Opcode(ins[dst]) == code.OpJump || code.Opcode(ins[dst]) == code.OpReturn) {
+				t.Fatalf("jump at %d in '%s' wasn't threaded", ip, tst.Input)
+			}
+		}
+		if jumps != tst.Jumps {
+			t.Fatalf("unexpected jumps in '%s': %d", tst.Input, jumps)
+		}
+
+		plain := New(tst.Input)
+		if err := plain.Prepare([]byte{NoOptimize}); err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, err)
+		}
+		for i, obj := range objects {
+			r1, e1 := threaded.Run(obj)
+			r2, e2 := plain.Run(obj)
+			if r1 != r2 || (e1 == nil) != (e2 == nil) {
+				t.Fatalf("different results running '%s' against object %d: %v %v, %v %v", tst.Input, i, r1, e1, r2, e2)
+			}
+		}
+	}
+}
+
+// TestFunctionSlots tests that calls to built-in functions are resolved
+// at compile-time, unless a variable might override them.
+func TestFunctionSlots(t *testing.T) {
+
+	resolved := func(e *Eval) bool {
+		ins := e.Bytecode()
+		for ip := 0; ip < len(ins); ip += code.Length(code.Opcode(ins[ip])) {
+			if code.Opcode(ins[ip]) == code.OpCallBuiltin {
+				return true
+			}
+		}
+		return false
+	}
+
+	tests := []struct {
+		Input    string
+		Resolved bool
+	}{
+		{`return upper(Name) == "STEVE";`, true},
+		{`if ( len(Name) == 5 ) { print(""); return true; } return false;`, true},
+		{`len = x => 5; return len(Name) == 5;`, false},
+		{`let len = x => 5; return len(Name) == 5;`, false},
+		{`f = len => len(3); return f(x => 5) == 5;`, false},
+		{`return custom(Name) == 5;`, true},
+	}
+
+	for _, tst := range tests {
+
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+			obj.AddFunction("custom", func(args []object.Object) object.Object {
+				return object.NewInteger(5)
+			})
+			if err := obj.Prepare(flags); err != nil {
+				t.Fatalf("Failed to compile '%s': %s", tst.Input, err)
+			}
+			if resolved(obj) != tst.Resolved {
+				t.Fatalf("unexpected resolution of '%s'", tst.Input)
+			}
+
+			ret, err := obj.Run(map[string]interface{}{"Name": "steve"})
+			if err != nil {
+				t.Fatalf("Failed to run '%s': %s", tst.Input, err)
+			}
+			if !ret {
+				t.Fatalf("unexpected result running '%s'", tst.Input)
+			}
+		}
+	}
+
+	// Functions which are replaced after compilation are used.
+	obj := New(`return len(Name) == 7;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	obj.AddFunction("len", func(args []object.Object) object.Object {
+		return object.NewInteger(7)
+	})
+	ret, err := obj.Run(map[string]interface{}{"Name": "steve"})
+	if err != nil || !ret {
+		t.Fatalf("replaced function wasn't used: %v %v", ret, err)
+	}
+
+	// As are functions which are added after compilation.
+	obj = New(`return later(Name) == 7;`)
+	if err = obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	obj.AddFunction("later", func(args []object.Object) object.Object {
+		return object.NewInteger(7)
+	})
+	ret, err = obj.Run(map[string]interface{}{"Name": "steve"})
+	if err != nil || !ret {
+		t.Fatalf("added function wasn't used: %v %v", ret, err)
+	}
+
+	// A host variable holding a lambda prevents resolution.
+	lambda := New(`double = x => x * 2; return true;`, WithPersistentState())
+	if err = lambda.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if _, err = lambda.Run(nil); err != nil {
+		t.Fatalf("Failed to run: %s", err)
+	}
+	obj = New(`return len(3) == 6;`)
+	obj.SetVariable("len", lambda.GetVariable("double"))
+	if err = obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if resolved(obj) {
+		t.Fatalf("call to a variable was resolved")
+	}
+	ret, err = obj.Run(nil)
+	if err != nil || !ret {
+		t.Fatalf("lambda variable wasn't used: %v %v", ret, err)
+	}
+}
+
+// TestRegisterOpcode tests that embedders may implement opcodes of their
+// own.
+func TestRegisterOpcode(t *testing.T) {
+
+	// Our own opcodes may not be replaced.
+	err := vm.RegisterOpcode(code.OpAdd, nil)
+	if err == nil {
+		t.Fatalf("expected an error replacing OpAdd")
+	}
+
+	// An opcode which doubles the 16-bit argument it is given.
+	double := code.OpFinal + 10
+	err = vm.RegisterOpcode(double, func(machine *vm.VM, obj interface{}, ip int) (int, object.Object, error) {
+		machine.Push(object.NewInteger(int64(machine.Operand(ip, 0) * 2)))
+		return ip + 3, nil, nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error registering an opcode: %s", err)
+	}
+
+	bytecode := code.Instructions{
+		byte(double), 0, 21,
+		byte(code.OpReturn),
+	}
+
+	machine := vm.New(nil, bytecode, environment.New())
+	out, err := machine.Run(nil)
+	if err != nil {
+		t.Fatalf("unexpected error running: %s", err)
+	}
+	if out.Inspect() != "42" {
+		t.Fatalf("unexpected result: %s", out.Inspect())
+	}
+
+	// Opcodes which haven't been registered are reported.
+	bytecode = code.Instructions{
+		byte(code.OpFinal + 11),
+		byte(code.OpTrue),
+		byte(code.OpReturn),
+	}
+
+	machine = vm.New(nil, bytecode, environment.New())
+	_, err = machine.Run(nil)
+	if err == nil || !strings.Contains(err.Error(), "unhandled opcode") {
+		t.Fatalf("expected an error running an unknown opcode, got %v", err)
+	}
+}
+
+// TestIterators tests iterating over collections via bytecode.
+func TestIterators(t *testing.T) {
+
+	constants := []object.Object{
+		&object.String{Value: "v"},
+		&object.String{Value: "k"},
+		&object.String{Value: "total"},
+		&object.String{Value: "Items"},
+	}
+
+	// total = 0; for ( k, v in Items ) { total = total + v; }
+	bytecode := code.Instructions{
+		byte(code.OpPush), 0, 0,
+		byte(code.OpConstant), 0, 2,
+		byte(code.OpSet),
+		byte(code.OpLookup), 0, 3,
+		byte(code.OpIterNew),
+		byte(code.OpIterNext), 0, 36,
+		byte(code.OpConstant), 0, 0,
+		byte(code.OpSet),
+		byte(code.OpConstant), 0, 1,
+		byte(code.OpSet),
+		byte(code.OpLookup), 0, 2,
+		byte(code.OpLookup), 0, 0,
+		byte(code.OpAdd),
+		byte(code.OpConstant), 0, 2,
+		byte(code.OpSet),
+		byte(code.OpJump), 0, 11,
+		byte(code.OpIterDone),
+		byte(code.OpLookup), 0, 2,
+		byte(code.OpReturn),
+	}
+
+	tests := []struct {
+		Items interface{}
+		Total string
+		Key   string
+		Error string
+	}{
+		{Items: []int{1, 2, 3}, Total: "6", Key: "2"},
+		{Items: []int{}, Total: "0"},
+		{Items: map[string]interface{}{"a": 10, "b": 20}, Total: "30", Key: "b"},
+		{Items: 3, Error: "cannot iterate over INTEGER"},
+	}
+
+	for _, tst := range tests {
+
+		env := environment.New()
+		machine := vm.New(constants, bytecode, env)
+		machine.SetPersistent(true)
+		out, err := machine.Run(map[string]interface{}{"Items": tst.Items})
+		if tst.Error != "" {
+			if err == nil || !strings.Contains(err.Error(), tst.Error) {
+				t.Fatalf("expected error '%s' for %v, got %v", tst.Error, tst.Items, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error for %v: %s", tst.Items, err)
+		}
+		if out.Inspect() != tst.Total {
+			t.Fatalf("unexpected total for %v: %s", tst.Items, out.Inspect())
+		}
+		key, ok := env.Get("k")
+		if (ok && key.Inspect() != tst.Key) || (!ok && tst.Key != "") {
+			t.Fatalf("unexpected final key for %v: %v", tst.Items, key)
+		}
+	}
+
+	// The iterator, key, value, and name of a variable are on the
+	// stack at once.
+	if total, depth := measure(bytecode); total != 19 || depth != 4 {
+		t.Fatalf("unexpected measurements: %d %d", total, depth)
+	}
+}
+
+// TestRegexpLiterals tests that regular expression literals are compiled
+// when the script is prepared.
+func TestRegexpLiterals(t *testing.T) {
+
+	obj := New(`x = "steve"; return Name ~= /steve/i && Name ~= x && Name !~ /^bob$/;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+
+	compiled := 0
+	for _, c := range obj.constants {
+		if str, ok := c.(*object.String); ok && str.Regexp != nil {
+			compiled++
+		}
+	}
+	if compiled != 2 {
+		t.Fatalf("unexpected number of compiled regexps: %d", compiled)
+	}
+
+	ret, err := obj.Run(map[string]interface{}{"Name": "Steve"})
+	if err != nil || ret {
+		t.Fatalf("expected a case-sensitive match to fail, got %v %v", ret, err)
+	}
+	ret, err = obj.Run(map[string]interface{}{"Name": "steve"})
+	if err != nil || !ret {
+		t.Fatalf("unexpected result: %v %v", ret, err)
+	}
+}
+
+// TestSeedRegexps tests that regular expressions may be compiled ahead
+// of time.
+func TestSeedRegexps(t *testing.T) {
+
+	obj := New(`return Name ~= Pattern;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if err := obj.SeedRegexps("^st", "+"); err == nil {
+		t.Fatalf("expected an error seeding an invalid regexp")
+	}
+	if err := obj.SeedRegexps("^st", "eve$"); err != nil {
+		t.Fatalf("unexpected error seeding: %s", err)
+	}
+
+	ret, err := obj.Run(map[string]interface{}{"Name": "steve", "Pattern": "^st"})
+	if err != nil || !ret {
+		t.Fatalf("unexpected result: %v %v", ret, err)
+	}
+
+	obj.FlushRegexps()
+	ret, err = obj.Run(map[string]interface{}{"Name": "steve", "Pattern": "eve$"})
+	if err != nil || !ret {
+		t.Fatalf("unexpected result: %v %v", ret, err)
+	}
+
+	// Evaluators may match concurrently.
+	objs := make([]interface{}, 200)
+	for i := range objs {
+		objs[i] = map[string]interface{}{"Name": fmt.Sprintf("steve%d", i), "Pattern": fmt.Sprintf("^steve%d$", i%7)}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err = obj.RunParallel(objs, 4); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+}
+
+// TestBetween tests our range-test operator.
+func TestBetween(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result bool
+		Error  bool
+	}
+
+	tests := []Test{
+		{Input: `return Port between 1024 and 65535;`, Result: true},
+		{Input: `return Port between 1024 and 8080;`, Result: true},
+		{Input: `return Port between 8080 and 8080;`, Result: true},
+		{Input: `return Port between 8081 and 9000;`, Result: false},
+		{Input: `return Port between 1 and 80;`, Result: false},
+		{Input: `return Port between 8000.5 and 10000.0;`, Result: true},
+		{Input: `return Port between 1 + 2 * 3 and Port + 1 && Name == "web";`, Result: true},
+		{Input: `return !(Port between 1 and 1023);`, Result: true},
+		{Input: `return Name between "a" and "x";`, Result: true},
+		{Input: `and = 3; return and between 1 and and + 1;`, Result: true},
+		{Input: `if ( Port between 1024 and 65535 ) { return true; } return false;`, Result: true},
+		{Input: `return Port between 1 and 80 || Port between 8000 and 9000;`, Result: true},
+
+		// The upper bound isn't consulted if the lower fails.
+		{Input: `return Port between 9000 and "x";`, Result: false},
+		{Input: `return Port between 1 and "x";`, Error: true},
+		{Input: `return Name between 1 and 2;`, Error: true},
+		{Input: `return true between false and true;`, Error: true},
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst.Input)
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, err)
+		}
+
+		ret, err := obj.Run(map[string]interface{}{"Port": 8080, "Name": "web"})
+		if tst.Error {
+			if err == nil {
+				t.Fatalf("expected an error running '%s'", tst.Input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error running '%s': %s", tst.Input, err)
+		}
+		if ret != tst.Result {
+			t.Fatalf("unexpected result running '%s': %v", tst.Input, ret)
+		}
+	}
+
+	// The bounds must be separated by "and".
+	for _, input := range []string{`return Port between 1;`, `return Port between 1 && 2;`, `return Port between 1, 2;`} {
+		obj := New(input)
+		if err := obj.Prepare(); err == nil {
+			t.Fatalf("expected an error compiling '%s'", input)
+		}
+	}
+}
+
+// TestIn tests the `in` operator, and sets supplied by the host.
+func TestIn(t *testing.T) {
+
+	ids := make([]string, 100000)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("%d", i*2)
+	}
+
+	type Test struct {
+		Input  string
+		Result bool
+		Error  bool
+	}
+
+	tests := []Test{
+		{Input: `return ID in Blocked;`, Result: true},
+		{Input: `return ID + 1 in Blocked;`, Result: false},
+		{Input: `return "1234" in Blocked && !("x" in Blocked);`, Result: true},
+		{Input: `return len(Blocked) == 100000 && type(Blocked) == "set";`, Result: true},
+		{Input: `return contains(Blocked, 8) && Blocked.contains("8");`, Result: true},
+		{Input: `return Name in ["steve", "bob"] && !(3 in ["3"]);`, Result: true},
+		{Input: `return "ev" in Name && "job" in Labels && !("age" in Labels);`, Result: true},
+		{Input: `if ( ID in Blocked ) { return true; } return false;`, Result: true},
+		{Input: `return ID in Blocked == true;`, Result: true},
+		{Input: `return 2.0 in [1, 2] && 2 in [1.0, 2.0] && 1.5 != 1;`, Result: true},
+		{Input: `return 1234.0 in Blocked && !(ID in [true, "1234"]);`, Result: true},
+		{Input: `return !(Labels in Blocked) && !([1] in Labels) && has_key(Labels, "job");`, Result: true},
+		{Input: `return ID in 3;`, Error: true},
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst.Input)
+		obj.SetVariable("Blocked", object.NewSet(ids))
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, err)
+		}
+
+		ret, err := obj.Run(map[string]interface{}{"ID": 1234, "Name": "steve", "Labels": map[string]string{"job": "safety"}})
+		if tst.Error {
+			if err == nil {
+				t.Fatalf("expected an error running '%s'", tst.Input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error running '%s': %s", tst.Input, err)
+		}
+		if ret != tst.Result {
+			t.Fatalf("unexpected result running '%s': %v", tst.Input, ret)
+		}
+	}
+}
+
+// TestDeepEquality tests comparing arrays, and hashes, with `==`.
+func TestDeepEquality(t *testing.T) {
+
+	type Address struct {
+		City string
+	}
+
+	obj := map[string]interface{}{
+		"Tags":    []string{"a", "b"},
+		"Counts":  []int{1, 2},
+		"Home":    Address{City: "Helsinki"},
+		"Work":    Address{City: "Helsinki"},
+		"Holiday": Address{City: "Tallinn"},
+	}
+
+	tests := []struct {
+		Input  string
+		Result bool
+		Error  bool
+	}{
+		{Input: `return [1, 2] == [1, 2];`, Result: true},
+		{Input: `return [1, 2] != [2, 1];`, Result: true},
+		{Input: `return [1, [2, "x"]] == [1.0, [2, "x"]];`, Result: true},
+		{Input: `return [] == [] && [1] != [];`, Result: true},
+		{Input: `return Tags == ["a", "b"] && Counts == [1, 2];`, Result: true},
+		{Input: `return Tags == Counts;`, Result: false},
+		{Input: `return Home == Work && Home != Holiday;`, Result: true},
+		{Input: `return ["a", "b"] in [Tags, Counts] && !([1] in [Counts]);`, Result: true},
+		{Input: `return Tags == "a";`, Error: true},
+		{Input: `return Home == Tags;`, Error: true},
+		{Input: `return [1] < [2];`, Error: true},
+	}
+
+	for _, tst := range tests {
+
+		e := New(tst.Input)
+		if err := e.Prepare(); err != nil {
+			t.Fatalf("failed to compile '%s': %s", tst.Input, err)
+		}
+
+		ret, err := e.Run(obj)
+		if tst.Error {
+			if err == nil {
+				t.Fatalf("expected an error running '%s'", tst.Input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error running '%s': %s", tst.Input, err)
+		}
+		if ret != tst.Result {
+			t.Fatalf("unexpected result running '%s': %v", tst.Input, ret)
+		}
+	}
+}
+
+// TestArrayArithmetic tests concatenating, repeating, and subtracting
+// arrays.
+func TestArrayArithmetic(t *testing.T) {
+
+	obj := map[string]interface{}{
+		"Tags":    []string{"a", "b", "c"},
+		"Removed": []string{"b"},
+		"Count":   2,
+	}
+
+	tests := []struct {
+		Input  string
+		Result bool
+		Error  bool
+	}{
+		{Input: `return [1, 2] + [3] == [1, 2, 3];`, Result: true},
+		{Input: `return [] + [] == [] && Tags + [] == Tags;`, Result: true},
+		{Input: `return len(Tags + Removed) == 4 && len(Tags) == 3;`, Result: true},
+		{Input: `return [1, "x"] * 2 == [1, "x", 1, "x"] && 3 * [0] == [0, 0, 0];`, Result: true},
+		{Input: `return Removed * Count == ["b", "b"] && [1] * 0 == [];`, Result: true},
+		{Input: `return Tags - Removed == ["a", "c"] && Tags - Tags == [];`, Result: true},
+		{Input: `return [1, 2.0, 3, 1] - [1.0, [2]] == [2.0, 3];`, Result: true},
+		{Input: `x = ["a"]; x += ["b"]; x *= 2; return x == ["a", "b", "a", "b"];`, Result: true},
+		{Input: `return [1] * -1;`, Error: true},
+		{Input: `return [1, 2] * 10000000000;`, Error: true},
+		{Input: `return [] * 9223372036854775807 == [];`, Result: true},
+		{Input: `return [1] * 1.5;`, Error: true},
+		{Input: `return [1] * [2];`, Error: true},
+		{Input: `return [1] + 2;`, Error: true},
+		{Input: `return [1] / [1];`, Error: true},
+	}
+
+	for _, tst := range tests {
+
+		e := New(tst.Input)
+		if err := e.Prepare(); err != nil {
+			t.Fatalf("failed to compile '%s': %s", tst.Input, err)
+		}
+
+		ret, err := e.Run(obj)
+		if tst.Error {
+			if err == nil {
+				t.Fatalf("expected an error running '%s'", tst.Input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error running '%s': %s", tst.Input, err)
+		}
+		if ret != tst.Result {
+			t.Fatalf("unexpected result running '%s': %v", tst.Input, ret)
+		}
+	}
+}
+
+// TestStringRepetition tests repeating strings with `*`.
+func TestStringRepetition(t *testing.T) {
+
+	tests := []struct {
+		Input  string
+		Result bool
+		Error  bool
+	}{
+		{Input: `return "-" * 3 == "---" && 2 * "ab" == "abab";`, Result: true},
+		{Input: `return "x" * 0 == "" && "" * 1000 == "";`, Result: true},
+		{Input: `return Name * Count == "bobbob";`, Result: true},
+		{Input: `return lpad(string(Count), 3, "0") + rpad(Name, 5, ".") == "002bob..";`, Result: true},
+		{Input: `return "x" * -1;`, Error: true},
+		{Input: `return "abc" * 100000000;`, Error: true},
+		{Input: `return "x" * 1.5;`, Error: true},
+		{Input: `return "x" - 1;`, Error: true},
+	}
+
+	for _, tst := range tests {
+
+		e := New(tst.Input)
+		if err := e.Prepare(); err != nil {
+			t.Fatalf("failed to compile '%s': %s", tst.Input, err)
+		}
+
+		ret, err := e.Run(map[string]interface{}{"Name": "bob", "Count": 2})
+		if tst.Error {
+			if err == nil {
+				t.Fatalf("expected an error running '%s'", tst.Input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error running '%s': %s", tst.Input, err)
+		}
+		if ret != tst.Result {
+			t.Fatalf("unexpected result running '%s': %v", tst.Input, ret)
+		}
+	}
+}
+
+// TestChainedComparisons tests that comparisons may be chained.
+func TestChainedComparisons(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result bool
+	}
+
+	tests := []Test{
+		{Input: `return 0 <= Score <= 100;`, Result: true},
+		{Input: `return 0 <= Score < 50;`, Result: false},
+		{Input: `return 100 >= Score > 49;`, Result: true},
+		{Input: `return 1 < 2 < Score < 51 <= 51;`, Result: true},
+		{Input: `return 1 < 2 < Score < 50 <= 51;`, Result: false},
+		{Input: `return 3 > 2 > 1;`, Result: true},
+		{Input: `return "a" < Name <= "z";`, Result: true},
+		{Input: `return 0 <= Score + 50 <= 100;`, Result: true},
+		{Input: `return 0 <= Score <= 100 && Name == "steve";`, Result: true},
+		{Input: `return 0 <= Score <= 10 || Name == "steve";`, Result: true},
+		{Input: `if ( 0 < Score <= 100 ) { return true; } return false;`, Result: true},
+		{Input: `return (1 < 2) == (2 < 3);`, Result: true},
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst.Input)
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, err)
+		}
+
+		ret, err := obj.Run(map[string]interface{}{"Score": 50, "Name": "steve"})
+		if err != nil {
+			t.Fatalf("unexpected error running '%s': %s", tst.Input, err)
+		}
+		if ret != tst.Result {
+			t.Fatalf("unexpected result running '%s': %v", tst.Input, ret)
+		}
+	}
+
+	// Grouping a comparison stops it from being chained, so this
+	// compares a boolean with an integer.
+	obj := New(`return (0 <= Score) <= 100;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if _, err := obj.Run(map[string]interface{}{"Score": 50}); err == nil {
+		t.Fatalf("expected an error comparing a boolean with an integer")
+	}
+
+	// Missing operands are reported.
+	obj = New(`return 0 <= Score <= ;`)
+	if err := obj.Prepare(); err == nil {
+		t.Fatalf("expected an error compiling an incomplete chain")
+	}
+}
+
+// TestUnicodeStrings tests that strings are handled as characters,
+// rather than bytes.
+func TestUnicodeStrings(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result bool
+	}
+
+	tests := []Test{
+		{Input: `return len(Name) == 6 && Name[0] == "J" && Name[2] == "r" && Name[5] == "n";`, Result: true},
+		{Input: `return Name[1] == "ü";`, Result: true},
+		{Input: `return type(Name[6]) == "null" && type(Name[-1]) == "null";`, Result: true},
+		{Input: `return "日本語"[1] == "本" && type("日本語"[3]) == "null";`, Result: true},
+		{Input: `return Decomposed == Name;`, Result: false},
+		{Input: `return normalize(Decomposed) == Name;`, Result: true},
+		{Input: `return normalize(Name, "NFD") == Decomposed;`, Result: true},
+		{Input: `return normalize("ﬁ", "nfkc") == "fi";`, Result: true},
+		{Input: `return fold(City) == fold("STRASSE");`, Result: true},
+		{Input: `return lower(City) == lower("STRASSE");`, Result: false},
+		{Input: `return Name.normalize().fold() == "jürgen";`, Result: true},
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst.Input)
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, err)
+		}
+
+		ret, err := obj.Run(map[string]interface{}{"Name": "Jürgen", "Decomposed": "Ju\u0308rgen", "City": "Straße"})
+		if err != nil {
+			t.Fatalf("unexpected error running '%s': %s", tst.Input, err)
+		}
+		if ret != tst.Result {
+			t.Fatalf("unexpected result running '%s': %v", tst.Input, ret)
+		}
+	}
+}
+
+// TestLogger tests that scripts may log messages via the host.
+func TestLogger(t *testing.T) {
+
+	obj := New(`
+if ( Count > 2 ) {
+   log("warn", "count is high", Count, Name);
+   return true;
+}
+log("debug", "count is fine");
+return false;
+`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+
+	// Running without a logger is fine.
+	if _, err := obj.Run(map[string]interface{}{"Count": 3, "Name": "steve"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var mutex sync.Mutex
+	var messages []string
+	obj.SetLogger(func(level string, message string, values []object.Object) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, v := range values {
+			message += " " + v.Inspect()
+		}
+		messages = append(messages, level+": "+message)
+	})
+
+	if _, err := obj.Run(map[string]interface{}{"Count": 3, "Name": "steve"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(messages) != 1 || messages[0] != "warn: count is high 3 steve" {
+		t.Fatalf("unexpected messages: %v", messages)
+	}
+
+	// Clones share the logger.
+	messages = nil
+	objs := []interface{}{
+		map[string]interface{}{"Count": 1},
+		map[string]interface{}{"Count": 2},
+		map[string]interface{}{"Count": 3},
+	}
+	if _, err := obj.RunParallel(objs, 2); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(messages) != 3 {
+		t.Fatalf("unexpected messages: %v", messages)
+	}
+
+	// Invalid levels are errors.
+	obj = New(`log("loud", "hello"); return true;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if _, err := obj.Run(nil); err == nil {
+		t.Fatalf("expected an error logging at an unknown level")
+	}
+}
+
+// TestAssert tests our assert function.
+func TestAssert(t *testing.T) {
+
+	obj := New(`assert(Count > 1, "count is too low"); return true;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if ret, err := obj.Run(map[string]interface{}{"Count": 2}); err != nil || !ret {
+		t.Fatalf("unexpected result: %v %v", ret, err)
+	}
+
+	_, err := obj.Run(map[string]interface{}{"Count": 1})
+	if err == nil || err.Error() != "count is too low" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e, ok := err.(*object.Error); !ok || e.Kind != object.AssertionError {
+		t.Fatalf("unexpected error kind: %v", err)
+	}
+
+	// Failed assertions may be caught.
+	obj = New(`return catch(assert(false), false) == false;`)
+	if err = obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if ret, err := obj.Run(nil); err != nil || !ret {
+		t.Fatalf("unexpected result: %v %v", ret, err)
+	}
+}
+
+// TestScriptTests tests running the tests a script defines.
+func TestScriptTests(t *testing.T) {
+
+	script := `
+rule "admin" { return Name == "root"; }
+
+test "high counts match" {
+  if ( Count > 3 ) {
+    assert(result, "expected a match");
+  }
+}
+
+test "roots are admins" {
+  assert(Name != "root" || rules.contains("admin"), "expected the admin rule");
+}
+
+test "counts are small" {
+  return Count < 10;
+}
+
+return Count > 3;
+`
+	type Input struct {
+		Name  string
+		Count int
+	}
+	fixtures := []Input{
+		{Name: "root", Count: 4},
+		{Name: "steve", Count: 12},
+	}
+
+	results, err := TestScript(script, fixtures)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(results) != 6 {
+		t.Fatalf("unexpected number of results: %d", len(results))
+	}
+
+	failed := 0
+	for _, r := range results {
+		if !r.Passed() {
+			failed++
+			if r.Name != "counts are small" || r.Fixture != 1 {
+				t.Fatalf("unexpected failure of %s against %d: %s", r.Name, r.Fixture, r.Err)
+			}
+		}
+	}
+	if failed != 1 {
+		t.Fatalf("unexpected number of failures: %d", failed)
+	}
+
+	// Tests don't affect the running of the script.
+	obj := New(script)
+	if err = obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if !obj.Stats().Native {
+		t.Fatalf("expected the script to be evaluated natively")
+	}
+	ret, err := obj.Run(fixtures[1])
+	if err != nil || !ret {
+		t.Fatalf("unexpected result: %v %v", ret, err)
+	}
+
+	// Failed assertions are reported.
+	results, err = TestScript(`return true; test "fails" { assert(Count == 3, "wrong count"); }`, []map[string]interface{}{{"Count": 4}})
+	if err != nil || len(results) != 1 || results[0].Passed() || results[0].Err.Error() != "wrong count" {
+		t.Fatalf("unexpected results: %v %v", results, err)
+	}
+
+	// Errors running the script fail each test.
+	results, err = TestScript(`return Name > 3; test "a" { } test "b" { }`, []map[string]interface{}{{"Name": "x"}})
+	if err != nil || len(results) != 2 || results[0].Passed() || results[1].Passed() {
+		t.Fatalf("unexpected results: %v %v", results, err)
+	}
+
+	// "test" remains usable as a variable.
+	results, err = TestScript(`test = 3; test += 1; return test == 4; test "x" { assert(result); }`, []int{1})
+	if err != nil || len(results) != 1 || !results[0].Passed() {
+		t.Fatalf("unexpected results: %v %v", results, err)
+	}
+
+	// Errors
+	bad := []string{
+		`return true; test "a" { } test "a" { }`,
+		`if ( true ) { test "a" { } } return true;`,
+		`return true; test "a" { `,
+	}
+	for _, script := range bad {
+		if _, err = TestScript(script, []int{1}); err == nil {
+			t.Fatalf("expected an error compiling '%s'", script)
+		}
+	}
+	if _, err = TestScript(`return true;`, 3); err == nil {
+		t.Fatalf("expected an error with invalid fixtures")
+	}
+	if _, err = New(`return true;`).RunTests([]int{1}); err == nil {
+		t.Fatalf("expected an error running tests of an unprepared script")
+	}
+}
+
+// TestCoverage tests the reporting of statement and branch coverage.
+func TestCoverage(t *testing.T) {
+
+	script := `
+if ( Count > 3 ) {
+  print("big");
+}
+x = 0;
+while ( x < Count ) {
+  x++;
+}
+return Count > 2;
+
+rule "small" {
+  if ( Count < 2 ) { return true; } else { return false; }
+}
+`
+	obj := New(script, WithCoverage())
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if obj.Stats().Native {
+		t.Fatalf("an instrumented script should not be evaluated natively")
+	}
+
+	// Nothing has been reached yet.
+	covered, total := obj.Coverage().Statements()
+	if covered != 0 || total != 9 {
+		t.Fatalf("unexpected statement coverage: %d/%d", covered, total)
+	}
+	covered, total = obj.Coverage().Branches()
+	if covered != 0 || total != 5 {
+		t.Fatalf("unexpected branch coverage: %d/%d", covered, total)
+	}
+
+	type Input struct {
+		Count int
+	}
+
+	if _, err := obj.Run(Input{Count: 0}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	report := obj.Coverage()
+	covered, total = report.Statements()
+	if covered != 4 || total != 9 {
+		t.Fatalf("unexpected statement coverage: %d/%d", covered, total)
+	}
+	covered, _ = report.Branches()
+	if covered != 1 {
+		t.Fatalf("unexpected branch coverage: %d\n%s", covered, report)
+	}
+	if !strings.Contains(report.String(), "not reached: line 3 statement") ||
+		!strings.Contains(report.String(), "not reached: line 2 then") ||
+		!strings.Contains(report.String(), "not reached: line 12 statement (rule small)") {
+		t.Fatalf("unexpected report:\n%s", report)
+	}
+
+	// Coverage accumulates over runs, including parallel ones.
+	if _, err := obj.RunAll(Input{Count: 1}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := obj.RunParallel([]Input{{Count: 4}, {Count: 5}, {Count: 6}}, 2); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	report = obj.Coverage()
+	covered, _ = report.Statements()
+	if covered != 8 || !strings.Contains(report.String(), "not reached: line 12 statement (rule small)") {
+		t.Fatalf("unexpected statement coverage:\n%s", report)
+	}
+	covered, _ = report.Branches()
+	if covered != 4 {
+		t.Fatalf("unexpected branch coverage:\n%s", report)
+	}
+	if report.Points[0].Count != 4 {
+		t.Fatalf("unexpected count for the first statement: %d", report.Points[0].Count)
+	}
+
+	obj.ResetCoverage()
+	if covered, _ = obj.Coverage().Statements(); covered != 0 {
+		t.Fatalf("coverage wasn't reset")
+	}
+
+	// Without the option there is nothing to report.
+	obj = New(script)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if _, err := obj.Run(Input{Count: 0}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(obj.Coverage().Points) != 0 {
+		t.Fatalf("unexpected coverage without instrumentation")
+	}
+}
+
+// TestTypePredicates tests our type-predicates, and that calls to them
+// are compiled to OpIsType.
+func TestTypePredicates(t *testing.T) {
+
+	type Input struct {
+		Count int
+		Price float64
+		Name  string
+		Tags  []string
+		Valid bool
+	}
+	input := Input{Count: 3, Price: 1.5, Name: "Steve", Tags: []string{"a"}, Valid: true}
+
+	tests := []struct {
+		Input  string
+		Result bool
+	}{
+		{Input: `return is_int(Count) && is_float(Price) && is_string(Name) && is_array(Tags) && is_bool(Valid);`, Result: true},
+		{Input: `return is_int(Price) || is_float(Count) || is_string(Tags) || is_array(Name) || is_bool(Count);`, Result: false},
+		{Input: `return is_int(Missing);`, Result: false},
+		{Input: `return is_string(Name.upper()) && is_int(len(Tags));`, Result: true},
+		{Input: `return Name.is_string() && !Count.is_string();`, Result: true},
+		{Input: `return len(filter([1, "two", 3], x => is_int(x))) == 2;`, Result: true},
+	}
+
+	fused := func(e *Eval) bool {
+		ins := e.Bytecode()
+		for ip := 0; ip < len(ins); ip += code.Length(code.Opcode(ins[ip])) {
+			if code.Opcode(ins[ip]) == code.OpIsType {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, tst := range tests {
+
+		for _, flags := range [][]byte{nil, {NoOptimize}} {
+			obj := New(tst.Input)
+			if err := obj.Prepare(flags); err != nil {
+				t.Fatalf("Failed to compile '%s': %s", tst.Input, err)
+			}
+
+			ret, err := obj.Run(input)
+			if err != nil {
+				t.Fatalf("unexpected error running '%s': %s", tst.Input, err)
+			}
+			if ret != tst.Result {
+				t.Fatalf("unexpected result running '%s': %v", tst.Input, ret)
+			}
+		}
+	}
+
+	// Calls are compiled to OpIsType.
+	obj := New(`return is_int(Count);`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if !fused(obj) {
+		t.Fatalf("expected is_int to be compiled to OpIsType")
+	}
+
+	// Unless the function has been replaced, or called with the
+	// wrong number of arguments.
+	obj = New(`return is_int(Count);`)
+	obj.AddFunction("is_int", func(args []object.Object) object.Object {
+		return object.NewBoolean(false)
+	})
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if fused(obj) {
+		t.Fatalf("a replaced function was compiled to OpIsType")
+	}
+	ret, err := obj.Run(input)
+	if err != nil || ret {
+		t.Fatalf("the replaced function wasn't called: %v %v", ret, err)
+	}
+
+	// A function replaced after the script has been compiled is called
+	// too, in place of the test.
+	obj = New(`return is_int(Count);`)
+	if err = obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if ret, err = obj.Run(input); err != nil || !ret {
+		t.Fatalf("unexpected result: %v %v", ret, err)
+	}
+	obj.AddFunction("is_int", func(args []object.Object) object.Object {
+		return &object.Error{Message: "replaced"}
+	})
+	if _, err = obj.Run(input); err == nil || !strings.Contains(err.Error(), "replaced") {
+		t.Fatalf("the function replaced after compilation wasn't called: %v", err)
+	}
+
+	obj = New(`return is_int(Count, 3);`)
+	if err = obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if _, err = obj.Run(input); err == nil {
+		t.Fatalf("expected an error calling is_int with two arguments")
+	}
+}
+
+// TestUnits tests that numbers may have duration and size units.
+func TestUnits(t *testing.T) {
+
+	tests := []string{
+		`return Latency > 5m && Latency < 2h;`,
+		`return Size between 10kb and 3MiB;`,
+		`return 1.5kb == 1500 && 1w == 7d && 1h == 3600s;`,
+		`return Latency / 1m == 10;`,
+		`return 100ms == 0.1 && 1500ms == 1.5 && 2000ms == 2s && type(2000ms) == "integer";`,
+		`return Latency > 250ms && Size == 1MiB && 1KB == 1kb && 2B == 2;`,
+		`return 1.5e3 == 1500 && 2E-1 == 0.2 && type(1e3) == "float" && 1e3s == 1000;`,
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst)
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst, err)
+		}
+
+		ret, err := obj.Run(map[string]interface{}{"Latency": 600, "Size": 1048576})
+		if err != nil {
+			t.Fatalf("unexpected error running '%s': %s", tst, err)
+		}
+		if !ret {
+			t.Fatalf("unexpected result running '%s'", tst)
+		}
+	}
+
+	// Unknown units are errors.
+	obj := New(`return Latency > 5min;`)
+	if err := obj.Prepare(); err == nil || !strings.Contains(err.Error(), "unknown unit 'min'") {
+		t.Fatalf("expected an error compiling an unknown unit, got %v", err)
+	}
+
+	// Units are case-sensitive, as "M" might be minutes or megabytes.
+	obj = New(`return Size > 5M;`)
+	if err := obj.Prepare(); err == nil || !strings.Contains(err.Error(), "case-sensitive") {
+		t.Fatalf("expected an error compiling an ambiguous unit, got %v", err)
+	}
+}
+
+// TestStrictBool tests that conditions must be booleans, if requested.
+func TestStrictBool(t *testing.T) {
+
+	tests := []struct {
+		Input  string
+		Result bool
+		Error  bool
+	}{
+		{Input: `if ( Name != "" ) { return true; } return false;`, Result: true},
+		{Input: `return Name == "bob" && Count > 1 || false;`, Result: true},
+		{Input: `while ( Count > 0 ) { Count--; } return Count == 0;`, Result: true},
+		{Input: `return len(filter([Name], x => x && true)) == 1;`, Error: true},
+		{Input: `if ( Name ) { return true; } return false;`, Error: true},
+		{Input: `while ( Count ) { Count--; } return true;`, Error: true},
+		{Input: `return Name && true;`, Error: true},
+		{Input: `return false || Count;`, Error: true},
+		{Input: `return Count;`, Error: true},
+		{Input: `return Name;`, Error: true},
+	}
+
+	for _, tst := range tests {
+
+		for _, optimize := range []bool{true, false} {
+
+			e := New(tst.Input, WithStrictBool())
+			var err error
+			if optimize {
+				err = e.Prepare()
+			} else {
+				err = e.Prepare([]byte{NoOptimize})
+			}
+			if err != nil {
+				t.Fatalf("failed to compile '%s': %s", tst.Input, err)
+			}
+
+			ret, err := e.Run(map[string]interface{}{"Name": "bob", "Count": 2})
+			if tst.Error {
+				if err == nil {
+					t.Fatalf("expected an error running '%s'", tst.Input)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("unexpected error running '%s': %s", tst.Input, err)
+			}
+			if ret != tst.Result {
+				t.Fatalf("unexpected result running '%s': %v", tst.Input, ret)
+			}
+		}
+	}
+
+	//
+	// Without the option the same scripts are fine.
+	//
+	e := New(`if ( Name ) { return Count; } return false;`)
+	if err := e.Prepare(); err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+	ret, err := e.Run(map[string]interface{}{"Name": "bob", "Count": 2})
+	if err != nil || !ret {
+		t.Fatalf("unexpected result: %v %v", ret, err)
+	}
+
+	//
+	// Named rules must return booleans too.
+	//
+	e = New(`rule "named" { return Name; }`, WithStrictBool())
+	if err = e.Prepare(); err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+	_, err = e.RunAll(map[string]interface{}{"Name": "bob"})
+	if err == nil || err.Error() != "rule named: script returned STRING, expected BOOLEAN at line 1" {
+		t.Fatalf("expected an error, got %v", err)
+	}
+
+	//
+	// The error identifies the statement which returned the value,
+	// and the value is only tested if it might not be a boolean.
+	//
+	e = New(`if ( Count > 3 ) {
+  return true;
+}
+return Name;`, WithStrictBool())
+	if err = e.Prepare(); err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+	if ret, err = e.Run(map[string]interface{}{"Name": "bob", "Count": 4}); err != nil || !ret {
+		t.Fatalf("unexpected result: %v %v", ret, err)
+	}
+	_, err = e.Run(map[string]interface{}{"Name": "bob", "Count": 2})
+	if err == nil || err.Error() != "script returned STRING, expected BOOLEAN at line 4" {
+		t.Fatalf("expected an error, got %v", err)
+	}
+	var out bytes.Buffer
+	if err = e.DumpTo(&out); err != nil {
+		t.Fatalf("failed to dump: %s", err)
+	}
+	if strings.Count(out.String(), "OpRequireBool") != 1 || !strings.Contains(out.String(), "// require a boolean, returned on line 4") {
+		t.Fatalf("unexpected bytecode:\n%s", out.String())
+	}
+}
+
+// TestWarnings tests the warnings reported when a script is prepared.
+func TestWarnings(t *testing.T) {
+
+	library := map[string]string{
+		"lib.ef": `let unused = 3;`,
+	}
+	resolver := func(name string) (string, error) {
+		return library[name], nil
+	}
+
+	tests := []struct {
+		Script   string
+		Warnings string
+	}{
+		{Script: `let x = Count * 2; return x > 3 && Name ~= /^b/;`, Warnings: "[]"},
+		{Script: `let x = 1;
+return Count > 3;`, Warnings: "[line 1: variable x is declared but never used]"},
+		{Script: `let x = 1; x++; return true;`, Warnings: "[line 1: variable x is declared but never used]"},
+		{Script: `if ( "3" == 3 ) { return true; }
+return 1 < 2.5;`, Warnings: `[line 1: comparison of a string and a number always fails: ("3" == 3)]`},
+		{Script: `return Name ~= /.*/;`, Warnings: "[line 1: the regular expression /.*/ matches everything]"},
+		{Script: `return Name ~= /x?/i || Name !~ /^$/;`, Warnings: "[line 1: the regular expression /x?/i matches everything]"},
+		{Script: `return true;
+print("never");`, Warnings: "[line 2: unreachable code]"},
+		{Script: `if ( Count > 3 ) {
+  return true;
+} else {
+  return false;
+}
+return false;`, Warnings: "[line 6: unreachable code]"},
+		{Script: `return Count > 3; rule "named" { return true; }`, Warnings: "[]"},
+		{Script: `include "lib.ef"; return true;`, Warnings: "[lib.ef:1: variable unused is declared but never used]"},
+		{Script: `total = Count * 2;
+return Count > 3;`, Warnings: "[line 1: variable total is assigned but never used]"},
+		{Script: `total = Count * 2; total += 1; return total > 3;`, Warnings: "[]"},
+		{Script: `if ( Count > 3 ) {
+  Count = Count + 1;
+}
+return Count > 5;`, Warnings: "[line 2: assignment to Count shadows the field of the same name]"},
+		{Script: `Name = "steve"; return Name == "steve";`, Warnings: "[]"},
+		{Script: `Limit = Limit * 2; return Count > Limit;`, Warnings: "[]"},
+	}
+
+	for _, tst := range tests {
+
+		e := New(tst.Script, WithIncludeResolver(resolver))
+		e.SetVariable("Limit", object.NewInteger(10))
+		if err := e.Prepare(); err != nil {
+			t.Fatalf("failed to compile '%s': %s", tst.Script, err)
+		}
+
+		out := fmt.Sprintf("%v", e.Warnings())
+		if out != tst.Warnings {
+			t.Fatalf("unexpected warnings for '%s': %s", tst.Script, out)
+		}
+	}
+
+	//
+	// Variables which persist may be used by the next run.
+	//
+	e := New(`total = Count; return true;`, WithPersistentState())
+	if err := e.Prepare(); err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+	if len(e.Warnings()) != 0 {
+		t.Fatalf("unexpected warnings: %v", e.Warnings())
+	}
+}
+
+// TestDoc tests the doc-comments of scripts, and rules.
+func TestDoc(t *testing.T) {
+
+	script := `// Blocks attempts to brute-force
+// our SSH servers.
+
+/*
+ * Connections to the SSH port.
+ */
+rule "ssh" {
+    return Port == 22; // not documentation
+}
+
+rule "undocumented" { return false; }
+// Telnet, which should be
+// blocked too.
+rule "telnet" {
+    return Port == 23;
+}
+return false;`
+
+	e := New(script)
+	if err := e.Prepare(); err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+
+	if e.Doc() != "Blocks attempts to brute-force\nour SSH servers." {
+		t.Fatalf("unexpected script doc: %q", e.Doc())
+	}
+
+	docs := map[string]string{
+		"ssh":          "Connections to the SSH port.",
+		"undocumented": "",
+		"telnet":       "Telnet, which should be\nblocked too.",
+		"missing":      "",
+	}
+	for name, doc := range docs {
+		if e.RuleDoc(name) != doc {
+			t.Fatalf("unexpected doc for %s: %q", name, e.RuleDoc(name))
+		}
+	}
+
+	//
+	// A comment immediately before the first rule documents the
+	// rule rather than the script.
+	//
+	e = New("/* The rule. */\nrule \"only\" { return true; }")
+	if err := e.Prepare(); err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+	if e.Doc() != "" || e.RuleDoc("only") != "The rule." {
+		t.Fatalf("unexpected docs: %q %q", e.Doc(), e.RuleDoc("only"))
+	}
+}
+
+// TestMetadata tests the metadata declared by pragmas.
+func TestMetadata(t *testing.T) {
+
+	script := `// Blocks brute-force attempts.
+#pragma name "block-ssh-bruteforce"
+#pragma version 3
+#pragma require-fields Source, Port
+#pragma owner security-team
+
+return Port == 22 && Source != "";`
+
+	e := New(script)
+	if err := e.Prepare(); err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+
+	m := e.Metadata()
+	if m.Name != "block-ssh-bruteforce" || m.Version != 3 {
+		t.Fatalf("unexpected metadata: %v", m)
+	}
+	if fmt.Sprintf("%v", m.RequireFields) != "[Source Port]" {
+		t.Fatalf("unexpected fields: %v", m.RequireFields)
+	}
+	if m.Pragmas["owner"] != "security-team" || len(m.Pragmas) != 4 {
+		t.Fatalf("unexpected pragmas: %v", m.Pragmas)
+	}
+	if e.Doc() != "Blocks brute-force attempts." {
+		t.Fatalf("unexpected doc: %q", e.Doc())
+	}
+
+	ret, err := e.Run(map[string]interface{}{"Port": 22, "Source": "10.0.0.1"})
+	if err != nil || !ret {
+		t.Fatalf("unexpected result: %v %v", ret, err)
+	}
+
+	//
+	// Scripts without pragmas have no metadata.
+	//
+	e = New(`return true;`)
+	if err = e.Prepare(); err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+	m = e.Metadata()
+	if m.Name != "" || m.Version != 0 || len(m.RequireFields) != 0 || len(m.Pragmas) != 0 {
+		t.Fatalf("unexpected metadata: %v", m)
+	}
+
+	errors := map[string]string{
+		"#pragma version three\nreturn true;":            "invalid version",
+		"#pragma version 1\n#pragma version 2\n":         "more than once",
+		"#pragma require-fields Port, 3\nreturn true;":   "invalid field",
+		"#pragma name \"unterminated\nreturn true;":      "invalid name",
+		"return true;\n#pragma version 1\n":              "must appear at the start",
+		"if ( true ) {\n#pragma version 1\n}\nreturn 1;": "must appear at the start",
+	}
+	for script, msg := range errors {
+		e = New(script)
+		err = e.Prepare()
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Fatalf("expected an error containing '%s' for '%s', got %v", msg, script, err)
+		}
+	}
+}
+
+// TestReader tests creating evaluators from readers.
+func TestReader(t *testing.T) {
+
+	e, err := NewReader(strings.NewReader(`return Name == "Steve";`))
+	if err != nil {
+		t.Fatalf("failed to read: %s", err)
+	}
+	if err = e.Prepare(); err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+	ret, err := e.Run(map[string]interface{}{"Name": "Steve"})
+	if err != nil || !ret {
+		t.Fatalf("unexpected result: %v %v", ret, err)
+	}
+
+	e, err = CompileReader(strings.NewReader(`return Count > 3;`), WithStrictBool())
+	if err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+	ret, err = e.Run(map[string]interface{}{"Count": 4})
+	if err != nil || !ret {
+		t.Fatalf("unexpected result: %v %v", ret, err)
+	}
+
+	_, err = CompileReader(strings.NewReader(`return (;`))
+	if err == nil {
+		t.Fatalf("expected an error compiling an invalid script")
+	}
+
+	_, err = NewReader(brokenReader{})
+	if err == nil || err.Error() != "broken" {
+		t.Fatalf("expected a read error, got %v", err)
+	}
+}
+
+// brokenReader is an io.Reader which always fails.
+type brokenReader struct{}
+
+// Read returns an error.
+func (brokenReader) Read([]byte) (int, error) {
+	return 0, fmt.Errorf("broken")
+}
+
+// TestOutput tests redirecting the output of scripts, and of Dump.
+func TestOutput(t *testing.T) {
+
+	e := New(`print("Name: ", Name); printf(" %d\n", Count); return true;`)
+	if err := e.Prepare(); err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+
+	var out bytes.Buffer
+	e.SetOutput(&out)
+	ret, err := e.Run(map[string]interface{}{"Name": "Steve", "Count": 3})
+	if err != nil || !ret {
+		t.Fatalf("unexpected result: %v %v", ret, err)
+	}
+	if out.String() != "Name: Steve 3\n" {
+		t.Fatalf("unexpected output: %q", out.String())
+	}
+
+	out.Reset()
+	if err = e.DumpTo(&out); err != nil {
+		t.Fatalf("failed to dump: %s", err)
+	}
+	if !strings.HasPrefix(out.String(), "Bytecode:\n") || !strings.Contains(out.String(), "Constants:") {
+		t.Fatalf("unexpected dump: %q", out.String())
+	}
+}
+
+// TestFloatPrecision tests rounding floats, and converting them to strings.
+func TestFloatPrecision(t *testing.T) {
+
+	tests := []struct {
+		Input     string
+		Precision int
+	}{
+		{Input: `return string(Price * 3) == "0.30000000000000004";`, Precision: -1},
+		{Input: `return string(Price * 3) == "0.3";`, Precision: 10},
+		{Input: `return sprintf("%v", Price * 3) == "0.3";`, Precision: 10},
+		{Input: `return round(Price * 3, 2) == 0.3;`, Precision: -1},
+		{Input: `return to_fixed(Price * 3, 2) == "0.30" && to_fixed(1.005, 2) == "1.01";`, Precision: -1},
+		{Input: `return round(2.5) == 3 && round(-2.5) == -3;`, Precision: -1},
+	}
+
+	for _, tst := range tests {
+		e := New(tst.Input, WithFloatPrecision(tst.Precision))
+		if err := e.Prepare(); err != nil {
+			t.Fatalf("failed to compile '%s': %s", tst.Input, err)
+		}
+		ret, err := e.Run(map[string]interface{}{"Price": 0.1})
+		if err != nil || !ret {
+			t.Fatalf("unexpected result for '%s': %v %v", tst.Input, ret, err)
+		}
+	}
+}
+
+// testSpan records a span, for TestTracer.
+type testSpan struct {
+	name  string
+	attrs map[string]interface{}
+	err   error
+	ended bool
+}
+
+// SetAttribute records the attribute.
+func (s *testSpan) SetAttribute(key string, value interface{}) {
+	s.attrs[key] = value
+}
+
+// End records the error.
+func (s *testSpan) End(err error) {
+	s.err = err
+	s.ended = true
+}
+
+// testTracer records the spans it starts.
+type testTracer struct {
+	spans []*testSpan
+}
+
+// Start starts a span.
+func (t *testTracer) Start(name string) Span {
+	s := &testSpan{name: name, attrs: make(map[string]interface{})}
+	t.spans = append(t.spans, s)
+	return s
+}
+
+// TestTracer tests tracing the preparation, and running, of scripts.
+func TestTracer(t *testing.T) {
+
+	tracer := &testTracer{}
+	e := New(`rule "big" { return Count > 10; } return Count > 3;`, WithTracer(tracer))
+	if err := e.Prepare(); err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+	if ret, err := e.RunJSON([]byte(`{"Count": 5}`)); err != nil || !ret {
+		t.Fatalf("unexpected result: %v %v", ret, err)
+	}
+	if _, err := e.Run(map[string]interface{}{"Count": "x"}); err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	if len(tracer.spans) != 4 {
+		t.Fatalf("unexpected spans: %v", tracer.spans)
+	}
+	hash := tracer.spans[0].attrs["script.hash"]
+	for i, name := range []string{SpanParse, SpanCompile, SpanRun, SpanRun} {
+		s := tracer.spans[i]
+		if s.name != name || !s.ended || s.attrs["script.hash"] != hash {
+			t.Fatalf("unexpected span %d: %+v", i, s)
+		}
+	}
+	if len(hash.(string)) != 64 {
+		t.Fatalf("unexpected hash: %v", hash)
+	}
+	c := tracer.spans[1].attrs
+	if c["rules"] != 1 || c["constants"] != e.Stats().Constants || c["instructions"] != e.Stats().Instructions {
+		t.Fatalf("unexpected compile attributes: %v", c)
+	}
+	if tracer.spans[2].attrs["result"] != true || tracer.spans[2].err != nil {
+		t.Fatalf("unexpected run span: %+v", tracer.spans[2])
+	}
+	if tracer.spans[3].attrs["result"] != false || tracer.spans[3].err == nil {
+		t.Fatalf("unexpected run span: %+v", tracer.spans[3])
+	}
+
+	// Failures are recorded.
+	tracer.spans = nil
+	if err := New(`return (;`, WithTracer(tracer)).Prepare(); err == nil {
+		t.Fatalf("expected a parse error")
+	}
+	if err := New(`return Name == "a" || Name == "b";`, WithTracer(tracer), WithLimits(Limits{MaxConstants: 1})).Prepare(); err == nil {
+		t.Fatalf("expected a limit error")
+	}
+	if len(tracer.spans) != 3 || tracer.spans[0].err == nil || tracer.spans[1].err != nil || tracer.spans[2].err == nil {
+		t.Fatalf("unexpected spans: %v", tracer.spans)
+	}
+
+	// The scripts of a program are traced by name.
+	tracer.spans = nil
+	p := NewProgram(WithTracer(tracer))
+	if err := p.Add("small", `return Count < 3;`); err != nil {
+		t.Fatalf("failed to add: %s", err)
+	}
+	if ret, err := p.Run("small", map[string]interface{}{"Count": 1}); err != nil || !ret {
+		t.Fatalf("unexpected result: %v %v", ret, err)
+	}
+	if len(tracer.spans) != 3 || tracer.spans[2].attrs["script.name"] != "small" ||
+		tracer.spans[2].attrs["script.hash"] != tracer.spans[0].attrs["script.hash"] {
+		t.Fatalf("unexpected spans: %v", tracer.spans)
+	}
+}
+
+// TestCall tests invoking the functions a script defines.
+func TestCall(t *testing.T) {
+
+	script := `
+score  = weight => Severity * weight;
+let urgent = limit => score(2) > limit;
+nested = x => y => x;
+limit  = 3;
+reach  = x => limit;
+broken = x => x + "one";
+
+if ( Severity > 1 ) { inner = x => x; }
+return Severity > 3;
+`
+	input := map[string]interface{}{"Severity": 6}
+
+	obj := New(script)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+
+	names := strings.Join(obj.Functions(), ",")
+	if names != "broken,nested,reach,score,urgent" {
+		t.Fatalf("unexpected functions: %s", names)
+	}
+
+	ret, err := obj.Call("score", input, &object.Integer{Value: 3})
+	if err != nil {
+		t.Fatalf("unexpected error calling score: %s", err)
+	}
+	if ret.Inspect() != "18" {
+		t.Fatalf("unexpected score: %s", ret.Inspect())
+	}
+
+	// Functions may call each other.
+	ret, err = obj.Call("urgent", input, &object.Integer{Value: 10})
+	if err != nil {
+		t.Fatalf("unexpected error calling urgent: %s", err)
+	}
+	if !ret.True() {
+		t.Fatalf("expected urgent to be true")
+	}
+
+	// The script isn't run, so its other variables aren't set.
+	ret, err = obj.Call("reach", input, &object.Integer{Value: 1})
+	if err != nil {
+		t.Fatalf("unexpected error calling reach: %s", err)
+	}
+	if ret.Type() != object.NULL {
+		t.Fatalf("expected reach to return null, got %s", ret.Inspect())
+	}
+
+	// Unless the host has set them.
+	obj.SetVariable("limit", &object.Integer{Value: 7})
+	ret, err = obj.Call("reach", input, &object.Integer{Value: 1})
+	if err != nil {
+		t.Fatalf("unexpected error calling reach: %s", err)
+	}
+	if ret.Inspect() != "7" {
+		t.Fatalf("unexpected result from reach: %s", ret.Inspect())
+	}
+
+	// Errors
+	errors := []struct {
+		name string
+		args []object.Object
+	}{
+		{name: "missing", args: []object.Object{&object.Integer{Value: 1}}},
+		{name: "inner", args: []object.Object{&object.Integer{Value: 1}}},
+		{name: "limit", args: []object.Object{&object.Integer{Value: 1}}},
+		{name: "score"},
+		{name: "broken", args: []object.Object{&object.Integer{Value: 1}}},
+	}
+	for _, tst := range errors {
+		if _, err := obj.Call(tst.name, input, tst.args...); err == nil {
+			t.Fatalf("expected an error calling %s", tst.name)
+		}
+	}
+
+	// The script still runs as normal.
+	ok, err := obj.Run(input)
+	if err != nil || !ok {
+		t.Fatalf("unexpected result running the script: %v %s", ok, err)
+	}
+}
+
+// TestRawStrings tests raw strings, and heredocs, in scripts.
+func TestRawStrings(t *testing.T) {
+
+	input := map[string]interface{}{"Version": "1.23", "Message": "first line\n\tsecond line"}
+
+	tests := []string{
+		"return Version ~= `^\\d+\\.\\d+$`;",
+		"return `a\\nb` == \"a\\\\nb\";",
+		"return len(`\\t`) == 2;",
+		"pattern = <<<END\n  ^first line$\n  END;\nreturn Message ~= \"(?m)\" + pattern;",
+		"if ( true ) {\n  msg = <<<EOT\n    first line\n    \tsecond line\n    EOT;\n  return Message == msg;\n}\nreturn false;",
+	}
+	for _, tst := range tests {
+		obj := New(tst)
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst, err)
+		}
+		ret, err := obj.Run(input)
+		if err != nil {
+			t.Fatalf("unexpected error running '%s': %s", tst, err)
+		}
+		if !ret {
+			t.Fatalf("unexpected result running '%s'", tst)
+		}
+	}
+}
+
+// TestEscapes tests the escape-sequences in strings.
+func TestEscapes(t *testing.T) {
+
+	input := map[string]interface{}{"Message": "name:\t\"café\"\n"}
+
+	obj := New(`return Message == "name:\t\"caf\u00e9\"\n";`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	ret, err := obj.Run(input)
+	if err != nil || !ret {
+		t.Fatalf("unexpected result: %v %v", ret, err)
+	}
+
+	// Unknown escape-sequences are errors.
+	obj = New("if ( true ) {\n  return Message ~= \"\\d+\";\n}")
+	err = obj.Prepare()
+	if err == nil {
+		t.Fatalf("expected an error preparing the script")
+	}
+	if !strings.Contains(err.Error(), `invalid escape-sequence \d in string around line 2`) {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+// TestCapture tests recording evidence via `capture`.
+func TestCapture(t *testing.T) {
+
+	input := map[string]interface{}{"SourceIP": "10.0.0.1", "Tags": []string{"a", "bb", "ccc"}}
+
+	script := `
+if ( capture("ip", SourceIP) == "10.0.0.1" ) {
+	long = filter(Tags, t => len(capture("tag", t)) > 1);
+	capture("count", len(long));
+	return true;
+}
+return false;
+`
+	obj := New(script)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if obj.Captures() != nil {
+		t.Fatalf("expected no captures before running")
+	}
+
+	ret, err := obj.Run(input)
+	if err != nil || !ret {
+		t.Fatalf("unexpected result: %v %v", ret, err)
+	}
+
+	expected := map[string]string{"ip": "10.0.0.1", "tag": "ccc", "count": "2"}
+	captures := obj.Captures()
+	if len(captures) != len(expected) {
+		t.Fatalf("unexpected captures: %v", captures)
+	}
+	for name, value := range expected {
+		if captures[name] == nil || captures[name].Inspect() != value {
+			t.Fatalf("unexpected capture of %s: %v", name, captures[name])
+		}
+	}
+
+	// Each run starts afresh.
+	ret, err = obj.Run(map[string]interface{}{"SourceIP": "10.0.0.2"})
+	if err != nil || ret {
+		t.Fatalf("unexpected result: %v %v", ret, err)
+	}
+	captures = obj.Captures()
+	if len(captures) != 1 || captures["ip"].Inspect() != "10.0.0.2" {
+		t.Fatalf("unexpected captures: %v", captures)
+	}
+
+	// Errors
+	errors := []string{
+		`capture("one"); return true;`,
+		`capture("one", 2, 3); return true;`,
+	}
+	for _, tst := range errors {
+		if err := New(tst).Prepare(); err == nil {
+			t.Fatalf("expected an error preparing '%s'", tst)
+		}
+	}
+	obj = New(`capture(3, 4); return true;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if _, err := obj.Run(input); err == nil {
+		t.Fatalf("expected an error capturing a value with a numeric name")
+	}
+}
+
+// testUserKey is the key beneath which TestRunContext stores the user in
+// its context.
+type testUserKey struct{}
+
+// TestRunContext tests passing request-scoped data to functions, via the
+// context given to RunContext.
+func TestRunContext(t *testing.T) {
+
+	user := func(call *environment.CallInfo, args []object.Object) object.Object {
+		name, _ := call.Context.Value(testUserKey{}).(string)
+		return &object.String{Value: name}
+	}
+
+	script := `
+if ( user() == "admin" ) { return true; }
+return len(filter(Owners, o => o == user())) > 0;
+`
+	obj := New(script)
+	obj.AddFunction("user", user)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+
+	input := map[string]interface{}{"Owners": []string{"steve", "kemp"}}
+
+	tests := []struct {
+		user     string
+		expected bool
+	}{
+		{user: "admin", expected: true},
+		{user: "kemp", expected: true},
+		{user: "bob", expected: false},
+	}
+	for _, tst := range tests {
+		ctx := context.WithValue(context.Background(), testUserKey{}, tst.user)
+		ret, err := obj.RunContext(ctx, input)
+		if err != nil {
+			t.Fatalf("unexpected error running as %s: %s", tst.user, err)
+		}
+		if ret != tst.expected {
+			t.Fatalf("unexpected result running as %s: %v", tst.user, ret)
+		}
+	}
+
+	// Without a context the function sees no user.
+	ret, err := obj.Run(input)
+	if err != nil || ret {
+		t.Fatalf("unexpected result without a context: %v %v", ret, err)
+	}
+
+	// Functions with other signatures are rejected when they're called.
+	obj = New(`return user();`)
+	obj.AddFunction("user", func() string { return "admin" })
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if _, err := obj.Run(input); err == nil || !strings.Contains(err.Error(), "unexpected type") {
+		t.Fatalf("expected an error calling a function with an unknown signature, got %v", err)
+	}
+}
+
+// TestCallInfoObject tests that functions may access the object a script
+// is running against.
+func TestCallInfoObject(t *testing.T) {
+
+	type Event struct {
+		Suffix string
+		Count  int
+		Name   string
+	}
+
+	var seen interface{}
+	field := func(call *environment.CallInfo, args []object.Object) object.Object {
+		seen = call.Object
+		return call.Field(args[0].Inspect())
+	}
+
+	script := `
+Name = "shadowed";
+return field("Co" + Suffix) == 3 && field("Name") == "steve" && type(field("Missing")) == "null";
+`
+	obj := New(script)
+	obj.AddFunction("field", field)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+
+	input := &Event{Suffix: "unt", Count: 3, Name: "steve"}
+	ret, err := obj.Run(input)
+	if err != nil || !ret {
+		t.Fatalf("unexpected result: %v %v", ret, err)
+	}
+	if seen != input {
+		t.Fatalf("the function was passed the wrong object: %v", seen)
+	}
+
+	// Maps work too, as do the fields given to RunFields.
+	ret, err = obj.Run(map[string]interface{}{"Suffix": "unt", "Count": 3, "Name": "steve"})
+	if err != nil || !ret {
+		t.Fatalf("unexpected result running against a map: %v %v", ret, err)
+	}
+	ret, err = obj.RunFields(map[string]object.Object{
+		"Suffix": &object.String{Value: "unt"},
+		"Count":  &object.Integer{Value: 3},
+		"Name":   &object.String{Value: "steve"},
+	})
+	if err != nil || !ret {
+		t.Fatalf("unexpected result running against fields: %v %v", ret, err)
+	}
+	if seen != nil {
+		t.Fatalf("expected no object to be passed for fields, got %v", seen)
+	}
+}
+
+// TestField tests looking up fields whose names are computed at run-time.
+func TestField(t *testing.T) {
+
+	type Event struct {
+		Region string
+		Count  int
+	}
+
+	input := map[string]interface{}{
+		"Region":  "eu",
+		"user_eu": "steve",
+		"Count":   3,
+		"Details": map[string]interface{}{"Name": "kemp"},
+	}
+
+	tests := []string{
+		`return field("user_" + Region) == "steve";`,
+		`return field("user_" + Region) == user_eu;`,
+		`return field("user_us", "nobody") == "nobody";`,
+		`return type(field("user_us")) == "null";`,
+		`return field("Details").Name == "kemp";`,
+		`Count = 7; return field("Count") == 3;`,
+		`return len(filter(["Count", "Missing"], f => field(f))) == 1;`,
+	}
+	for _, tst := range tests {
+		obj := New(tst)
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst, err)
+		}
+		ret, err := obj.Run(input)
+		if err != nil {
+			t.Fatalf("unexpected error running '%s': %s", tst, err)
+		}
+		if !ret {
+			t.Fatalf("unexpected result running '%s'", tst)
+		}
+	}
+
+	// Structures work too.
+	obj := New(`return field("Reg" + "ion") == "eu" && field("Count") == 3;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	ret, err := obj.Run(&Event{Region: "eu", Count: 3})
+	if err != nil || !ret {
+		t.Fatalf("unexpected result: %v %v", ret, err)
+	}
+}
+
+// TestFields tests listing the names of the fields of an object.
+func TestFields(t *testing.T) {
+
+	type Event struct {
+		Name      string
+		DebugInfo string
+		Count     int
+	}
+
+	script := `
+if ( Name == "steve" && len(filter(fields(), f => f ~= /^debug/i)) > 0 ) {
+	return false;
+}
+return Name != "" && len(fields()) == 3;
+`
+	obj := New(script)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+
+	tests := []struct {
+		input    interface{}
+		expected bool
+	}{
+		{input: map[string]interface{}{"Name": "steve", "debug_info": "x", "Count": 1}, expected: false},
+		{input: map[string]interface{}{"Name": "steve", "info": "x", "Count": 1}, expected: true},
+		{input: map[string]interface{}{"Name": "kemp", "debug_info": "x", "Count": 1}, expected: true},
+		{input: &Event{Name: "steve", DebugInfo: "x"}, expected: false},
+		{input: Event{Name: "kemp", DebugInfo: "x"}, expected: true},
+	}
+	for i, tst := range tests {
+		ret, err := obj.Run(tst.input)
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %s", i, err)
+		}
+		if ret != tst.expected {
+			t.Fatalf("test %d: unexpected result %v", i, ret)
+		}
+	}
+
+	ret, err := obj.RunFields(map[string]object.Object{
+		"Name":  &object.String{Value: "steve"},
+		"Other": &object.String{Value: "x"},
+		"Count": &object.Integer{Value: 1},
+	})
+	if err != nil || !ret {
+		t.Fatalf("unexpected result running against fields: %v %v", ret, err)
+	}
+}
+
+// testPerson is used by TestMethods.
+type testPerson struct {
+	Name  string
+	Born  int
+	calls *int
+}
+
+// Age is read as a field, and counts the number of times it is called.
+func (p testPerson) Age() int {
+	*p.calls++
+	return 2024 - p.Born
+}
+
+// Initial is only available via a pointer.
+func (p *testPerson) Initial() string {
+	return p.Name[:1]
+}
+
+// Older takes an argument, so it isn't available.
+func (p testPerson) Older(years int) int {
+	return 2024 - p.Born + years
+}
+
+// Both returns two values, so it isn't available.
+func (p testPerson) Both() (int, error) {
+	return 0, nil
+}
+
+// TestMethods tests reading the methods of structures as fields.
+func TestMethods(t *testing.T) {
+
+	calls := 0
+	input := &testPerson{Name: "Steve", Born: 1976, calls: &calls}
+
+	tests := []string{
+		`return Age == 48;`,
+		`return Age() == 48;`,
+		`return Age > 40 && Age < 50 && Age() != 0;`,
+		`return Initial == "S" && Initial() == "S";`,
+		`return type(Older) == "null" && type(Both) == "null";`,
+		`return Age == 48 && len(filter([1, 2], x => Age() == 48)) == 2;`,
+	}
+	for _, tst := range tests {
+		calls = 0
+		obj := New(tst)
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst, err)
+		}
+		ret, err := obj.Run(input)
+		if err != nil {
+			t.Fatalf("unexpected error running '%s': %s", tst, err)
+		}
+		if !ret {
+			t.Fatalf("unexpected result running '%s'", tst)
+		}
+		if calls > 1 {
+			t.Fatalf("the method was called %d times running '%s'", calls, tst)
+		}
+	}
+
+	// Methods are called afresh for each run.
+	obj := New(`return Age == 48;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	calls = 0
+	for i := 0; i < 3; i++ {
+		if ret, err := obj.Run(input); err != nil || !ret {
+			t.Fatalf("unexpected result: %v %v", ret, err)
+		}
+	}
+	if calls != 3 {
+		t.Fatalf("expected the method to be called for each run, not %d times", calls)
+	}
+
+	// Pointer methods aren't available from a copy of the structure,
+	// and methods which take arguments can't be called.
+	errors := []struct {
+		script string
+		input  interface{}
+	}{
+		{script: `return Initial() == "S";`, input: *input},
+		{script: `return Older() == 48;`, input: input},
+		{script: `return Age(1) == 48;`, input: input},
+		{script: `return Age() == 48;`, input: map[string]interface{}{"Age": 48}},
+	}
+	for _, tst := range errors {
+		obj := New(tst.script)
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.script, err)
+		}
+		if _, err := obj.Run(tst.input); err == nil {
+			t.Fatalf("expected an error running '%s'", tst.script)
+		}
+	}
+}
+
+// testAccount has an unexported field, which accessors expose by another
+// name.
+type testAccount struct {
+	Owner   string
+	Balance int
+	secret  string
+}
+
+// TestAccessors tests the fields supplied by the host.
+func TestAccessors(t *testing.T) {
+
+	calls := 0
+	accessors := map[string]func(obj interface{}) interface{}{
+		"Secret": func(obj interface{}) interface{} {
+			calls++
+			return obj.(*testAccount).secret
+		},
+		"Overdrawn": func(obj interface{}) interface{} {
+			return obj.(*testAccount).Balance < 0
+		},
+		"Balance": func(obj interface{}) interface{} {
+			return obj.(*testAccount).Balance * 100
+		},
+		"Missing": func(obj interface{}) interface{} {
+			return nil
+		},
+	}
+	input := &testAccount{Owner: "Steve", Balance: -3, secret: "hunter2"}
+
+	tests := []string{
+		`return Secret == "hunter2";`,
+		`return Overdrawn;`,
+		`return Balance == -300;`,
+		`return type(Missing) == "null";`,
+		`return Owner == "Steve" && Secret == "hunter2" && Secret != "";`,
+		`return len(filter([1, 2], x => Secret == "hunter2")) == 2;`,
+		`return field("Secret") == "hunter2";`,
+		`return len(fields()) == 6 && len(filter(fields(), f => f == "Secret")) == 1;`,
+		`if (Owner == "Steve") { return Balance == -300; } return false;`,
+	}
+	for _, tst := range tests {
+		calls = 0
+		obj := New(tst, WithAccessors(accessors))
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst, err)
+		}
+		ret, err := obj.Run(input)
+		if err != nil {
+			t.Fatalf("unexpected error running '%s': %s", tst, err)
+		}
+		if !ret {
+			t.Fatalf("unexpected result running '%s'", tst)
+		}
+		if calls > 1 {
+			t.Fatalf("the accessor was called %d times running '%s'", calls, tst)
+		}
+	}
+
+	// Accessors are per-evaluator.
+	obj := New(`return type(Secret) == "null" && Balance == -3;`)
+	if err := obj.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	if ret, err := obj.Run(input); err != nil || !ret {
+		t.Fatalf("unexpected result: %v %v", ret, err)
+	}
+
+	// They apply to the scripts of a program too.
+	p := NewProgram(WithAccessors(accessors))
+	if err := p.Add("secret", `return Secret == "hunter2";`); err != nil {
+		t.Fatalf("Failed to add: %s", err)
+	}
+	if ret, err := p.Run("secret", input); err != nil || !ret {
+		t.Fatalf("unexpected result: %v %v", ret, err)
+	}
+}
@@ -0,0 +1,183 @@
+// explain.go contains code for explaining why a script returned the
+// result that it did.
+
+package evalfilter
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/skx/evalfilter/v2/ast"
+	"github.com/skx/evalfilter/v2/code"
+	"github.com/skx/evalfilter/v2/environment"
+	"github.com/skx/evalfilter/v2/object"
+)
+
+// Explanation describes how a script arrived at its result, as returned
+// by Explain.
+type Explanation struct {
+	// Result is the result of the script.
+	Result bool
+
+	// Steps holds the top-level expressions which were evaluated,
+	// such as the conditions of if-statements, and the values which
+	// were returned, in the order they were evaluated.
+	//
+	// An expression which was evaluated more than once, within a
+	// loop for example, appears each time.
+	Steps []*ExplainNode
+}
+
+// ExplainNode describes the evaluation of a single expression.
+type ExplainNode struct {
+	// Expression is the expression, in the form shown by the
+	// parse-tree.
+	Expression string
+
+	// Value is the value the expression produced.
+	Value object.Object
+
+	// Children holds the expressions which were evaluated to produce
+	// this one, such as the operands of a comparison, or the
+	// arguments of a function call.
+	Children []*ExplainNode
+}
+
+// String returns a human-readable form of the explanation, in which each
+// expression is followed by its value, and the expressions it depends
+// upon are indented beneath it.
+func (x *Explanation) String() string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "result: %t\n", x.Result)
+	for _, step := range x.Steps {
+		step.write(&out, 1)
+	}
+	return out.String()
+}
+
+// write adds the node, and its children, to the given output.
+func (n *ExplainNode) write(out *strings.Builder, depth int) {
+	fmt.Fprintf(out, "%s%s => %s\n", strings.Repeat("  ", depth), n.Expression, n.Value.Inspect())
+	for _, child := range n.Children {
+		child.write(out, depth+1)
+	}
+}
+
+// traceNode records an expression which is traced when explaining a
+// script.
+type traceNode struct {
+	// expr is the expression.
+	expr ast.Expression
+
+	// parent is the ID of the closest traced expression which
+	// contains this one, or -1.
+	parent int
+}
+
+// Explain runs the script against the given object, as Run does, and
+// returns an explanation of how it arrived at its result, listing each
+// expression which was evaluated along with its value.
+//
+// This allows you to answer questions such as "why was this event
+// dropped?" without reading the bytecode.
+//
+// The script is compiled again, without optimization, the first time it
+// is explained, and any errors running it are returned along with the
+// explanation of what happened before the error.
+func (e *Eval) Explain(obj interface{}) (*Explanation, error) {
+
+	if e.machine == nil {
+		return nil, fmt.Errorf("the script has not been prepared")
+	}
+
+	if e.explainer == nil {
+
+		env := e.environment
+		if e.persistent {
+			env = environment.NewIsolated(e.environment)
+		}
+
+		x := &Eval{
+			Script:          e.Script,
+			environment:     env,
+			includeResolver: e.includeResolver,
+			including:       make(map[string]bool),
+			assigned:        make(map[string]bool),
+			persistent:      e.persistent,
+			parserOptions:   e.parserOptions,
+			strict:          e.strict,
+			intDivision:     e.intDivision,
+			accessors:       e.accessors,
+			limits:          e.limits,
+			explaining:      true,
+		}
+		err := x.Prepare([]byte{NoOptimize})
+		if err != nil {
+			return nil, err
+		}
+		e.explainer = x
+	}
+	x := e.explainer
+
+	//
+	// Expressions are recorded after their operands, so when each
+	// is recorded it adopts the pending expressions it contains.
+	//
+	var pending []*ExplainNode
+	var ids []int
+	x.machine.SetTracer(func(id int, val object.Object) {
+		n := len(pending)
+		for n > 0 && x.traceNodes[ids[n-1]].parent == id {
+			n--
+		}
+
+		node := &ExplainNode{Expression: describe(x.traceNodes[id].expr), Value: val}
+		node.Children = append(node.Children, pending[n:]...)
+
+		pending = append(pending[:n], node)
+		ids = append(ids[:n], id)
+	})
+	defer x.machine.SetTracer(nil)
+
+	ret, err := x.Run(obj)
+	return &Explanation{Result: ret, Steps: pending}, err
+}
+
+// describe returns the given expression as a single line, without the
+// statement-terminators which the parse-tree adds after function calls.
+func describe(expr ast.Expression) string {
+	str := strings.Replace(expr.String(), ");\n", ")", -1)
+	return strings.Join(strings.Fields(str), " ")
+}
+
+// traced returns true if the given expression produces a value which
+// should be recorded when explaining a script.
+func traced(expr ast.Expression) bool {
+	switch expr.(type) {
+	case *ast.AssignStatement, *ast.IfExpression, *ast.WhileStatement, *ast.FunctionLiteral:
+		return false
+	}
+	return true
+}
+
+// compileTraced compiles the given expression, followed by an instruction
+// to record its value.
+func (e *Eval) compileTraced(expr ast.Expression) error {
+
+	id := len(e.traceNodes)
+	parent := -1
+	if len(e.tracing) > 0 {
+		parent = e.tracing[len(e.tracing)-1]
+	}
+	e.traceNodes = append(e.traceNodes, traceNode{expr: expr, parent: parent})
+
+	e.tracing = append(e.tracing, id)
+	err := e.compileNode(expr)
+	e.tracing = e.tracing[:len(e.tracing)-1]
+	if err != nil {
+		return err
+	}
+
+	e.emit(code.OpTrace, id)
+	return nil
+}
@@ -0,0 +1,699 @@
+// fast.go contains a specialised evaluator for simple filters.
+
+package evalfilter
+
+import (
+	"math"
+	"reflect"
+	"strings"
+
+	"github.com/skx/evalfilter/v2/ast"
+	"github.com/skx/evalfilter/v2/environment"
+	"github.com/skx/evalfilter/v2/object"
+)
+
+// fastKind describes the type of a fastValue.
+type fastKind int
+
+// The types of values we handle natively.
+const (
+	fastBool fastKind = iota
+	fastInt
+	fastFloat
+	fastString
+)
+
+// fastValue holds a native golang value, without boxing it in an object.
+type fastValue struct {
+	kind fastKind
+	b    bool
+	i    int64
+	f    float64
+	s    string
+}
+
+// True returns whether this value is true-like, in the same way as the
+// equivalent object would.
+func (v fastValue) True() bool {
+	switch v.kind {
+	case fastBool:
+		return v.b
+	case fastInt:
+		return v.i != 0
+	case fastFloat:
+		return v.f != 0
+	}
+	return v.s != ""
+}
+
+// fastNode is a node in the expression-tree of a fastFilter.
+//
+// Evaluating a node returns false if it can't be evaluated natively,
+// for example because its operands have different types.
+type fastNode func(fields []fastValue) (fastValue, bool)
+
+// fastFilter evaluates scripts which consist of nothing more than the
+// comparison of fields against literals, such as:
+//
+//	return Count > 3 && Name == "Steve";
+//
+// The fields are read from the object natively, rather than being
+// converted to objects, and the expression is evaluated without the
+// overhead of the virtual machine.  If anything unusual is encountered,
+// such as a missing field, or a comparison between values of different
+// types, we give up and the script is executed by the virtual machine
+// as normal - so the results are always the same.
+type fastFilter struct {
+	// fields holds the names of the fields the script uses.
+	fields []string
+
+	// known holds the fields whose values are known ahead of time,
+	// which are treated as literals.
+	known map[string]object.Object
+
+	// cond is the expression which is evaluated.
+	cond fastNode
+
+	// ifTrue and ifFalse are the results we return, depending on
+	// whether the expression is true.
+	ifTrue  bool
+	ifFalse bool
+
+	// strict is true if conditions must be booleans, in which case
+	// we give up on anything else, so that the virtual machine can
+	// report the error.
+	strict bool
+
+	// types caches the location of the fields within the structure
+	// types we've run against.  A nil entry means the structure has
+	// no such field.
+	types map[reflect.Type][][]int
+}
+
+// newFastFilter returns a fastFilter for the given program, or nil if the
+// program is too complex to be handled by one.
+//
+// The values of the given fields are known, if the script has been
+// specialized, and strict is true if conditions must be booleans.
+func newFastFilter(program *ast.Program, known map[string]object.Object, strict bool) *fastFilter {
+
+	expr, ifTrue, ifFalse, ok := filterCondition(program)
+	if !ok {
+		return nil
+	}
+
+	f := &fastFilter{ifTrue: ifTrue, ifFalse: ifFalse, known: known, strict: strict}
+
+	f.cond = f.compile(expr)
+	if f.cond == nil {
+		return nil
+	}
+
+	f.types = make(map[reflect.Type][][]int)
+	return f
+}
+
+// filterCondition returns the condition tested by a simple filter, along
+// with the results it returns if the condition is true, and if it is
+// false.  We return false if the program isn't a simple filter.
+//
+// We accept programs of the following forms:
+//
+//	return EXPR;
+//	if ( EXPR ) { return BOOL; } return BOOL;
+//	if ( EXPR ) { return BOOL; } else { return BOOL; }
+func filterCondition(program *ast.Program) (ast.Expression, bool, bool, bool) {
+
+	// Named rules, and tests, are compiled separately, and pragmas
+	// generate no code, so we ignore them.
+	var stmts []ast.Statement
+	for _, s := range program.Statements {
+		switch s.(type) {
+		case *ast.RuleStatement, *ast.TestStatement, *ast.PragmaStatement:
+		default:
+			stmts = append(stmts, s)
+		}
+	}
+
+	switch len(stmts) {
+	case 1:
+		if ret, ok := stmts[0].(*ast.ReturnStatement); ok {
+			return ret.ReturnValue, true, false, true
+		}
+
+		cond, consequence, alternative, ok := fastIf(stmts[0])
+		if !ok || alternative == nil {
+			return nil, false, false, false
+		}
+		return cond, *consequence, *alternative, true
+
+	case 2:
+		cond, consequence, alternative, ok := fastIf(stmts[0])
+		if !ok || alternative != nil {
+			return nil, false, false, false
+		}
+		last, ok := fastReturn(stmts[1])
+		if !ok {
+			return nil, false, false, false
+		}
+		return cond, *consequence, last, true
+	}
+
+	return nil, false, false, false
+}
+
+// fastIf tests whether the given statement is an if-statement whose
+// blocks only return boolean literals.  The alternative is nil if the
+// statement has no else-block.
+func fastIf(stmt ast.Statement) (ast.Expression, *bool, *bool, bool) {
+
+	es, ok := stmt.(*ast.ExpressionStatement)
+	if !ok {
+		return nil, nil, nil, false
+	}
+	ie, ok := es.Expression.(*ast.IfExpression)
+	if !ok || ie.Consequence == nil || len(ie.Consequence.Statements) != 1 {
+		return nil, nil, nil, false
+	}
+
+	consequence, ok := fastReturn(ie.Consequence.Statements[0])
+	if !ok {
+		return nil, nil, nil, false
+	}
+
+	if ie.Alternative == nil {
+		return ie.Condition, &consequence, nil, true
+	}
+
+	if len(ie.Alternative.Statements) != 1 {
+		return nil, nil, nil, false
+	}
+	alternative, ok := fastReturn(ie.Alternative.Statements[0])
+	if !ok {
+		return nil, nil, nil, false
+	}
+
+	return ie.Condition, &consequence, &alternative, true
+}
+
+// fastReturn tests whether the given statement returns a boolean
+// literal, and returns its value.
+func fastReturn(stmt ast.Statement) (bool, bool) {
+	ret, ok := stmt.(*ast.ReturnStatement)
+	if !ok {
+		return false, false
+	}
+	lit, ok := ret.ReturnValue.(*ast.BooleanLiteral)
+	if !ok {
+		return false, false
+	}
+	return lit.Value, true
+}
+
+// compile converts the given expression to a fastNode, or returns nil
+// if that isn't possible.
+func (f *fastFilter) compile(expr ast.Expression) fastNode {
+
+	switch node := expr.(type) {
+
+	case *ast.BooleanLiteral:
+		val := fastValue{kind: fastBool, b: node.Value}
+		return func([]fastValue) (fastValue, bool) { return val, true }
+
+	case *ast.IntegerLiteral:
+		val := fastValue{kind: fastInt, i: node.Value}
+		return func([]fastValue) (fastValue, bool) { return val, true }
+
+	case *ast.FloatLiteral:
+		val := fastValue{kind: fastFloat, f: node.Value}
+		return func([]fastValue) (fastValue, bool) { return val, true }
+
+	case *ast.StringLiteral:
+		val := fastValue{kind: fastString, s: node.Value}
+		return func([]fastValue) (fastValue, bool) { return val, true }
+
+	case *ast.Identifier:
+		name := strings.TrimPrefix(node.Value, "$")
+		if obj, ok := f.known[name]; ok {
+			val, ok := fastLiteral(obj)
+			if !ok {
+				return nil
+			}
+			return func([]fastValue) (fastValue, bool) { return val, true }
+		}
+
+		idx := f.field(name)
+		return func(fields []fastValue) (fastValue, bool) { return fields[idx], true }
+
+	case *ast.PrefixExpression:
+		return f.compilePrefix(node)
+
+	case *ast.BetweenExpression:
+		value := f.compile(node.Value)
+		low := f.compile(node.Low)
+		high := f.compile(node.High)
+		if value == nil || low == nil || high == nil {
+			return nil
+		}
+		return fastBetween(value, low, high)
+
+	case *ast.InfixExpression:
+		left := f.compile(node.Left)
+		right := f.compile(node.Right)
+		if left == nil || right == nil {
+			return nil
+		}
+
+		switch node.Operator {
+		case "&&", "||":
+			return fastLogical(node.Operator, left, right, f.strict)
+		case "==", "!=", "<", "<=", ">", ">=":
+			return fastCompare(node.Operator, left, right)
+		}
+	}
+
+	return nil
+}
+
+// compilePrefix converts the given prefix expression to a fastNode, or
+// returns nil if that isn't possible.
+func (f *fastFilter) compilePrefix(node *ast.PrefixExpression) fastNode {
+
+	switch node.Operator {
+	case "!":
+		right := f.compile(node.Right)
+		if right == nil {
+			return nil
+		}
+		return func(fields []fastValue) (fastValue, bool) {
+			val, ok := right(fields)
+			if !ok {
+				return val, false
+			}
+
+			// Only booleans are negated, everything else
+			// which isn't null is false.
+			if val.kind == fastBool {
+				return fastValue{kind: fastBool, b: !val.b}, true
+			}
+			return fastValue{kind: fastBool}, true
+		}
+
+	case "-":
+		// Only negative literals are supported.
+		switch lit := node.Right.(type) {
+		case *ast.IntegerLiteral:
+			if lit.Value == math.MinInt64 {
+				return nil
+			}
+			val := fastValue{kind: fastInt, i: -lit.Value}
+			return func([]fastValue) (fastValue, bool) { return val, true }
+		case *ast.FloatLiteral:
+			val := fastValue{kind: fastFloat, f: -lit.Value}
+			return func([]fastValue) (fastValue, bool) { return val, true }
+		}
+	}
+
+	return nil
+}
+
+// fastLiteral converts the given object to a fastValue, returning false
+// if that isn't possible.
+func fastLiteral(obj object.Object) (fastValue, bool) {
+	switch o := obj.(type) {
+	case *object.Boolean:
+		return fastValue{kind: fastBool, b: o.Value}, true
+	case *object.Integer:
+		return fastValue{kind: fastInt, i: o.Value}, true
+	case *object.Float:
+		return fastValue{kind: fastFloat, f: o.Value}, true
+	case *object.String:
+		return fastValue{kind: fastString, s: o.Value}, true
+	}
+	return fastValue{}, false
+}
+
+// field returns the index of the named field, adding it to the list of
+// fields we read if it isn't already present.
+func (f *fastFilter) field(name string) int {
+	for i, existing := range f.fields {
+		if existing == name {
+			return i
+		}
+	}
+	f.fields = append(f.fields, name)
+	return len(f.fields) - 1
+}
+
+// fastLogical returns a node which performs a logical operation.
+//
+// As with the virtual machine both operands are always evaluated, and if
+// strict is true they must be booleans.
+func fastLogical(op string, left, right fastNode, strict bool) fastNode {
+	return func(fields []fastValue) (fastValue, bool) {
+		l, ok := left(fields)
+		if !ok {
+			return l, false
+		}
+		r, ok := right(fields)
+		if !ok {
+			return r, false
+		}
+
+		// The virtual machine treats a pair of numbers, or a pair
+		// of strings, differently.
+		if (fastNumeric(l) && fastNumeric(r)) || (l.kind == fastString && r.kind == fastString) {
+			return l, false
+		}
+		if strict && (l.kind != fastBool || r.kind != fastBool) {
+			return l, false
+		}
+
+		res := fastValue{kind: fastBool}
+		if op == "&&" {
+			res.b = l.True() && r.True()
+		} else {
+			res.b = l.True() || r.True()
+		}
+		return res, true
+	}
+}
+
+// fastCompare returns a node which compares two values.
+func fastCompare(op string, left, right fastNode) fastNode {
+	return func(fields []fastValue) (fastValue, bool) {
+		l, ok := left(fields)
+		if !ok {
+			return l, false
+		}
+		r, ok := right(fields)
+		if !ok {
+			return r, false
+		}
+
+		res := fastValue{kind: fastBool}
+
+		switch {
+		case l.kind == fastInt && r.kind == fastInt:
+			res.b = fastOrdered(op, compareInts(l.i, r.i))
+
+		case fastNumeric(l) && fastNumeric(r):
+			lf, rf := fastFloatValue(l), fastFloatValue(r)
+
+			// Comparing NaN is an error, which the virtual
+			// machine reports.
+			if math.IsNaN(lf) || math.IsNaN(rf) {
+				return res, false
+			}
+
+			switch op {
+			case "==":
+				res.b = lf == rf
+			case "!=":
+				res.b = lf != rf
+			case "<":
+				res.b = lf < rf
+			case "<=":
+				res.b = lf <= rf
+			case ">":
+				res.b = lf > rf
+			case ">=":
+				res.b = lf >= rf
+			}
+
+		case l.kind == fastString && r.kind == fastString:
+			res.b = fastOrdered(op, strings.Compare(l.s, r.s))
+
+		case l.kind == fastBool && r.kind == fastBool:
+			// Booleans have no ordering.
+			switch op {
+			case "==":
+				res.b = l.b == r.b
+			case "!=":
+				res.b = l.b != r.b
+			default:
+				return res, false
+			}
+
+		default:
+			return res, false
+		}
+
+		return res, true
+	}
+}
+
+// fastBetween returns a node which tests a value against a range.
+//
+// As with the virtual machine the upper bound is only compared if the
+// value is not below the lower bound.
+func fastBetween(value, low, high fastNode) fastNode {
+	lower := fastCompare(">=", value, low)
+	upper := fastCompare("<=", value, high)
+	return func(fields []fastValue) (fastValue, bool) {
+		res, ok := lower(fields)
+		if !ok || !res.b {
+			return res, ok
+		}
+		return upper(fields)
+	}
+}
+
+// compareInts returns -1, 0, or 1 depending on the ordering of the values.
+func compareInts(l, r int64) int {
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
+	}
+	return 0
+}
+
+// fastOrdered returns the result of the given comparison, given the
+// result of comparing two values.
+func fastOrdered(op string, cmp int) bool {
+	switch op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	}
+	return cmp >= 0
+}
+
+// fastNumeric returns true if the value is an integer or a float.
+func fastNumeric(v fastValue) bool {
+	return v.kind == fastInt || v.kind == fastFloat
+}
+
+// fastFloatValue promotes a numeric value to a float64.
+func fastFloatValue(v fastValue) float64 {
+	if v.kind == fastInt {
+		return float64(v.i)
+	}
+	return v.f
+}
+
+// copy returns a copy of the filter, with a cache of its own, so that it
+// may be used concurrently with us.
+func (f *fastFilter) copy() *fastFilter {
+	c := *f
+	c.types = make(map[reflect.Type][][]int)
+	return &c
+}
+
+// run evaluates the filter against the given object.
+//
+// We return false if we couldn't evaluate the filter, in which case the
+// caller should use the virtual machine instead.
+func (f *fastFilter) run(obj interface{}, env *environment.Environment) (bool, bool) {
+
+	// Objects which supply their own fields aren't handled.
+	if _, ok := obj.(FieldProvider); ok {
+		return false, false
+	}
+
+	var buf [8]fastValue
+	fields := buf[:0]
+
+	for _, name := range f.fields {
+
+		// Variables take precedence over fields.
+		if _, ok := env.Get(name); ok {
+			return false, false
+		}
+
+		val, ok := f.value(obj, name)
+		if !ok {
+			return false, false
+		}
+		fields = append(fields, val)
+	}
+
+	val, ok := f.cond(fields)
+	if !ok || (f.strict && val.kind != fastBool) {
+		return false, false
+	}
+
+	if val.True() {
+		return f.ifTrue, true
+	}
+	return f.ifFalse, true
+}
+
+// value returns the named field of the given object.
+func (f *fastFilter) value(obj interface{}, name string) (fastValue, bool) {
+
+	switch o := obj.(type) {
+	case map[string]interface{}:
+		v, ok := o[name]
+		if !ok {
+			return fastValue{}, false
+		}
+		return fastNative(v)
+
+	case map[string]object.Object:
+		v, ok := o[name]
+		if !ok {
+			return fastValue{}, false
+		}
+		return fastObject(v)
+	}
+
+	if obj == nil {
+		return fastValue{}, false
+	}
+
+	val := reflect.ValueOf(obj)
+	if val.Kind() == reflect.Ptr {
+		if val.IsNil() {
+			return fastValue{}, false
+		}
+		val = val.Elem()
+	}
+
+	switch val.Kind() {
+	case reflect.Map:
+		if val.Type().Key().Kind() != reflect.String {
+			return fastValue{}, false
+		}
+		v := val.MapIndex(reflect.ValueOf(name).Convert(val.Type().Key()))
+		if !v.IsValid() {
+			return fastValue{}, false
+		}
+		return fastReflect(v)
+
+	case reflect.Struct:
+		index := f.index(val.Type(), name)
+		if index == nil {
+			return fastValue{}, false
+		}
+		for i, n := range index {
+			if i > 0 && val.Kind() == reflect.Ptr {
+				if val.IsNil() {
+					return fastValue{}, false
+				}
+				val = val.Elem()
+			}
+			val = val.Field(n)
+		}
+		return fastReflect(val)
+	}
+
+	return fastValue{}, false
+}
+
+// index returns the location of the named field within the given
+// structure type, or nil if there is no such field.
+func (f *fastFilter) index(typ reflect.Type, name string) []int {
+
+	indexes, ok := f.types[typ]
+	if !ok {
+		indexes = make([][]int, len(f.fields))
+		for i, n := range f.fields {
+			if field, found := typ.FieldByName(n); found {
+				indexes[i] = field.Index
+			}
+		}
+		f.types[typ] = indexes
+	}
+
+	for i, n := range f.fields {
+		if n == name {
+			return indexes[i]
+		}
+	}
+	return nil
+}
+
+// fastNative converts a common golang value to a fastValue.
+func fastNative(v interface{}) (fastValue, bool) {
+	switch v := v.(type) {
+	case string:
+		return fastValue{kind: fastString, s: v}, true
+	case int:
+		return fastValue{kind: fastInt, i: int64(v)}, true
+	case int64:
+		return fastValue{kind: fastInt, i: v}, true
+	case float64:
+		return fastValue{kind: fastFloat, f: v}, true
+	case bool:
+		return fastValue{kind: fastBool, b: v}, true
+	case nil:
+		return fastValue{}, false
+	}
+	return fastReflect(reflect.ValueOf(v))
+}
+
+// fastObject converts an object to a fastValue.
+func fastObject(v object.Object) (fastValue, bool) {
+	switch v := v.(type) {
+	case *object.String:
+		return fastValue{kind: fastString, s: v.Value}, true
+	case *object.Integer:
+		return fastValue{kind: fastInt, i: v.Value}, true
+	case *object.Float:
+		return fastValue{kind: fastFloat, f: v.Value}, true
+	case *object.Boolean:
+		return fastValue{kind: fastBool, b: v.Value}, true
+	}
+	return fastValue{}, false
+}
+
+// fastReflect converts a value, discovered via reflection, to a fastValue.
+//
+// This mirrors the conversion the virtual machine performs.
+func fastReflect(val reflect.Value) (fastValue, bool) {
+
+	for val.Kind() == reflect.Interface || val.Kind() == reflect.Ptr {
+		if val.IsNil() {
+			return fastValue{}, false
+		}
+		val = val.Elem()
+	}
+
+	switch val.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return fastValue{kind: fastInt, i: val.Int()}, true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if val.Uint() > math.MaxInt64 {
+			return fastValue{kind: fastFloat, f: float64(val.Uint())}, true
+		}
+		return fastValue{kind: fastInt, i: int64(val.Uint())}, true
+	case reflect.Float32, reflect.Float64:
+		return fastValue{kind: fastFloat, f: val.Float()}, true
+	case reflect.String:
+		return fastValue{kind: fastString, s: val.String()}, true
+	case reflect.Bool:
+		return fastValue{kind: fastBool, b: val.Bool()}, true
+	}
+
+	return fastValue{}, false
+}
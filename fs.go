@@ -0,0 +1,70 @@
+//go:build go1.16
+// +build go1.16
+
+// fs.go contains code for compiling all of the scripts held in a file
+// system, such as one which is embedded via go:embed.
+
+package evalfilter
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// ScriptExtension is the extension of the files which LoadFS compiles.
+const ScriptExtension = ".ef"
+
+// LoadFS compiles each of the scripts in the given file system, and the
+// directories beneath it, whose names end in ScriptExtension.
+//
+// The evaluators are prepared, and are returned by the paths of their
+// scripts, without the extension, so `rules/ssh.ef` becomes `rules/ssh`.
+// This allows a set of scripts to be embedded in an application:
+//
+//	//go:embed rules
+//	var rules embed.FS
+//
+//	scripts, err := evalfilter.LoadFS(rules)
+//
+// Unless another resolver is given in the options, scripts may include
+// others from the same file system via their paths.  An error is
+// returned if any of the scripts can't be read, or compiled.
+func LoadFS(fsys fs.FS, options ...Option) (map[string]*Eval, error) {
+
+	resolver := func(name string) (string, error) {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+	options = append([]Option{WithIncludeResolver(resolver)}, options...)
+
+	scripts := make(map[string]*Eval)
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || path.Ext(name) != ScriptExtension {
+			return nil
+		}
+
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+
+		e := New(string(data), options...)
+		if err := e.Prepare(); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		scripts[strings.TrimSuffix(name, ScriptExtension)] = e
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return scripts, nil
+}
@@ -0,0 +1,46 @@
+//go:build go1.16
+// +build go1.16
+
+package evalfilter
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// TestLoadFS tests compiling the scripts held in a file system.
+func TestLoadFS(t *testing.T) {
+
+	fsys := fstest.MapFS{
+		"ssh.ef":          {Data: []byte(`include "lib/ports.ef"; return Port == ssh;`)},
+		"lib/ports.ef":    {Data: []byte(`ssh = 22;`)},
+		"rules/telnet.ef": {Data: []byte(`return Port == 23;`)},
+		"README.md":       {Data: []byte(`not a script`)},
+	}
+
+	scripts, err := LoadFS(fsys)
+	if err != nil {
+		t.Fatalf("failed to load: %s", err)
+	}
+	if len(scripts) != 3 {
+		t.Fatalf("unexpected scripts: %v", scripts)
+	}
+
+	for name, port := range map[string]int{"ssh": 22, "rules/telnet": 23} {
+		e, ok := scripts[name]
+		if !ok {
+			t.Fatalf("script %s is missing", name)
+		}
+		ret, err := e.Run(map[string]interface{}{"Port": port})
+		if err != nil || !ret {
+			t.Fatalf("unexpected result for %s: %v %v", name, ret, err)
+		}
+	}
+
+	fsys["broken.ef"] = &fstest.MapFile{Data: []byte(`return (;`)}
+	_, err = LoadFS(fsys)
+	if err == nil || !strings.HasPrefix(err.Error(), "broken.ef: ") {
+		t.Fatalf("expected an error for broken.ef, got %v", err)
+	}
+}
@@ -7,18 +7,9 @@ import "github.com/skx/evalfilter/v2"
 func Fuzz(data []byte) int {
 
 	//
-	// Create the helper
+	// Parse the program, create the bytecode, optimize it, and
+	// run it - within the limits which prevent it looping forever,
+	// or using all of our memory.
 	//
-	eval := evalfilter.New(string(data))
-
-	//
-	// Parse the program.
-	//
-	// Create the bytecode.
-	//
-	// Optimize it.
-	//
-	eval.Prepare()
-
-	return 0
+	return evalfilter.FuzzCompileAndRun(data)
 }
@@ -0,0 +1,46 @@
+//go:build go1.18
+// +build go1.18
+
+package evalfilter
+
+import (
+	"testing"
+)
+
+// FuzzScripts runs random scripts via FuzzCompileAndRun, which allows the
+// native fuzzing of `go test -fuzz=FuzzScripts` to be used in place of
+// go-fuzz.
+func FuzzScripts(f *testing.F) {
+
+	for _, seed := range []string{
+		`return Count == 3 && Name ~= /^s/i;`,
+		`i = 0; while ( i < Count ) { i++; } return i > 2;`,
+		`return len(filter(Tags, t => type(t) == "string")) > 0;`,
+		`rule "admin" { return Admin; } return Nested.Values[1] == 2;`,
+		`return catch( int(Name), 0 ) == 0;`,
+	} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		FuzzCompileAndRun(data)
+	})
+}
+
+// FuzzPaths runs random scripts via FuzzDifferential, which fails if the
+// ways in which we execute them disagree.
+func FuzzPaths(f *testing.F) {
+
+	for _, seed := range []string{
+		`return Count == 3 && Name ~= /^s/i;`,
+		`return Price > 1 && Price < 2 || Missing == "";`,
+		`i = 0; while ( i < Count ) { i++; } return i > 2;`,
+		`return 1 + 2 * 3 == 7 && "a" + "b" == "ab";`,
+	} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		FuzzDifferential(data)
+	})
+}
@@ -0,0 +1,110 @@
+// fuzzing.go contains the entry-points used when fuzz-testing the lexer,
+// parser, compiler, and virtual machine.
+
+package evalfilter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// FuzzLimits are the limits applied to the scripts prepared by the fuzzing
+// entry-points, which ensure that every input is handled quickly, and
+// without using much memory.
+var FuzzLimits = Limits{
+	MaxInstructions: 4096,
+	MaxConstants:    1024,
+	MaxDepth:        64,
+	MaxRegexps:      32,
+	MaxSteps:        100000,
+}
+
+// fuzzObject is the object the fuzzing entry-points run scripts against.
+func fuzzObject() map[string]interface{} {
+	return map[string]interface{}{
+		"Name":   "Steve",
+		"Count":  3,
+		"Price":  1.25,
+		"Admin":  true,
+		"Tags":   []interface{}{"one", 2, 3.5, false},
+		"Nested": map[string]interface{}{"Name": "Kemp", "Values": []int{1, 2, 3}},
+	}
+}
+
+// FuzzCompile prepares the given script, with FuzzLimits, and returns 1 if
+// it's valid, or 0 if it isn't, which is the convention of go-fuzz.
+func FuzzCompile(data []byte) int {
+
+	e := New(string(data), WithLimits(FuzzLimits))
+	if err := e.Prepare(); err != nil {
+		return 0
+	}
+	return 1
+}
+
+// FuzzCompileAndRun prepares the given script, with FuzzLimits, and runs
+// it, along with any named rules it defines, against a fixed object.
+//
+// It returns 1 if the script was run, whether or not that failed, and 0
+// if it wasn't valid.  Scripts which call functions whose results might
+// differ between runs, as reported by Nondeterminism, are prepared but
+// not run, so that the results are reproducible, and anything the script
+// prints is discarded.
+func FuzzCompileAndRun(data []byte) int {
+
+	e := New(string(data), WithLimits(FuzzLimits))
+	e.SetOutput(ioutil.Discard)
+	if err := e.Prepare(); err != nil {
+		return 0
+	}
+
+	calls, err := e.Nondeterminism()
+	if err != nil || len(calls) > 0 {
+		return 0
+	}
+
+	_, _ = e.Run(fuzzObject())
+	_, _ = e.RunAll(fuzzObject())
+	return 1
+}
+
+// FuzzDifferential prepares the given script, with FuzzLimits, and runs it
+// in each of the ways in which we might execute it - natively, via the
+// optimized bytecode, and via the unoptimized bytecode - and panics if
+// they disagree, so that the fuzzer reports the script as a crasher.
+//
+// It returns 1 if the script was run, and 0 if it wasn't, for the same
+// reasons as FuzzCompileAndRun.
+func FuzzDifferential(data []byte) int {
+
+	e := New(string(data), WithLimits(FuzzLimits))
+	if err := e.Prepare(); err != nil {
+		return 0
+	}
+	calls, err := e.Nondeterminism()
+	if err != nil || len(calls) > 0 {
+		return 0
+	}
+
+	//
+	// The unoptimized bytecode is larger, so it isn't limited by
+	// size, and output is discarded.
+	//
+	limits := FuzzLimits
+	limits.MaxInstructions = 0
+	limits.MaxConstants = 0
+	quiet := func(e *Eval) {
+		e.SetOutput(ioutil.Discard)
+	}
+
+	divergences, err := differential(string(data), []Option{WithLimits(limits), quiet},
+		fuzzObject(), map[string]interface{}{})
+	if err != nil {
+		return 0
+	}
+	if len(divergences) > 0 {
+		panic(fmt.Sprintf("the execution paths diverge for %q:\n%s", data, strings.Join(divergences, "\n")))
+	}
+	return 1
+}
@@ -0,0 +1,104 @@
+// geoip.go contains the interface which allows scripts to find the
+// country, and the autonomous system, of an IP address.
+
+package evalfilter
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/skx/evalfilter/v2/object"
+)
+
+// GeoIPProvider is implemented by the host application to locate IP
+// addresses, typically via a MaxMind database, or a similar service,
+// which scripts may query via the `country` and `asn` functions.
+//
+// Providers must be safe for concurrent use.
+type GeoIPProvider interface {
+	// Country returns the ISO 3166-1 alpha-2 code of the country in
+	// which the given address is located, such as "GB", and false if
+	// it isn't known.
+	Country(ip net.IP) (string, bool, error)
+
+	// ASN returns the number of the autonomous system which announces
+	// the given address, and false if it isn't known.
+	ASN(ip net.IP) (int64, bool, error)
+}
+
+// WithGeoIPProvider makes the given provider available to scripts, via
+// the following functions:
+//
+//	country(ip)
+//	asn(ip)
+//
+// These return the upper-case code of the country, and the number of the
+// autonomous system, respectively, or Null if the address isn't known.
+// As Null is false this allows scripts to write geofencing rules such as:
+//
+//	if ( country(SourceIP) in [ "KP", "IR" ] ) { return true; }
+//
+// These functions are not available unless this option is used.
+func WithGeoIPProvider(provider GeoIPProvider) Option {
+	return func(e *Eval) {
+		e.AddFunction("country", func(args []object.Object) object.Object {
+			return country(provider, args)
+		})
+		e.AddFunction("asn", func(args []object.Object) object.Object {
+			return asn(provider, args)
+		})
+	}
+}
+
+// country is the implementation of our `country` function.
+func country(provider GeoIPProvider, args []object.Object) object.Object {
+
+	ip, e := geoIPAddress("country", args)
+	if e != nil {
+		return e
+	}
+
+	code, ok, err := provider.Country(ip)
+	if err != nil {
+		return &object.Error{Message: fmt.Sprintf("country failed: %s", err.Error())}
+	}
+	if !ok {
+		return object.NewNull()
+	}
+	return &object.String{Value: strings.ToUpper(code)}
+}
+
+// asn is the implementation of our `asn` function.
+func asn(provider GeoIPProvider, args []object.Object) object.Object {
+
+	ip, e := geoIPAddress("asn", args)
+	if e != nil {
+		return e
+	}
+
+	number, ok, err := provider.ASN(ip)
+	if err != nil {
+		return &object.Error{Message: fmt.Sprintf("asn failed: %s", err.Error())}
+	}
+	if !ok {
+		return object.NewNull()
+	}
+	return object.NewInteger(number)
+}
+
+// geoIPAddress returns the single argument given to the named function,
+// which must be an IPv4, or IPv6, address.
+func geoIPAddress(name string, args []object.Object) (net.IP, *object.Error) {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return nil, &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("%s expects one argument, got %d", name, len(args))}
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(args[0].Inspect()))
+	if ip == nil {
+		return nil, &object.Error{Kind: object.ValueError, Message: fmt.Sprintf("%s expects an IP address, got %q", name, args[0].Inspect())}
+	}
+	return ip, nil
+}
@@ -5,4 +5,5 @@ go 1.12
 require (
 	github.com/dvyukov/go-fuzz v0.0.0-20191206100749-a378175e205c // indirect
 	github.com/google/subcommands v1.0.1
+	golang.org/x/text v0.3.6
 )
@@ -0,0 +1,84 @@
+// host.go contains the functions which allow scripts to access details
+// of the host they're running upon, if permitted.
+
+package evalfilter
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/skx/evalfilter/v2/object"
+)
+
+// WithHostAccess allows scripts to access details of the host they're
+// running upon, via the following functions:
+//
+//	getenv(name [, default])
+//	hostname()
+//
+// This allows a filter to branch on the environment it has been deployed
+// to, without the need to template the script.
+//
+// If any names are given then only the environment variables with those
+// names may be read, otherwise scripts may read any variable.
+//
+// These functions are not available unless this option is used, as
+// scripts may not be as trusted as the host application.
+func WithHostAccess(names ...string) Option {
+
+	var allowed map[string]bool
+	if len(names) > 0 {
+		allowed = make(map[string]bool, len(names))
+		for _, name := range names {
+			allowed[name] = true
+		}
+	}
+
+	return func(e *Eval) {
+		e.AddFunction("getenv", func(args []object.Object) object.Object {
+			return getenv(allowed, args)
+		})
+		e.AddFunction("hostname", hostname)
+	}
+}
+
+// getenv is the implementation of our `getenv` function.
+//
+// It returns the value of the given environment variable, or the
+// optional default if the variable isn't set.
+func getenv(allowed map[string]bool, args []object.Object) object.Object {
+
+	// We expect one argument, and an optional default
+	if len(args) != 1 && len(args) != 2 {
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("getenv expects one or two arguments, got %d", len(args))}
+	}
+
+	name := args[0].Inspect()
+	if allowed != nil && !allowed[name] {
+		return &object.Error{Kind: object.ValueError, Message: fmt.Sprintf("access to the environment variable %s is not permitted", name)}
+	}
+
+	val, ok := os.LookupEnv(name)
+	if !ok {
+		if len(args) == 2 {
+			return args[1]
+		}
+		return &object.String{Value: ""}
+	}
+	return &object.String{Value: val}
+}
+
+// hostname is the implementation of our `hostname` function.
+func hostname(args []object.Object) object.Object {
+
+	// We expect no arguments
+	if len(args) != 0 {
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("hostname expects no arguments, got %d", len(args))}
+	}
+
+	name, err := os.Hostname()
+	if err != nil {
+		return &object.Error{Message: fmt.Sprintf("failed to get the hostname: %s", err.Error())}
+	}
+	return &object.String{Value: name}
+}
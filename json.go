@@ -0,0 +1,90 @@
+// json.go contains code for running scripts against JSON documents.
+
+package evalfilter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/skx/evalfilter/v2/object"
+)
+
+// RunJSON executes the script against the given JSON object, rather than
+// against a golang object or map.
+//
+// This saves you from having to unmarshal the document into a structure
+// of your own.  Nested objects are available as hashes, so a script may
+// test "Request.Headers.Host", for example, and arrays may be indexed
+// as usual.  Numbers without a fractional part are treated as integers.
+func (e *Eval) RunJSON(data []byte) (bool, error) {
+
+	fields, err := jsonFields(data)
+	if err != nil {
+		return false, err
+	}
+
+	return e.RunFields(fields)
+}
+
+// ExplainJSON explains the result of running the script against the given
+// JSON object, as Explain does for a golang object or map.
+func (e *Eval) ExplainJSON(data []byte) (*Explanation, error) {
+
+	fields, err := jsonFields(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.Explain(fields)
+}
+
+// jsonFields decodes the given JSON object into a set of fields.
+func jsonFields(data []byte) (map[string]object.Object, error) {
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var doc map[string]interface{}
+	err := dec.Decode(&doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode JSON: %s", err.Error())
+	}
+
+	fields := make(map[string]object.Object, len(doc))
+	for name, val := range doc {
+		fields[name] = jsonToObject(val)
+	}
+	return fields, nil
+}
+
+// jsonToObject converts a decoded JSON value to an object.
+func jsonToObject(val interface{}) object.Object {
+
+	switch v := val.(type) {
+	case map[string]interface{}:
+		hash := &object.Hash{Pairs: make(map[string]object.Object, len(v))}
+		for name, member := range v {
+			hash.Pairs[name] = jsonToObject(member)
+		}
+		return hash
+	case []interface{}:
+		arr := &object.Array{Elements: make([]object.Object, len(v))}
+		for i, member := range v {
+			arr.Elements[i] = jsonToObject(member)
+		}
+		return arr
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return object.NewInteger(i)
+		}
+		f, _ := v.Float64()
+		return &object.Float{Value: f}
+	case string:
+		return &object.String{Value: v}
+	case bool:
+		return object.NewBoolean(v)
+	}
+
+	return object.NewNull()
+}
@@ -8,8 +8,12 @@ package lexer
 import (
 	"errors"
 	"fmt"
+	"math"
+	"sort"
+	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/skx/evalfilter/v2/token"
 )
@@ -30,6 +34,33 @@ type Lexer struct {
 
 	// Previous token.
 	prevToken token.Token
+
+	// lines holds the number of newlines we've read.
+	lines int
+
+	// line holds the line upon which the current token started.
+	line int
+
+	// comments holds the comments we've skipped over, in the order
+	// in which they appeared.
+	comments []Comment
+
+	// symbols holds the operators, added via AddOperator, which are
+	// made of symbols, the longest first, and words holds those which
+	// are words.
+	symbols []string
+	words   map[string]bool
+}
+
+// Comment holds a comment which the lexer skipped over.
+type Comment struct {
+	// Token holds the text of the comment, including the `//`, or
+	// the `/*` and `*/`, which delimit it, and the line upon which
+	// it started.
+	Token token.Token
+
+	// Trailing is true if the comment follows code on the same line.
+	Trailing bool
 }
 
 // New creates a Lexer instance from the given string
@@ -65,20 +96,86 @@ func (l *Lexer) readChar() {
 	} else {
 		l.ch = l.characters[l.readPosition]
 	}
+	if l.ch == rune('\n') {
+		l.lines++
+	}
 	l.position = l.readPosition
 	l.readPosition++
 }
 
+// AddOperator causes the given operator, which is added by the host
+// application, to be returned as an OPERATOR token.
+//
+// An operator which is a word, such as `inside`, is recognized in place
+// of the identifier of the same name.  One which is made of symbols, such
+// as `~>`, is recognized in preference to the operators which begin it,
+// so it shouldn't begin with a complete operator of our own which might
+// be followed by an operand beginning with its remaining symbols.
+func (l *Lexer) AddOperator(op string) {
+	if isLetter(firstRune(op)) {
+		if l.words == nil {
+			l.words = make(map[string]bool)
+		}
+		l.words[op] = true
+		return
+	}
+
+	for _, sym := range l.symbols {
+		if sym == op {
+			return
+		}
+	}
+	l.symbols = append(l.symbols, op)
+	sort.SliceStable(l.symbols, func(i, j int) bool {
+		return len([]rune(l.symbols[i])) > len([]rune(l.symbols[j]))
+	})
+}
+
+// Comments returns the comments we've skipped over so far, in the order
+// in which they appeared.
+func (l *Lexer) Comments() []Comment {
+	return l.comments
+}
+
 // NextToken reads and returns the next token, skipping any intervening
 // white space, and swallowing any comments, in the process.
+//
+// Each token records the line upon which it started.
 func (l *Lexer) NextToken() token.Token {
+	tok := l.nextToken()
+	tok.Line = l.line
+	return tok
+}
+
+// nextToken reads and returns the next token.
+func (l *Lexer) nextToken() token.Token {
 	var tok token.Token
 	l.skipWhitespace()
 
-	// skip single-line comments
-	if l.ch == rune('/') && l.peekChar() == rune('/') {
-		l.skipComment()
-		return (l.NextToken())
+	// skip comments, which are either `// ...` or `/* ... */`.
+	if l.ch == rune('/') && (l.peekChar() == rune('/') || l.peekChar() == rune('*')) {
+		if !l.readComment() {
+			l.line = l.lines + 1
+			return token.Token{Type: token.ILLEGAL, Literal: "unterminated comment"}
+		}
+		return (l.nextToken())
+	}
+
+	l.line = l.lines + 1
+
+	// pragmas occupy the remainder of their line.
+	if l.ch == rune('#') && l.isPragma() {
+		return l.readPragma()
+	}
+
+	// operators added by the host take precedence over our own.
+	if op := l.matchOperator(); op != "" {
+		for range []rune(op) {
+			l.readChar()
+		}
+		tok = token.Token{Type: token.OPERATOR, Literal: op}
+		l.prevToken = tok
+		return tok
 	}
 
 	switch l.ch {
@@ -88,12 +185,24 @@ func (l *Lexer) NextToken() token.Token {
 			ch := l.ch
 			l.readChar()
 			tok = token.Token{Type: token.AND, Literal: string(ch) + string(l.ch)}
+		} else {
+			tok = newToken(token.BITAND, l.ch)
+		}
+	case rune('^'):
+		if l.peekChar() == rune('^') {
+			ch := l.ch
+			l.readChar()
+			tok = token.Token{Type: token.XOR, Literal: string(ch) + string(l.ch)}
+		} else {
+			tok = newToken(token.BITXOR, l.ch)
 		}
 	case rune('|'):
 		if l.peekChar() == rune('|') {
 			ch := l.ch
 			l.readChar()
 			tok = token.Token{Type: token.OR, Literal: string(ch) + string(l.ch)}
+		} else {
+			tok = newToken(token.BITOR, l.ch)
 		}
 
 	case rune('='):
@@ -101,6 +210,10 @@ func (l *Lexer) NextToken() token.Token {
 			ch := l.ch
 			l.readChar()
 			tok = token.Token{Type: token.EQ, Literal: string(ch) + string(l.ch)}
+		} else if l.peekChar() == rune('>') {
+			ch := l.ch
+			l.readChar()
+			tok = token.Token{Type: token.ARROW, Literal: string(ch) + string(l.ch)}
 		} else {
 			tok = newToken(token.ASSIGN, l.ch)
 		}
@@ -121,7 +234,17 @@ func (l *Lexer) NextToken() token.Token {
 		tok = newToken(token.PERIOD, l.ch)
 
 	case rune('+'):
-		tok = newToken(token.PLUS, l.ch)
+		if l.peekChar() == rune('=') {
+			ch := l.ch
+			l.readChar()
+			tok = token.Token{Type: token.PLUSEQUALS, Literal: string(ch) + string(l.ch)}
+		} else if l.peekChar() == rune('+') && l.isIncrement() {
+			ch := l.ch
+			l.readChar()
+			tok = token.Token{Type: token.PLUSPLUS, Literal: string(ch) + string(l.ch)}
+		} else {
+			tok = newToken(token.PLUS, l.ch)
+		}
 
 	case rune('%'):
 		tok = newToken(token.MOD, l.ch)
@@ -142,7 +265,17 @@ func (l *Lexer) NextToken() token.Token {
 		tok = newToken(token.RSQUARE, l.ch)
 
 	case rune('-'):
-		tok = newToken(token.MINUS, l.ch)
+		if l.peekChar() == rune('=') {
+			ch := l.ch
+			l.readChar()
+			tok = token.Token{Type: token.MINUSEQUALS, Literal: string(ch) + string(l.ch)}
+		} else if l.peekChar() == rune('-') && l.isIncrement() {
+			ch := l.ch
+			l.readChar()
+			tok = token.Token{Type: token.MINUSMINUS, Literal: string(ch) + string(l.ch)}
+		} else {
+			tok = newToken(token.MINUS, l.ch)
+		}
 
 	case rune('/'):
 
@@ -161,7 +294,13 @@ func (l *Lexer) NextToken() token.Token {
 			l.prevToken.Type == token.RSQUARE ||
 			l.prevToken.Type == token.FLOAT ||
 			l.prevToken.Type == token.INT {
-			tok = newToken(token.SLASH, l.ch)
+			if l.peekChar() == rune('=') {
+				ch := l.ch
+				l.readChar()
+				tok = token.Token{Type: token.SLASHEQUALS, Literal: string(ch) + string(l.ch)}
+			} else {
+				tok = newToken(token.SLASH, l.ch)
+			}
 		} else {
 			str, err := l.readRegexp()
 			if err == nil {
@@ -178,6 +317,10 @@ func (l *Lexer) NextToken() token.Token {
 			ch := l.ch
 			l.readChar()
 			tok = token.Token{Type: token.POW, Literal: string(ch) + string(l.ch)}
+		} else if l.peekChar() == rune('=') {
+			ch := l.ch
+			l.readChar()
+			tok = token.Token{Type: token.ASTERISKEQUALS, Literal: string(ch) + string(l.ch)}
 		} else {
 			tok = newToken(token.ASTERISK, l.ch)
 		}
@@ -187,6 +330,19 @@ func (l *Lexer) NextToken() token.Token {
 			ch := l.ch
 			l.readChar()
 			tok = token.Token{Type: token.LTEQUALS, Literal: string(ch) + string(l.ch)}
+		} else if l.peekChar() == rune('<') && l.peekCharAt(2) == rune('<') {
+			str, err := l.readHeredoc()
+			if err == nil {
+				tok.Type = token.STRING
+				tok.Literal = str
+			} else {
+				tok.Type = token.ILLEGAL
+				tok.Literal = err.Error()
+			}
+		} else if l.peekChar() == rune('<') {
+			ch := l.ch
+			l.readChar()
+			tok = token.Token{Type: token.SHL, Literal: string(ch) + string(l.ch)}
 		} else {
 			tok = newToken(token.LT, l.ch)
 		}
@@ -196,6 +352,10 @@ func (l *Lexer) NextToken() token.Token {
 			ch := l.ch
 			l.readChar()
 			tok = token.Token{Type: token.GTEQUALS, Literal: string(ch) + string(l.ch)}
+		} else if l.peekChar() == rune('>') {
+			ch := l.ch
+			l.readChar()
+			tok = token.Token{Type: token.SHR, Literal: string(ch) + string(l.ch)}
 		} else {
 			tok = newToken(token.GT, l.ch)
 		}
@@ -205,6 +365,16 @@ func (l *Lexer) NextToken() token.Token {
 			ch := l.ch
 			l.readChar()
 			tok = token.Token{Type: token.CONTAINS, Literal: string(ch) + string(l.ch)}
+		} else if l.peekChar() == rune('*') {
+			ch := l.ch
+			l.readChar()
+			tok = token.Token{Type: token.IMATCHES, Literal: string(ch) + string(l.ch)}
+		} else if l.peekChar() == rune('/') {
+			ch := l.ch
+			l.readChar()
+			tok = token.Token{Type: token.INTDIV, Literal: string(ch) + string(l.ch)}
+		} else {
+			tok = newToken(token.BITNOT, l.ch)
 		}
 
 	case rune('!'):
@@ -217,6 +387,11 @@ func (l *Lexer) NextToken() token.Token {
 				ch := l.ch
 				l.readChar()
 				tok = token.Token{Type: token.MISSING, Literal: string(ch) + string(l.ch)}
+
+				if l.peekChar() == rune('*') {
+					l.readChar()
+					tok = token.Token{Type: token.IMISSING, Literal: tok.Literal + string(l.ch)}
+				}
 			} else {
 				tok = newToken(token.BANG, l.ch)
 			}
@@ -232,6 +407,16 @@ func (l *Lexer) NextToken() token.Token {
 			tok.Literal = err.Error()
 		}
 
+	case rune('`'):
+		str, err := l.readRawString()
+		if err == nil {
+			tok.Type = token.STRING
+			tok.Literal = str
+		} else {
+			tok.Type = token.ILLEGAL
+			tok.Literal = err.Error()
+		}
+
 	case rune('\''):
 		str, err := l.readString('\'')
 
@@ -258,11 +443,15 @@ func (l *Lexer) NextToken() token.Token {
 		tok.Literal = l.readIdentifier()
 		if len(tok.Literal) > 0 {
 			tok.Type = token.LookupIdentifier(tok.Literal)
+			if l.words[tok.Literal] {
+				tok.Type = token.OPERATOR
+			}
 			l.prevToken = tok
 			return tok
 		}
 		tok.Type = token.ILLEGAL
 		tok.Literal = fmt.Sprintf("invalid character for indentifier '%c'", l.ch)
+		l.readChar()
 		return tok
 
 	}
@@ -299,12 +488,92 @@ func (l *Lexer) skipWhitespace() {
 	}
 }
 
-// skip a comment (until the end of the line).
-func (l *Lexer) skipComment() {
-	for l.ch != '\n' && l.ch != rune(0) {
+// read a comment, which either lasts until the end of the line, or until
+// the `*/` which terminates it, and record it.
+//
+// We return false if the comment is never terminated.
+func (l *Lexer) readComment() bool {
+	start := l.position
+	line := l.lines + 1
+
+	// The comment is trailing if there's code before it.
+	trailing := false
+	for i := start - 1; i >= 0 && l.characters[i] != rune('\n'); i-- {
+		if !isWhitespace(l.characters[i]) {
+			trailing = true
+			break
+		}
+	}
+
+	if l.peekChar() == rune('*') {
+		l.readChar()
+		l.readChar()
+		for !(l.ch == rune('*') && l.peekChar() == rune('/')) {
+			if l.ch == rune(0) {
+				return false
+			}
+			l.readChar()
+		}
+		l.readChar()
 		l.readChar()
+	} else {
+		for l.ch != '\n' && l.ch != rune(0) {
+			l.readChar()
+		}
+	}
+
+	end := l.position
+	if end > len(l.characters) {
+		end = len(l.characters)
 	}
+	l.comments = append(l.comments, Comment{
+		Token:    token.Token{Type: token.COMMENT, Literal: string(l.characters[start:end]), Line: line},
+		Trailing: trailing,
+	})
+
 	l.skipWhitespace()
+	return true
+}
+
+// isPragma returns true if we're at the start of a pragma, which is
+// `#pragma` followed by white space.
+func (l *Lexer) isPragma() bool {
+	const pragma = "#pragma"
+	end := l.position + len(pragma)
+	if end > len(l.characters) || string(l.characters[l.position:end]) != pragma {
+		return false
+	}
+	return end == len(l.characters) || isWhitespace(l.characters[end])
+}
+
+// read a pragma, such as `#pragma version 3`, returning the remainder
+// of its line as the literal.
+func (l *Lexer) readPragma() token.Token {
+	start := l.position + len("#pragma")
+	for l.ch != '\n' && l.ch != rune(0) {
+		l.readChar()
+	}
+
+	end := l.position
+	if end > len(l.characters) {
+		end = len(l.characters)
+	}
+	tok := token.Token{Type: token.PRAGMA, Literal: strings.TrimSpace(string(l.characters[start:end]))}
+	l.prevToken = tok
+	return tok
+}
+
+// matchOperator returns the operator, made of symbols, which begins at
+// our current position, or the empty string if there is none.
+func (l *Lexer) matchOperator() string {
+	for _, op := range l.symbols {
+		runes := []rune(op)
+		end := l.position + len(runes)
+		if end <= len(l.characters) && string(l.characters[l.position:end]) == op {
+			return op
+		}
+	}
+	return ""
 }
 
 // read a number.  We only care about numerical digits here, floats will
@@ -321,8 +590,32 @@ func (l *Lexer) readNumber() string {
 }
 
 // read a decimal number, either int or floating-point.
+//
+// Integers may also be written in hexadecimal, octal, or binary
+// via the "0x", "0o", and "0b" prefixes, which may be upper-case as
+// they may be in golang, and floating-point numbers
+// may have an exponent, as in "1.5e3".
 func (l *Lexer) readDecimal() token.Token {
 
+	//
+	// Is this a prefixed-integer?
+	//
+	if l.ch == rune('0') && strings.ContainsRune("xobXOB", l.peekChar()) {
+
+		// Save the prefix, and skip over it.
+		prefix := "0" + string(l.peekChar())
+		l.readChar()
+		l.readChar()
+
+		// Read the digits; the parser will validate them.
+		digits := ""
+		for isDigit(l.ch) || unicode.IsLetter(l.ch) {
+			digits += string(l.ch)
+			l.readChar()
+		}
+		return token.Token{Type: token.INT, Literal: prefix + digits}
+	}
+
 	//
 	// Read an integer-number.
 	//
@@ -338,16 +631,146 @@ func (l *Lexer) readDecimal() token.Token {
 
 		// Get the float-component.
 		fraction := l.readNumber()
-		return token.Token{Type: token.FLOAT, Literal: integer + "." + fraction}
+		return l.readUnit(token.Token{Type: token.FLOAT, Literal: integer + "." + fraction + l.readExponent()})
 	}
 
 	//
-	// Just an integer.
+	// An exponent makes this a floating-point number too.
 	//
-	return token.Token{Type: token.INT, Literal: integer}
+	if exponent := l.readExponent(); exponent != "" {
+		return l.readUnit(token.Token{Type: token.FLOAT, Literal: integer + exponent})
+	}
+
+	//
+	// Just an integer, with an optional unit.
+	//
+	return l.readUnit(token.Token{Type: token.INT, Literal: integer})
+}
+
+// readExponent reads the exponent of a floating-point number, such as the
+// "e3" in "1.5e3", if there is one.
+func (l *Lexer) readExponent() string {
+
+	if l.ch != rune('e') && l.ch != rune('E') {
+		return ""
+	}
+
+	//
+	// The exponent may have a sign, but it must have digits, as
+	// otherwise the "e" might be the start of something else.
+	//
+	n := 1
+	if l.peekChar() == rune('+') || l.peekChar() == rune('-') {
+		n = 2
+	}
+	if !isDigit(l.peekCharAt(n)) {
+		return ""
+	}
+
+	exponent := ""
+	for i := 0; i < n; i++ {
+		exponent += string(l.ch)
+		l.readChar()
+	}
+	return exponent + l.readNumber()
+}
+
+// unit describes one of the suffixes which may follow a number, and
+// converts it, by multiplying by mult and dividing by div.
+type unit struct {
+	mult int64
+	div  int64
+}
+
+// units holds the suffixes which may follow a number.  Durations are
+// converted to seconds, and sizes to bytes.
+//
+// Units are case-sensitive, so that "5M" can't be mistaken for either
+// five minutes or five megabytes.  Sizes may be written in lower-case,
+// or as they're usually abbreviated.
+var units = map[string]unit{
+	"ms": {1, 1000},
+	"s":  {1, 1},
+	"m":  {60, 1},
+	"h":  {60 * 60, 1},
+	"d":  {24 * 60 * 60, 1},
+	"w":  {7 * 24 * 60 * 60, 1},
+
+	"b":  {1, 1},
+	"B":  {1, 1},
+	"kb": {1000, 1},
+	"kB": {1000, 1},
+	"KB": {1000, 1},
+	"mb": {1000 * 1000, 1},
+	"MB": {1000 * 1000, 1},
+	"gb": {1000 * 1000 * 1000, 1},
+	"GB": {1000 * 1000 * 1000, 1},
+	"tb": {1000 * 1000 * 1000 * 1000, 1},
+	"TB": {1000 * 1000 * 1000 * 1000, 1},
+
+	"kib": {1 << 10, 1},
+	"KiB": {1 << 10, 1},
+	"mib": {1 << 20, 1},
+	"MiB": {1 << 20, 1},
+	"gib": {1 << 30, 1},
+	"GiB": {1 << 30, 1},
+	"tib": {1 << 40, 1},
+	"TiB": {1 << 40, 1},
+}
+
+// readUnit reads the unit which follows a number, if any, such as the
+// "m" in "5m", and returns the number converted by it.
+//
+// The result is an integer, unless the number was converted to a value
+// which isn't whole, as in "1.5s", or "100ms".
+func (l *Lexer) readUnit(num token.Token) token.Token {
+
+	if !unicode.IsLetter(l.ch) {
+		return num
+	}
+
+	suffix := ""
+	for unicode.IsLetter(l.ch) {
+		suffix += string(l.ch)
+		l.readChar()
+	}
+
+	u, ok := units[suffix]
+	if !ok {
+		for name := range units {
+			if strings.EqualFold(name, suffix) {
+				return token.Token{Type: token.ILLEGAL, Literal: fmt.Sprintf("unknown unit '%s' after number %s, units are case-sensitive", suffix, num.Literal)}
+			}
+		}
+		if suffix == "e" || suffix == "E" {
+			return token.Token{Type: token.ILLEGAL, Literal: fmt.Sprintf("unknown unit '%s' after number %s, an exponent must have digits", suffix, num.Literal)}
+		}
+		return token.Token{Type: token.ILLEGAL, Literal: fmt.Sprintf("unknown unit '%s' after number %s", suffix, num.Literal)}
+	}
+
+	if num.Type == token.INT && u.div == 1 {
+		val, err := strconv.ParseInt(num.Literal, 10, 64)
+		if err == nil && val <= math.MaxInt64/u.mult {
+			return token.Token{Type: token.INT, Literal: strconv.FormatInt(val*u.mult, 10)}
+		}
+	} else {
+		val, err := strconv.ParseFloat(num.Literal, 64)
+		val = val * float64(u.mult) / float64(u.div)
+		if err == nil && val < math.MaxInt64 {
+			if val == math.Trunc(val) {
+				return token.Token{Type: token.INT, Literal: strconv.FormatInt(int64(val), 10)}
+			}
+			return token.Token{Type: token.FLOAT, Literal: strconv.FormatFloat(val, 'f', -1, 64)}
+		}
+	}
+	return token.Token{Type: token.ILLEGAL, Literal: fmt.Sprintf("number %s%s is too large", num.Literal, suffix)}
 }
 
 // read a string, deliminated by the given character.
+//
+// The escape-sequences `\n`, `\r`, `\t`, `\"`, `\'`, `\\`, and `\uXXXX`
+// are supported, and a backslash at the end of a line joins it to the
+// next.  Any other escape-sequence is an error.
 func (l *Lexer) readString(delim rune) (string, error) {
 	out := ""
 
@@ -374,23 +797,25 @@ func (l *Lexer) readString(delim rune) (string, error) {
 
 			l.readChar()
 
-			if l.ch == rune(0) {
+			switch l.ch {
+			case rune(0):
 				return "", errors.New("unterminated string")
-			}
-			if l.ch == rune('n') {
+			case 'n':
 				l.ch = '\n'
-			}
-			if l.ch == rune('r') {
+			case 'r':
 				l.ch = '\r'
-			}
-			if l.ch == rune('t') {
+			case 't':
 				l.ch = '\t'
-			}
-			if l.ch == rune('"') {
-				l.ch = '"'
-			}
-			if l.ch == rune('\\') {
-				l.ch = '\\'
+			case '"', '\'', '\\':
+				// used as-is
+			case 'u':
+				ch, err := l.readUnicodeEscape()
+				if err != nil {
+					return "", err
+				}
+				l.ch = ch
+			default:
+				return "", fmt.Errorf("invalid escape-sequence \\%c in string around line %d", l.ch, l.lines+1)
 			}
 		}
 		out = out + string(l.ch)
@@ -400,6 +825,122 @@ func (l *Lexer) readString(delim rune) (string, error) {
 	return out, nil
 }
 
+// readUnicodeEscape reads the four hexadecimal digits which follow `\u`
+// in a string, and returns the character they describe.
+func (l *Lexer) readUnicodeEscape() (rune, error) {
+	digits := ""
+	for len(digits) < 4 && isHexDigit(l.peekChar()) {
+		l.readChar()
+		digits += string(l.ch)
+	}
+	if len(digits) < 4 {
+		return 0, fmt.Errorf("invalid escape-sequence \\u%s in string around line %d, expected four hexadecimal digits", digits, l.lines+1)
+	}
+
+	val, _ := strconv.ParseUint(digits, 16, 32)
+	ch := rune(val)
+	if !utf8.ValidRune(ch) {
+		return 0, fmt.Errorf("invalid escape-sequence \\u%s in string around line %d, which isn't a valid character", digits, l.lines+1)
+	}
+	return ch, nil
+}
+
+// read a raw string, deliminated by backticks, in which there are no
+// escape-sequences, and which may span several lines.
+func (l *Lexer) readRawString() (string, error) {
+	out := ""
+
+	for {
+		l.readChar()
+
+		if l.ch == rune(0) {
+			return "", fmt.Errorf("unterminated string")
+		}
+		if l.ch == '`' {
+			break
+		}
+		out = out + string(l.ch)
+	}
+
+	return out, nil
+}
+
+// read a heredoc, which contains the lines between one beginning with
+// `<<<` and the name of its delimiter, and one containing that name:
+//
+//	message = <<<END
+//	  Multiple lines, with no escape-sequences.
+//	  END;
+//
+// As in a raw string there are no escape-sequences.  The indentation of
+// the delimiter, on the closing line, is removed from each line, so the
+// heredoc may be indented along with the code around it.
+func (l *Lexer) readHeredoc() (string, error) {
+
+	// skip the `<<<`
+	l.readChar()
+	l.readChar()
+	l.readChar()
+
+	if !isLetter(l.ch) {
+		return "", fmt.Errorf("expected the name of a heredoc delimiter, got '%c'", l.ch)
+	}
+	name := ""
+	for isIdentifier(l.peekChar()) {
+		name += string(l.ch)
+		l.readChar()
+	}
+	name += string(l.ch)
+	l.readChar()
+
+	if l.ch != rune('\n') {
+		return "", fmt.Errorf("heredoc delimiter %s must be followed by a newline", name)
+	}
+
+	delim := []rune(name)
+	var lines []string
+	for {
+
+		//
+		// We're at the end of a line, so look for the delimiter
+		// at the start of the next, after any indentation.
+		//
+		start := l.readPosition
+		i := start
+		for i < len(l.characters) && (l.characters[i] == ' ' || l.characters[i] == '\t') {
+			i++
+		}
+		end := i + len(delim)
+		if end <= len(l.characters) && string(l.characters[i:end]) == name &&
+			(end == len(l.characters) || !isIdentifier(l.characters[end])) {
+
+			// finish on the last character of the delimiter
+			for l.readPosition < end {
+				l.readChar()
+			}
+
+			indent := string(l.characters[start:i])
+			for n, line := range lines {
+				lines[n] = strings.TrimPrefix(line, indent)
+			}
+			return strings.Join(lines, "\n"), nil
+		}
+
+		line := ""
+		for {
+			l.readChar()
+			if l.ch == rune(0) {
+				return "", fmt.Errorf("unterminated heredoc %s", name)
+			}
+			if l.ch == rune('\n') {
+				break
+			}
+			line += string(l.ch)
+		}
+		lines = append(lines, line)
+	}
+}
+
 // read a regexp, including flags.
 func (l *Lexer) readRegexp() (string, error) {
 	out := ""
@@ -458,16 +999,73 @@ func (l *Lexer) peekChar() rune {
 	return l.characters[l.readPosition]
 }
 
+// peekCharAt returns the character the given distance ahead of our
+// current position, so peekCharAt(1) is the same as peekChar().
+func (l *Lexer) peekCharAt(n int) rune {
+	if l.position+n >= len(l.characters) {
+		return rune(0)
+	}
+	return l.characters[l.position+n]
+}
+
+// isIncrement returns true if the `++`, or `--`, at our position is an
+// increment, or decrement, rather than a pair of signs.
+//
+// That is only the case in statement position, either directly after an
+// identifier at the end of a statement, as in "count++;", or directly
+// before an identifier at the start of one, as in "--count;".  Elsewhere
+// "5--3", and "a--b", remain the subtraction of a negation.
+func (l *Lexer) isIncrement() bool {
+	switch l.prevToken.Type {
+	case token.IDENT:
+		return l.endsStatement(2)
+	case "", token.SEMICOLON, token.LBRACE, token.RBRACE:
+		return isLetter(l.peekCharAt(2))
+	}
+	return false
+}
+
+// endsStatement returns true if the character the given distance ahead
+// of our position, ignoring blanks, ends a statement, or a line.
+func (l *Lexer) endsStatement(n int) bool {
+	for {
+		switch l.peekCharAt(n) {
+		case rune(' '), rune('\t'), rune('\r'):
+			n++
+		case rune(0), rune(';'), rune('}'), rune('\n'):
+			return true
+		case rune('/'):
+			next := l.peekCharAt(n + 1)
+			return next == rune('/') || next == rune('*')
+		default:
+			return false
+		}
+	}
+}
+
 // determinate ch is identifier or not.  Identifiers may be alphanumeric,
-// but they must start with a letter.  Here that works because we are only
+// and may contain `$` and `_`, but they must start with a letter.  Here that works because we are only
 // called if the first character is alphabetical.
 func isIdentifier(ch rune) bool {
-	if unicode.IsLetter(ch) || unicode.IsDigit(ch) || ch == '$' {
+	if unicode.IsLetter(ch) || unicode.IsDigit(ch) || ch == '$' || ch == '_' {
 		return true
 	}
 	return false
 }
 
+// isLetter returns true if the given character may begin an identifier.
+func isLetter(ch rune) bool {
+	return unicode.IsLetter(ch) || ch == '_'
+}
+
+// firstRune returns the first character of the given string.
+func firstRune(str string) rune {
+	for _, ch := range str {
+		return ch
+	}
+	return rune(0)
+}
+
 // is white space
 func isWhitespace(ch rune) bool {
 	return ch == rune(' ') || ch == rune('\t') || ch == rune('\n') || ch == rune('\r')
@@ -477,3 +1075,8 @@ func isWhitespace(ch rune) bool {
 func isDigit(ch rune) bool {
 	return rune('0') <= ch && ch <= rune('9')
 }
+
+// is hexadecimal Digit
+func isHexDigit(ch rune) bool {
+	return isDigit(ch) || (rune('a') <= ch && ch <= rune('f')) || (rune('A') <= ch && ch <= rune('F'))
+}
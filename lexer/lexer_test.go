@@ -33,8 +33,165 @@ func TestWhile(t *testing.T) {
 	}
 }
 
+func TestIntDiv(t *testing.T) {
+	input := `Total ~/ 2 / 3 // comment`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.IDENT, "Total"},
+		{token.INTDIV, "~/"},
+		{token.INT, "2"},
+		{token.SLASH, "/"},
+		{token.INT, "3"},
+		{token.EOF, ""},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestRawStrings(t *testing.T) {
+	input := "a = `\\d+\\.\\d+`;\n" +
+		"b = `two\nlines`;\n" +
+		"c = <<<END\n" +
+		"  first \\n\n" +
+		"\n" +
+		"    second\n" +
+		"  END;\n" +
+		"d = x <<< 2;\n" +
+		"e = 1 << 2;\n" +
+		"f = <<<END\nENDING\nEND"
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+		expectedLine    int
+	}{
+		{token.IDENT, "a", 1},
+		{token.ASSIGN, "=", 1},
+		{token.STRING, `\d+\.\d+`, 1},
+		{token.SEMICOLON, ";", 1},
+		{token.IDENT, "b", 2},
+		{token.ASSIGN, "=", 2},
+		{token.STRING, "two\nlines", 2},
+		{token.SEMICOLON, ";", 3},
+		{token.IDENT, "c", 4},
+		{token.ASSIGN, "=", 4},
+		{token.STRING, "first \\n\n\n  second", 4},
+		{token.SEMICOLON, ";", 8},
+		{token.IDENT, "d", 9},
+		{token.ASSIGN, "=", 9},
+		{token.IDENT, "x", 9},
+		{token.ILLEGAL, "expected the name of a heredoc delimiter, got ' '", 9},
+		{token.INT, "2", 9},
+		{token.SEMICOLON, ";", 9},
+		{token.IDENT, "e", 10},
+		{token.ASSIGN, "=", 10},
+		{token.INT, "1", 10},
+		{token.SHL, "<<", 10},
+		{token.INT, "2", 10},
+		{token.SEMICOLON, ";", 10},
+		{token.IDENT, "f", 11},
+		{token.ASSIGN, "=", 11},
+		{token.STRING, "ENDING", 11},
+		{token.EOF, "", 13},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+		if tok.Line != tt.expectedLine {
+			t.Fatalf("tests[%d] - Line wrong, expected=%d, got=%d", i, tt.expectedLine, tok.Line)
+		}
+	}
+
+	errors := map[string]string{
+		"`unterminated":          "unterminated string",
+		"<<<END\nno delimiter\n": "unterminated heredoc END",
+		"<<<END;\nEND":           "heredoc delimiter END must be followed by a newline",
+	}
+	for input, expected := range errors {
+		tok := New(input).NextToken()
+		if tok.Type != token.ILLEGAL || tok.Literal != expected {
+			t.Fatalf("unexpected token for %q: %v", input, tok)
+		}
+	}
+}
+
+func TestEscapes(t *testing.T) {
+	tests := map[string]string{
+		`"a\nb\tc\rd"`:        "a\nb\tc\rd",
+		`"say \"hi\""`:        `say "hi"`,
+		`'it\'s'`:             "it's",
+		`"back\\slash"`:       `back\slash`,
+		`"\u00e9t\u00C9"`:     "étÉ",
+		`"\u263a!"`:           "☺!",
+		"\"joined \\\nline\"": "joined line",
+	}
+	for input, expected := range tests {
+		tok := New(input).NextToken()
+		if tok.Type != token.STRING || tok.Literal != expected {
+			t.Fatalf("unexpected token for %s: %v", input, tok)
+		}
+	}
+
+	errors := map[string]string{
+		`"\d+"`:          "invalid escape-sequence \\d in string around line 1",
+		"\n\n'\\.'":      "invalid escape-sequence \\. in string around line 3",
+		`"\u12"`:         "invalid escape-sequence \\u12 in string around line 1, expected four hexadecimal digits",
+		`"\uD800"`:       "invalid escape-sequence \\uD800 in string around line 1, which isn't a valid character",
+		`"unterminated\`: "unterminated string",
+	}
+	for input, expected := range errors {
+		tok := New(input).NextToken()
+		if tok.Type != token.ILLEGAL || tok.Literal != expected {
+			t.Fatalf("unexpected token for %s: %v", input, tok)
+		}
+	}
+}
+
+func TestBetween(t *testing.T) {
+	input := `Port between 1 and 10`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.IDENT, "Port"},
+		{token.BETWEEN, "between"},
+		{token.INT, "1"},
+		{token.IDENT, "and"},
+		{token.INT, "10"},
+		{token.EOF, ""},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
 func TestNextToken1(t *testing.T) {
-	input := `=+√%(){},;~= !~"`
+	input := `=+√%(){},;~= !~ ~* !~*^"`
 
 	tests := []struct {
 		expectedType    token.Type
@@ -52,6 +209,9 @@ func TestNextToken1(t *testing.T) {
 		{token.SEMICOLON, ";"},
 		{token.CONTAINS, "~="},
 		{token.MISSING, "!~"},
+		{token.IMATCHES, "~*"},
+		{token.IMISSING, "!~*"},
+		{token.BITXOR, "^"},
 		{token.ILLEGAL, "unterminated string"},
 		{token.EOF, ""},
 	}
@@ -338,6 +498,27 @@ func TestLine(t *testing.T) {
 }
 
 // TestRegexp ensures a simple regexp can be parsed.
+// TestTokenLines tests that tokens record the line they started upon.
+func TestTokenLines(t *testing.T) {
+	input := `if ( a )
+{
+  // comment
+
+  return "multi
+line";
+}
+	b`
+
+	lines := []int{1, 1, 1, 1, 2, 5, 5, 6, 7, 8, 8}
+	l := New(input)
+	for i, line := range lines {
+		tok := l.NextToken()
+		if tok.Line != line {
+			t.Fatalf("tests[%d] - line wrong for %q, expected=%d, got=%d", i, tok.Literal, line, tok.Line)
+		}
+	}
+}
+
 func TestRegexp(t *testing.T) {
 	input := `if ( f ~= /steve/i )
 if ( f ~= /steve/m )
@@ -449,3 +630,448 @@ a = 3/4;
 		}
 	}
 }
+
+func TestBitwise(t *testing.T) {
+	input := `a & b | c ^ ~d << 2 >> 1 && e || f ^^ g`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.IDENT, "a"},
+		{token.BITAND, "&"},
+		{token.IDENT, "b"},
+		{token.BITOR, "|"},
+		{token.IDENT, "c"},
+		{token.BITXOR, "^"},
+		{token.BITNOT, "~"},
+		{token.IDENT, "d"},
+		{token.SHL, "<<"},
+		{token.INT, "2"},
+		{token.SHR, ">>"},
+		{token.INT, "1"},
+		{token.AND, "&&"},
+		{token.IDENT, "e"},
+		{token.OR, "||"},
+		{token.IDENT, "f"},
+		{token.XOR, "^^"},
+		{token.IDENT, "g"},
+		{token.EOF, ""},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestPrefixedIntegers(t *testing.T) {
+	input := `0xFF 0o755 0b1010 0 0.5 0xZZ 0X1F 0O17 0B11`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.INT, "0xFF"},
+		{token.INT, "0o755"},
+		{token.INT, "0b1010"},
+		{token.INT, "0"},
+		{token.FLOAT, "0.5"},
+		{token.INT, "0xZZ"},
+		{token.INT, "0X1F"},
+		{token.INT, "0O17"},
+		{token.INT, "0B11"},
+		{token.EOF, ""},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestCompoundAssignment(t *testing.T) {
+	input := `a += 1; a -= 2; a *= 3; a /= 4; a++; a--;`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.IDENT, "a"},
+		{token.PLUSEQUALS, "+="},
+		{token.INT, "1"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "a"},
+		{token.MINUSEQUALS, "-="},
+		{token.INT, "2"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "a"},
+		{token.ASTERISKEQUALS, "*="},
+		{token.INT, "3"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "a"},
+		{token.SLASHEQUALS, "/="},
+		{token.INT, "4"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "a"},
+		{token.PLUSPLUS, "++"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "a"},
+		{token.MINUSMINUS, "--"},
+		{token.SEMICOLON, ";"},
+		{token.EOF, ""},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+// TestIncrementPosition tests that `++` and `--` are only increments in
+// statement position, and are otherwise pairs of signs.
+func TestIncrementPosition(t *testing.T) {
+	input := `--a; 5--3; a--b; x = --y; b++ // done`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.MINUSMINUS, "--"},
+		{token.IDENT, "a"},
+		{token.SEMICOLON, ";"},
+		{token.INT, "5"},
+		{token.MINUS, "-"},
+		{token.MINUS, "-"},
+		{token.INT, "3"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "a"},
+		{token.MINUS, "-"},
+		{token.MINUS, "-"},
+		{token.IDENT, "b"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "x"},
+		{token.ASSIGN, "="},
+		{token.MINUS, "-"},
+		{token.MINUS, "-"},
+		{token.IDENT, "y"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "b"},
+		{token.PLUSPLUS, "++"},
+		{token.EOF, ""},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+// TestArrow tests the lambda-arrow is distinct from assignment/equality.
+func TestArrow(t *testing.T) {
+	input := `f = x => x == 1;`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.IDENT, "f"},
+		{token.ASSIGN, "="},
+		{token.IDENT, "x"},
+		{token.ARROW, "=>"},
+		{token.IDENT, "x"},
+		{token.EQ, "=="},
+		{token.INT, "1"},
+		{token.SEMICOLON, ";"},
+		{token.EOF, ""},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+// TestUnderscore tests that identifiers may contain underscores.
+func TestUnderscore(t *testing.T) {
+	input := `counter_incr(user_name);`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.IDENT, "counter_incr"},
+		{token.LPAREN, "("},
+		{token.IDENT, "user_name"},
+		{token.RPAREN, ")"},
+		{token.SEMICOLON, ";"},
+		{token.EOF, ""},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+// TestUnits tests that durations and sizes are converted.
+func TestUnits(t *testing.T) {
+	input := `5m 2h 30s 1d 1w 10kb 3MiB 2GB 1.5h 1.5s 0.5kib 7b 5x 9999999999999999h 5 m 100ms 2000ms 1.5ms 4B 5kB 6KB 7KiB 5M 3Mb 2H 1.5e3 2e3 1E-3 2.5e+2s 1e3ms 2e 3e+x`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.INT, "300"},
+		{token.INT, "7200"},
+		{token.INT, "30"},
+		{token.INT, "86400"},
+		{token.INT, "604800"},
+		{token.INT, "10000"},
+		{token.INT, "3145728"},
+		{token.INT, "2000000000"},
+		{token.INT, "5400"},
+		{token.FLOAT, "1.5"},
+		{token.INT, "512"},
+		{token.INT, "7"},
+		{token.ILLEGAL, "unknown unit 'x' after number 5"},
+		{token.ILLEGAL, "number 9999999999999999h is too large"},
+		{token.INT, "5"},
+		{token.IDENT, "m"},
+		{token.FLOAT, "0.1"},
+		{token.INT, "2"},
+		{token.FLOAT, "0.0015"},
+		{token.INT, "4"},
+		{token.INT, "5000"},
+		{token.INT, "6000"},
+		{token.INT, "7168"},
+		{token.ILLEGAL, "unknown unit 'M' after number 5, units are case-sensitive"},
+		{token.ILLEGAL, "unknown unit 'Mb' after number 3, units are case-sensitive"},
+		{token.ILLEGAL, "unknown unit 'H' after number 2, units are case-sensitive"},
+		{token.FLOAT, "1.5e3"},
+		{token.FLOAT, "2e3"},
+		{token.FLOAT, "1E-3"},
+		{token.INT, "250"},
+		{token.INT, "1"},
+		{token.ILLEGAL, "unknown unit 'e' after number 2, an exponent must have digits"},
+		{token.ILLEGAL, "unknown unit 'e' after number 3, an exponent must have digits"},
+		{token.PLUS, "+"},
+		{token.IDENT, "x"},
+		{token.EOF, ""},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestIn(t *testing.T) {
+	input := `ID in Blocked`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.IDENT, "ID"},
+		{token.IN, "in"},
+		{token.IDENT, "Blocked"},
+		{token.EOF, ""},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+// TestAddOperator tests that the operators added by the host are lexed.
+func TestAddOperator(t *testing.T) {
+	input := `Point inside Area && Version ~> "1.2" && A ~>> B && inside_ ~ 3`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.IDENT, "Point"},
+		{token.OPERATOR, "inside"},
+		{token.IDENT, "Area"},
+		{token.AND, "&&"},
+		{token.IDENT, "Version"},
+		{token.OPERATOR, "~>"},
+		{token.STRING, "1.2"},
+		{token.AND, "&&"},
+		{token.IDENT, "A"},
+		{token.OPERATOR, "~>>"},
+		{token.IDENT, "B"},
+		{token.AND, "&&"},
+		{token.IDENT, "inside_"},
+		{token.BITNOT, "~"},
+		{token.INT, "3"},
+		{token.EOF, ""},
+	}
+	l := New(input)
+	l.AddOperator("~>")
+	l.AddOperator("inside")
+	l.AddOperator("~>>")
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+// TestBlockComment tests that `/* ... */` comments are skipped, and that
+// comments are recorded.
+func TestBlockComment(t *testing.T) {
+	input := `/* a comment
+   on two lines */
+a = 1; // trailing
+b /* inline */ / 2;`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.IDENT, "a"},
+		{token.ASSIGN, "="},
+		{token.INT, "1"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "b"},
+		{token.SLASH, "/"},
+		{token.INT, "2"},
+		{token.SEMICOLON, ";"},
+		{token.EOF, ""},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+
+	comments := l.Comments()
+	expected := []Comment{
+		{Token: token.Token{Type: token.COMMENT, Literal: "/* a comment\n   on two lines */", Line: 1}},
+		{Token: token.Token{Type: token.COMMENT, Literal: "// trailing", Line: 3}, Trailing: true},
+		{Token: token.Token{Type: token.COMMENT, Literal: "/* inline */", Line: 4}, Trailing: true},
+	}
+	if len(comments) != len(expected) {
+		t.Fatalf("expected %d comments, got %v", len(expected), comments)
+	}
+	for i, c := range expected {
+		if comments[i] != c {
+			t.Fatalf("comments[%d] - expected %v, got %v", i, c, comments[i])
+		}
+	}
+
+	// An unterminated comment is an error.
+	l = New(`a /* never ends`)
+	l.NextToken()
+	tok := l.NextToken()
+	if tok.Type != token.ILLEGAL {
+		t.Fatalf("expected an error, got %v", tok)
+	}
+}
+
+// TestPragma tests that pragmas are lexed as a single token.
+func TestPragma(t *testing.T) {
+	input := `#pragma name "block-ssh"
+#pragma  version 3
+#pragmatic`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.PRAGMA, `name "block-ssh"`},
+		{token.PRAGMA, "version 3"},
+		{token.ILLEGAL, "invalid character for indentifier '#'"},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+// TestInvalidCharacter tests that we skip over characters which can't
+// begin a token, rather than returning them forever.
+func TestInvalidCharacter(t *testing.T) {
+	input := `a \ b § c`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.IDENT, "a"},
+		{token.ILLEGAL, "invalid character for indentifier '\\'"},
+		{token.IDENT, "b"},
+		{token.ILLEGAL, "invalid character for indentifier '§'"},
+		{token.IDENT, "c"},
+		{token.EOF, ""},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
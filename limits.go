@@ -0,0 +1,155 @@
+// limits.go contains the code which restricts the complexity of the
+// scripts we'll prepare, and the work they may do when they're run.
+
+package evalfilter
+
+import (
+	"fmt"
+
+	"github.com/skx/evalfilter/v2/ast"
+	"github.com/skx/evalfilter/v2/code"
+	"github.com/skx/evalfilter/v2/object"
+)
+
+// Limits restricts the complexity of the scripts which may be prepared,
+// which allows platforms that run filters written by their users to
+// reject pathological scripts before they are ever run.
+//
+// A limit of zero means there is no limit.
+type Limits struct {
+	// MaxInstructions is the maximum number of bytecode instructions,
+	// after optimization, including those of rules and lambdas.
+	MaxInstructions int
+
+	// MaxConstants is the maximum number of constants.
+	MaxConstants int
+
+	// MaxDepth is the maximum depth to which statements, and
+	// expressions, may be nested.
+	MaxDepth int
+
+	// MaxRegexps is the maximum number of regular expressions, which
+	// includes calls to the `match` function.
+	MaxRegexps int
+
+	// MaxSteps is the maximum number of instructions a single run of
+	// the script may execute, including those of the lambdas it calls.
+	//
+	// Unlike the other limits this is tested as the script runs, and
+	// a run which exceeds it fails with an error.  Building a large
+	// string, or array, counts as a step for every 64 bytes, or
+	// elements.
+	MaxSteps int
+}
+
+// LimitError is the error returned by Prepare if a script exceeds one
+// of the limits it was given.
+type LimitError struct {
+	// Limit is the name of the limit which was exceeded.
+	Limit string
+
+	// Value is the value the script reached.
+	Value int
+
+	// Max is the value of the limit.
+	Max int
+}
+
+// Error returns a description of the limit which was exceeded.
+func (l *LimitError) Error() string {
+	return fmt.Sprintf("script exceeds the limit on %s: %d > %d", l.Limit, l.Value, l.Max)
+}
+
+// WithLimits restricts the complexity of the scripts which may be
+// prepared.  Prepare returns a LimitError if any limit is exceeded, other
+// than MaxSteps, which limits the work done by each run.
+//
+// Included scripts count towards the limits of the script which
+// includes them.
+func WithLimits(limits Limits) Option {
+	return func(e *Eval) {
+		e.limits = limits
+	}
+}
+
+// checkProgram tests whether the given program, which is either our
+// script or one it includes, exceeds the limits on nesting, and on the
+// number of regular expressions.
+func (e *Eval) checkProgram(program *ast.Program) error {
+
+	if e.limits.MaxDepth > 0 {
+		if depth := astDepth(program); depth > e.limits.MaxDepth {
+			return &LimitError{Limit: "nesting depth", Value: depth, Max: e.limits.MaxDepth}
+		}
+	}
+
+	if e.limits.MaxRegexps > 0 {
+		ast.Walk(program, func(node ast.Node) bool {
+			switch n := node.(type) {
+			case *ast.RegexpLiteral:
+				e.regexps++
+			case *ast.CallExpression:
+				if n.Function.String() == "match" {
+					e.regexps++
+				}
+			}
+			return true
+		})
+		if e.regexps > e.limits.MaxRegexps {
+			return &LimitError{Limit: "regular expressions", Value: e.regexps, Max: e.limits.MaxRegexps}
+		}
+	}
+
+	return nil
+}
+
+// checkSize tests whether our compiled program exceeds the limits on the
+// number of instructions, and constants.
+func (e *Eval) checkSize() error {
+
+	if e.limits.MaxConstants > 0 && len(e.constants) > e.limits.MaxConstants {
+		return &LimitError{Limit: "constants", Value: len(e.constants), Max: e.limits.MaxConstants}
+	}
+
+	if e.limits.MaxInstructions > 0 {
+		count := countInstructions(e.instructions)
+		for _, r := range e.rules {
+			count += countInstructions(r.instructions)
+		}
+		for _, c := range e.constants {
+			if fn, ok := c.(*object.Function); ok {
+				count += countInstructions(fn.Body)
+			}
+		}
+		if count > e.limits.MaxInstructions {
+			return &LimitError{Limit: "instructions", Value: count, Max: e.limits.MaxInstructions}
+		}
+	}
+
+	return nil
+}
+
+// countInstructions returns the number of instructions in the given
+// bytecode.
+func countInstructions(instructions code.Instructions) int {
+	count := 0
+	for ip := 0; ip < len(instructions); ip += code.Length(code.Opcode(instructions[ip])) {
+		count++
+	}
+	return count
+}
+
+// astDepth returns the depth of the given node, counting itself.
+func astDepth(node ast.Node) int {
+	max := 0
+	ast.Walk(node, func(n ast.Node) bool {
+		if n == node {
+			return true
+		}
+		if d := astDepth(n); d > max {
+			max = d
+		}
+		return false
+	})
+	return max + 1
+}
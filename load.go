@@ -0,0 +1,38 @@
+// load.go contains code for creating evaluators from scripts which are
+// read from an io.Reader.
+
+package evalfilter
+
+import (
+	"io"
+	"io/ioutil"
+)
+
+// NewReader creates a new instance of the evaluator, as New does, for
+// the script which is read from the given reader.
+//
+// An error is only returned if the script can't be read, the evaluator
+// must still be prepared before it is used.
+func NewReader(r io.Reader, options ...Option) (*Eval, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return New(string(data), options...), nil
+}
+
+// CompileReader creates an evaluator for the script which is read from
+// the given reader, and prepares it.
+//
+// This saves the caller from reading the script themselves, and from
+// the separate call to Prepare, when the default flags are suitable.
+func CompileReader(r io.Reader, options ...Option) (*Eval, error) {
+	e, err := NewReader(r, options...)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.Prepare(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
@@ -0,0 +1,162 @@
+// lookup.go contains the interface which allows scripts to look up
+// values in tables supplied by the host application.
+
+package evalfilter
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/skx/evalfilter/v2/object"
+)
+
+// LookupProvider is implemented by the host application to supply named
+// tables of values, such as lists of blocked addresses, which scripts
+// may query via the `lookup` function.
+//
+// A provider might hold its tables in memory, as with the MemoryLookup,
+// or query an external service such as redis.  Providers must be safe
+// for concurrent use.
+type LookupProvider interface {
+	// Lookup returns the value stored beneath the given key in the
+	// named table, and false if there is no such value.
+	//
+	// An error should be returned if the table doesn't exist, or
+	// couldn't be queried.
+	Lookup(table string, key string) (object.Object, bool, error)
+}
+
+// WithLookupProvider makes the tables of the given provider available
+// to scripts, via the following function:
+//
+//	lookup(table, key [, default])
+//
+// This returns the value stored beneath the key, or the default, or
+// Null, if there is no such value.  As Null is false this allows scripts
+// to test for membership of a list:
+//
+//	if ( lookup("blocked_ips", SourceIP) ) { return true; }
+func WithLookupProvider(provider LookupProvider) Option {
+	return func(e *Eval) {
+		e.AddFunction("lookup", func(args []object.Object) object.Object {
+			return lookup(provider, args)
+		})
+	}
+}
+
+// lookup is the implementation of our `lookup` function.
+func lookup(provider LookupProvider, args []object.Object) object.Object {
+
+	// We expect two arguments, and an optional default
+	if len(args) != 2 && len(args) != 3 {
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("lookup expects two or three arguments, got %d", len(args))}
+	}
+
+	val, ok, err := provider.Lookup(args[0].Inspect(), args[1].Inspect())
+	if err != nil {
+		return &object.Error{Message: fmt.Sprintf("lookup failed: %s", err.Error())}
+	}
+	if ok {
+		return val
+	}
+	if len(args) == 3 {
+		return args[2]
+	}
+	return object.NewNull()
+}
+
+// MemoryLookup is a LookupProvider which holds its tables in memory.
+//
+// Tables may be added, or replaced, while scripts are running.
+type MemoryLookup struct {
+	// mutex protects our tables.
+	mutex sync.RWMutex
+
+	// tables holds our tables, by name.
+	tables map[string]map[string]object.Object
+}
+
+// NewMemoryLookup creates a new MemoryLookup, without any tables.
+func NewMemoryLookup() *MemoryLookup {
+	return &MemoryLookup{tables: make(map[string]map[string]object.Object)}
+}
+
+// Lookup returns the value stored beneath the given key in the named
+// table, and false if there is no such value.
+func (m *MemoryLookup) Lookup(table string, key string) (object.Object, bool, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	values, ok := m.tables[table]
+	if !ok {
+		return nil, false, fmt.Errorf("unknown table %s", table)
+	}
+	val, ok := values[key]
+	return val, ok, nil
+}
+
+// AddTable adds a table, which maps each key to the given string.
+//
+// Any existing table with the same name is replaced.
+func (m *MemoryLookup) AddTable(table string, values map[string]string) {
+	t := make(map[string]object.Object, len(values))
+	for k, v := range values {
+		t[k] = &object.String{Value: v}
+	}
+	m.set(table, t)
+}
+
+// AddSet adds a table which maps each of the given keys to true, which
+// is useful for allow-lists and deny-lists.
+//
+// Any existing table with the same name is replaced.
+func (m *MemoryLookup) AddSet(table string, keys []string) {
+	t := make(map[string]object.Object, len(keys))
+	for _, k := range keys {
+		t[k] = object.NewBoolean(true)
+	}
+	m.set(table, t)
+}
+
+// AddCSV adds a table read from the given CSV data.
+//
+// The first column of each record is the key.  If there is a second
+// column it holds the value, otherwise the key is mapped to true, as
+// with AddSet.  Any further columns are ignored.
+//
+// Any existing table with the same name is replaced.
+func (m *MemoryLookup) AddCSV(table string, r io.Reader) error {
+
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	t := make(map[string]object.Object)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read table %s: %s", table, err.Error())
+		}
+
+		if len(record) > 1 {
+			t[record[0]] = &object.String{Value: record[1]}
+		} else {
+			t[record[0]] = object.NewBoolean(true)
+		}
+	}
+
+	m.set(table, t)
+	return nil
+}
+
+// set stores the given table.
+func (m *MemoryLookup) set(table string, values map[string]object.Object) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.tables[table] = values
+}
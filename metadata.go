@@ -0,0 +1,105 @@
+// metadata.go contains code for the metadata a script declares about
+// itself, via pragmas.
+
+package evalfilter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/skx/evalfilter/v2/ast"
+)
+
+// Metadata holds the information a script declares about itself, via the
+// pragmas at its start:
+//
+//	#pragma name "block-ssh-bruteforce"
+//	#pragma version 3
+//	#pragma require-fields Source, Port
+//
+// This allows the scripts deployed across a fleet to be inventoried,
+// without the need to run them.
+type Metadata struct {
+	// Name is the name of the script, from `#pragma name`.
+	Name string
+
+	// Version is the version of the script, from `#pragma version`,
+	// or zero if it wasn't declared.
+	Version int
+
+	// RequireFields holds the names of the fields the script expects
+	// the objects it is run against to have, from the comma-separated
+	// list given to `#pragma require-fields`.
+	RequireFields []string
+
+	// Pragmas holds the value of every pragma, by name, including
+	// those which are only meaningful to the host application.
+	Pragmas map[string]string
+}
+
+// Metadata returns the metadata the script declared via pragmas, which
+// is empty if it declared none.
+func (e *Eval) Metadata() Metadata {
+	m := e.metadata
+	m.RequireFields = append([]string(nil), m.RequireFields...)
+	m.Pragmas = make(map[string]string, len(e.metadata.Pragmas))
+	for name, value := range e.metadata.Pragmas {
+		m.Pragmas[name] = value
+	}
+	return m
+}
+
+// programMetadata returns the metadata declared by the pragmas of the
+// given program.
+func programMetadata(program *ast.Program) (Metadata, error) {
+
+	m := Metadata{Pragmas: make(map[string]string)}
+
+	for _, s := range program.Statements {
+		p, ok := s.(*ast.PragmaStatement)
+		if !ok {
+			continue
+		}
+
+		if _, found := m.Pragmas[p.Name]; found {
+			return m, fmt.Errorf("pragma %s is declared more than once", p.Name)
+		}
+		m.Pragmas[p.Name] = p.Value
+
+		switch p.Name {
+
+		case "name":
+			name := p.Value
+			if strings.HasPrefix(name, `"`) {
+				unquoted, err := strconv.Unquote(name)
+				if err != nil {
+					return m, fmt.Errorf("pragma name: invalid name %s", name)
+				}
+				name = unquoted
+			}
+			if name == "" {
+				return m, fmt.Errorf("pragma name: the name is empty")
+			}
+			m.Name = name
+
+		case "version":
+			version, err := strconv.Atoi(p.Value)
+			if err != nil || version < 0 {
+				return m, fmt.Errorf("pragma version: invalid version '%s'", p.Value)
+			}
+			m.Version = version
+
+		case "require-fields":
+			for _, field := range strings.Split(p.Value, ",") {
+				field = strings.TrimSpace(field)
+				if !decisionField(field) {
+					return m, fmt.Errorf("pragma require-fields: invalid field '%s'", field)
+				}
+				m.RequireFields = append(m.RequireFields, field)
+			}
+		}
+	}
+
+	return m, nil
+}
@@ -0,0 +1,298 @@
+package object
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// Each encoded object begins with a single byte, identifying its type.
+const (
+	tagArray byte = iota + 1
+	tagBoolean
+	tagError
+	tagFloat
+	tagFunction
+	tagInteger
+	tagNull
+	tagString
+	tagHash
+	tagSet
+)
+
+// Encode serializes the given object into a compact binary form, which
+// may be persisted, or passed to another process, and later restored
+// via Decode.
+//
+// Functions are encoded without the scope they were bound to, so a
+// decoded function cannot be invoked until it is evaluated again.
+func Encode(obj Object) ([]byte, error) {
+	var buf bytes.Buffer
+	err := encode(&buf, obj)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode restores an object which was serialized via Encode.
+func Decode(data []byte) (Object, error) {
+	r := bytes.NewReader(data)
+	obj, err := decode(r)
+	if err != nil {
+		return nil, err
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%d trailing byte(s) after encoded object", r.Len())
+	}
+	return obj, nil
+}
+
+// encode writes the given object to the buffer.
+func encode(buf *bytes.Buffer, obj Object) error {
+
+	switch o := obj.(type) {
+	case *Array:
+		buf.WriteByte(tagArray)
+		writeUint(buf, uint64(len(o.Elements)))
+		for _, el := range o.Elements {
+			err := encode(buf, el)
+			if err != nil {
+				return err
+			}
+		}
+	case *Boolean:
+		buf.WriteByte(tagBoolean)
+		if o.Value {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case *Error:
+		buf.WriteByte(tagError)
+		writeString(buf, o.Message)
+		writeString(buf, string(o.Kind))
+	case *Float:
+		buf.WriteByte(tagFloat)
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, math.Float64bits(o.Value))
+		buf.Write(b)
+	case *Function:
+		buf.WriteByte(tagFunction)
+		writeUint(buf, uint64(len(o.Parameters)))
+		for _, p := range o.Parameters {
+			writeString(buf, p)
+		}
+		writeString(buf, o.Source)
+		writeString(buf, string(o.Body))
+	case *Hash:
+		buf.WriteByte(tagHash)
+		keys := make([]string, 0, len(o.Pairs))
+		for k := range o.Pairs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		writeUint(buf, uint64(len(keys)))
+		for _, k := range keys {
+			writeString(buf, k)
+			err := encode(buf, o.Pairs[k])
+			if err != nil {
+				return err
+			}
+		}
+	case *Integer:
+		buf.WriteByte(tagInteger)
+		b := make([]byte, binary.MaxVarintLen64)
+		n := binary.PutVarint(b, o.Value)
+		buf.Write(b[:n])
+	case *Null:
+		buf.WriteByte(tagNull)
+	case *Set:
+		buf.WriteByte(tagSet)
+		members := make([]string, 0, len(o.Members))
+		for m := range o.Members {
+			members = append(members, m)
+		}
+		sort.Strings(members)
+		writeUint(buf, uint64(len(members)))
+		for _, m := range members {
+			writeString(buf, m)
+		}
+	case *String:
+		buf.WriteByte(tagString)
+		writeString(buf, o.Value)
+	default:
+		return fmt.Errorf("cannot encode object of type %T", obj)
+	}
+	return nil
+}
+
+// decode reads a single object from the reader.
+func decode(r *bytes.Reader) (Object, error) {
+
+	tag, err := r.ReadByte()
+	if err != nil {
+		return nil, errors.New("unexpected end of encoded data")
+	}
+
+	switch tag {
+	case tagArray:
+		n, err := readUint(r)
+		if err != nil {
+			return nil, err
+		}
+		// Each element takes at least one byte.
+		if n > uint64(r.Len()) {
+			return nil, errors.New("truncated array")
+		}
+		arr := &Array{Elements: make([]Object, n)}
+		for i := range arr.Elements {
+			arr.Elements[i], err = decode(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	case tagBoolean:
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, errors.New("truncated boolean")
+		}
+		return NewBoolean(b != 0), nil
+	case tagError:
+		msg, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		kind, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		return &Error{Message: msg, Kind: ErrorKind(kind)}, nil
+	case tagFloat:
+		b := make([]byte, 8)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, errors.New("truncated float")
+		}
+		return &Float{Value: math.Float64frombits(binary.BigEndian.Uint64(b))}, nil
+	case tagFunction:
+		n, err := readUint(r)
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(r.Len()) {
+			return nil, errors.New("truncated function")
+		}
+		fn := &Function{}
+		for i := uint64(0); i < n; i++ {
+			p, err := readString(r)
+			if err != nil {
+				return nil, err
+			}
+			fn.Parameters = append(fn.Parameters, p)
+		}
+		if fn.Source, err = readString(r); err != nil {
+			return nil, err
+		}
+		body, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		fn.Body = []byte(body)
+		return fn, nil
+	case tagHash:
+		n, err := readUint(r)
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(r.Len()) {
+			return nil, errors.New("truncated hash")
+		}
+		hash := &Hash{Pairs: make(map[string]Object, n)}
+		for i := uint64(0); i < n; i++ {
+			k, err := readString(r)
+			if err != nil {
+				return nil, err
+			}
+			hash.Pairs[k], err = decode(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return hash, nil
+	case tagInteger:
+		v, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, errors.New("truncated integer")
+		}
+		return NewInteger(v), nil
+	case tagNull:
+		return NewNull(), nil
+	case tagSet:
+		n, err := readUint(r)
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(r.Len()) {
+			return nil, errors.New("truncated set")
+		}
+		set := &Set{Members: make(map[string]struct{}, n)}
+		for i := uint64(0); i < n; i++ {
+			m, err := readString(r)
+			if err != nil {
+				return nil, err
+			}
+			set.Members[m] = struct{}{}
+		}
+		return set, nil
+	case tagString:
+		str, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		return &String{Value: str}, nil
+	}
+
+	return nil, fmt.Errorf("unknown object tag %d", tag)
+}
+
+// writeUint writes a variable-length unsigned integer to the buffer.
+func writeUint(buf *bytes.Buffer, n uint64) {
+	b := make([]byte, binary.MaxVarintLen64)
+	buf.Write(b[:binary.PutUvarint(b, n)])
+}
+
+// writeString writes a length-prefixed string to the buffer.
+func writeString(buf *bytes.Buffer, s string) {
+	writeUint(buf, uint64(len(s)))
+	buf.WriteString(s)
+}
+
+// readUint reads a variable-length unsigned integer.
+func readUint(r *bytes.Reader) (uint64, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, errors.New("truncated length")
+	}
+	return n, nil
+}
+
+// readString reads a length-prefixed string.
+func readString(r *bytes.Reader) (string, error) {
+	n, err := readUint(r)
+	if err != nil {
+		return "", err
+	}
+	if n > uint64(r.Len()) {
+		return "", errors.New("truncated string")
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", errors.New("truncated string")
+	}
+	return string(b), nil
+}
@@ -0,0 +1,86 @@
+package object
+
+import (
+	"testing"
+)
+
+// TestEncoding tests that objects survive a round-trip through our codec.
+func TestEncoding(t *testing.T) {
+
+	tests := []Object{
+		&Array{Elements: []Object{}},
+		&Array{Elements: []Object{
+			&Integer{Value: 3},
+			&String{Value: "steve"},
+			&Array{Elements: []Object{&Boolean{Value: true}}},
+		}},
+		&Boolean{Value: true},
+		&Boolean{Value: false},
+		&Error{Message: "oops"},
+		&Float{Value: 3.25},
+		&Float{Value: -0.1},
+		&Function{Parameters: []string{"x"}, Source: "x => x * 2", Body: []byte{1, 2, 3}},
+		&Hash{Pairs: map[string]Object{}},
+		&Hash{Pairs: map[string]Object{
+			"name": &String{Value: "steve"},
+			"tags": &Array{Elements: []Object{&String{Value: "kemp"}}},
+			"sub":  &Hash{Pairs: map[string]Object{"x": &Integer{Value: 1}}},
+		}},
+		&Integer{Value: 0},
+		&Integer{Value: -9223372036854775808},
+		&Integer{Value: 9223372036854775807},
+		&Null{},
+		NewSet([]string{}),
+		NewSet([]string{"b", "a", "3"}),
+		&String{Value: ""},
+		&String{Value: "Steve Kemp π"},
+	}
+
+	for _, obj := range tests {
+
+		data, err := Encode(obj)
+		if err != nil {
+			t.Fatalf("failed to encode %s: %s", obj.Inspect(), err.Error())
+		}
+
+		out, err := Decode(data)
+		if err != nil {
+			t.Fatalf("failed to decode %s: %s", obj.Inspect(), err.Error())
+		}
+
+		if out.Type() != obj.Type() || out.Inspect() != obj.Inspect() {
+			t.Fatalf("round-trip failed: %s became %s", obj.Inspect(), out.Inspect())
+		}
+	}
+
+	// The body of a function must survive too.
+	data, _ := Encode(&Function{Source: "x", Body: []byte{9, 8}})
+	out, _ := Decode(data)
+	if string(out.(*Function).Body) != string([]byte{9, 8}) {
+		t.Fatalf("function body was lost")
+	}
+}
+
+// TestDecodeErrors tests that malformed input is rejected.
+func TestDecodeErrors(t *testing.T) {
+
+	valid, _ := Encode(&Array{Elements: []Object{&String{Value: "steve"}, &Float{Value: 1}}})
+
+	tests := [][]byte{
+		{},
+		{0xFF},
+		append(append([]byte{}, valid...), 0),
+	}
+
+	// Every truncation of a valid encoding must fail.
+	for i := 1; i < len(valid); i++ {
+		tests = append(tests, valid[:i])
+	}
+
+	for _, data := range tests {
+		_, err := Decode(data)
+		if err == nil {
+			t.Fatalf("expected an error decoding %v", data)
+		}
+	}
+}
@@ -6,13 +6,20 @@
 // * Array.
 // * Boolean value.
 // * Floating-point number.
+// * Function, created via a lambda-expression.
+// * Hash, holding named values.
 // * Integer number.
 // * Null
+// * Set of strings, which is created by the host application.
 // * String value.
 //
 // To allow these objects to be used interchanagably there is a simple
 // interface which all object-types must implement, which is simple to
 // satisfy.
+//
+// Objects must not be modified once they've been created, as common
+// values, such as small integers, are shared.  NewInteger, NewBoolean,
+// and NewNull return shared values where possible.
 package object
 
 // Type describes the type of an object.
@@ -20,13 +27,17 @@ type Type string
 
 // pre-defined object types.
 const (
-	ARRAY   = "ARRAY"
-	BOOLEAN = "BOOLEAN"
-	ERROR   = "ERROR"
-	FLOAT   = "FLOAT"
-	INTEGER = "INTEGER"
-	NULL    = "NULL"
-	STRING  = "STRING"
+	ARRAY    = "ARRAY"
+	BOOLEAN  = "BOOLEAN"
+	ERROR    = "ERROR"
+	FLOAT    = "FLOAT"
+	FUNCTION = "FUNCTION"
+	HASH     = "HASH"
+	INTEGER  = "INTEGER"
+	ITERATOR = "ITERATOR"
+	NULL     = "NULL"
+	SET      = "SET"
+	STRING   = "STRING"
 )
 
 // Object is the interface that all of our various object-types must implement.
@@ -46,4 +57,12 @@ type Object interface {
 	// This is used when an object is used in an `if` expression,
 	// for example, or with the logical `&&` and `||` operations.
 	True() bool
+
+	// ToInterface returns the native golang equivalent of this
+	// object, so that the results of a script may be used without
+	// testing for each object-type.
+	//
+	// Integers are int64, floats float64, arrays []interface{},
+	// hashes map[string]interface{}, and null is nil.
+	ToInterface() interface{}
 }
@@ -35,3 +35,12 @@ func (ao *Array) Inspect() string {
 func (ao *Array) True() bool {
 	return (len(ao.Elements) != 0)
 }
+
+// ToInterface returns the elements of the array as native golang values.
+func (ao *Array) ToInterface() interface{} {
+	out := make([]interface{}, len(ao.Elements))
+	for i, el := range ao.Elements {
+		out[i] = el.ToInterface()
+	}
+	return out
+}
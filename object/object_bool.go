@@ -4,6 +4,23 @@ import (
 	"fmt"
 )
 
+// The shared boolean values.
+var (
+	trueValue  = &Boolean{Value: true}
+	falseValue = &Boolean{Value: false}
+)
+
+// NewBoolean returns an object wrapping the given value.
+//
+// There are only two possible values, so they are shared rather than
+// allocated each time.
+func NewBoolean(value bool) *Boolean {
+	if value {
+		return trueValue
+	}
+	return falseValue
+}
+
 // Boolean wraps bool and implements the Object interface.
 type Boolean struct {
 	// Value holds the boolean value we wrap.
@@ -26,3 +43,8 @@ func (b *Boolean) Inspect() string {
 func (b *Boolean) True() bool {
 	return b.Value
 }
+
+// ToInterface returns the value as a native golang bool.
+func (b *Boolean) ToInterface() interface{} {
+	return b.Value
+}
@@ -0,0 +1,137 @@
+package object
+
+import (
+	"strconv"
+)
+
+// Comparable is implemented by the objects which may be compared for
+// equality, which are integers, floats, strings, booleans, arrays, and
+// hashes.
+//
+// This defines the meaning of `==`, and `!=`, as well as the membership
+// of an array for the `in` operator.
+type Comparable interface {
+	Object
+
+	// Equal returns true if the object is equal to the other.
+	//
+	// Integers and floats are compared by value, so `1 == 1.0`,
+	// but other objects are only equal to those of the same type.
+	// Arrays, and hashes, are equal if their members are.
+	Equal(other Object) bool
+}
+
+// Hashable is implemented by the objects which may be used as the key of
+// a hash, or the member of a set, which are integers, floats, strings,
+// and booleans.
+//
+// Objects which are Equal have the same key, so `3` and `"3"` are the
+// same key, and so are `1` and `1.0`.
+type Hashable interface {
+	Object
+
+	// HashKey returns the key under which the object is stored.
+	HashKey() string
+}
+
+// Equal returns true if the given objects are equal.  Objects which are
+// not Comparable are never equal.
+func Equal(a Object, b Object) bool {
+	if c, ok := a.(Comparable); ok {
+		return c.Equal(b)
+	}
+	return false
+}
+
+// HashKey returns the key under which the given object is stored in a
+// hash, or a set, or false if it isn't Hashable.
+func HashKey(obj Object) (string, bool) {
+	if h, ok := obj.(Hashable); ok {
+		return h.HashKey(), true
+	}
+	return "", false
+}
+
+// Equal returns true if the other object is an array of the same length,
+// whose elements are equal to ours.
+func (ao *Array) Equal(other Object) bool {
+	o, ok := other.(*Array)
+	if !ok || len(ao.Elements) != len(o.Elements) {
+		return false
+	}
+	for i, el := range ao.Elements {
+		if !Equal(el, o.Elements[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Equal returns true if the other object is a boolean with the same value.
+func (b *Boolean) Equal(other Object) bool {
+	o, ok := other.(*Boolean)
+	return ok && b.Value == o.Value
+}
+
+// HashKey returns the key under which the boolean is stored.
+func (b *Boolean) HashKey() string {
+	return strconv.FormatBool(b.Value)
+}
+
+// Equal returns true if the other object is a number with the same value.
+func (f *Float) Equal(other Object) bool {
+	switch o := other.(type) {
+	case *Float:
+		return f.Value == o.Value
+	case *Integer:
+		return f.Value == float64(o.Value)
+	}
+	return false
+}
+
+// HashKey returns the key under which the float is stored.
+func (f *Float) HashKey() string {
+	return f.Inspect()
+}
+
+// Equal returns true if the other object is a hash with the same names,
+// whose members are equal to ours.
+func (h *Hash) Equal(other Object) bool {
+	o, ok := other.(*Hash)
+	if !ok || len(h.Pairs) != len(o.Pairs) {
+		return false
+	}
+	for name, val := range h.Pairs {
+		if member, found := o.Pairs[name]; !found || !Equal(val, member) {
+			return false
+		}
+	}
+	return true
+}
+
+// Equal returns true if the other object is a number with the same value.
+func (i *Integer) Equal(other Object) bool {
+	switch o := other.(type) {
+	case *Integer:
+		return i.Value == o.Value
+	case *Float:
+		return float64(i.Value) == o.Value
+	}
+	return false
+}
+
+// HashKey returns the key under which the integer is stored.
+func (i *Integer) HashKey() string {
+	return strconv.FormatInt(i.Value, 10)
+}
+
+// Equal returns true if the other object is a string with the same value.
+func (s *String) Equal(other Object) bool {
+	o, ok := other.(*String)
+	return ok && s.Value == o.Value
+}
+
+// HashKey returns the key under which the string is stored.
+func (s *String) HashKey() string {
+	return s.Value
+}
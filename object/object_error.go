@@ -1,9 +1,45 @@
 package object
 
+// ErrorKind describes the kind of failure an Error reports.
+type ErrorKind string
+
+// pre-defined error kinds.
+const (
+	// AssertionError is used when an assertion made via the
+	// `assert` function fails.
+	AssertionError ErrorKind = "assertion"
+
+	// ArgumentError is used when a function is called with the
+	// wrong number of arguments.
+	ArgumentError ErrorKind = "argument"
+
+	// ConversionError is used when a value cannot be converted
+	// to the requested type, such as `int("steve")`.
+	ConversionError ErrorKind = "conversion"
+
+	// TypeError is used when a function is given a value of
+	// the wrong type.
+	TypeError ErrorKind = "type"
+
+	// ValueError is used when a function is given a value which
+	// is invalid, such as a malformed regular expression.
+	ValueError ErrorKind = "value"
+
+	// StoreError is used when the Store supplied by the host
+	// application fails to get, or set, a value.
+	StoreError ErrorKind = "store"
+)
+
 // Error wraps string and implements Object interface.
+//
+// It also implements the golang error interface, so errors raised by
+// functions are returned to the host application unchanged.
 type Error struct {
 	// Message contains the error-message we're wrapping
 	Message string
+
+	// Kind describes the kind of error, and may be empty.
+	Kind ErrorKind
 }
 
 // Type returns the type of this object.
@@ -22,3 +58,14 @@ func (e *Error) Inspect() string {
 func (e *Error) True() bool {
 	return false
 }
+
+// ToInterface returns the error itself, as it implements the golang
+// error interface.
+func (e *Error) ToInterface() interface{} {
+	return e
+}
+
+// Error returns the error-message, implementing the error interface.
+func (e *Error) Error() string {
+	return e.Message
+}
@@ -11,7 +11,15 @@ type Float struct {
 }
 
 // Inspect returns a string-representation of the given object.
+//
+// This uses the fewest digits which represent the value exactly, and
+// never uses scientific notation, so that the result is stable, and may
+// be compared with the strings which scripts build.  Negative zero is
+// shown as "0".
 func (f *Float) Inspect() string {
+	if f.Value == 0 {
+		return "0"
+	}
 	return strconv.FormatFloat(f.Value, 'f', -1, 64)
 }
 
@@ -26,3 +34,8 @@ func (f *Float) Type() Type {
 func (f *Float) True() bool {
 	return (f.Value != 0)
 }
+
+// ToInterface returns the value as a native golang float64.
+func (f *Float) ToInterface() interface{} {
+	return f.Value
+}
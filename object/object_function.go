@@ -0,0 +1,48 @@
+package object
+
+// Function wraps a lambda-expression, such as `x => x > 3`, and implements
+// the Object interface.
+//
+// The compiler creates a Function with the parameter names, the source of
+// the lambda, and the bytecode of its body.  When the lambda is evaluated
+// at run-time the virtual machine creates a copy with the Call member
+// populated, binding the function to the scope it was created within.
+type Function struct {
+	// Parameters holds the names of the arguments the function accepts.
+	Parameters []string
+
+	// Source holds the source of the lambda, for display purposes.
+	Source string
+
+	// Body holds the compiled bytecode of the function-body.
+	Body []byte
+
+	// Call invokes the function with the given arguments.
+	//
+	// This is nil until the virtual machine has bound the function
+	// to its enclosing scope.
+	Call func(args []Object) (Object, error)
+}
+
+// Type returns the type of this object.
+func (f *Function) Type() Type {
+	return FUNCTION
+}
+
+// Inspect returns a string-representation of the given object.
+func (f *Function) Inspect() string {
+	return f.Source
+}
+
+// True returns whether this object wraps a true-like value.
+//
+// Used when this object is the conditional in a comparison, etc.
+func (f *Function) True() bool {
+	return true
+}
+
+// ToInterface returns the function itself, as there is no native
+// equivalent.
+func (f *Function) ToInterface() interface{} {
+	return f
+}
@@ -0,0 +1,60 @@
+package object
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+)
+
+// Hash wraps a set of named values and implements the Object interface.
+//
+// Hashes are created from nested objects, such as JSON objects or the
+// struct-typed fields of the object a script is executed against, and
+// their members may be accessed via `Parent.Child`, or `Parent["Child"]`.
+type Hash struct {
+	// Pairs holds the members of the hash, by name.
+	Pairs map[string]Object
+}
+
+// Type returns the type of this object.
+func (h *Hash) Type() Type {
+	return HASH
+}
+
+// Inspect returns a string-representation of the given object.
+//
+// The members are sorted by name, so that the output is stable.
+func (h *Hash) Inspect() string {
+	keys := make([]string, 0, len(h.Pairs))
+	for k := range h.Pairs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+": "+h.Pairs[k].Inspect())
+	}
+
+	var out bytes.Buffer
+	out.WriteString("{")
+	out.WriteString(strings.Join(pairs, ", "))
+	out.WriteString("}")
+	return out.String()
+}
+
+// True returns whether this object wraps a true-like value.
+//
+// Used when this object is the conditional in a comparison, etc.
+func (h *Hash) True() bool {
+	return (len(h.Pairs) != 0)
+}
+
+// ToInterface returns the members of the hash as native golang values.
+func (h *Hash) ToInterface() interface{} {
+	out := make(map[string]interface{}, len(h.Pairs))
+	for name, val := range h.Pairs {
+		out[name] = val.ToInterface()
+	}
+	return out
+}
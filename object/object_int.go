@@ -4,6 +4,36 @@ import (
 	"fmt"
 )
 
+// The range of integers which are shared, rather than being allocated
+// each time they're created.
+const (
+	minSharedInteger = -128
+	maxSharedInteger = 1024
+)
+
+// sharedIntegers holds the integers in the range above.
+var sharedIntegers [maxSharedInteger - minSharedInteger + 1]Integer
+
+// init populates our shared integers.
+func init() {
+	for i := range sharedIntegers {
+		sharedIntegers[i].Value = int64(i + minSharedInteger)
+	}
+}
+
+// NewInteger returns an object wrapping the given value.
+//
+// Objects are never modified once they've been created, so the small
+// integers which are used most often are shared rather than allocated.
+// We don't pool larger values for reuse, as an object may be stored in
+// a variable and outlive the run which created it.
+func NewInteger(value int64) *Integer {
+	if value >= minSharedInteger && value <= maxSharedInteger {
+		return &sharedIntegers[value-minSharedInteger]
+	}
+	return &Integer{Value: value}
+}
+
 // Integer wraps int64 and implements the Object interface.
 type Integer struct {
 	// Value holds the integer value this object wraps
@@ -26,3 +56,8 @@ func (i *Integer) Type() Type {
 func (i *Integer) True() bool {
 	return (i.Value != 0)
 }
+
+// ToInterface returns the value as a native golang int64.
+func (i *Integer) ToInterface() interface{} {
+	return i.Value
+}
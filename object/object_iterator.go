@@ -0,0 +1,109 @@
+package object
+
+import (
+	"sort"
+)
+
+// Iterable is implemented by the objects whose members may be iterated
+// over, which are arrays, strings, and hashes.
+type Iterable interface {
+	// Iterator returns a new iterator over the members of the object.
+	Iterator() Iterator
+}
+
+// Iterator returns the members of a collection in turn.
+//
+// Unlike our other objects an iterator changes as it is used, so each
+// is created for a single iteration, and must not be shared.
+type Iterator interface {
+	Object
+
+	// Next returns the key and value of the next member, or false
+	// if there are no more members.
+	//
+	// The keys of arrays and strings are the index of each member,
+	// and the members of a string are its characters.  Hashes are
+	// iterated over in the order of their keys.
+	Next() (Object, Object, bool)
+}
+
+// iterator holds the state of an iteration, and implements Iterator.
+type iterator struct {
+	// next returns the key and value at the given position.
+	next func(i int) (Object, Object)
+
+	// i is the position of the next member, and count the number
+	// of members.
+	i     int
+	count int
+}
+
+// Type returns the type of this object.
+func (it *iterator) Type() Type {
+	return ITERATOR
+}
+
+// Inspect returns a string-representation of the given object.
+func (it *iterator) Inspect() string {
+	return "iterator"
+}
+
+// True returns whether this object wraps a true-like value.
+//
+// An iterator is true if it has members remaining.
+func (it *iterator) True() bool {
+	return it.i < it.count
+}
+
+// ToInterface returns the iterator itself, as there is no native
+// equivalent.
+func (it *iterator) ToInterface() interface{} {
+	return it
+}
+
+// Next returns the key and value of the next member.
+func (it *iterator) Next() (Object, Object, bool) {
+	if it.i >= it.count {
+		return nil, nil, false
+	}
+	key, val := it.next(it.i)
+	it.i++
+	return key, val, true
+}
+
+// Iterator returns an iterator over the elements of the array.
+func (ao *Array) Iterator() Iterator {
+	return &iterator{
+		count: len(ao.Elements),
+		next: func(i int) (Object, Object) {
+			return NewInteger(int64(i)), ao.Elements[i]
+		},
+	}
+}
+
+// Iterator returns an iterator over the characters of the string.
+func (s *String) Iterator() Iterator {
+	chars := []rune(s.Value)
+	return &iterator{
+		count: len(chars),
+		next: func(i int) (Object, Object) {
+			return NewInteger(int64(i)), &String{Value: string(chars[i])}
+		},
+	}
+}
+
+// Iterator returns an iterator over the members of the hash.
+func (h *Hash) Iterator() Iterator {
+	keys := make([]string, 0, len(h.Pairs))
+	for k := range h.Pairs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return &iterator{
+		count: len(keys),
+		next: func(i int) (Object, Object) {
+			return &String{Value: keys[i]}, h.Pairs[keys[i]]
+		},
+	}
+}
@@ -1,5 +1,13 @@
 package object
 
+// nullValue is the shared null value.
+var nullValue = &Null{}
+
+// NewNull returns the null value.
+func NewNull() *Null {
+	return nullValue
+}
+
 // Null wraps nothing and implements our Object interface.
 type Null struct{}
 
@@ -19,3 +27,8 @@ func (n *Null) Inspect() string {
 func (n *Null) True() bool {
 	return false
 }
+
+// ToInterface returns nil.
+func (n *Null) ToInterface() interface{} {
+	return nil
+}
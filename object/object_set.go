@@ -0,0 +1,77 @@
+package object
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+)
+
+// Set wraps a set of strings and implements the Object interface.
+//
+// Sets are created by the host application, and made available to
+// scripts as variables, so that membership may be tested via the `in`
+// operator without scanning an array.  Values are compared as strings,
+// so `3 in set` is true if the set contains "3".
+type Set struct {
+	// Members holds the members of the set.
+	Members map[string]struct{}
+}
+
+// NewSet creates a set containing the given values.
+func NewSet(values []string) *Set {
+	s := &Set{Members: make(map[string]struct{}, len(values))}
+	for _, v := range values {
+		s.Members[v] = struct{}{}
+	}
+	return s
+}
+
+// Contains returns true if the given object is a member of the set.
+func (s *Set) Contains(obj Object) bool {
+	key, ok := HashKey(obj)
+	if !ok {
+		return false
+	}
+	_, ok = s.Members[key]
+	return ok
+}
+
+// Type returns the type of this object.
+func (s *Set) Type() Type {
+	return SET
+}
+
+// Inspect returns a string-representation of the given object.
+//
+// The members are sorted, so that the output is stable.
+func (s *Set) Inspect() string {
+	members := make([]string, 0, len(s.Members))
+	for m := range s.Members {
+		members = append(members, m)
+	}
+	sort.Strings(members)
+
+	var out bytes.Buffer
+	out.WriteString("set(")
+	out.WriteString(strings.Join(members, ", "))
+	out.WriteString(")")
+	return out.String()
+}
+
+// True returns whether this object wraps a true-like value.
+//
+// Used when this object is the conditional in a comparison, etc.
+func (s *Set) True() bool {
+	return (len(s.Members) != 0)
+}
+
+// ToInterface returns the members of the set as a sorted slice of
+// strings.
+func (s *Set) ToInterface() interface{} {
+	members := make([]string, 0, len(s.Members))
+	for m := range s.Members {
+		members = append(members, m)
+	}
+	sort.Strings(members)
+	return members
+}
@@ -1,9 +1,18 @@
 package object
 
+import "regexp"
+
 // String wraps string and implements the Object interface.
 type String struct {
 	// Value holds the string value this object wraps.
 	Value string
+
+	// Regexp holds the compiled form of Value, if this string is a
+	// regular expression literal.
+	//
+	// The compiler sets this so that the expression needn't be
+	// compiled at run-time.
+	Regexp *regexp.Regexp
 }
 
 // Type returns the type of this object.
@@ -22,3 +31,8 @@ func (s *String) Inspect() string {
 func (s *String) True() bool {
 	return (s.Value != "")
 }
+
+// ToInterface returns the value as a native golang string.
+func (s *String) ToInterface() interface{} {
+	return s.Value
+}
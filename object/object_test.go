@@ -0,0 +1,239 @@
+package object
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// Test that common values are shared.
+func TestShared(t *testing.T) {
+
+	for _, v := range []int64{minSharedInteger, -1, 0, 1, 3, maxSharedInteger} {
+		if NewInteger(v) != NewInteger(v) {
+			t.Errorf("integer %d is not shared", v)
+		}
+		if NewInteger(v).Value != v {
+			t.Errorf("integer %d has the wrong value %d", v, NewInteger(v).Value)
+		}
+	}
+
+	for _, v := range []int64{minSharedInteger - 1, maxSharedInteger + 1, 1 << 40} {
+		if NewInteger(v) == NewInteger(v) {
+			t.Errorf("integer %d is shared", v)
+		}
+		if NewInteger(v).Value != v {
+			t.Errorf("integer %d has the wrong value %d", v, NewInteger(v).Value)
+		}
+	}
+
+	if NewBoolean(true) != NewBoolean(true) || !NewBoolean(true).Value {
+		t.Errorf("true is not shared")
+	}
+	if NewBoolean(false) != NewBoolean(false) || NewBoolean(false).Value {
+		t.Errorf("false is not shared")
+	}
+	if NewNull() != NewNull() {
+		t.Errorf("null is not shared")
+	}
+}
+
+// Test that sets compare their members as strings.
+func TestSet(t *testing.T) {
+
+	s := NewSet([]string{"steve", "3", "3"})
+	if len(s.Members) != 2 || !s.True() {
+		t.Errorf("unexpected members: %s", s.Inspect())
+	}
+	if s.Inspect() != "set(3, steve)" {
+		t.Errorf("unexpected string-form: %s", s.Inspect())
+	}
+	if !s.Contains(&String{Value: "steve"}) || !s.Contains(NewInteger(3)) || s.Contains(NewInteger(4)) {
+		t.Errorf("unexpected membership")
+	}
+	if NewSet(nil).True() {
+		t.Errorf("an empty set should be false")
+	}
+}
+
+func TestIterator(t *testing.T) {
+
+	collect := func(it Iterator) string {
+		out := ""
+		for {
+			k, v, ok := it.Next()
+			if !ok {
+				break
+			}
+			out += k.Inspect() + "=" + v.Inspect() + " "
+		}
+		return out
+	}
+
+	tests := []struct {
+		Input  Iterable
+		Output string
+	}{
+		{Input: &Array{Elements: []Object{NewInteger(3), &String{Value: "x"}}}, Output: "0=3 1=x "},
+		{Input: &String{Value: "héy"}, Output: "0=h 1=é 2=y "},
+		{Input: &Hash{Pairs: map[string]Object{"b": NewInteger(2), "a": NewInteger(1)}}, Output: "a=1 b=2 "},
+		{Input: &Array{}, Output: ""},
+	}
+
+	for _, tst := range tests {
+		it := tst.Input.Iterator()
+		if it.Type() != ITERATOR || it.True() != (tst.Output != "") {
+			t.Errorf("unexpected iterator for %v", tst.Input)
+		}
+		if out := collect(it); out != tst.Output {
+			t.Errorf("unexpected members of %v: %s", tst.Input, out)
+		}
+		if it.True() {
+			t.Errorf("iterator should be exhausted")
+		}
+		if _, _, ok := it.Next(); ok {
+			t.Errorf("iterator returned a member after it was exhausted")
+		}
+	}
+}
+
+// Test converting objects to native values.
+func TestToInterface(t *testing.T) {
+
+	fn := &Function{Source: "x => x"}
+	errObj := &Error{Message: "failed"}
+
+	tests := []struct {
+		Input  Object
+		Output interface{}
+	}{
+		{NewInteger(-3), int64(-3)},
+		{&Float{Value: 1.5}, 1.5},
+		{&String{Value: "steve"}, "steve"},
+		{NewBoolean(true), true},
+		{NewNull(), nil},
+		{NewSet([]string{"b", "a"}), []string{"a", "b"}},
+		{&Array{Elements: []Object{NewInteger(1), &String{Value: "x"}, NewNull()}}, []interface{}{int64(1), "x", nil}},
+		{&Array{}, []interface{}{}},
+		{&Hash{Pairs: map[string]Object{
+			"name": &String{Value: "steve"},
+			"tags": &Array{Elements: []Object{NewBoolean(false)}},
+		}}, map[string]interface{}{"name": "steve", "tags": []interface{}{false}}},
+		{fn, fn},
+		{errObj, errObj},
+	}
+
+	for _, tst := range tests {
+		if out := tst.Input.ToInterface(); !reflect.DeepEqual(out, tst.Output) {
+			t.Errorf("unexpected value for %s: %#v", tst.Input.Inspect(), out)
+		}
+	}
+
+	if err, ok := errObj.ToInterface().(error); !ok || err.Error() != "failed" {
+		t.Errorf("an error should convert to an error")
+	}
+}
+
+// Test comparing, and hashing, objects.
+func TestCompare(t *testing.T) {
+
+	tests := []struct {
+		A     Object
+		B     Object
+		Equal bool
+	}{
+		{NewInteger(3), NewInteger(3), true},
+		{NewInteger(3), &Float{Value: 3}, true},
+		{&Float{Value: 3.5}, &Float{Value: 3.5}, true},
+		{&Float{Value: 3.5}, NewInteger(3), false},
+		{&String{Value: "3"}, NewInteger(3), false},
+		{&String{Value: "a"}, &String{Value: "a"}, true},
+		{NewBoolean(true), NewBoolean(true), true},
+		{NewBoolean(true), NewInteger(1), false},
+		{NewNull(), NewNull(), false},
+	}
+
+	for _, tst := range tests {
+		if Equal(tst.A, tst.B) != tst.Equal {
+			t.Errorf("unexpected equality of %s and %s", tst.A.Inspect(), tst.B.Inspect())
+		}
+
+		// Equal objects have the same key.
+		a, okA := HashKey(tst.A)
+		b, okB := HashKey(tst.B)
+		if tst.Equal && (!okA || !okB || a != b) {
+			t.Errorf("equal objects %s and %s have different keys", tst.A.Inspect(), tst.B.Inspect())
+		}
+	}
+
+	for _, obj := range []Object{NewNull(), &Array{}, &Hash{}, &Function{}} {
+		if _, ok := HashKey(obj); ok {
+			t.Errorf("%s should not be hashable", obj.Type())
+		}
+	}
+
+	arr := func(elements ...Object) *Array {
+		return &Array{Elements: elements}
+	}
+	hash := func(name string, val Object) *Hash {
+		return &Hash{Pairs: map[string]Object{name: val}}
+	}
+
+	collections := []struct {
+		A     Object
+		B     Object
+		Equal bool
+	}{
+		{&Array{}, &Array{}, true},
+		{arr(NewInteger(1), &String{Value: "x"}), arr(&Float{Value: 1}, &String{Value: "x"}), true},
+		{arr(NewInteger(1)), arr(NewInteger(1), NewInteger(1)), false},
+		{arr(NewInteger(1), NewInteger(2)), arr(NewInteger(2), NewInteger(1)), false},
+		{arr(arr(NewBoolean(true))), arr(arr(NewBoolean(true))), true},
+		{arr(NewNull()), arr(NewNull()), false},
+		{&Hash{}, &Hash{}, true},
+		{hash("a", arr(NewInteger(1))), hash("a", arr(NewInteger(1))), true},
+		{hash("a", NewInteger(1)), hash("b", NewInteger(1)), false},
+		{hash("a", NewInteger(1)), &Hash{}, false},
+		{&Hash{}, &Array{}, false},
+	}
+	for _, tst := range collections {
+		if Equal(tst.A, tst.B) != tst.Equal || Equal(tst.B, tst.A) != tst.Equal {
+			t.Errorf("unexpected equality of %s and %s", tst.A.Inspect(), tst.B.Inspect())
+		}
+	}
+
+	set := NewSet([]string{"3", "true", "x"})
+	for _, obj := range []Object{NewInteger(3), &Float{Value: 3}, NewBoolean(true), &String{Value: "x"}} {
+		if !set.Contains(obj) {
+			t.Errorf("set should contain %s", obj.Inspect())
+		}
+	}
+	if set.Contains(&Array{Elements: []Object{&String{Value: "x"}}}) {
+		t.Errorf("set should not contain an array")
+	}
+}
+
+func TestFloatInspect(t *testing.T) {
+
+	tenth, fifth := 0.1, 0.2
+
+	tests := []struct {
+		Input  float64
+		Output string
+	}{
+		{1.5, "1.5"},
+		{-0.25, "-0.25"},
+		{3, "3"},
+		{math.Copysign(0, -1), "0"},
+		{1e21, "1000000000000000000000"},
+		{1e-7, "0.0000001"},
+		{tenth + fifth, "0.30000000000000004"},
+	}
+
+	for _, tst := range tests {
+		out := (&Float{Value: tst.Input}).Inspect()
+		if out != tst.Output {
+			t.Errorf("unexpected output for %v: %s, expected %s", tst.Input, out, tst.Output)
+		}
+	}
+}
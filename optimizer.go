@@ -9,6 +9,11 @@
 //
 // Once we've done that we can convert some jumping operations which might
 // use those results into unconditional jumps, or NOPs as appropriate.
+// Jumps to other jumps are made to go directly to their destination, and
+// code which can no longer be reached is removed.
+//
+// Finally we replace some common sequences of instructions with a single
+// fused instruction, which does the same job with less overhead.
 //
 // Brief discussion in this blog post:
 //
@@ -21,6 +26,7 @@ import (
 	"fmt"
 
 	"github.com/skx/evalfilter/v2/code"
+	"github.com/skx/evalfilter/v2/object"
 )
 
 // optimize optimizes our bytecode by working over the program
@@ -56,12 +62,24 @@ func (e *Eval) optimize() int {
 		changes++
 	}
 
+	// Shorten chains of jumps, and remove the code they skip
+	if e.threadJumps() {
+		changes++
+	}
+	e.removeUnreachable()
+
 	// Remove NOPs
 	e.removeNOPs()
 
-	// Finally kill dead code
+	// Kill dead code
 	e.removeDeadCode()
 
+	// Finally replace common sequences with fused instructions
+	if e.fuseInstructions() {
+		e.removeNOPs()
+		changes++
+	}
+
 	// And return the changes.
 	return changes
 }
@@ -211,7 +229,7 @@ func (e *Eval) optimizeMaths() (bool, error) {
 			// reset our argument counters.
 			args = nil
 
-		case code.OpMul, code.OpAdd, code.OpSub, code.OpDiv:
+		case code.OpMul, code.OpAdd, code.OpSub, code.OpDiv, code.OpIntDiv:
 
 			//
 			// Primitive maths operation.
@@ -224,9 +242,11 @@ func (e *Eval) optimizeMaths() (bool, error) {
 			// become "OpPush 4" with a series of NOps.
 			//
 			// If we didn't then it is something we
-			// should leave alone.
+			// should leave alone.  Division is only
+			// collapsed if integers are divided as
+			// integers, as the result isn't a float.
 			//
-			if len(args) >= 2 {
+			if len(args) >= 2 && (op != code.OpDiv || e.intDivision) {
 
 				// Get the two arguments
 				a := args[len(args)-1]
@@ -249,7 +269,7 @@ func (e *Eval) optimizeMaths() (bool, error) {
 				if op == code.OpSub {
 					result = b.value - a.value
 				}
-				if op == code.OpDiv {
+				if op == code.OpDiv || op == code.OpIntDiv {
 
 					// found division by zero
 					if a.value == 0 {
@@ -421,6 +441,156 @@ func (e *Eval) optimizeJumps() bool {
 	return false
 }
 
+// threadJumps updates jumps whose destination is another jump, so that
+// they go directly to the final destination.
+//
+// Nested if-statements, and loops, lead to code like this:
+//
+//   000010 OpJump 20
+//   ..
+//   000020 OpJump 30
+//
+// In which case the first jump can go straight to 30.  A jump whose
+// destination is a return is replaced by the return itself, because
+// that does the same thing.
+func (e *Eval) threadJumps() bool {
+
+	changed := false
+
+	ip := 0
+	ln := len(e.instructions)
+	for ip < ln {
+
+		op := code.Opcode(e.instructions[ip])
+		opLen := code.Length(op)
+
+		switch op {
+		case code.OpJump, code.OpJumpIfFalse, code.OpTry, code.OpIterNext:
+
+			dst := int(binary.BigEndian.Uint16(e.instructions[ip+1 : ip+3]))
+			final := e.jumpDestination(dst)
+
+			if op == code.OpJump && final < ln && code.Opcode(e.instructions[final]) == code.OpReturn {
+				e.instructions[ip] = byte(code.OpReturn)
+				e.instructions[ip+1] = byte(code.OpNop)
+				e.instructions[ip+2] = byte(code.OpNop)
+				changed = true
+				break
+			}
+
+			if final != dst {
+				binary.BigEndian.PutUint16(e.instructions[ip+1:ip+3], uint16(final))
+				changed = true
+			}
+		}
+
+		ip += opLen
+	}
+
+	return changed
+}
+
+// jumpDestination returns the offset at which execution really continues
+// after a jump to the given offset, by skipping any NOPs, and following
+// any unconditional jumps.
+func (e *Eval) jumpDestination(ip int) int {
+
+	ln := len(e.instructions)
+
+	// An infinite loop jumps to itself, so we bound the number
+	// of jumps we'll follow.
+	for hops := 0; hops < ln; hops++ {
+
+		for ip < ln && code.Opcode(e.instructions[ip]) == code.OpNop {
+			ip++
+		}
+		if ip >= ln || code.Opcode(e.instructions[ip]) != code.OpJump {
+			return ip
+		}
+		ip = int(binary.BigEndian.Uint16(e.instructions[ip+1 : ip+3]))
+	}
+	return ip
+}
+
+// removeUnreachable replaces the instructions which can't be reached,
+// such as those following a return, or the branches which specialization
+// has shown are never taken, with OpNop.  Jumps to the following
+// instruction are removed too.
+func (e *Eval) removeUnreachable() {
+
+	//
+	// Follow every path through the program, from the start.
+	//
+	reached := make(map[int]bool)
+	pending := []int{0}
+
+	ln := len(e.instructions)
+	for len(pending) > 0 {
+
+		ip := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		for ip < ln && !reached[ip] {
+			reached[ip] = true
+
+			op := code.Opcode(e.instructions[ip])
+			switch op {
+			case code.OpJump, code.OpJumpIfFalse, code.OpTry, code.OpIterNext:
+				pending = append(pending, int(binary.BigEndian.Uint16(e.instructions[ip+1:ip+3])))
+			case code.OpLookupConstantEqual:
+				pending = append(pending, int(binary.BigEndian.Uint16(e.instructions[ip+5:ip+7])))
+			}
+			if op == code.OpJump || op == code.OpReturn {
+				break
+			}
+			ip += code.Length(op)
+		}
+	}
+
+	ip := 0
+	for ip < ln {
+
+		op := code.Opcode(e.instructions[ip])
+		opLen := code.Length(op)
+
+		if !reached[ip] {
+			for i := ip; i < ip+opLen; i++ {
+				e.instructions[i] = byte(code.OpNop)
+			}
+		}
+
+		ip += opLen
+	}
+
+	//
+	// Now remove jumps over the code we've removed.
+	//
+	ip = 0
+	for ip < ln {
+
+		op := code.Opcode(e.instructions[ip])
+		opLen := code.Length(op)
+
+		if op == code.OpJump {
+			dst := int(binary.BigEndian.Uint16(e.instructions[ip+1 : ip+3]))
+
+			skipped := dst > ip
+			for i := ip + opLen; i < dst && i < ln; i++ {
+				if code.Opcode(e.instructions[i]) != code.OpNop {
+					skipped = false
+				}
+			}
+			if skipped {
+				for i := ip; i < ip+opLen; i++ {
+					e.instructions[i] = byte(code.OpNop)
+				}
+			}
+		}
+
+		ip += opLen
+	}
+}
+
 // removeNOPs removes any inline NOP instructions.
 //
 // It also rewrites the destinations for jumps as appropriate, to
@@ -452,12 +622,6 @@ func (e *Eval) removeNOPs() {
 		op := code.Opcode(e.instructions[ip])
 		opLen := code.Length(op)
 
-		// Get the opcode's argument, if any.
-		opArg := 0
-		if opLen > 1 {
-			opArg = int(binary.BigEndian.Uint16(e.instructions[ip+1 : ip+3]))
-		}
-
 		//
 		// Now we do the magic.
 		//
@@ -490,23 +654,18 @@ func (e *Eval) removeNOPs() {
 			rewrite[ip] = len(tmp)
 
 			//
-			// Copy the instruction.
-			//
-			tmp = append(tmp, byte(op))
-
+			// Copy the instruction, and any arguments.
 			//
-			// Copy any argument.
-			//
-			if opLen > 1 {
-				b := make([]byte, 2)
-				binary.BigEndian.PutUint16(b, uint16(opArg))
-
-				tmp = append(tmp, b...)
-			}
+			tmp = append(tmp, e.instructions[ip:ip+opLen]...)
 		}
 		ip += opLen
 	}
 
+	//
+	// A jump might point to the end of the program.
+	//
+	rewrite[ln] = len(tmp)
+
 	//
 	// If we've done this correctly we've now got a temporary
 	// program with no NOPs.   We now need to patch up
@@ -539,7 +698,7 @@ func (e *Eval) removeNOPs() {
 		// We use the rewrite map we already made,
 		// which contains "old -> new".
 		//
-		case code.OpJump, code.OpJumpIfFalse:
+		case code.OpJump, code.OpJumpIfFalse, code.OpTry, code.OpIterNext:
 
 			// The old destination is in "opArg".
 			//
@@ -555,6 +714,12 @@ func (e *Eval) removeNOPs() {
 			tmp[ip+1] = b[0]
 			tmp[ip+2] = b[1]
 
+		// The jump-target of our fused comparison is
+		// the third argument.
+		case code.OpLookupConstantEqual:
+
+			opArg = int(binary.BigEndian.Uint16(tmp[ip+5 : ip+7]))
+			binary.BigEndian.PutUint16(tmp[ip+5:ip+7], uint16(rewrite[opArg]))
 		}
 
 		//
@@ -602,27 +767,12 @@ func (e *Eval) removeDeadCode() {
 		//
 		opLen := code.Length(op)
 
-		//
-		// If the opcode is more than a single byte long
-		// we read the argument here.
-		//
-		opArg := 0
-		if opLen > 1 {
-
-			//
-			// Note in the future we might have to cope
-			// with opcodes with more than a single argument,
-			// and they might be different sizes.
-			//
-			opArg = int(binary.BigEndian.Uint16(e.instructions[ip+1 : ip+3]))
-		}
-
 		//
 		// Now we do the magic.
 		//
 		switch op {
 
-		case code.OpJumpIfFalse, code.OpJump:
+		case code.OpJumpIfFalse, code.OpJump, code.OpTry, code.OpIterNext, code.OpLookupConstantEqual:
 			return
 
 		case code.OpReturn:
@@ -634,16 +784,8 @@ func (e *Eval) removeDeadCode() {
 
 		default:
 
-			tmp = append(tmp, byte(op))
-			if opLen > 1 {
-
-				// Make a buffer for the arg
-				b := make([]byte, 2)
-				binary.BigEndian.PutUint16(b, uint16(opArg))
-
-				// append
-				tmp = append(tmp, b...)
-			}
+			// Copy the instruction, and any arguments.
+			tmp = append(tmp, e.instructions[ip:ip+opLen]...)
 		}
 		ip += opLen
 	}
@@ -653,3 +795,93 @@ func (e *Eval) removeDeadCode() {
 	//
 	e.instructions = tmp
 }
+
+// fuseInstructions replaces common sequences of instructions with a
+// single "superinstruction", which reduces the overhead of dispatching
+// each of them in turn.
+//
+// Given a condition such as `if ( Name == "Steve" )` we would expect
+// that to be encoded as:
+//
+//	000000 OpLookup 0
+//	000003 OpConstant 1
+//	000006 OpEqual
+//	000007 OpJumpIfFalse 20
+//
+// That can be replaced by "OpLookupConstantEqual 0 1 20", "NOP", "NOP",
+// & "NOP".  If the comparison is against a small integer, which uses
+// OpPush rather than OpConstant, the integer is added as a constant.
+//
+// Sequences which contain the destination of a jump are left alone.
+func (e *Eval) fuseInstructions() bool {
+
+	//
+	// Find the destinations of all jumps, because we can't fuse
+	// a sequence which some other code jumps into the middle of.
+	//
+	targets := make(map[int]bool)
+
+	ip := 0
+	ln := len(e.instructions)
+	for ip < ln {
+
+		op := code.Opcode(e.instructions[ip])
+		opLen := code.Length(op)
+
+		switch op {
+		case code.OpJump, code.OpJumpIfFalse, code.OpTry, code.OpIterNext:
+			targets[int(binary.BigEndian.Uint16(e.instructions[ip+1:ip+3]))] = true
+		case code.OpLookupConstantEqual:
+			targets[int(binary.BigEndian.Uint16(e.instructions[ip+5:ip+7]))] = true
+		}
+
+		ip += opLen
+	}
+
+	//
+	// Now look for the sequence we can replace.
+	//
+	changed := false
+
+	ip = 0
+	for ip < ln {
+
+		op := code.Opcode(e.instructions[ip])
+		opLen := code.Length(op)
+
+		//
+		// OpLookup (3), OpConstant/OpPush (3), OpEqual (1),
+		// and OpJumpIfFalse (3).
+		//
+		if op == code.OpLookup && ip+10 <= ln &&
+			(code.Opcode(e.instructions[ip+3]) == code.OpConstant || code.Opcode(e.instructions[ip+3]) == code.OpPush) &&
+			code.Opcode(e.instructions[ip+6]) == code.OpEqual &&
+			code.Opcode(e.instructions[ip+7]) == code.OpJumpIfFalse &&
+			!targets[ip+3] && !targets[ip+6] && !targets[ip+7] {
+
+			name := binary.BigEndian.Uint16(e.instructions[ip+1 : ip+3])
+			val := int(binary.BigEndian.Uint16(e.instructions[ip+4 : ip+6]))
+			dst := binary.BigEndian.Uint16(e.instructions[ip+8 : ip+10])
+
+			if code.Opcode(e.instructions[ip+3]) == code.OpPush {
+				val = e.addConstant(object.NewInteger(int64(val)))
+			}
+
+			e.instructions[ip] = byte(code.OpLookupConstantEqual)
+			binary.BigEndian.PutUint16(e.instructions[ip+1:ip+3], name)
+			binary.BigEndian.PutUint16(e.instructions[ip+3:ip+5], uint16(val))
+			binary.BigEndian.PutUint16(e.instructions[ip+5:ip+7], dst)
+			e.instructions[ip+7] = byte(code.OpNop)
+			e.instructions[ip+8] = byte(code.OpNop)
+			e.instructions[ip+9] = byte(code.OpNop)
+
+			changed = true
+			ip += 10
+			continue
+		}
+
+		ip += opLen
+	}
+
+	return changed
+}
@@ -28,9 +28,14 @@ const (
 	LOWEST
 	ASSIGN // =
 	COND   // OR or AND
+	XOR    // ^^
 	EQUALS // == or !=
 	CMP
 	LESSGREATER // > or <
+	BITOR       // |
+	BITXOR      // ^
+	BITAND      // &
+	SHIFT       // << or >>
 	SUM         // + or -
 	PRODUCT     // * or /
 	POWER       // **
@@ -43,25 +48,45 @@ const (
 // precedence contains the prededence for each token-type, which
 // is part of the magic of a Pratt-Parser.
 var precedences = map[token.Type]int{
-	token.ASSIGN:   ASSIGN,
-	token.EQ:       EQUALS,
-	token.NOTEQ:    EQUALS,
-	token.LT:       LESSGREATER,
-	token.LTEQUALS: LESSGREATER,
-	token.GT:       LESSGREATER,
-	token.GTEQUALS: LESSGREATER,
-	token.CONTAINS: LESSGREATER,
-	token.MISSING:  LESSGREATER,
-	token.PLUS:     SUM,
-	token.MINUS:    SUM,
-	token.SLASH:    PRODUCT,
-	token.ASTERISK: PRODUCT,
-	token.POW:      POWER,
-	token.MOD:      MOD,
-	token.AND:      COND,
-	token.OR:       COND,
-	token.LPAREN:   CALL,
-	token.LSQUARE:  INDEX,
+	token.ASSIGN:         ASSIGN,
+	token.ARROW:          ASSIGN,
+	token.ASTERISKEQUALS: ASSIGN,
+	token.MINUSEQUALS:    ASSIGN,
+	token.PLUSEQUALS:     ASSIGN,
+	token.SLASHEQUALS:    ASSIGN,
+	token.MINUSMINUS:     CALL,
+	token.PLUSPLUS:       CALL,
+	token.PERIOD:         CALL,
+	token.EQ:             EQUALS,
+	token.NOTEQ:          EQUALS,
+	token.LT:             LESSGREATER,
+	token.LTEQUALS:       LESSGREATER,
+	token.GT:             LESSGREATER,
+	token.GTEQUALS:       LESSGREATER,
+	token.CONTAINS:       LESSGREATER,
+	token.MISSING:        LESSGREATER,
+	token.IMATCHES:       LESSGREATER,
+	token.IMISSING:       LESSGREATER,
+	token.BETWEEN:        LESSGREATER,
+	token.IN:             LESSGREATER,
+	token.OPERATOR:       LESSGREATER,
+	token.PLUS:           SUM,
+	token.MINUS:          SUM,
+	token.SLASH:          PRODUCT,
+	token.INTDIV:         PRODUCT,
+	token.ASTERISK:       PRODUCT,
+	token.POW:            POWER,
+	token.MOD:            MOD,
+	token.AND:            COND,
+	token.OR:             COND,
+	token.XOR:            XOR,
+	token.BITAND:         BITAND,
+	token.BITOR:          BITOR,
+	token.BITXOR:         BITXOR,
+	token.SHL:            SHIFT,
+	token.SHR:            SHIFT,
+	token.LPAREN:         CALL,
+	token.LSQUARE:        INDEX,
 }
 
 // Parser is the object which maintains our parser state.
@@ -89,19 +114,60 @@ type Parser struct {
 	// infixParseFns holds a map of parsing methods for
 	// infix-based syntax.
 	infixParseFns map[token.Type]infixParseFn
+
+	// selectors is true if JSONPath-style selectors are accepted.
+	selectors bool
+
+	// pragmas is true while pragmas may appear, which is until the
+	// first statement which isn't a pragma.
+	pragmas bool
+}
+
+// Option is a function which can be passed to New, to configure
+// the parser.
+type Option func(*Parser)
+
+// WithSelectors causes the parser to accept JSONPath-style selectors,
+// such as `$.request.headers["X-Forwarded-For"]`, in which `$` refers
+// to the object the script is run against.
+//
+// `$.name` and `$["name"]` are the field `name`, and the remainder of
+// the selector is the usual member access, and indexing, so the example
+// is the same as `request.headers["X-Forwarded-For"]`.
+func WithSelectors() Option {
+	return func(p *Parser) {
+		p.selectors = true
+	}
+}
+
+// WithOperators causes the parser to accept the given infix operators,
+// which are added by the host application, such as `inside`, or `~>`.
+//
+// They all have the same precedence as the comparison operators, and
+// the lexer is configured to recognize them.
+func WithOperators(ops ...string) Option {
+	return func(p *Parser) {
+		for _, op := range ops {
+			p.l.AddOperator(op)
+		}
+	}
 }
 
 // New returns a new parser.
 //
 // Once constructed it can be used to parse an input-program
 // into an AST.
-func New(l *lexer.Lexer) *Parser {
+func New(l *lexer.Lexer, options ...Option) *Parser {
 	p := &Parser{l: l, errors: []string{}}
+	for _, option := range options {
+		option(p)
+	}
 	p.nextToken()
 	p.nextToken()
 
 	p.prefixParseFns = make(map[token.Type]prefixParseFn)
 	p.registerPrefix(token.BANG, p.parsePrefixExpression)
+	p.registerPrefix(token.BITNOT, p.parsePrefixExpression)
 	p.registerPrefix(token.EOF, p.parseEOF)
 	p.registerPrefix(token.FALSE, p.parseBooleanLiteral)
 	p.registerPrefix(token.FLOAT, p.parseFloatLiteral)
@@ -112,6 +178,8 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerPrefix(token.LPAREN, p.parseGroupedExpression)
 	p.registerPrefix(token.LSQUARE, p.parseArrayLiteral)
 	p.registerPrefix(token.MINUS, p.parsePrefixExpression)
+	p.registerPrefix(token.MINUSMINUS, p.parsePrefixIncrement)
+	p.registerPrefix(token.PLUSPLUS, p.parsePrefixIncrement)
 	p.registerPrefix(token.REGEXP, p.parseRegexpLiteral)
 	p.registerPrefix(token.SQRT, p.parsePrefixExpression)
 	p.registerPrefix(token.STRING, p.parseStringLiteral)
@@ -120,24 +188,44 @@ func New(l *lexer.Lexer) *Parser {
 
 	p.infixParseFns = make(map[token.Type]infixParseFn)
 	p.registerInfix(token.AND, p.parseInfixExpression)
+	p.registerInfix(token.ARROW, p.parseFunctionLiteral)
 	p.registerInfix(token.ASSIGN, p.parseAssignExpression)
 	p.registerInfix(token.ASTERISK, p.parseInfixExpression)
+	p.registerInfix(token.ASTERISKEQUALS, p.parseCompoundAssignExpression)
+	p.registerInfix(token.BETWEEN, p.parseBetweenExpression)
+	p.registerInfix(token.BITAND, p.parseInfixExpression)
+	p.registerInfix(token.BITOR, p.parseInfixExpression)
+	p.registerInfix(token.BITXOR, p.parseInfixExpression)
 	p.registerInfix(token.CONTAINS, p.parseInfixExpression)
 	p.registerInfix(token.EQ, p.parseInfixExpression)
-	p.registerInfix(token.GT, p.parseInfixExpression)
-	p.registerInfix(token.GTEQUALS, p.parseInfixExpression)
+	p.registerInfix(token.GT, p.parseComparisonExpression)
+	p.registerInfix(token.GTEQUALS, p.parseComparisonExpression)
+	p.registerInfix(token.IMATCHES, p.parseInfixExpression)
+	p.registerInfix(token.IMISSING, p.parseInfixExpression)
+	p.registerInfix(token.IN, p.parseInfixExpression)
 	p.registerInfix(token.LPAREN, p.parseCallExpression)
 	p.registerInfix(token.LSQUARE, p.parseIndexExpression)
-	p.registerInfix(token.LT, p.parseInfixExpression)
-	p.registerInfix(token.LTEQUALS, p.parseInfixExpression)
+	p.registerInfix(token.LT, p.parseComparisonExpression)
+	p.registerInfix(token.LTEQUALS, p.parseComparisonExpression)
 	p.registerInfix(token.MINUS, p.parseInfixExpression)
+	p.registerInfix(token.MINUSEQUALS, p.parseCompoundAssignExpression)
+	p.registerInfix(token.MINUSMINUS, p.parsePostfixIncrement)
 	p.registerInfix(token.MISSING, p.parseInfixExpression)
 	p.registerInfix(token.MOD, p.parseInfixExpression)
 	p.registerInfix(token.NOTEQ, p.parseInfixExpression)
+	p.registerInfix(token.OPERATOR, p.parseInfixExpression)
 	p.registerInfix(token.OR, p.parseInfixExpression)
+	p.registerInfix(token.PERIOD, p.parseMethodCallExpression)
 	p.registerInfix(token.PLUS, p.parseInfixExpression)
+	p.registerInfix(token.PLUSEQUALS, p.parseCompoundAssignExpression)
+	p.registerInfix(token.PLUSPLUS, p.parsePostfixIncrement)
 	p.registerInfix(token.POW, p.parseInfixExpression)
+	p.registerInfix(token.SHL, p.parseInfixExpression)
+	p.registerInfix(token.SHR, p.parseInfixExpression)
 	p.registerInfix(token.SLASH, p.parseInfixExpression)
+	p.registerInfix(token.INTDIV, p.parseInfixExpression)
+	p.registerInfix(token.SLASHEQUALS, p.parseCompoundAssignExpression)
+	p.registerInfix(token.XOR, p.parseInfixExpression)
 
 	return p
 }
@@ -173,6 +261,8 @@ func (p *Parser) nextToken() {
 func (p *Parser) ParseProgram() *ast.Program {
 	program := &ast.Program{}
 	program.Statements = []ast.Statement{}
+	first := p.curToken.Line
+	p.pragmas = true
 	for p.curToken.Type != token.EOF && p.curToken.Type != token.ILLEGAL {
 		stmt := p.parseStatement()
 		if stmt == nil {
@@ -185,12 +275,73 @@ func (p *Parser) ParseProgram() *ast.Program {
 	if p.curToken.Type == token.ILLEGAL {
 		p.errors = append(p.errors, p.curToken.Literal)
 	}
+
+	p.attachComments(program, first)
 	return program
 }
 
+// attachComments records the comments of the program, whose first
+// statement began on the given line, and attaches those which document
+// it, and its rules.
+//
+// Adjacent comments, which aren't trailing code, form a group.  A group
+// which ends on the line before a rule documents the rule, and the first
+// group documents the program if it comes before the first statement,
+// and doesn't document a rule instead.
+func (p *Parser) attachComments(program *ast.Program, first int) {
+
+	var groups [][]*ast.Comment
+	for _, c := range p.l.Comments() {
+		comment := &ast.Comment{Token: c.Token, Trailing: c.Trailing}
+		program.Comments = append(program.Comments, comment)
+
+		if comment.Trailing {
+			continue
+		}
+		n := len(groups)
+		if n > 0 {
+			last := groups[n-1][len(groups[n-1])-1]
+			if comment.Token.Line <= last.EndLine()+1 {
+				groups[n-1] = append(groups[n-1], comment)
+				continue
+			}
+		}
+		groups = append(groups, []*ast.Comment{comment})
+	}
+
+	claimed := make(map[int]bool)
+	for _, stmt := range program.Statements {
+		r, ok := stmt.(*ast.RuleStatement)
+		if !ok {
+			continue
+		}
+		for i, g := range groups {
+			if g[len(g)-1].EndLine() == r.Token.Line-1 {
+				r.Doc = g
+				claimed[i] = true
+			}
+		}
+	}
+
+	if len(groups) > 0 && !claimed[0] && (len(program.Statements) == 0 || groups[0][len(groups[0])-1].EndLine() < first) {
+		program.Doc = groups[0]
+	}
+}
+
 // parseStatement parses a single statement.
 func (p *Parser) parseStatement() ast.Statement {
+	if p.curToken.Type != token.PRAGMA {
+		p.pragmas = false
+	}
+
 	switch p.curToken.Type {
+	case token.PRAGMA:
+		pr := p.parsePragmaStatement()
+		if pr == nil {
+			return nil
+		}
+		return pr
+
 	case token.RETURN:
 		r := p.parseReturnStatement()
 		if r == nil {
@@ -198,6 +349,40 @@ func (p *Parser) parseStatement() ast.Statement {
 		}
 		return r
 
+	case token.LET:
+		l := p.parseLetStatement()
+		if l == nil {
+			return nil
+		}
+		return l
+
+	case token.INCLUDE:
+		i := p.parseIncludeStatement()
+		if i == nil {
+			return nil
+		}
+		return i
+
+	case token.RULE:
+		r := p.parseRuleStatement()
+		if r == nil {
+			return nil
+		}
+		return r
+
+	case token.IDENT:
+		// "test" isn't a keyword, so that it remains usable as
+		// the name of a variable, it only introduces a test when
+		// followed by the name of one.
+		if p.curToken.Literal == "test" && p.peekTokenIs(token.STRING) {
+			t := p.parseTestStatement()
+			if t == nil {
+				return nil
+			}
+			return t
+		}
+		return p.parseExpressionStatement()
+
 	default:
 		return p.parseExpressionStatement()
 	}
@@ -218,6 +403,95 @@ func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
 	return stmt
 }
 
+// parseLetStatement parses a let-statement, declaring a local variable.
+func (p *Parser) parseLetStatement() *ast.LetStatement {
+	stmt := &ast.LetStatement{Token: p.curToken}
+	if !p.expectPeek(token.IDENT) {
+		return nil
+	}
+	stmt.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	if !p.expectPeek(token.ASSIGN) {
+		return nil
+	}
+	p.nextToken()
+	stmt.Value = p.parseExpression(LOWEST)
+	if stmt.Value == nil {
+		return nil
+	}
+	for p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+	return stmt
+}
+
+// parseIncludeStatement parses an include-statement.
+func (p *Parser) parseIncludeStatement() *ast.IncludeStatement {
+	stmt := &ast.IncludeStatement{Token: p.curToken}
+	if !p.expectPeek(token.STRING) {
+		return nil
+	}
+	stmt.Name = p.curToken.Literal
+	for p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+	return stmt
+}
+
+// parsePragmaStatement parses a pragma, such as `#pragma version 3`,
+// which may only appear at the start of the script.
+func (p *Parser) parsePragmaStatement() *ast.PragmaStatement {
+	if !p.pragmas {
+		msg := fmt.Sprintf("pragmas must appear at the start of the script around line %d", p.l.GetLine())
+		p.errors = append(p.errors, msg)
+		return nil
+	}
+
+	stmt := &ast.PragmaStatement{Token: p.curToken}
+	fields := strings.Fields(p.curToken.Literal)
+	if len(fields) == 0 {
+		msg := fmt.Sprintf("expected the name of a pragma around line %d", p.l.GetLine())
+		p.errors = append(p.errors, msg)
+		return nil
+	}
+	stmt.Name = fields[0]
+	stmt.Value = strings.TrimSpace(strings.TrimPrefix(p.curToken.Literal, stmt.Name))
+	return stmt
+}
+
+// parseRuleStatement parses a named rule.
+func (p *Parser) parseRuleStatement() *ast.RuleStatement {
+	stmt := &ast.RuleStatement{Token: p.curToken}
+	if !p.expectPeek(token.STRING) {
+		return nil
+	}
+	stmt.Name = p.curToken.Literal
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+	stmt.Body = p.parseBlockStatement()
+	if stmt.Body == nil {
+		return nil
+	}
+	return stmt
+}
+
+// parseTestStatement parses a named test.
+func (p *Parser) parseTestStatement() *ast.TestStatement {
+	stmt := &ast.TestStatement{Token: p.curToken}
+	if !p.expectPeek(token.STRING) {
+		return nil
+	}
+	stmt.Name = p.curToken.Literal
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+	stmt.Body = p.parseBlockStatement()
+	if stmt.Body == nil {
+		return nil
+	}
+	return stmt
+}
+
 // Function called on error if there is no prefix-based parsing method
 // for the given token.
 func (p *Parser) noPrefixParseFnError(t token.Type) {
@@ -282,6 +556,44 @@ func (p *Parser) parseEOF() ast.Expression {
 
 // parseIdentifier parses an identifier.
 func (p *Parser) parseIdentifier() ast.Expression {
+	if p.selectors && p.curToken.Literal == "$" {
+		return p.parseSelector()
+	}
+	return &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+}
+
+// parseSelector parses the root of a JSONPath-style selector, `$.name`
+// or `$["name"]`, into the identifier `name`.  The remainder of the
+// selector is parsed as usual.
+func (p *Parser) parseSelector() ast.Expression {
+
+	root := p.curToken
+
+	switch p.peekToken.Type {
+
+	case token.PERIOD:
+		p.nextToken()
+		if !p.expectPeek(token.IDENT) {
+			return nil
+		}
+
+	case token.LSQUARE:
+		p.nextToken()
+		if !p.expectPeek(token.STRING) {
+			return nil
+		}
+		name := p.curToken
+		if !p.expectPeek(token.RSQUARE) {
+			return nil
+		}
+		return &ast.Identifier{Token: token.Token{Type: token.IDENT, Literal: name.Literal, Line: name.Line}, Value: name.Literal}
+
+	default:
+		msg := fmt.Sprintf("expected a field after %s around line %d", root.Literal, p.l.GetLine())
+		p.errors = append(p.errors, msg)
+		return nil
+	}
+
 	return &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
 }
 
@@ -292,9 +604,14 @@ func (p *Parser) parseIntegerLiteral() ast.Expression {
 	var value int64
 	var err error
 
-	if strings.HasPrefix(p.curToken.Literal, "0b") {
+	// The prefix may be upper-case.
+	lower := strings.ToLower(p.curToken.Literal)
+
+	if strings.HasPrefix(lower, "0b") {
 		value, err = strconv.ParseInt(p.curToken.Literal[2:], 2, 64)
-	} else if strings.HasPrefix(p.curToken.Literal, "0x") {
+	} else if strings.HasPrefix(lower, "0o") {
+		value, err = strconv.ParseInt(p.curToken.Literal[2:], 8, 64)
+	} else if strings.HasPrefix(lower, "0x") {
 		value, err = strconv.ParseInt(p.curToken.Literal[2:], 16, 64)
 	} else {
 		value, err = strconv.ParseInt(p.curToken.Literal, 10, 64)
@@ -352,6 +669,47 @@ func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 	return expression
 }
 
+// parseComparisonExpression parses an ordering comparison, which may be
+// chained with further comparisons, such as "0 <= Score <= 100".
+//
+// A chain is rewritten to the conjunction of each pairwise comparison,
+// so "a < b <= c" is "(a < b) && (b <= c)".  Note that this means the
+// operands in the middle of a chain are evaluated twice.
+//
+// A comparison which is grouped with parenthesis is not part of a chain,
+// so "(a < b) < c" compares the result of "a < b" with "c".
+func (p *Parser) parseComparisonExpression(left ast.Expression) ast.Expression {
+	cmp, ok := p.parseInfixExpression(left).(*ast.InfixExpression)
+	if !ok || cmp.Right == nil {
+		return nil
+	}
+
+	var result ast.Expression = cmp
+	for p.peekTokenIs(token.LT) || p.peekTokenIs(token.LTEQUALS) || p.peekTokenIs(token.GT) || p.peekTokenIs(token.GTEQUALS) {
+		p.nextToken()
+
+		next := &ast.InfixExpression{
+			Token:    p.curToken,
+			Operator: p.curToken.Literal,
+			Left:     cmp.Right,
+		}
+		p.nextToken()
+		next.Right = p.parseExpression(LESSGREATER)
+		if next.Right == nil {
+			return nil
+		}
+
+		result = &ast.InfixExpression{
+			Token:    token.Token{Type: token.AND, Literal: "&&"},
+			Operator: "&&",
+			Left:     result,
+			Right:    next,
+		}
+		cmp = next
+	}
+	return result
+}
+
 // parseGroupedExpression parses a grouped-expression.
 func (p *Parser) parseGroupedExpression() ast.Expression {
 	p.nextToken()
@@ -520,6 +878,123 @@ func (p *Parser) parseAssignExpression(name ast.Expression) ast.Expression {
 	return stmt
 }
 
+// parseCompoundAssignExpression parses an assignment which updates a
+// variable in-place, such as "x += 3".
+//
+// This is rewritten to the simple assignment "x = x + 3".
+func (p *Parser) parseCompoundAssignExpression(name ast.Expression) ast.Expression {
+	stmt := &ast.AssignStatement{Token: p.curToken}
+	n, ok := name.(*ast.Identifier)
+	if !ok {
+		msg := fmt.Sprintf("expected assign token to be IDENT, got %s instead around line %d", name.TokenLiteral(), p.l.GetLine())
+		p.errors = append(p.errors, msg)
+		return nil
+	}
+	stmt.Name = n
+
+	// "+=" -> "+"
+	operator := strings.TrimSuffix(p.curToken.Literal, "=")
+	tok := token.Token{Type: token.Type(operator), Literal: operator}
+
+	// Skip over the operator
+	p.nextToken()
+
+	stmt.Value = &ast.InfixExpression{
+		Token:    tok,
+		Left:     n,
+		Operator: operator,
+		Right:    p.parseExpression(LOWEST),
+	}
+	return stmt
+}
+
+// parsePostfixIncrement parses "x++" or "x--".
+func (p *Parser) parsePostfixIncrement(name ast.Expression) ast.Expression {
+	return p.newIncrement(p.curToken, name)
+}
+
+// parsePrefixIncrement parses "++x" or "--x".
+func (p *Parser) parsePrefixIncrement() ast.Expression {
+	tok := p.curToken
+	p.nextToken()
+	name := p.parseExpression(PREFIX)
+	if name == nil {
+		return nil
+	}
+	return p.newIncrement(tok, name)
+}
+
+// newIncrement creates the assignment "x = x + 1", or "x = x - 1",
+// for the given increment/decrement operator.
+func (p *Parser) newIncrement(op token.Token, name ast.Expression) ast.Expression {
+	stmt := &ast.AssignStatement{Token: op}
+	n, ok := name.(*ast.Identifier)
+	if !ok {
+		msg := fmt.Sprintf("expected %s to be applied to an IDENT, got %s instead around line %d", op.Literal, name.TokenLiteral(), op.Line)
+		p.errors = append(p.errors, msg)
+		return nil
+	}
+	stmt.Name = n
+
+	// "++" -> "+"
+	operator := op.Literal[:1]
+
+	stmt.Value = &ast.InfixExpression{
+		Token:    token.Token{Type: token.Type(operator), Literal: operator},
+		Left:     n,
+		Operator: operator,
+		Right:    &ast.IntegerLiteral{Token: token.Token{Type: token.INT, Literal: "1"}, Value: 1},
+	}
+	return stmt
+}
+
+// parseFunctionLiteral parses a lambda-expression, such as "x => x * 2".
+//
+// The body of the lambda extends as far as possible, so it is
+// terminated by the end of the statement, or the closing of the
+// argument-list it appears within.
+func (p *Parser) parseFunctionLiteral(param ast.Expression) ast.Expression {
+	fn := &ast.FunctionLiteral{Token: p.curToken}
+	n, ok := param.(*ast.Identifier)
+	if !ok {
+		msg := fmt.Sprintf("expected lambda parameter to be IDENT, got %s instead around line %d", param.TokenLiteral(), p.l.GetLine())
+		p.errors = append(p.errors, msg)
+		return nil
+	}
+	fn.Parameters = []*ast.Identifier{n}
+
+	// Skip over the `=>`
+	p.nextToken()
+
+	fn.Body = p.parseExpression(LOWEST)
+	return fn
+}
+
+// parseBetweenExpression parses a range-test, such as
+// "Port between 1024 and 65535".
+//
+// The word "and" is only special here, so it remains usable as the
+// name of a variable elsewhere.
+func (p *Parser) parseBetweenExpression(value ast.Expression) ast.Expression {
+	exp := &ast.BetweenExpression{Token: p.curToken, Value: value}
+
+	// Skip over the `between`
+	p.nextToken()
+	exp.Low = p.parseExpression(LESSGREATER)
+
+	if !p.peekTokenIs(token.IDENT) || p.peekToken.Literal != "and" {
+		msg := fmt.Sprintf("expected 'and' after the lower bound of 'between', got %s instead around line %d", p.peekToken.Literal, p.l.GetLine())
+		p.errors = append(p.errors, msg)
+		return nil
+	}
+	p.nextToken()
+
+	// Skip over the `and`
+	p.nextToken()
+	exp.High = p.parseExpression(LESSGREATER)
+	return exp
+}
+
 // parseCallExpression parses a function-call expression.
 func (p *Parser) parseCallExpression(function ast.Expression) ast.Expression {
 	exp := &ast.CallExpression{Token: p.curToken, Function: function}
@@ -527,6 +1002,38 @@ func (p *Parser) parseCallExpression(function ast.Expression) ast.Expression {
 	return exp
 }
 
+// parseMethodCallExpression parses a method-call upon a value, such
+// as `Name.lower()`, or access to the member of a hash, such as
+// `Address.City`.
+//
+// A method-call is rewritten to a call of the function with the receiver
+// as the first argument, so `Name.contains("bob")` is `contains(Name, "bob")`.
+//
+// Member access is rewritten to an index-expression, so `Address.City`
+// is `Address["City"]`.
+func (p *Parser) parseMethodCallExpression(receiver ast.Expression) ast.Expression {
+	period := p.curToken
+	if !p.expectPeek(token.IDENT) {
+		return nil
+	}
+	method := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+
+	if !p.peekTokenIs(token.LPAREN) {
+		key := token.Token{Type: token.STRING, Literal: method.Value}
+		return &ast.IndexExpression{
+			Token: period,
+			Left:  receiver,
+			Index: &ast.StringLiteral{Token: key, Value: key.Literal},
+		}
+	}
+	p.nextToken()
+
+	exp := &ast.CallExpression{Token: p.curToken, Function: method}
+	args := p.parseExpressionList(token.RPAREN)
+	exp.Arguments = append([]ast.Expression{receiver}, args...)
+	return exp
+}
+
 // parseIndexExpression parse an array-index expression.
 func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
 	exp := &ast.IndexExpression{Token: p.curToken, Left: left}
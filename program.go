@@ -0,0 +1,190 @@
+// program.go contains the Program type, which holds many scripts which
+// share their constants, and environment.
+
+package evalfilter
+
+import (
+	"fmt"
+
+	"github.com/skx/evalfilter/v2/code"
+	"github.com/skx/evalfilter/v2/object"
+	"github.com/skx/evalfilter/v2/vm"
+)
+
+// maxConstants is the number of constants which may be referred to by
+// the 16-bit arguments of our instructions.
+const maxConstants = 65536
+
+// Program holds many scripts, which are compiled against a single pool
+// of constants, and a single environment, and run by a single virtual
+// machine.
+//
+// This reduces the memory used by an application which runs thousands
+// of similar scripts, such as one filter for each of its users, as the
+// strings, numbers, and functions they have in common are only stored
+// once.
+//
+// Scripts which define named rules are not supported, and like an
+// evaluator a Program should not be run concurrently.
+type Program struct {
+	// template holds the configuration shared by our scripts.
+	template *Eval
+
+	// constants holds the constants shared by our scripts, and
+	// constIndex their offsets by type and value.
+	constants  []object.Object
+	constIndex map[string]int
+
+	// scripts holds the compiled form of each script, by name, and
+	// names their names in the order they were added.
+	scripts map[string]*programScript
+	names   []string
+
+	// machine runs our scripts, it is created when first needed.
+	machine *vm.VM
+}
+
+// programScript holds one of the scripts of a Program.
+type programScript struct {
+	// instructions holds the bytecode of the script.
+	instructions code.Instructions
+
+	// fast is used in place of the virtual machine, if possible.
+	fast *fastFilter
+
+	// hash is the hash of the script, recorded upon the spans which
+	// trace it.
+	hash string
+}
+
+// NewProgram creates a Program, which is initially empty.
+//
+// The options are the same as those accepted by New, and apply to all
+// of the scripts which are added.
+func NewProgram(options ...Option) *Program {
+	return &Program{
+		template: New("", options...),
+		scripts:  make(map[string]*programScript),
+	}
+}
+
+// AddFunction adds a function to the environment shared by our scripts,
+// which must be done before the scripts which call it are added.
+func (p *Program) AddFunction(name string, fun interface{}) {
+	p.template.AddFunction(name, fun)
+}
+
+// AddOperator adds an infix operator to the environment shared by our
+// scripts, which must be done before the scripts which use it are added.
+func (p *Program) AddOperator(name string, fun func(left, right object.Object) object.Object) error {
+	return p.template.AddOperator(name, fun)
+}
+
+// SetVariable adds, or updates, a variable in the environment shared by
+// our scripts.
+func (p *Program) SetVariable(name string, value object.Object) {
+	p.template.SetVariable(name, value)
+}
+
+// Add compiles the given script, and adds it to the program with the
+// given name, which must be unique.
+func (p *Program) Add(name string, script string) error {
+
+	if _, found := p.scripts[name]; found {
+		return fmt.Errorf("script %s has already been added", name)
+	}
+
+	e := &Eval{
+		Script:          script,
+		environment:     p.template.environment,
+		includeResolver: p.template.includeResolver,
+		including:       make(map[string]bool),
+		assigned:        make(map[string]bool),
+		persistent:      p.template.persistent,
+		limits:          p.template.limits,
+		parserOptions:   p.template.parserOptions,
+		strict:          p.template.strict,
+		intDivision:     p.template.intDivision,
+		accessors:       p.template.accessors,
+		tracer:          p.template.tracer,
+		constants:       p.constants,
+		constIndex:      p.constIndex,
+	}
+
+	err := e.Prepare()
+	if err == nil && len(e.rules) > 0 {
+		err = fmt.Errorf("named rules are not supported in a program")
+	}
+	if err == nil && len(e.constants) > maxConstants {
+		err = fmt.Errorf("the program has too many constants")
+	}
+
+	//
+	// If the script can't be added we discard the constants it
+	// added, by forgetting the index which refers to them.
+	//
+	if err != nil {
+		p.constIndex = nil
+		return fmt.Errorf("script %s: %s", name, err)
+	}
+
+	p.constants = e.constants
+	p.constIndex = e.constIndex
+	p.scripts[name] = &programScript{instructions: e.instructions, fast: e.fast, hash: e.scriptHash}
+	p.names = append(p.names, name)
+
+	//
+	// The constants might have moved, so we need a new machine.
+	//
+	p.machine = nil
+	return nil
+}
+
+// Names returns the names of our scripts, in the order they were added.
+func (p *Program) Names() []string {
+	return append([]string(nil), p.names...)
+}
+
+// Run runs the named script against the given object, in the same way
+// as the Run method of an evaluator.
+func (p *Program) Run(name string, obj interface{}) (bool, error) {
+
+	s, found := p.scripts[name]
+	if !found {
+		return false, fmt.Errorf("script %s has not been added", name)
+	}
+
+	if p.template.tracer == nil {
+		return p.run(name, s, obj)
+	}
+
+	span := p.template.tracer.Start(SpanRun)
+	span.SetAttribute("script.hash", s.hash)
+	span.SetAttribute("script.name", name)
+	ret, err := p.run(name, s, obj)
+	span.SetAttribute("result", ret)
+	span.End(err)
+	return ret, err
+}
+
+// run runs the given script, which has the given name, for Run.
+func (p *Program) run(name string, s *programScript, obj interface{}) (bool, error) {
+
+	if s.fast != nil {
+		if ret, ok := s.fast.run(obj, p.template.environment); ok {
+			return ret, nil
+		}
+	}
+
+	if p.machine == nil {
+		p.machine = vm.New(p.constants, nil, p.template.environment)
+		p.template.configure(p.machine)
+	}
+
+	p.machine.Select(s.instructions)
+	out, err := p.machine.Run(obj)
+	if err != nil {
+		return false, fmt.Errorf("script %s: %s", name, err)
+	}
+	return p.template.result(out)
+}
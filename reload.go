@@ -0,0 +1,168 @@
+// reload.go contains code for replacing a running script, without
+// interrupting the goroutines which are using it.
+
+package evalfilter
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Source returns the current contents of a script, for a Reloader.
+type Source func() (string, error)
+
+// FileSource returns a Source which reads the script from the named file.
+func FileSource(path string) Source {
+	return func() (string, error) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+}
+
+// Reloader runs a script which may be replaced while it is in use.
+//
+// It loads the script from a Source, and whenever Reload is called, or
+// periodically via Watch, it loads the script again.  If the script has
+// changed it is compiled, and validated, and if that succeeds it replaces
+// the running script.  If not the running script is left as it was.
+//
+// A Reloader is safe for concurrent use; each call to Run uses the script
+// which was active at the time, so runs which are in progress complete
+// with the script they started with.
+type Reloader struct {
+	// mutex serialises reloads.
+	mutex sync.Mutex
+
+	// source supplies the script.
+	source Source
+
+	// validate is called to approve a script before it is used.
+	validate func(*Eval) error
+
+	// options are applied to every script we compile.
+	options []Option
+
+	// active holds the *reloadable which is currently in use.
+	active atomic.Value
+}
+
+// reloadable is a compiled script, and copies of it which may be run
+// concurrently.
+type reloadable struct {
+	// src is the source of the script.
+	src string
+
+	// eval is the compiled script.
+	eval *Eval
+
+	// pool holds copies of eval, for use by Run.
+	pool *sync.Pool
+}
+
+// NewReloader creates a Reloader which runs the script supplied by the
+// given source, compiled with the given options.
+//
+// If validate is not nil it is called with each compiled script, which
+// is only used if it returns nil.  This allows you to reject scripts
+// which fail their tests, for example, via RunTests.
+//
+// An error is returned if the script can't be loaded, compiled, or
+// validated.
+func NewReloader(source Source, validate func(*Eval) error, options ...Option) (*Reloader, error) {
+	r := &Reloader{
+		source:   source,
+		validate: validate,
+		options:  options,
+	}
+
+	_, err := r.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the script from our source, and if it has changed
+// replaces the running script with it.
+//
+// It returns true if the script was replaced.  If the new script can't
+// be loaded, compiled, or validated, an error is returned and the running
+// script remains in use.
+func (r *Reloader) Reload() (bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	src, err := r.source()
+	if err != nil {
+		return false, fmt.Errorf("failed to load script: %s", err.Error())
+	}
+
+	if cur, ok := r.active.Load().(*reloadable); ok && cur.src == src {
+		return false, nil
+	}
+
+	e := New(src, r.options...)
+	err = e.Prepare()
+	if err != nil {
+		return false, fmt.Errorf("failed to compile script: %s", err.Error())
+	}
+
+	if r.validate != nil {
+		err = r.validate(e)
+		if err != nil {
+			return false, fmt.Errorf("script failed validation: %s", err.Error())
+		}
+	}
+
+	r.active.Store(&reloadable{src: src, eval: e, pool: clonePool(e)})
+	return true, nil
+}
+
+// Watch calls Reload at the given interval, until the context is
+// cancelled.  Any errors reloading the script are passed to the given
+// function, if it is not nil.
+//
+// Watch blocks, so you'll usually launch it in a goroutine of its own.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, err := r.Reload()
+			if err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+// Run runs the active script against the given object, as Eval.Run does.
+//
+// Unlike Eval.Run this may be called from multiple goroutines at once.
+func (r *Reloader) Run(obj interface{}) (bool, error) {
+	p := r.active.Load().(*reloadable)
+
+	e := p.pool.Get().(*Eval)
+	defer p.pool.Put(e)
+
+	return e.Run(obj)
+}
+
+// Current returns the active script.
+//
+// This is useful for inspecting the script, via Stats for example, but
+// note that the script must not be run from multiple goroutines at once.
+func (r *Reloader) Current() *Eval {
+	return r.active.Load().(*reloadable).eval
+}
@@ -0,0 +1,160 @@
+// Package ruleset allows a collection of named scripts, each of which
+// has a priority and an action, to be evaluated against an object.
+//
+// Rather than reporting a single result it reports which rules matched,
+// according to a policy:
+//
+//	rs := ruleset.New(ruleset.FirstMatch)
+//	rs.Add(ruleset.Rule{Name: "block-admin", Priority: 10, Script: `return User == "admin";`})
+//	rs.Add(ruleset.Rule{Name: "allow", Script: `return true;`})
+//
+//	matched, err := rs.Evaluate(event)
+//
+// The rules are compiled into a single evalfilter.Program, so that they
+// share their constants.
+package ruleset
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/skx/evalfilter/v2"
+)
+
+// Policy determines which of the matching rules are reported.
+type Policy int
+
+const (
+	// FirstMatch reports only the matching rule with the highest
+	// priority.
+	FirstMatch Policy = iota
+
+	// AllMatch reports every matching rule, from the highest
+	// priority to the lowest.
+	AllMatch
+)
+
+// Action is invoked with the object a rule matched.
+//
+// If an action returns an error then evaluation stops, and the error is
+// returned.
+type Action func(rule *Rule, obj interface{}) error
+
+// Rule is a single rule of a RuleSet.
+type Rule struct {
+	// Name is the name of the rule, which must be unique.
+	Name string
+
+	// Priority determines the order in which the rules are tested,
+	// those with the highest priority are tested first.  Rules with
+	// the same priority are tested in the order they were added.
+	Priority int
+
+	// Script is the script which is run against each object, the
+	// rule matches if it returns true.
+	Script string
+
+	// Action is invoked for each object the rule matches, if it is
+	// not nil.
+	Action Action
+}
+
+// RuleSet holds a collection of rules.
+//
+// A RuleSet should not be evaluated concurrently.
+type RuleSet struct {
+	// policy determines which matching rules are reported.
+	policy Policy
+
+	// program holds the compiled scripts of our rules.
+	program *evalfilter.Program
+
+	// rules holds our rules, sorted by priority.
+	rules []*Rule
+}
+
+// New creates an empty RuleSet, with the given policy.
+//
+// The options are passed to evalfilter.NewProgram, and apply to the
+// scripts of all the rules.
+func New(policy Policy, options ...evalfilter.Option) *RuleSet {
+	return &RuleSet{
+		policy:  policy,
+		program: evalfilter.NewProgram(options...),
+	}
+}
+
+// Program returns the evalfilter.Program which holds the scripts of our
+// rules, which allows functions, and variables, to be made available
+// to them.
+func (rs *RuleSet) Program() *evalfilter.Program {
+	return rs.program
+}
+
+// Add compiles the script of the given rule, and adds it to the set.
+func (rs *RuleSet) Add(rule Rule) error {
+
+	if rule.Name == "" {
+		return fmt.Errorf("a rule must have a name")
+	}
+
+	err := rs.program.Add(rule.Name, rule.Script)
+	if err != nil {
+		return err
+	}
+
+	r := rule
+	rs.rules = append(rs.rules, &r)
+
+	sort.SliceStable(rs.rules, func(i, j int) bool {
+		return rs.rules[i].Priority > rs.rules[j].Priority
+	})
+	return nil
+}
+
+// Rules returns our rules, in the order they are tested.
+func (rs *RuleSet) Rules() []Rule {
+	rules := make([]Rule, len(rs.rules))
+	for i, r := range rs.rules {
+		rules[i] = *r
+	}
+	return rules
+}
+
+// Evaluate tests our rules against the given object, in order of their
+// priority, and returns those which matched according to our policy.
+// The action of each rule which is reported is invoked.
+//
+// If a rule fails, or an action returns an error, then evaluation stops
+// and the error is returned, along with the rules which matched before
+// that.
+func (rs *RuleSet) Evaluate(obj interface{}) ([]Rule, error) {
+
+	var matched []Rule
+
+	for _, r := range rs.rules {
+
+		ok, err := rs.program.Run(r.Name, obj)
+		if err != nil {
+			return matched, err
+		}
+		if !ok {
+			continue
+		}
+
+		matched = append(matched, *r)
+
+		if r.Action != nil {
+			err = r.Action(r, obj)
+			if err != nil {
+				return matched, fmt.Errorf("rule %s: %s", r.Name, err)
+			}
+		}
+
+		if rs.policy == FirstMatch {
+			break
+		}
+	}
+
+	return matched, nil
+}
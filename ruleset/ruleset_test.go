@@ -0,0 +1,124 @@
+package ruleset
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/skx/evalfilter/v2/object"
+)
+
+type Event struct {
+	User  string
+	Count int
+}
+
+// names returns the names of the given rules.
+func names(rules []Rule) string {
+	var out []string
+	for _, r := range rules {
+		out = append(out, r.Name)
+	}
+	return strings.Join(out, ",")
+}
+
+func TestPolicies(t *testing.T) {
+
+	rules := []Rule{
+		{Name: "default", Priority: 0, Script: `return true;`},
+		{Name: "busy", Priority: 5, Script: `return Count > 10;`},
+		{Name: "admin", Priority: 10, Script: `return User == "admin";`},
+		{Name: "busy-admin", Priority: 5, Script: `return User == "admin" && Count > limit;`},
+	}
+
+	tests := []struct {
+		Policy Policy
+		Event  Event
+		Result string
+	}{
+		{FirstMatch, Event{User: "admin", Count: 20}, "admin"},
+		{FirstMatch, Event{User: "bob", Count: 20}, "busy"},
+		{FirstMatch, Event{User: "bob", Count: 1}, "default"},
+		{AllMatch, Event{User: "admin", Count: 20}, "admin,busy,busy-admin,default"},
+		{AllMatch, Event{User: "bob", Count: 20}, "busy,default"},
+		{AllMatch, Event{User: "admin", Count: 1}, "admin,default"},
+	}
+
+	for _, tst := range tests {
+
+		rs := New(tst.Policy)
+		rs.Program().SetVariable("limit", object.NewInteger(15))
+		for _, r := range rules {
+			if err := rs.Add(r); err != nil {
+				t.Fatalf("unexpected error adding %s: %s", r.Name, err)
+			}
+		}
+		if names(rs.Rules()) != "admin,busy,busy-admin,default" {
+			t.Fatalf("unexpected order: %s", names(rs.Rules()))
+		}
+
+		matched, err := rs.Evaluate(tst.Event)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if names(matched) != tst.Result {
+			t.Fatalf("unexpected matches for %v: %s", tst.Event, names(matched))
+		}
+	}
+}
+
+func TestActions(t *testing.T) {
+
+	var actions []string
+	record := func(rule *Rule, obj interface{}) error {
+		actions = append(actions, rule.Name+":"+obj.(Event).User)
+		return nil
+	}
+
+	rs := New(AllMatch)
+	rs.Add(Rule{Name: "a", Priority: 2, Script: `return Count > 1;`, Action: record})
+	rs.Add(Rule{Name: "b", Priority: 1, Script: `return Count > 2;`, Action: record})
+	rs.Add(Rule{Name: "c", Script: `return Count > 3;`})
+
+	matched, err := rs.Evaluate(Event{User: "steve", Count: 5})
+	if err != nil || names(matched) != "a,b,c" {
+		t.Fatalf("unexpected result: %v %v", matched, err)
+	}
+	if strings.Join(actions, " ") != "a:steve b:steve" {
+		t.Fatalf("unexpected actions: %v", actions)
+	}
+
+	// An action which fails stops the evaluation.
+	rs.Add(Rule{Name: "fail", Priority: 3, Script: `return true;`, Action: func(rule *Rule, obj interface{}) error {
+		return fmt.Errorf("failed")
+	}})
+	matched, err = rs.Evaluate(Event{Count: 5})
+	if err == nil || err.Error() != "rule fail: failed" || names(matched) != "fail" {
+		t.Fatalf("unexpected result: %v %v", matched, err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+
+	rs := New(FirstMatch)
+	if err := rs.Add(Rule{Script: `return true;`}); err == nil {
+		t.Fatalf("expected an error adding a rule without a name")
+	}
+	if err := rs.Add(Rule{Name: "broken", Script: `return ( ;`}); err == nil {
+		t.Fatalf("expected an error adding a broken rule")
+	}
+	if err := rs.Add(Rule{Name: "count", Priority: 1, Script: `return Count + 1 > 3;`}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := rs.Add(Rule{Name: "count", Script: `return true;`}); err == nil {
+		t.Fatalf("expected an error adding a duplicate rule")
+	}
+	if len(rs.Rules()) != 1 {
+		t.Fatalf("unexpected rules: %v", rs.Rules())
+	}
+
+	// A rule which fails stops the evaluation.
+	if _, err := rs.Evaluate(map[string]interface{}{"Count": []string{"x"}}); err == nil {
+		t.Fatalf("expected an error evaluating")
+	}
+}
@@ -0,0 +1,168 @@
+// shadow.go contains code for comparing two versions of a script.
+
+package evalfilter
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sync"
+)
+
+// Shadow runs objects through both an active script, and a candidate
+// which is intended to replace it, recording those for which they
+// disagree.
+//
+// This allows a change to a script to be tested against real traffic
+// before it is rolled out; the results of the active script are used
+// as normal, while the candidate's are only compared with them.
+//
+// A Shadow is safe for concurrent use.
+type Shadow struct {
+	// active and candidate hold copies of the scripts we compare,
+	// so that we may be run concurrently.
+	active    *sync.Pool
+	candidate *sync.Pool
+
+	// mutex protects our report.
+	mutex sync.Mutex
+
+	// report holds the divergences we've seen.
+	report ShadowReport
+
+	// samples is the maximum number of divergences to record.
+	samples int
+
+	// rand selects the divergences to record.
+	rand *rand.Rand
+}
+
+// Divergence records an object for which the active, and candidate,
+// scripts disagreed.
+type Divergence struct {
+	// Object is a snapshot of the object, encoded as JSON, or
+	// formatted via fmt if that isn't possible.
+	Object string
+
+	// Active and Candidate hold the result of each script.
+	Active    bool
+	Candidate bool
+
+	// ActiveErr and CandidateErr hold the error raised by each
+	// script, if any.
+	ActiveErr    error
+	CandidateErr error
+}
+
+// ShadowReport summarises the comparison of two scripts.
+type ShadowReport struct {
+	// Runs is the number of objects which were compared.
+	Runs int
+
+	// Divergences is the number of objects for which the scripts
+	// returned different results, or only one raised an error.
+	Divergences int
+
+	// Samples holds a random sample of the divergences.
+	Samples []Divergence
+}
+
+// NewShadow creates a Shadow which compares the given scripts, both of
+// which must have been prepared.
+//
+// Up to the given number of divergences are recorded, selected at random
+// from all those which are seen, so the sample remains representative of
+// a long run.
+func NewShadow(active *Eval, candidate *Eval, samples int) (*Shadow, error) {
+
+	if active.machine == nil || candidate.machine == nil {
+		return nil, fmt.Errorf("the scripts have not been prepared")
+	}
+
+	return &Shadow{
+		active:    clonePool(active),
+		candidate: clonePool(candidate),
+		samples:   samples,
+		rand:      rand.New(rand.NewSource(rand.Int63())),
+	}, nil
+}
+
+// Run runs both scripts against the given object, and returns the result
+// of the active script, as Eval.Run would.
+func (s *Shadow) Run(obj interface{}) (bool, error) {
+
+	a := s.active.Get().(*Eval)
+	ret, err := a.Run(obj)
+	s.active.Put(a)
+
+	c := s.candidate.Get().(*Eval)
+	cret, cerr := c.Run(obj)
+	s.candidate.Put(c)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.report.Runs++
+
+	if (err == nil) == (cerr == nil) && (err != nil || ret == cret) {
+		return ret, err
+	}
+	s.report.Divergences++
+
+	//
+	// Reservoir sampling; the n-th divergence replaces one of our
+	// samples with probability samples/n.
+	//
+	slot := len(s.report.Samples)
+	if slot >= s.samples {
+		slot = s.rand.Intn(s.report.Divergences)
+		if slot >= s.samples {
+			return ret, err
+		}
+	}
+
+	d := Divergence{
+		Object:       snapshot(obj),
+		Active:       ret,
+		Candidate:    cret,
+		ActiveErr:    err,
+		CandidateErr: cerr,
+	}
+	if slot == len(s.report.Samples) {
+		s.report.Samples = append(s.report.Samples, d)
+	} else {
+		s.report.Samples[slot] = d
+	}
+
+	return ret, err
+}
+
+// Report returns the results of the comparison so far.
+func (s *Shadow) Report() ShadowReport {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	report := s.report
+	report.Samples = append([]Divergence(nil), s.report.Samples...)
+	return report
+}
+
+// snapshot returns the given object encoded as JSON, so that it may be
+// examined later, even if the object itself is modified.
+func snapshot(obj interface{}) string {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return fmt.Sprintf("%+v", obj)
+	}
+	return string(data)
+}
+
+// clonePool returns a pool of copies of the given script, which may be
+// used to run it from several goroutines at once.
+func clonePool(e *Eval) *sync.Pool {
+	return &sync.Pool{
+		New: func() interface{} {
+			return e.clone()
+		},
+	}
+}
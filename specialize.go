@@ -0,0 +1,286 @@
+// specialize.go contains code for specializing a script against fields
+// whose values are known ahead of time.
+
+package evalfilter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/skx/evalfilter/v2/code"
+	"github.com/skx/evalfilter/v2/environment"
+	"github.com/skx/evalfilter/v2/object"
+	"github.com/skx/evalfilter/v2/vm"
+)
+
+// foldable holds the operations which may be evaluated ahead of time,
+// if their operands are constant, along with the number of operands they
+// take.  OpArray is also folded, it takes the number of operands given by
+// its argument.
+var foldable = map[code.Opcode]int{
+	code.OpMinus:        1,
+	code.OpBang:         1,
+	code.OpRoot:         1,
+	code.OpBitNot:       1,
+	code.OpAdd:          2,
+	code.OpSub:          2,
+	code.OpMul:          2,
+	code.OpDiv:          2,
+	code.OpIntDiv:       2,
+	code.OpMod:          2,
+	code.OpPower:        2,
+	code.OpLess:         2,
+	code.OpLessEqual:    2,
+	code.OpGreater:      2,
+	code.OpGreaterEqual: 2,
+	code.OpEqual:        2,
+	code.OpNotEqual:     2,
+	code.OpMatches:      2,
+	code.OpNotMatches:   2,
+	code.OpIMatches:     2,
+	code.OpNotIMatches:  2,
+	code.OpAnd:          2,
+	code.OpOr:           2,
+	code.OpXor:          2,
+	code.OpBitAnd:       2,
+	code.OpBitOr:        2,
+	code.OpBitXor:       2,
+	code.OpShiftLeft:    2,
+	code.OpShiftRight:   2,
+	code.OpIn:           2,
+	code.OpBetween:      3,
+}
+
+// Specialize returns a copy of the script in which the given fields have
+// the given values, regardless of the object the script is run against.
+//
+// This is useful when some fields are fixed for a particular caller,
+// such as the configuration of a tenant.  Their values are substituted
+// into the bytecode, any operations whose operands are then known are
+// evaluated ahead of time, and the branches which can no longer be
+// taken are removed - resulting in a smaller, faster, program.
+//
+// The copy shares our functions, and variables, but is otherwise
+// independent of us.
+func (e *Eval) Specialize(fields map[string]object.Object) (*Eval, error) {
+
+	if e.machine == nil {
+		return nil, fmt.Errorf("the script has not been prepared")
+	}
+
+	//
+	// The fields are also set as variables, which take precedence
+	// over fields, so that they have the same values anywhere we
+	// can't substitute them - such as where the script updates them.
+	//
+	env := environment.NewIsolated(e.environment)
+	known := make(map[string]object.Object)
+	for name, val := range fields {
+		name = strings.TrimPrefix(name, "$")
+		env.Set(name, val)
+		known[name] = val
+	}
+
+	s := &Eval{
+		Script:          e.Script,
+		environment:     env,
+		includeResolver: e.includeResolver,
+		including:       make(map[string]bool),
+		assigned:        make(map[string]bool),
+		persistent:      e.persistent,
+		coverage:        e.coverage,
+		parserOptions:   e.parserOptions,
+		strict:          e.strict,
+		intDivision:     e.intDivision,
+		accessors:       e.accessors,
+		tracer:          e.tracer,
+		known:           known,
+	}
+
+	err := s.Prepare()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// specialize replaces the lookup of each field whose value is known with
+// a constant, and then evaluates any operations whose operands are all
+// constant.
+//
+// Fields which the script assigns to are left alone, as are the
+// parameters of lambdas, which might share their names.
+func (e *Eval) specialize() {
+
+	ip := 0
+	ln := len(e.instructions)
+	for ip < ln {
+
+		op := code.Opcode(e.instructions[ip])
+		opLen := code.Length(op)
+
+		if op == code.OpLookup {
+			name := e.constants[binary.BigEndian.Uint16(e.instructions[ip+1:ip+3])].Inspect()
+			name = strings.TrimPrefix(name, "$")
+
+			if val, ok := e.known[name]; ok && !e.assigned[name] {
+				e.instructions[ip] = byte(code.OpConstant)
+				binary.BigEndian.PutUint16(e.instructions[ip+1:ip+3], uint16(e.addConstant(val)))
+			}
+		}
+
+		ip += opLen
+	}
+
+	for e.foldConstants() {
+	}
+	for e.optimizeJumps() {
+	}
+	e.removeUnreachable()
+}
+
+// foldConstants replaces an operation whose operands are all constants
+// with its result, returning true if it made a change.
+//
+// Given an expression such as `Mode == "strict"`, in which Mode is known,
+// we would expect that to be encoded as:
+//
+//	000000 OpConstant 0
+//	000003 OpConstant 1
+//	000006 OpEqual
+//
+// That can be replaced by six "OpNop" instructions followed by "OpTrue",
+// which leaves the result next to any jump which tests it.
+//
+// The operation is evaluated by the virtual machine, so the result is
+// the same as it would have been at run-time.  Operations which fail
+// are left alone, so that the error is reported when the script runs.
+func (e *Eval) foldConstants() bool {
+
+	//
+	// Find the destinations of all jumps, because a sequence which
+	// some other code jumps into the middle of isn't constant.
+	//
+	targets := make(map[int]bool)
+
+	ip := 0
+	ln := len(e.instructions)
+	for ip < ln {
+
+		op := code.Opcode(e.instructions[ip])
+		if op == code.OpJump || op == code.OpJumpIfFalse || op == code.OpTry || op == code.OpIterNext {
+			targets[int(binary.BigEndian.Uint16(e.instructions[ip+1:ip+3]))] = true
+		}
+
+		ip += code.Length(op)
+	}
+
+	//
+	// The offsets of the adjacent constants we've seen.
+	//
+	var loads []int
+
+	ip = 0
+	for ip < ln {
+
+		op := code.Opcode(e.instructions[ip])
+		opLen := code.Length(op)
+
+		if targets[ip] {
+			loads = nil
+		}
+
+		switch op {
+
+		case code.OpNop:
+
+		case code.OpPush, code.OpTrue, code.OpFalse:
+			loads = append(loads, ip)
+
+		case code.OpConstant:
+
+			// Lambdas are bound at run-time, so can't be folded.
+			c := e.constants[binary.BigEndian.Uint16(e.instructions[ip+1:ip+3])]
+			if _, ok := c.(*object.Function); ok {
+				loads = nil
+				break
+			}
+			loads = append(loads, ip)
+
+		default:
+			n, ok := foldable[op]
+			if op == code.OpArray {
+				n = int(binary.BigEndian.Uint16(e.instructions[ip+1 : ip+3]))
+				ok = n > 0
+			}
+			if ok && len(loads) >= n && e.fold(loads[len(loads)-n:], ip) {
+				return true
+			}
+			loads = nil
+		}
+
+		ip += opLen
+	}
+
+	return false
+}
+
+// fold evaluates the operation at the given offset, whose operands are
+// loaded by the instructions at the given offsets, and replaces them all
+// with the result.  It returns false if that isn't possible.
+func (e *Eval) fold(loads []int, ip int) bool {
+
+	//
+	// Run the operation, in a program of its own.
+	//
+	var program code.Instructions
+	for _, offset := range loads {
+		program = append(program, e.instructions[offset:offset+code.Length(code.Opcode(e.instructions[offset]))]...)
+	}
+	end := ip + code.Length(code.Opcode(e.instructions[ip]))
+	program = append(program, e.instructions[ip:end]...)
+	program = append(program, byte(code.OpReturn))
+
+	machine := vm.New(e.constants, program, e.environment)
+	machine.SetStrict(e.strict)
+	machine.SetIntegerDivision(e.intDivision)
+	val, err := machine.Run(nil)
+	if err != nil || val == nil {
+		return false
+	}
+
+	//
+	// Now work out how to load the result.
+	//
+	var result []byte
+	switch v := val.(type) {
+	case *object.Boolean:
+		result = []byte{byte(code.OpFalse)}
+		if v.Value {
+			result[0] = byte(code.OpTrue)
+		}
+	case *object.Integer:
+		if v.Value >= 0 && v.Value <= 65534 {
+			result = []byte{byte(code.OpPush), 0, 0}
+			binary.BigEndian.PutUint16(result[1:], uint16(v.Value))
+		}
+	}
+	if result == nil {
+		result = []byte{byte(code.OpConstant), 0, 0}
+		binary.BigEndian.PutUint16(result[1:], uint16(e.addConstant(val)))
+	}
+
+	//
+	// The result replaces the operands, and the operation.
+	//
+	start := loads[0]
+	if end-start < len(result) {
+		return false
+	}
+	for i := start; i < end; i++ {
+		e.instructions[i] = byte(code.OpNop)
+	}
+	copy(e.instructions[end-len(result):], result)
+	return true
+}
@@ -57,3 +57,11 @@ func (s *Stack) Pop() (object.Object, error) {
 
 	return result, nil
 }
+
+// Entries returns a copy of the values stored upon the stack, with
+// the top-most value last.
+func (s *Stack) Entries() []object.Object {
+	entries := make([]object.Object, len(s.entries))
+	copy(entries, s.entries)
+	return entries
+}
@@ -94,3 +94,26 @@ func TestEmptyStack(t *testing.T) {
 		t.Errorf("should receive an error popping an empty stack!")
 	}
 }
+
+// Test we can retrieve the entries.
+func TestEntries(t *testing.T) {
+	s := New()
+
+	s.Push(&object.Integer{Value: 1})
+	s.Push(&object.Integer{Value: 2})
+
+	entries := s.Entries()
+	if len(entries) != 2 {
+		t.Fatalf("unexpected number of entries: %d", len(entries))
+	}
+	if entries[1].Inspect() != "2" {
+		t.Errorf("entries are in the wrong order")
+	}
+
+	// Changing the copy doesn't change the stack.
+	entries[1] = &object.Integer{Value: 3}
+	val, _ := s.Pop()
+	if val.Inspect() != "2" {
+		t.Errorf("stack was modified via its entries")
+	}
+}
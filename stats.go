@@ -0,0 +1,183 @@
+// stats.go contains code for reporting upon a compiled program.
+
+package evalfilter
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+
+	"github.com/skx/evalfilter/v2/code"
+	"github.com/skx/evalfilter/v2/object"
+)
+
+// Stats contains metadata about a compiled program.
+//
+// It is returned by the Stats method, once Prepare has been called.
+type Stats struct {
+	// Instructions holds the number of bytecode instructions in the
+	// program, including those of any named rules.
+	Instructions int
+
+	// Constants holds the number of entries in the constant pool.
+	Constants int
+
+	// Hash contains a SHA256 checksum of the compiled bytecode and
+	// constants, in hex.
+	//
+	// Two scripts which compile to the same program will have the
+	// same hash, which makes this suitable as a cache-key.
+	Hash string
+
+	// MaxStackDepth is an estimate of the largest number of items
+	// which will be present upon the stack while the program runs.
+	//
+	// This is calculated by walking the bytecode once, so values
+	// left behind by a loop are only counted for a single iteration.
+	MaxStackDepth int
+
+	// Native is true if the script is simple enough to be evaluated
+	// against native golang values, without the virtual machine.
+	//
+	// Such scripts only compare fields against literals, and they
+	// still fall back to the virtual machine if a field is missing,
+	// or has an unexpected type.
+	Native bool
+}
+
+// Stats returns metadata about our compiled program.
+//
+// This should only be called once Prepare has successfully compiled
+// the script.
+func (e *Eval) Stats() Stats {
+
+	s := Stats{Constants: len(e.constants), Native: e.fast != nil}
+
+	//
+	// The main program, and then each of the rules.
+	//
+	programs := []code.Instructions{e.instructions}
+	for _, r := range e.rules {
+		programs = append(programs, r.instructions)
+	}
+
+	for _, ins := range programs {
+		count, depth := measure(ins)
+		s.Instructions += count
+		if depth > s.MaxStackDepth {
+			s.MaxStackDepth = depth
+		}
+	}
+
+	//
+	// Hash the bytecode and the constants.
+	//
+	// Each item is prefixed by its length, so that the boundaries
+	// between them are unambiguous.
+	//
+	h := sha256.New()
+	add := func(data []byte) {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, uint64(len(data)))
+		h.Write(b)
+		h.Write(data)
+	}
+	for _, ins := range programs {
+		add(ins)
+	}
+	for _, r := range e.rules {
+		add([]byte(r.name))
+	}
+	for _, c := range e.constants {
+		add([]byte(c.Type()))
+		add([]byte(c.Inspect()))
+		if fn, ok := c.(*object.Function); ok {
+			add(fn.Body)
+		}
+	}
+	s.Hash = hex.EncodeToString(h.Sum(nil))
+
+	return s
+}
+
+// measure returns the number of instructions in the given bytecode, and
+// the largest stack-depth reached when walking it from start to finish.
+func measure(instructions code.Instructions) (int, int) {
+
+	count := 0
+	depth := 0
+	max := 0
+
+	ip := 0
+	for ip < len(instructions) {
+
+		op := code.Opcode(instructions[ip])
+		opLen := code.Length(op)
+
+		opArg := 0
+		if opLen > 1 {
+			opArg = int(binary.BigEndian.Uint16(instructions[ip+1 : ip+3]))
+		}
+
+		switch op {
+
+		// Operations which push a value.
+		case code.OpConstant, code.OpPush, code.OpLookup, code.OpClosure, code.OpTrue, code.OpFalse:
+			depth++
+
+			// Operations which pop a name and a value.
+		case code.OpSet, code.OpLet:
+			depth -= 2
+
+			// Operations which replace the top value, or which
+			// don't touch the stack.
+		case code.OpNop, code.OpJump, code.OpTry, code.OpIterNew, code.OpCover, code.OpTrace, code.OpIsType, code.OpRequireBool, code.OpEndTry, code.OpEnterScope, code.OpLeaveScope, code.OpMinus, code.OpBang, code.OpRoot, code.OpBitNot:
+
+			// Operations which pop a single value.
+		case code.OpJumpIfFalse, code.OpReturn, code.OpIterDone:
+			depth--
+
+			// Push the key and value of the next member.
+		case code.OpIterNext:
+			depth += 2
+
+			// Pop the name, and the arguments, push the result.
+		case code.OpCall:
+			depth -= opArg
+
+			// Pop the arguments, push the result.
+		case code.OpCallBuiltin:
+			depth -= int(binary.BigEndian.Uint16(instructions[ip+3:ip+5])) - 1
+
+			// Pop the elements, push the array.
+		case code.OpArray:
+			depth -= opArg - 1
+
+			// Push the field and the constant, then pop both.
+		case code.OpLookupConstantEqual:
+			if depth+2 > max {
+				max = depth + 2
+			}
+
+			// Pop the value and its bounds, push the result.
+		case code.OpBetween:
+			depth -= 2
+
+			// Everything else pops two values, and pushes one.
+		default:
+			depth--
+		}
+
+		if depth < 0 {
+			depth = 0
+		}
+		if depth > max {
+			max = depth
+		}
+
+		count++
+		ip += opLen
+	}
+
+	return count, max
+}
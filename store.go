@@ -0,0 +1,284 @@
+// store.go contains the state-store which allows scripts to maintain
+// state across runs.
+
+package evalfilter
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/skx/evalfilter/v2/object"
+)
+
+// Store is implemented by the host application to hold state which
+// persists across runs, and which may be shared between evaluators.
+//
+// It allows scripts to implement rate-limits, or to discard duplicate
+// events, for example.  A store might be held in memory, as with the
+// MemoryStore, or in an external service such as redis.
+//
+// A ttl of zero means that a value never expires.  Stores must be safe
+// for concurrent use.
+type Store interface {
+	// Get returns the value stored beneath the given key, and
+	// false if there is no such value, or it has expired.
+	Get(key string) (object.Object, bool)
+
+	// Set stores the given value beneath the given key.
+	Set(key string, value object.Object, ttl time.Duration) error
+
+	// Incr adds delta to the integer counter stored beneath the
+	// given key, and returns the updated value.
+	//
+	// If the counter doesn't exist it is created, with the given
+	// ttl.  The ttl of an existing counter is not changed, so a
+	// counter counts the events within a fixed window.
+	Incr(key string, delta int64, ttl time.Duration) (int64, error)
+}
+
+// WithStore makes the given store available to scripts, via the
+// following functions:
+//
+//	state_get(key [, default])
+//	state_set(key, value [, ttl])
+//	counter_incr(key [, ttl])
+//
+// Time-to-live values are given in seconds.
+func WithStore(store Store) Option {
+	return func(e *Eval) {
+		e.AddFunction("state_get", func(args []object.Object) object.Object {
+			return stateGet(store, args)
+		})
+		e.AddFunction("state_set", func(args []object.Object) object.Object {
+			return stateSet(store, args)
+		})
+		e.AddFunction("counter_incr", func(args []object.Object) object.Object {
+			return counterIncr(store, args)
+		})
+	}
+}
+
+// stateGet is the implementation of our `state_get` function.
+//
+// It returns the value stored beneath the given key, or the optional
+// default if there is no such value.
+func stateGet(store Store, args []object.Object) object.Object {
+
+	// We expect one argument, and an optional default
+	if len(args) != 1 && len(args) != 2 {
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("state_get expects one or two arguments, got %d", len(args))}
+	}
+
+	val, ok := store.Get(args[0].Inspect())
+	if ok {
+		return val
+	}
+	if len(args) == 2 {
+		return args[1]
+	}
+	return object.NewNull()
+}
+
+// stateSet is the implementation of our `state_set` function.
+//
+// It stores the given value beneath the given key, with an optional
+// time-to-live, and returns the value.
+func stateSet(store Store, args []object.Object) object.Object {
+
+	// We expect two arguments, and an optional ttl
+	if len(args) != 2 && len(args) != 3 {
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("state_set expects two or three arguments, got %d", len(args))}
+	}
+
+	var ttl time.Duration
+	if len(args) == 3 {
+		var e *object.Error
+		ttl, e = ttlArgument("state_set", args[2])
+		if e != nil {
+			return e
+		}
+	}
+
+	err := store.Set(args[0].Inspect(), args[1], ttl)
+	if err != nil {
+		return &object.Error{Kind: object.StoreError, Message: fmt.Sprintf("state_set failed: %s", err.Error())}
+	}
+	return args[1]
+}
+
+// counterIncr is the implementation of our `counter_incr` function.
+//
+// It increments the counter stored beneath the given key, creating it
+// with an optional time-to-live if it doesn't exist, and returns the
+// updated count.
+func counterIncr(store Store, args []object.Object) object.Object {
+
+	// We expect one argument, and an optional ttl
+	if len(args) != 1 && len(args) != 2 {
+		return &object.Error{Kind: object.ArgumentError, Message: fmt.Sprintf("counter_incr expects one or two arguments, got %d", len(args))}
+	}
+
+	var ttl time.Duration
+	if len(args) == 2 {
+		var e *object.Error
+		ttl, e = ttlArgument("counter_incr", args[1])
+		if e != nil {
+			return e
+		}
+	}
+
+	count, err := store.Incr(args[0].Inspect(), 1, ttl)
+	if err != nil {
+		return &object.Error{Kind: object.StoreError, Message: fmt.Sprintf("counter_incr failed: %s", err.Error())}
+	}
+	return object.NewInteger(count)
+}
+
+// ttlArgument converts a time-to-live, given in seconds, to a duration.
+func ttlArgument(name string, arg object.Object) (time.Duration, *object.Error) {
+
+	var secs float64
+	switch arg := arg.(type) {
+	case *object.Integer:
+		secs = float64(arg.Value)
+	case *object.Float:
+		secs = arg.Value
+	default:
+		return 0, &object.Error{Kind: object.TypeError, Message: fmt.Sprintf("%s expects a numeric ttl, got %s", name, arg.Type())}
+	}
+
+	if secs < 0 || math.IsNaN(secs) {
+		return 0, &object.Error{Kind: object.ValueError, Message: fmt.Sprintf("%s expects a non-negative ttl, got %s", name, arg.Inspect())}
+	}
+
+	// Infinity, and anything else too large to be a duration.
+	if secs*float64(time.Second) >= math.MaxInt64 {
+		return 0, &object.Error{Kind: object.ValueError, Message: fmt.Sprintf("%s expects a ttl of at most %d seconds, got %s", name, math.MaxInt64/int64(time.Second), arg.Inspect())}
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
+
+// memorySweepMin is the smallest number of entries a MemoryStore holds
+// before it sweeps away those which have expired.
+const memorySweepMin = 1024
+
+// MemoryStore is a Store which holds its values in memory.
+//
+// Expired values are discarded when they're next accessed, and all of
+// them are swept away whenever the number of values held has doubled
+// since the last sweep.  So keys which are never read again, such as
+// the counters of a rate-limit over many users, don't accumulate.
+type MemoryStore struct {
+	// mutex protects our entries.
+	mutex sync.Mutex
+
+	// entries holds the values we store, by key.
+	entries map[string]memoryEntry
+
+	// sweepAt is the number of entries at which we next sweep
+	// away those which have expired.
+	sweepAt int
+
+	// now returns the current time.
+	now func() time.Time
+}
+
+// memoryEntry is a value held within a MemoryStore.
+type memoryEntry struct {
+	// value is the stored value.
+	value object.Object
+
+	// expires is the time at which the value expires, if non-zero.
+	expires time.Time
+}
+
+// NewMemoryStore creates a new, empty, MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		entries: make(map[string]memoryEntry),
+		sweepAt: memorySweepMin,
+		now:     time.Now,
+	}
+}
+
+// sweep discards every expired entry, if we've grown enough since we
+// last did so.  The caller must hold the mutex.
+func (m *MemoryStore) sweep() {
+	if len(m.entries) < m.sweepAt {
+		return
+	}
+
+	now := m.now()
+	for key, ent := range m.entries {
+		if !ent.expires.IsZero() && !now.Before(ent.expires) {
+			delete(m.entries, key)
+		}
+	}
+
+	m.sweepAt = 2 * len(m.entries)
+	if m.sweepAt < memorySweepMin {
+		m.sweepAt = memorySweepMin
+	}
+}
+
+// lookup returns the entry beneath the given key, discarding it if it
+// has expired.  The caller must hold the mutex.
+func (m *MemoryStore) lookup(key string) (memoryEntry, bool) {
+	ent, ok := m.entries[key]
+	if ok && !ent.expires.IsZero() && !m.now().Before(ent.expires) {
+		delete(m.entries, key)
+		return memoryEntry{}, false
+	}
+	return ent, ok
+}
+
+// expiry returns the time at which a value with the given ttl expires.
+func (m *MemoryStore) expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return m.now().Add(ttl)
+}
+
+// Get returns the value stored beneath the given key.
+func (m *MemoryStore) Get(key string) (object.Object, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	ent, ok := m.lookup(key)
+	return ent.value, ok
+}
+
+// Set stores the given value beneath the given key.
+func (m *MemoryStore) Set(key string, value object.Object, ttl time.Duration) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.sweep()
+	m.entries[key] = memoryEntry{value: value, expires: m.expiry(ttl)}
+	return nil
+}
+
+// Incr adds delta to the counter stored beneath the given key.
+func (m *MemoryStore) Incr(key string, delta int64, ttl time.Duration) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	ent, ok := m.lookup(key)
+	if !ok {
+		m.sweep()
+		m.entries[key] = memoryEntry{value: object.NewInteger(delta), expires: m.expiry(ttl)}
+		return delta, nil
+	}
+
+	cur, ok := ent.value.(*object.Integer)
+	if !ok {
+		return 0, fmt.Errorf("the value of %s is not an integer", key)
+	}
+
+	ent.value = object.NewInteger(cur.Value + delta)
+	m.entries[key] = ent
+	return cur.Value + delta, nil
+}
@@ -0,0 +1,126 @@
+// testscript.go contains code for running the tests a script defines.
+
+package evalfilter
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/skx/evalfilter/v2/object"
+)
+
+// TestResult holds the result of running one of the tests a script
+// defined, via `test "name" { .. }`, against a single fixture.
+type TestResult struct {
+	// Name is the name of the test.
+	Name string
+
+	// Fixture is the index of the fixture the test was run against.
+	Fixture int
+
+	// Err holds the reason the test failed, or nil if it passed.
+	Err error
+}
+
+// Passed returns true if the test passed.
+func (t TestResult) Passed() bool {
+	return t.Err == nil
+}
+
+// TestScript compiles the given script, and runs each of the tests it
+// defines against each of the given fixtures, which must be a slice or
+// an array.
+//
+// This allows the rules of a script to be tested in the same language,
+// for example:
+//
+//	return Count > 3;
+//
+//	test "high counts match" {
+//	  if ( Count > 3 ) { assert(result, "expected a match"); }
+//	}
+//
+// See RunTests for details of how each test is run.  An error is only
+// returned if the script could not be compiled, or the fixtures are
+// invalid - the results report the failure of any individual test.
+func TestScript(script string, fixtures interface{}, options ...Option) ([]TestResult, error) {
+
+	e := New(script, options...)
+
+	err := e.Prepare()
+	if err != nil {
+		return nil, err
+	}
+
+	return e.RunTests(fixtures)
+}
+
+// RunTests runs each of the tests the script defines against each of the
+// given fixtures, which must be a slice or an array.
+//
+// For each fixture the script is run first, and the variable `result`
+// is set to the value it returned, and `rules` to an array holding the
+// names of the rules which matched, if any.  Each test is then run
+// against the fixture, and fails if it raises an error, for example via
+// `assert`, or if it returns a false value.  A test which fails to
+// return passes.
+//
+// The results are ordered by fixture, and then by test.
+func (e *Eval) RunTests(fixtures interface{}) ([]TestResult, error) {
+
+	if e.machine == nil {
+		return nil, fmt.Errorf("the script has not been prepared")
+	}
+
+	val := reflect.ValueOf(fixtures)
+	if val.Kind() != reflect.Slice && val.Kind() != reflect.Array {
+		return nil, fmt.Errorf("RunTests expects a slice, got %T", fixtures)
+	}
+
+	var results []TestResult
+
+	for i := 0; i < val.Len(); i++ {
+
+		obj := element(val, i)
+
+		//
+		// Run the script, and its rules, against the fixture.
+		//
+		ret, err := e.Run(obj)
+		if err == nil {
+			var matched []string
+			matched, err = e.RunAll(obj)
+
+			names := make([]object.Object, len(matched))
+			for n, name := range matched {
+				names[n] = &object.String{Value: name}
+			}
+			e.SetVariable("result", object.NewBoolean(ret))
+			e.SetVariable("rules", &object.Array{Elements: names})
+		}
+
+		for _, t := range e.tests {
+
+			res := TestResult{Name: t.name, Fixture: i}
+
+			if err != nil {
+				res.Err = fmt.Errorf("error running script: %s", err.Error())
+				results = append(results, res)
+				continue
+			}
+
+			out, terr := t.machine.Run(obj)
+			switch {
+			case terr != nil:
+				res.Err = terr
+			case out.Type() == object.ERROR:
+				res.Err = fmt.Errorf("%s", out.Inspect())
+			case !out.True():
+				res.Err = fmt.Errorf("test returned %s", out.Inspect())
+			}
+			results = append(results, res)
+		}
+	}
+
+	return results, nil
+}
@@ -16,61 +16,96 @@ type Type string
 type Token struct {
 	Type    Type
 	Literal string
+
+	// Line is the line of the script upon which the token was
+	// found, starting from one.  It is zero for tokens which
+	// were synthesized by the parser.
+	Line int
 }
 
 // pre-defined Type
 const (
-	AND       = "&&"
-	ASSIGN    = "="
-	ASTERISK  = "*"
-	BANG      = "!"
-	COMMA     = ","
-	CONTAINS  = "~="
-	ELSE      = "ELSE"
-	EOF       = "EOF"
-	EQ        = "=="
-	FALSE     = "FALSE"
-	FLOAT     = "FLOAT"
-	GT        = ">"
-	GTEQUALS  = ">="
-	IDENT     = "IDENT"
-	IF        = "IF"
-	ILLEGAL   = "ILLEGAL"
-	INT       = "INT"
-	LBRACE    = "{"
-	LPAREN    = "("
-	LSQUARE   = "["
-	LT        = "<"
-	LTEQUALS  = "<="
-	MINUS     = "-"
-	MISSING   = "!~"
-	MOD       = "%"
-	NOTEQ     = "!="
-	OR        = "||"
-	PERIOD    = "."
-	PLUS      = "+"
-	POW       = "**"
-	RBRACE    = "}"
-	REGEXP    = "REGEXP"
-	RETURN    = "RETURN"
-	RPAREN    = ")"
-	RSQUARE   = "]"
-	SEMICOLON = ";"
-	SLASH     = "/"
-	SQRT      = "√"
-	STRING    = "STRING"
-	TRUE      = "TRUE"
-	WHILE     = "WHILE"
+	AND            = "&&"
+	ARROW          = "=>"
+	ASSIGN         = "="
+	ASTERISK       = "*"
+	ASTERISKEQUALS = "*="
+	BANG           = "!"
+	BETWEEN        = "BETWEEN"
+	BITAND         = "&"
+	BITNOT         = "~"
+	BITOR          = "|"
+	BITXOR         = "^"
+	COMMA          = ","
+	COMMENT        = "COMMENT"
+	CONTAINS       = "~="
+	ELSE           = "ELSE"
+	EOF            = "EOF"
+	EQ             = "=="
+	FALSE          = "FALSE"
+	FLOAT          = "FLOAT"
+	GT             = ">"
+	GTEQUALS       = ">="
+	IDENT          = "IDENT"
+	IF             = "IF"
+	IMATCHES       = "~*"
+	IMISSING       = "!~*"
+	ILLEGAL        = "ILLEGAL"
+	IN             = "IN"
+	INCLUDE        = "INCLUDE"
+	INT            = "INT"
+	INTDIV         = "~/"
+	LBRACE         = "{"
+	LET            = "LET"
+	LPAREN         = "("
+	LSQUARE        = "["
+	LT             = "<"
+	LTEQUALS       = "<="
+	MINUS          = "-"
+	MINUSEQUALS    = "-="
+	MINUSMINUS     = "--"
+	MISSING        = "!~"
+	MOD            = "%"
+	NOTEQ          = "!="
+	OPERATOR       = "OPERATOR"
+	OR             = "||"
+	PERIOD         = "."
+	PLUS           = "+"
+	PLUSEQUALS     = "+="
+	PLUSPLUS       = "++"
+	POW            = "**"
+	PRAGMA         = "PRAGMA"
+	RBRACE         = "}"
+	REGEXP         = "REGEXP"
+	RETURN         = "RETURN"
+	RPAREN         = ")"
+	RULE           = "RULE"
+	RSQUARE        = "]"
+	SEMICOLON      = ";"
+	SHL            = "<<"
+	SHR            = ">>"
+	SLASH          = "/"
+	SLASHEQUALS    = "/="
+	SQRT           = "√"
+	STRING         = "STRING"
+	TRUE           = "TRUE"
+	WHILE          = "WHILE"
+	XOR            = "^^"
 )
 
 // reversed keywords
 var keywords = map[string]Type{
-	"else":   ELSE,
-	"false":  FALSE,
-	"if":     IF,
-	"return": RETURN,
-	"true":   TRUE,
-	"while":  WHILE,
+	"between": BETWEEN,
+	"else":    ELSE,
+	"false":   FALSE,
+	"if":      IF,
+	"in":      IN,
+	"include": INCLUDE,
+	"let":     LET,
+	"return":  RETURN,
+	"rule":    RULE,
+	"true":    TRUE,
+	"while":   WHILE,
 }
 
 // LookupIdentifier used to determinate whether identifier is keyword nor not
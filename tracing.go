@@ -0,0 +1,96 @@
+// tracing.go contains the interfaces via which the host application may
+// trace the preparation, and running, of scripts.
+
+package evalfilter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// The names of the spans we create.
+const (
+	// SpanParse covers lexing, and parsing, a script.
+	SpanParse = "evalfilter.Parse"
+
+	// SpanCompile covers compiling a script to bytecode, optimizing
+	// it, and testing it against any limits.
+	SpanCompile = "evalfilter.Compile"
+
+	// SpanRun covers running a script against an object.
+	SpanRun = "evalfilter.Run"
+)
+
+// Tracer is implemented by host applications which wish to trace the
+// work we do, via OpenTelemetry for example, which helps to find where
+// the time is spent by a pipeline which filters its events.
+//
+// Every span has the attribute "script.hash", which is the SHA256 hash
+// of the script, in hex.  Compile spans also have "instructions",
+// "constants", "rules", and "native", which are described by Stats, and
+// Run spans have "result", along with "script.name" for the scripts of a
+// Program.
+type Tracer interface {
+	// Start begins the span with the given name.
+	Start(name string) Span
+}
+
+// Span is a single piece of work, which is being traced.
+type Span interface {
+	// SetAttribute records an attribute of the span, whose value is
+	// a string, an int, or a bool.
+	SetAttribute(key string, value interface{})
+
+	// End finishes the span, with the error it failed with, if any.
+	End(err error)
+}
+
+// WithTracer causes spans to be created, via the given tracer, when the
+// script is parsed, compiled, and run.
+//
+// The tracer is shared by the copies of the evaluator which RunParallel
+// creates, so it may be called concurrently.
+func WithTracer(tracer Tracer) Option {
+	return func(e *Eval) {
+		e.tracer = tracer
+	}
+}
+
+// noSpan is the span we use when we have no tracer.
+type noSpan struct{}
+
+// SetAttribute does nothing.
+func (noSpan) SetAttribute(key string, value interface{}) {}
+
+// End does nothing.
+func (noSpan) End(err error) {}
+
+// span starts the span with the given name, if we have a tracer.
+func (e *Eval) span(name string) Span {
+	if e.tracer == nil {
+		return noSpan{}
+	}
+
+	if e.scriptHash == "" {
+		sum := sha256.Sum256([]byte(e.Script))
+		e.scriptHash = hex.EncodeToString(sum[:])
+	}
+
+	s := e.tracer.Start(name)
+	s.SetAttribute("script.hash", e.scriptHash)
+	return s
+}
+
+// traceRun runs the given function, which runs our script, within a span
+// if we have a tracer.
+func (e *Eval) traceRun(run func() (bool, error)) (bool, error) {
+	if e.tracer == nil {
+		return run()
+	}
+
+	s := e.span(SpanRun)
+	ret, err := run()
+	s.SetAttribute("result", ret)
+	s.End(err)
+	return ret, err
+}
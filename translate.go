@@ -0,0 +1,388 @@
+// translate.go contains code for translating simple filters into the
+// queries of other systems, so that they may be evaluated by a datastore
+// rather than by us.
+
+package evalfilter
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/skx/evalfilter/v2/ast"
+	"github.com/skx/evalfilter/v2/lexer"
+	"github.com/skx/evalfilter/v2/parser"
+)
+
+// SQL translates the script into the condition of an SQL WHERE clause,
+// using placeholders for the values it compares fields against, which
+// are returned in the order they appear.
+//
+// Only simple filters may be translated, which are of the same form as
+// those we evaluate without the virtual machine:
+//
+//	return EXPR;
+//	if ( EXPR ) { return BOOL; } return BOOL;
+//	if ( EXPR ) { return BOOL; } else { return BOOL; }
+//
+// The expression may compare fields against literals, using the usual
+// comparison operators, `between`, or `in` with an array of literals,
+// and combine those comparisons with `&&`, `||`, and `!`.  Anything else
+// results in an error.
+//
+// Field names are quoted, as SQL identifiers, so they may be reserved
+// words, or contain any characters.
+//
+// Note that the datastore's own rules are used for comparisons, so the
+// results might differ from ours for missing fields, or where strings
+// are compared without regard to case.
+func (e *Eval) SQL() (string, []interface{}, error) {
+
+	expr, ifTrue, ifFalse, err := e.translatable()
+	if err != nil {
+		return "", nil, err
+	}
+
+	if ifTrue == ifFalse {
+		if ifTrue {
+			return "1 = 1", nil, nil
+		}
+		return "1 = 0", nil, nil
+	}
+
+	var args []interface{}
+	where, err := sqlCondition(expr, &args)
+	if err != nil {
+		return "", nil, err
+	}
+	if !ifTrue {
+		where = "NOT " + where
+	}
+	return where, args, nil
+}
+
+// Elasticsearch translates the script into an Elasticsearch query, in
+// the form of the query DSL, which may be encoded as JSON.
+//
+// The same scripts are accepted as by SQL.
+func (e *Eval) Elasticsearch() (map[string]interface{}, error) {
+
+	expr, ifTrue, ifFalse, err := e.translatable()
+	if err != nil {
+		return nil, err
+	}
+
+	if ifTrue == ifFalse {
+		if ifTrue {
+			return map[string]interface{}{"match_all": map[string]interface{}{}}, nil
+		}
+		return map[string]interface{}{"match_none": map[string]interface{}{}}, nil
+	}
+
+	query, err := esQuery(expr)
+	if err != nil {
+		return nil, err
+	}
+	if !ifTrue {
+		query = esBool("must_not", query)
+	}
+	return query, nil
+}
+
+// translatable parses the script, and returns the condition it tests,
+// along with the results it returns if that is true, and if it is false.
+func (e *Eval) translatable() (ast.Expression, bool, bool, error) {
+
+	p := parser.New(lexer.New(e.Script), e.parserOptions...)
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		return nil, false, false, fmt.Errorf("\nErrors parsing script:\n" +
+			strings.Join(p.Errors(), "\n"))
+	}
+
+	expr, ifTrue, ifFalse, ok := filterCondition(program)
+	if !ok {
+		return nil, false, false, fmt.Errorf("the script is not a simple filter")
+	}
+	return expr, ifTrue, ifFalse, nil
+}
+
+// sqlOperators maps our comparison operators to those of SQL.
+var sqlOperators = map[string]string{
+	"==": "=",
+	"!=": "<>",
+	"<":  "<",
+	"<=": "<=",
+	">":  ">",
+	">=": ">=",
+}
+
+// sqlCondition translates the given expression into SQL, appending the
+// values it uses to the given arguments.
+func sqlCondition(expr ast.Expression, args *[]interface{}) (string, error) {
+
+	switch node := expr.(type) {
+
+	case *ast.BooleanLiteral:
+		if node.Value {
+			return "1 = 1", nil
+		}
+		return "1 = 0", nil
+
+	case *ast.PrefixExpression:
+		if node.Operator != "!" {
+			break
+		}
+		cond, err := sqlCondition(node.Right, args)
+		if err != nil {
+			return "", err
+		}
+		return "NOT " + cond, nil
+
+	case *ast.InfixExpression:
+		switch node.Operator {
+
+		case "&&", "||":
+			left, err := sqlCondition(node.Left, args)
+			if err != nil {
+				return "", err
+			}
+			right, err := sqlCondition(node.Right, args)
+			if err != nil {
+				return "", err
+			}
+			op := "AND"
+			if node.Operator == "||" {
+				op = "OR"
+			}
+			return fmt.Sprintf("(%s %s %s)", left, op, right), nil
+
+		case "in":
+			field, ok := translateField(node.Left)
+			values, ok2 := translateValues(node.Right)
+			if !ok || !ok2 {
+				break
+			}
+			marks := make([]string, len(values))
+			for i, v := range values {
+				marks[i] = "?"
+				*args = append(*args, v)
+			}
+			return fmt.Sprintf("%s IN (%s)", sqlIdentifier(field), strings.Join(marks, ", ")), nil
+
+		default:
+			field, op, value, ok := translateComparison(node)
+			if !ok {
+				break
+			}
+			*args = append(*args, value)
+			return fmt.Sprintf("%s %s ?", sqlIdentifier(field), sqlOperators[op]), nil
+		}
+
+	case *ast.BetweenExpression:
+		field, ok := translateField(node.Value)
+		low, ok2 := translateValue(node.Low)
+		high, ok3 := translateValue(node.High)
+		if !ok || !ok2 || !ok3 {
+			break
+		}
+		*args = append(*args, low, high)
+		return fmt.Sprintf("%s BETWEEN ? AND ?", sqlIdentifier(field)), nil
+	}
+
+	return "", fmt.Errorf("cannot translate %s", expr.String())
+}
+
+// sqlIdentifier quotes the given field name, as an SQL identifier, so
+// that it can't be mistaken for anything else.
+func sqlIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// esRanges maps our comparison operators to those of an Elasticsearch
+// range query.
+var esRanges = map[string]string{
+	"<":  "lt",
+	"<=": "lte",
+	">":  "gt",
+	">=": "gte",
+}
+
+// esQuery translates the given expression into an Elasticsearch query.
+func esQuery(expr ast.Expression) (map[string]interface{}, error) {
+
+	switch node := expr.(type) {
+
+	case *ast.BooleanLiteral:
+		if node.Value {
+			return map[string]interface{}{"match_all": map[string]interface{}{}}, nil
+		}
+		return map[string]interface{}{"match_none": map[string]interface{}{}}, nil
+
+	case *ast.PrefixExpression:
+		if node.Operator != "!" {
+			break
+		}
+		query, err := esQuery(node.Right)
+		if err != nil {
+			return nil, err
+		}
+		return esBool("must_not", query), nil
+
+	case *ast.InfixExpression:
+		switch node.Operator {
+
+		case "&&", "||":
+			left, err := esQuery(node.Left)
+			if err != nil {
+				return nil, err
+			}
+			right, err := esQuery(node.Right)
+			if err != nil {
+				return nil, err
+			}
+			if node.Operator == "&&" {
+				return esBool("filter", left, right), nil
+			}
+			query := esBool("should", left, right)
+			query["bool"].(map[string]interface{})["minimum_should_match"] = 1
+			return query, nil
+
+		case "in":
+			field, ok := translateField(node.Left)
+			values, ok2 := translateValues(node.Right)
+			if !ok || !ok2 {
+				break
+			}
+			return map[string]interface{}{"terms": map[string]interface{}{field: values}}, nil
+
+		default:
+			field, op, value, ok := translateComparison(node)
+			if !ok {
+				break
+			}
+
+			term := map[string]interface{}{"term": map[string]interface{}{field: value}}
+			switch op {
+			case "==":
+				return term, nil
+			case "!=":
+				return esBool("must_not", term), nil
+			}
+			return esRange(field, map[string]interface{}{esRanges[op]: value}), nil
+		}
+
+	case *ast.BetweenExpression:
+		field, ok := translateField(node.Value)
+		low, ok2 := translateValue(node.Low)
+		high, ok3 := translateValue(node.High)
+		if !ok || !ok2 || !ok3 {
+			break
+		}
+		return esRange(field, map[string]interface{}{"gte": low, "lte": high}), nil
+	}
+
+	return nil, fmt.Errorf("cannot translate %s", expr.String())
+}
+
+// esBool returns an Elasticsearch bool query, with the given queries as
+// its clauses of the given kind.
+func esBool(kind string, queries ...map[string]interface{}) map[string]interface{} {
+	clauses := make([]interface{}, len(queries))
+	for i, q := range queries {
+		clauses[i] = q
+	}
+	return map[string]interface{}{"bool": map[string]interface{}{kind: clauses}}
+}
+
+// esRange returns an Elasticsearch range query for the given field.
+func esRange(field string, bounds map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"range": map[string]interface{}{field: bounds}}
+}
+
+// translateComparison returns the field, operator, and value, of the
+// given comparison between a field and a literal.  If the literal comes
+// first the operator is reversed, so that the field always comes first.
+func translateComparison(node *ast.InfixExpression) (string, string, interface{}, bool) {
+
+	if _, ok := sqlOperators[node.Operator]; !ok {
+		return "", "", nil, false
+	}
+
+	if field, ok := translateField(node.Left); ok {
+		value, ok := translateValue(node.Right)
+		return field, node.Operator, value, ok
+	}
+
+	field, ok := translateField(node.Right)
+	if !ok {
+		return "", "", nil, false
+	}
+	value, ok := translateValue(node.Left)
+
+	reversed := map[string]string{"<": ">", "<=": ">=", ">": "<", ">=": "<="}
+	op := node.Operator
+	if r, found := reversed[op]; found {
+		op = r
+	}
+	return field, op, value, ok
+}
+
+// translateField returns the name of the field the expression refers to.
+//
+// Selectors allow a field to have any name at all, so the translators
+// must take care to quote it where it isn't simply data.
+func translateField(expr ast.Expression) (string, bool) {
+	ident, ok := expr.(*ast.Identifier)
+	if !ok {
+		return "", false
+	}
+	return strings.TrimPrefix(ident.Value, "$"), true
+}
+
+// translateValue returns the value of the given literal.
+func translateValue(expr ast.Expression) (interface{}, bool) {
+
+	switch node := expr.(type) {
+	case *ast.BooleanLiteral:
+		return node.Value, true
+	case *ast.IntegerLiteral:
+		return node.Value, true
+	case *ast.FloatLiteral:
+		return node.Value, true
+	case *ast.StringLiteral:
+		return node.Value, true
+	case *ast.PrefixExpression:
+		if node.Operator != "-" {
+			break
+		}
+		switch lit := node.Right.(type) {
+		case *ast.IntegerLiteral:
+			if lit.Value != math.MinInt64 {
+				return -lit.Value, true
+			}
+		case *ast.FloatLiteral:
+			return -lit.Value, true
+		}
+	}
+
+	return nil, false
+}
+
+// translateValues returns the values of the given array of literals.
+func translateValues(expr ast.Expression) ([]interface{}, bool) {
+
+	array, ok := expr.(*ast.ArrayLiteral)
+	if !ok || len(array.Elements) == 0 {
+		return nil, false
+	}
+
+	values := make([]interface{}, len(array.Elements))
+	for i, el := range array.Elements {
+		values[i], ok = translateValue(el)
+		if !ok {
+			return nil, false
+		}
+	}
+	return values, true
+}
@@ -0,0 +1,640 @@
+// dispatch.go contains the table of handlers which implement each of
+// our instructions.
+
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/skx/evalfilter/v2/code"
+	"github.com/skx/evalfilter/v2/environment"
+	"github.com/skx/evalfilter/v2/object"
+)
+
+// OpcodeHandler implements a single instruction.
+//
+// It is invoked with the object the script is running against, and the
+// offset of the instruction within the bytecode, and returns the offset
+// of the next instruction to execute.
+//
+// If the instruction terminates the script it returns the result of the
+// script instead, which must be non-nil.
+type OpcodeHandler func(vm *VM, obj interface{}, ip int) (int, object.Object, error)
+
+// dispatch holds the handler for each opcode, indexed by the opcode.
+//
+// Using a table, rather than a switch statement, keeps the cost of
+// dispatching each instruction constant regardless of the number of
+// opcodes we support.
+var dispatch [256]OpcodeHandler
+
+func init() {
+	dispatch[code.OpNop] = opNop
+	dispatch[code.OpPush] = opPush
+	dispatch[code.OpConstant] = opConstant
+	dispatch[code.OpLookup] = opLookup
+	dispatch[code.OpLookupConstantEqual] = opLookupConstantEqual
+	dispatch[code.OpSet] = opSet
+	dispatch[code.OpLet] = opLet
+	dispatch[code.OpEnterScope] = opEnterScope
+	dispatch[code.OpLeaveScope] = opLeaveScope
+	dispatch[code.OpArray] = opArray
+	dispatch[code.OpClosure] = opClosure
+	dispatch[code.OpTry] = opTry
+	dispatch[code.OpCover] = opCover
+	dispatch[code.OpTrace] = opTrace
+	dispatch[code.OpIsType] = opIsType
+	dispatch[code.OpRequireBool] = opRequireBool
+	dispatch[code.OpEndTry] = opEndTry
+	dispatch[code.OpArrayIndex] = opArrayIndex
+	dispatch[code.OpBetween] = opBetween
+	dispatch[code.OpIn] = opIn
+	dispatch[code.OpIterNew] = opIterNew
+	dispatch[code.OpIterNext] = opIterNext
+	dispatch[code.OpIterDone] = opIterDone
+	dispatch[code.OpCapture] = opCapture
+	dispatch[code.OpBang] = opBang
+	dispatch[code.OpMinus] = opMinus
+	dispatch[code.OpBitNot] = opBitNot
+	dispatch[code.OpRoot] = opRoot
+	dispatch[code.OpTrue] = opTrue
+	dispatch[code.OpFalse] = opFalse
+	dispatch[code.OpReturn] = opReturn
+	dispatch[code.OpJump] = opJump
+	dispatch[code.OpJumpIfFalse] = opJumpIfFalse
+	dispatch[code.OpCall] = opCall
+	dispatch[code.OpCallBuiltin] = opCallBuiltin
+	dispatch[code.OpCustomOp] = opCustomOp
+	dispatch[code.OpCodeSingleArg] = opFake
+	dispatch[code.OpFinal] = opFake
+
+	// maths & comparisons
+	for _, op := range []code.Opcode{code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpIntDiv, code.OpMod, code.OpPower, code.OpLess, code.OpLessEqual, code.OpGreater, code.OpGreaterEqual, code.OpEqual, code.OpNotEqual, code.OpMatches, code.OpNotMatches, code.OpIMatches, code.OpNotIMatches, code.OpAnd, code.OpOr, code.OpXor, code.OpBitAnd, code.OpBitOr, code.OpBitXor, code.OpShiftLeft, code.OpShiftRight} {
+		dispatch[op] = opBinary
+	}
+}
+
+// RegisterOpcode installs the handler for an experimental opcode, which
+// must be one which is unused by our instruction-set, (i.e. greater than
+// code.OpFinal).
+//
+// Our compiler will never generate such an instruction, so this is only
+// useful to embedders who construct bytecode of their own.  Note that
+// our optimizer and disassembler treat unknown opcodes as being a single
+// byte long, and that handlers are shared by all machines.  Handlers
+// should be registered before any machine is run, typically from an
+// init function.
+func RegisterOpcode(op code.Opcode, handler OpcodeHandler) error {
+	if op <= code.OpFinal {
+		return fmt.Errorf("opcode %d is reserved", op)
+	}
+	dispatch[op] = handler
+	return nil
+}
+
+// Operand returns the n'th 16-bit argument of the instruction at the
+// given offset.
+func (vm *VM) Operand(ip int, n int) int {
+	return int(binary.BigEndian.Uint16(vm.bytecode[ip+1+2*n : ip+3+2*n]))
+}
+
+// Push stores the given value upon our stack.
+func (vm *VM) Push(value object.Object) {
+	vm.stack.Push(value)
+}
+
+// Pop removes a value from our stack.
+func (vm *VM) Pop() (object.Object, error) {
+	return vm.stack.Pop()
+}
+
+// NOP
+func opNop(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+	return ip + 1, nil, nil
+}
+
+// Store an integer upon the stack
+func opPush(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+	vm.stack.Push(object.NewInteger(int64(vm.Operand(ip, 0))))
+	return ip + 3, nil, nil
+}
+
+// Push a constant upon the stack
+func opConstant(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+	vm.stack.Push(vm.constants[vm.Operand(ip, 0)])
+	return ip + 3, nil, nil
+}
+
+// Lookup variable/field, by name
+func opLookup(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+
+	// Get the name.
+	name := vm.constants[vm.Operand(ip, 0)].Inspect()
+
+	// Lookup the value.
+	vm.stack.Push(vm.lookup(obj, name))
+	return ip + 3, nil, nil
+}
+
+// Lookup a field, and jump if it doesn't equal a constant
+func opLookupConstantEqual(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+
+	name := vm.constants[vm.Operand(ip, 0)].Inspect()
+	val := vm.constants[vm.Operand(ip, 1)]
+
+	equal, err := vm.equal(vm.lookup(obj, name), val)
+	if err != nil {
+		return ip, nil, err
+	}
+	if !equal {
+		return vm.Operand(ip, 2), nil, nil
+	}
+	return ip + 7, nil, nil
+}
+
+// Set a variable by name
+func opSet(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+
+	name, err := vm.stack.Pop()
+	if err != nil {
+		return ip, nil, err
+	}
+	val, err := vm.stack.Pop()
+	if err != nil {
+		return ip, nil, err
+	}
+
+	vm.scope.Set(name.Inspect(), val)
+	return ip + 1, nil, nil
+}
+
+// Declare a local variable by name
+func opLet(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+
+	name, err := vm.stack.Pop()
+	if err != nil {
+		return ip, nil, err
+	}
+	val, err := vm.stack.Pop()
+	if err != nil {
+		return ip, nil, err
+	}
+
+	vm.scope.Define(name.Inspect(), val)
+	return ip + 1, nil, nil
+}
+
+// Enter a block with local variables
+func opEnterScope(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+	vm.scope = environment.NewEnclosed(vm.scope)
+	return ip + 1, nil, nil
+}
+
+// Leave a block with local variables
+func opLeaveScope(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+	if vm.scope == vm.global || vm.scope.Outer() == nil {
+		return ip, nil, fmt.Errorf("attempted to leave the top-level scope")
+	}
+	vm.scope = vm.scope.Outer()
+	return ip + 1, nil, nil
+}
+
+// maths & comparisons
+func opBinary(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+	err := vm.executeBinaryOperation(code.Opcode(vm.bytecode[ip]))
+	if err != nil {
+		return ip, nil, err
+	}
+	return ip + 1, nil, nil
+}
+
+// Store an array
+func opArray(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+
+	n := vm.Operand(ip, 0)
+
+	elements := make([]object.Object, n)
+	for n > 0 {
+		var err error
+		elements[n-1], err = vm.stack.Pop()
+		if err != nil {
+			return ip, nil, err
+		}
+		n--
+	}
+	vm.stack.Push(&object.Array{Elements: elements})
+	return ip + 3, nil, nil
+}
+
+// Create a function, bound to the current scope.
+func opClosure(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+	fn := vm.constants[vm.Operand(ip, 0)].(*object.Function)
+	vm.stack.Push(vm.closure(fn, obj))
+	return ip + 3, nil, nil
+}
+
+// Install an error-handler
+func opTry(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+	vm.handlers = append(vm.handlers, handler{ip: vm.Operand(ip, 0), depth: vm.stack.Size(), scope: vm.scope})
+	return ip + 3, nil, nil
+}
+
+// Count a visit to a statement, or branch
+func opCover(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+	n := vm.Operand(ip, 0)
+	if n < len(vm.coverage) {
+		atomic.AddUint64(&vm.coverage[n], 1)
+	}
+	return ip + 3, nil, nil
+}
+
+// Test the type of a value
+func opIsType(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+	val, err := vm.stack.Pop()
+	if err != nil {
+		return ip, nil, err
+	}
+
+	// The type-predicate in the slot may have been replaced since we
+	// were compiled, in which case we call the replacement.
+	slot := vm.Operand(ip, 0)
+	typ, ok := vm.environment.TypePredicate(slot)
+	if !ok {
+		name, fn, found := vm.environment.GetFunctionSlot(slot)
+		if !found {
+			return ip, nil, fmt.Errorf("the function in slot %d does not exist", slot)
+		}
+		if err = vm.callBuiltin(name, fn, []object.Object{val}); err != nil {
+			return ip, nil, err
+		}
+		return ip + 3, nil, nil
+	}
+
+	vm.stack.Push(vm.nativeBoolToBooleanObject(val.Type() == typ))
+	return ip + 3, nil, nil
+}
+
+// Test that the value on the top of the stack is a boolean.
+func opRequireBool(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+	val, err := vm.stack.Pop()
+	if err != nil {
+		return ip, nil, err
+	}
+	if val.Type() != object.BOOLEAN && val.Type() != object.ERROR {
+		line := vm.Operand(ip, 0)
+		if line == 0 {
+			return ip, nil, fmt.Errorf("script returned %s, expected %s", val.Type(), object.BOOLEAN)
+		}
+		return ip, nil, fmt.Errorf("script returned %s, expected %s at line %d", val.Type(), object.BOOLEAN, line)
+	}
+	vm.stack.Push(val)
+	return ip + 3, nil, nil
+}
+
+// Record the value on the top of the stack
+func opTrace(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+	val, err := vm.stack.Pop()
+	if err != nil {
+		return ip, nil, err
+	}
+	vm.stack.Push(val)
+	if vm.tracer != nil {
+		vm.tracer(vm.Operand(ip, 0), val)
+	}
+	return ip + 3, nil, nil
+}
+
+// Remove an error-handler
+func opEndTry(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+	if len(vm.handlers) == 0 {
+		return ip, nil, fmt.Errorf("attempted to remove a missing error-handler")
+	}
+	vm.handlers = vm.handlers[:len(vm.handlers)-1]
+	return ip + 1, nil, nil
+}
+
+// Lookup an array index
+func opArrayIndex(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+
+	index, err := vm.stack.Pop()
+	if err != nil {
+		return ip, nil, err
+	}
+	left, err := vm.stack.Pop()
+	if err != nil {
+		return ip, nil, err
+	}
+
+	err = vm.executeIndexExpression(left, index)
+	if err != nil {
+		return ip, nil, err
+	}
+	return ip + 1, nil, nil
+}
+
+// Test a value against a range
+func opBetween(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+	err := vm.executeBetween()
+	if err != nil {
+		return ip, nil, err
+	}
+	return ip + 1, nil, nil
+}
+
+// Test whether a value is a member of a collection
+func opIn(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+	err := vm.executeIn()
+	if err != nil {
+		return ip, nil, err
+	}
+	return ip + 1, nil, nil
+}
+
+// Create an iterator over a collection.
+func opIterNew(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+
+	val, err := vm.stack.Pop()
+	if err != nil {
+		return ip, nil, err
+	}
+
+	iterable, ok := val.(object.Iterable)
+	if !ok {
+		return ip, nil, fmt.Errorf("cannot iterate over %s", val.Type())
+	}
+
+	vm.stack.Push(iterable.Iterator())
+	return ip + 1, nil, nil
+}
+
+// Push the next key and value of an iterator, or jump when it is done.
+func opIterNext(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+
+	val, err := vm.stack.Pop()
+	if err != nil {
+		return ip, nil, err
+	}
+
+	it, ok := val.(object.Iterator)
+	if !ok {
+		return ip, nil, fmt.Errorf("OpIterNext expected an iterator, got %s", val.Type())
+	}
+	vm.stack.Push(it)
+
+	key, value, ok := it.Next()
+	if !ok {
+		return vm.Operand(ip, 0), nil, nil
+	}
+
+	vm.stack.Push(key)
+	vm.stack.Push(value)
+	return ip + 3, nil, nil
+}
+
+// Discard a completed iterator.
+func opIterDone(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+
+	val, err := vm.stack.Pop()
+	if err != nil {
+		return ip, nil, err
+	}
+
+	if _, ok := val.(object.Iterator); !ok {
+		return ip, nil, fmt.Errorf("OpIterDone expected an iterator, got %s", val.Type())
+	}
+	return ip + 1, nil, nil
+}
+
+// Record a value as evidence, with the given name.
+func opCapture(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+
+	val, err := vm.stack.Pop()
+	if err != nil {
+		return ip, nil, err
+	}
+	name, err := vm.stack.Pop()
+	if err != nil {
+		return ip, nil, err
+	}
+
+	if name.Type() != object.STRING {
+		return ip, nil, fmt.Errorf("capture expects a STRING name, got %s", name.Type())
+	}
+	if vm.captures == nil {
+		vm.captures = make(map[string]object.Object)
+	}
+	vm.captures[name.Inspect()] = val
+
+	vm.stack.Push(val)
+	return ip + 1, nil, nil
+}
+
+// !true -> false
+func opBang(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+	err := vm.executeBangOperator()
+	if err != nil {
+		return ip, nil, err
+	}
+	return ip + 1, nil, nil
+}
+
+// -1
+func opMinus(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+	err := vm.executeMinusOperator()
+	if err != nil {
+		return ip, nil, err
+	}
+	return ip + 1, nil, nil
+}
+
+// ~1
+func opBitNot(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+	err := vm.executeBitNotOperator()
+	if err != nil {
+		return ip, nil, err
+	}
+	return ip + 1, nil, nil
+}
+
+// square root
+func opRoot(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+	err := vm.executeSquareRoot()
+	if err != nil {
+		return ip, nil, err
+	}
+	return ip + 1, nil, nil
+}
+
+// Boolean literal
+func opTrue(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+	vm.stack.Push(True)
+	return ip + 1, nil, nil
+}
+
+// Boolean literal
+func opFalse(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+	vm.stack.Push(False)
+	return ip + 1, nil, nil
+}
+
+// return from script
+func opReturn(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+	result, err := vm.stack.Pop()
+	if err != nil {
+		return ip, nil, err
+	}
+	if result == nil {
+		result = Null
+	}
+	return ip, result, nil
+}
+
+// flow-control: unconditional jump
+func opJump(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+	return vm.Operand(ip, 0), nil, nil
+}
+
+// flow-control: jump if stack contains non-true
+func opJumpIfFalse(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+
+	condition, err := vm.stack.Pop()
+	if err != nil {
+		return ip, nil, err
+	}
+
+	if vm.strict && condition.Type() != object.BOOLEAN {
+		return ip, nil, fmt.Errorf("condition must be a boolean, not %s", condition.Type())
+	}
+
+	// If the condition evaluated to a non-true
+	// then we change the IP.
+	if !condition.True() {
+		return vm.Operand(ip, 0), nil, nil
+	}
+	return ip + 3, nil, nil
+}
+
+// function-call: This is messy.
+func opCall(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+
+	// get the name of the function from the stack.
+	fName, err := vm.stack.Pop()
+	if err != nil {
+		return ip, nil, err
+	}
+
+	//
+	// The argument to the call-instruction is the
+	// number of arguments to pass to the function
+	// we're to invoke.
+	//
+	fnArgs, err := vm.popArguments(vm.Operand(ip, 0))
+	if err != nil {
+		return ip, nil, err
+	}
+
+	// A variable might hold a lambda, which we invoke
+	// in preference to any built-in function.
+	if val, ok := vm.scope.Get(fName.Inspect()); ok {
+		if lambda, ok := val.(*object.Function); ok && lambda.Call != nil {
+			ret, err := lambda.Call(fnArgs)
+			if err != nil {
+				return ip, nil, err
+			}
+			vm.stack.Push(ret)
+			return ip + 3, nil, nil
+		}
+	}
+
+	// Get the function we're to invoke.
+	fn, ok := vm.environment.GetFunction(fName.Inspect())
+	if !ok {
+
+		// A method of the object may be called in the same
+		// way, if it takes no arguments.
+		if len(fnArgs) == 0 {
+			if val, found := vm.callMethod(obj, fName.Inspect()); found {
+				vm.stack.Push(val)
+				return ip + 3, nil, nil
+			}
+		}
+		return ip, nil, fmt.Errorf("the function %s does not exist", fName.Inspect())
+	}
+
+	// Call the function
+	err = vm.callBuiltin(fName.Inspect(), fn, fnArgs)
+	if err != nil {
+		return ip, nil, err
+	}
+	return ip + 3, nil, nil
+}
+
+// function-call, via the slot the compiler found.
+func opCallBuiltin(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+
+	// The number of arguments is our second argument.
+	fnArgs, err := vm.popArguments(vm.Operand(ip, 1))
+	if err != nil {
+		return ip, nil, err
+	}
+
+	// Get the function we're to invoke.
+	name, fn, ok := vm.environment.GetFunctionSlot(vm.Operand(ip, 0))
+	if !ok {
+		return ip, nil, fmt.Errorf("the function in slot %d does not exist", vm.Operand(ip, 0))
+	}
+
+	err = vm.callBuiltin(name, fn, fnArgs)
+	if err != nil {
+		return ip, nil, err
+	}
+	return ip + 5, nil, nil
+}
+
+func opCustomOp(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+
+	// The operands are the two values on the stack.
+	args, err := vm.popArguments(2)
+	if err != nil {
+		return ip, nil, err
+	}
+
+	// Get the operator we're to apply.
+	name, fn, ok := vm.environment.GetOperatorSlot(vm.Operand(ip, 0))
+	if !ok {
+		return ip, nil, fmt.Errorf("the operator in slot %d does not exist", vm.Operand(ip, 0))
+	}
+
+	err = vm.callBuiltin(name, fn, args)
+	if err != nil {
+		return ip, nil, err
+	}
+	return ip + 3, nil, nil
+}
+
+// These two opcodes are just used for internal use.  They are never
+// generated, and they should never be executed either.
+func opFake(vm *VM, obj interface{}, ip int) (int, object.Object, error) {
+	return ip, nil, fmt.Errorf("tried to execute fake instruction %s - this is definitely a bug", code.String(code.Opcode(vm.bytecode[ip])))
+}
+
+// popArguments pops the given number of arguments from the stack, for
+// a function-call.
+//
+// Of course these are in reverse, so we create an array and pop each
+// stack-argument off into the correct location.
+func (vm *VM) popArguments(n int) ([]object.Object, error) {
+
+	args := make([]object.Object, n)
+	for n > 0 {
+		var err error
+		args[n-1], err = vm.stack.Pop()
+		if err != nil {
+			return nil, err
+		}
+		n--
+	}
+	return args, nil
+}
@@ -9,11 +9,11 @@
 package vm
 
 import (
-	"encoding/binary"
+	"context"
 	"fmt"
 	"math"
-	"os"
 	"reflect"
+	"sort"
 	"strings"
 
 	"github.com/skx/evalfilter/v2/code"
@@ -23,13 +23,26 @@ import (
 )
 
 // True is our global "true" object.
-var True = &object.Boolean{Value: true}
+var True = object.NewBoolean(true)
 
 // False is our global "false" object.
-var False = &object.Boolean{Value: false}
+var False = object.NewBoolean(false)
 
 // Null is our global "false" object.
-var Null = &object.Null{}
+var Null = object.NewNull()
+
+// maxSequenceLength is the largest number of elements an array, or bytes
+// a string, may have if it is created by repetition, or concatenation,
+// which prevents a script from using all of our memory.
+const maxSequenceLength = 1 << 24
+
+// fieldProvider is implemented by objects which can supply the values
+// of their own fields, without the need for reflection.
+//
+// This matches the FieldProvider interface of the evalfilter package.
+type fieldProvider interface {
+	GetField(name string) (object.Object, bool)
+}
 
 // VM is the structure which holds our state.
 type VM struct {
@@ -55,6 +68,21 @@ type VM struct {
 	// and functions to be get/set.
 	environment *environment.Environment
 
+	// scope holds the environment for the block we're currently
+	// executing.  This is the same as global, unless we're inside
+	// a block which has declared local variables.
+	scope *environment.Environment
+
+	// global holds the top-level environment for the current run.
+	//
+	// Unless we're persistent this is discarded at the start of the
+	// next run, so variables set by one run don't leak into the next.
+	global *environment.Environment
+
+	// persistent is true if variables set by the script should
+	// be stored in our environment, and persist between runs.
+	persistent bool
+
 	// fields contains the contents of all the fields in the object
 	// or map we're executing against.  We discover these via reflection
 	// at run-time.
@@ -62,6 +90,91 @@ type VM struct {
 	// Reflection is slow so the map here is used as a cache, avoiding
 	// the need to reparse the same object multiple times.
 	fields map[string]object.Object
+
+	// types caches the location of the fields of the structure types
+	// we've executed against, by name, so that we can convert only the
+	// fields a script uses without repeating the reflection needed to
+	// find them.
+	//
+	// A nil index means the structure has no field of that name.
+	types map[reflect.Type]map[string][]int
+
+	// methods caches the index of the methods which may be read as
+	// fields, in the same way, where -1 means there is no such method.
+	methods map[reflect.Type]map[string]int
+
+	// accessors holds the functions which supply the values of fields
+	// on behalf of the host, such as unexported, or computed, fields.
+	accessors map[string]func(obj interface{}) interface{}
+
+	// inspected is true if we've converted all the fields of the
+	// object we're executing against, via inspectObject.
+	inspected bool
+
+	// visiting holds the pointers we're following while converting
+	// an object via reflection, which allows us to avoid looping
+	// forever when we encounter a self-referential structure.
+	visiting map[visit]bool
+
+	// handlers holds the error-handlers which have been installed
+	// via OpTry, the most recent last.
+	handlers []handler
+
+	// coverage holds the counters which OpCover increments, if
+	// coverage has been requested.  They may be shared between
+	// machines, so are updated atomically.
+	coverage []uint64
+
+	// tracer receives the values recorded by OpTrace, if any.
+	tracer func(id int, value object.Object)
+
+	// strict is true if conditions, and the operands of `&&` and
+	// `||`, must be booleans.
+	strict bool
+
+	// intDivision is true if OpDiv divides two integers as integers,
+	// rather than as floats.
+	intDivision bool
+
+	// maxSteps is the largest number of instructions a single run
+	// may execute, if it's non-zero, and steps counts those the
+	// current run has executed.  The counter is shared with the
+	// machines which run lambdas.
+	maxSteps int
+	steps    *int
+
+	// captures holds the values the current run has recorded as
+	// evidence, via `capture`, by name.  The map is shared with the
+	// machines which run lambdas.
+	captures map[string]object.Object
+
+	// context is the context of the current run, and object the
+	// object it is running against, which are passed to the functions
+	// which accept a CallInfo.
+	context context.Context
+	object  interface{}
+}
+
+// handler holds the state saved by an OpTry instruction.
+type handler struct {
+	// ip is the offset at which execution resumes after an error.
+	ip int
+
+	// depth is the size of the stack when the handler was installed.
+	depth int
+
+	// scope is the scope which was current when the handler was
+	// installed.
+	scope *environment.Environment
+}
+
+// visit identifies a pointer which we're following.
+type visit struct {
+	// ptr is the address we're visiting.
+	ptr uintptr
+
+	// typ is the type of the pointer.
+	typ reflect.Type
 }
 
 // New constructs a new virtual machine.
@@ -72,9 +185,111 @@ func New(constants []object.Object, bytecode code.Instructions, env *environment
 		environment: env,
 		bytecode:    bytecode,
 		stack:       stack.New(),
+		types:       make(map[reflect.Type]map[string][]int),
+		methods:     make(map[reflect.Type]map[string]int),
 	}
 }
 
+// SetPersistent controls whether variables set by the script persist
+// between runs.
+//
+// By default each run stores the variables it sets in an environment of
+// its own, which is discarded at the start of the next run.  If the
+// machine is persistent they're stored in the environment it was
+// constructed with instead.
+func (vm *VM) SetPersistent(persistent bool) {
+	vm.persistent = persistent
+}
+
+// Select replaces the bytecode the machine runs.
+//
+// This allows a single machine to run any of several programs which
+// share the same constants, and environment, such as the scripts held
+// in an evalfilter.Program.
+func (vm *VM) Select(bytecode code.Instructions) {
+	vm.bytecode = bytecode
+}
+
+// SetCoverage sets the counters which are incremented by the OpCover
+// instructions the compiler generates when coverage is requested.
+//
+// The counters may be shared by several machines, even those running
+// concurrently.
+func (vm *VM) SetCoverage(counts []uint64) {
+	vm.coverage = counts
+}
+
+// SetTracer sets the function which receives the values recorded by
+// the OpTrace instructions the compiler generates for Explain.
+func (vm *VM) SetTracer(tracer func(id int, value object.Object)) {
+	vm.tracer = tracer
+}
+
+// SetStrict controls whether conditions must be booleans.
+//
+// By default any value may be used as a condition, and is tested by its
+// truthiness.  If the machine is strict the conditions of `if`, and of
+// `while`, as well as the operands of `&&` and `||`, must be booleans
+// instead, and anything else is an error.
+func (vm *VM) SetStrict(strict bool) {
+	vm.strict = strict
+}
+
+// SetIntegerDivision controls how two integers are divided by OpDiv.
+//
+// By default they're promoted to floats, so that 5 / 2 is 2.5, but if
+// integer division is enabled the result is truncated to an integer, as
+// it is by OpIntDiv, so that 5 / 2 is 2.
+func (vm *VM) SetIntegerDivision(enabled bool) {
+	vm.intDivision = enabled
+}
+
+// SetMaxSteps limits the number of instructions a single run may
+// execute, including those of the lambdas it calls, which prevents a
+// script from looping forever.  Zero means there is no limit.
+//
+// Building a large string, or array, counts as a step for every 64
+// bytes, or elements, so a loop which does so can't run for long.
+//
+// A run which exceeds the limit fails with an error, which can't be
+// caught by the script.
+func (vm *VM) SetMaxSteps(max int) {
+	vm.maxSteps = max
+}
+
+// SetAccessors sets the functions which supply the values of the named
+// fields of the object we're run against, taking precedence over the
+// fields, and methods, of a structure, or the keys of a map.
+//
+// This allows the host to expose unexported, or computed, fields.
+func (vm *VM) SetAccessors(accessors map[string]func(obj interface{}) interface{}) {
+	vm.accessors = accessors
+}
+
+// stepError returns the error raised when we exceed the limit on steps.
+func (vm *VM) stepError() error {
+	return fmt.Errorf("script exceeds the limit on steps: %d", vm.maxSteps)
+}
+
+// charge counts the work of building a string, or an array, of the given
+// size towards the limit on steps.
+func (vm *VM) charge(size int) error {
+	if vm.steps == nil {
+		return nil
+	}
+	*vm.steps += size / 64
+	if *vm.steps > vm.maxSteps {
+		return vm.stepError()
+	}
+	return nil
+}
+
+// Global returns the top-level environment used by the most recent run,
+// which contains the variables it set, or nil if we've not been run.
+func (vm *VM) Global() *environment.Environment {
+	return vm.global
+}
+
 // Run launches our virtual machine, intepreting the bytecode-program we were
 // constructed with.
 //
@@ -85,21 +300,160 @@ func New(constants []object.Object, bytecode code.Instructions, env *environment
 // (Although our compiler does not implement for/while/do/until loops
 // a hand-created program could build such a things via the instruction-set.)
 func (vm *VM) Run(obj interface{}) (object.Object, error) {
+	return vm.RunContext(context.Background(), obj)
+}
+
+// RunContext runs our bytecode-program in the same way as Run, but passes
+// the given context to the functions which accept a CallInfo.
+//
+// The context isn't tested while the program runs, so cancelling it won't
+// interrupt a program which is running.
+func (vm *VM) RunContext(ctx context.Context, obj interface{}) (object.Object, error) {
+
+	//
+	// Make an empty map to store field/map contents.
+	//
+	return vm.run(ctx, obj, make(map[string]object.Object), false)
+}
+
+// RunFields runs our bytecode-program in the same way as Run, but takes
+// the values of the fields from the given map, rather than from an
+// object.
+//
+// This bypasses reflection entirely, and the map is used as-is rather
+// than being copied, which suits hosts which already hold their data as
+// objects.  The map isn't modified.
+func (vm *VM) RunFields(fields map[string]object.Object) (object.Object, error) {
+	if fields == nil {
+		fields = make(map[string]object.Object)
+	}
+	return vm.run(context.Background(), nil, fields, true)
+}
+
+// run runs our bytecode-program, from the start, with the given fields.
+//
+// If inspected is true the fields are complete, otherwise they are
+// discovered from the object as they are needed.
+func (vm *VM) run(ctx context.Context, obj interface{}, fields map[string]object.Object, inspected bool) (object.Object, error) {
 
 	// Sanity-check the bytecode program is non-empty
 	if len(vm.bytecode) < 1 {
 		return nil, fmt.Errorf("the bytecode program is empty")
 	}
 
+	vm.start(ctx, fields, inspected)
+	vm.object = obj
+	return vm.execute(obj)
+}
+
+// start prepares the machine for a new run, with the given context and
+// fields.
+func (vm *VM) start(ctx context.Context, fields map[string]object.Object, inspected bool) {
+
+	vm.context = ctx
+	vm.fields = fields
+	vm.inspected = inspected
+
+	vm.steps = nil
+	if vm.maxSteps > 0 {
+		vm.steps = new(int)
+	}
+
 	//
-	// Make an empty map to store field/map contents.
+	// Start in the top-level scope, which is isolated from our
+	// environment unless we're persistent.
 	//
-	vm.fields = make(map[string]object.Object)
+	vm.global = vm.environment
+	if !vm.persistent {
+		vm.global = environment.NewIsolated(vm.environment)
+	}
+	vm.scope = vm.global
 
 	//
-	// Instruction pointer and length.
+	// Discard any error-handlers left over from a previous run, which
+	// returned from within a `catch`.
 	//
+	vm.handlers = nil
+
+	vm.captures = nil
+}
+
+// Captures returns the values the most recent run recorded as evidence,
+// via `capture`, by name, or nil if there were none.
+func (vm *VM) Captures() map[string]object.Object {
+	if len(vm.captures) == 0 {
+		return nil
+	}
+	return vm.captures
+}
+
+// Call invokes the named function, from those given, against the given
+// object, with the given arguments - without running our bytecode.
+//
+// Each of the functions is defined in the top-level scope first, so
+// that they may call each other.
+func (vm *VM) Call(name string, functions map[string]*object.Function, obj interface{}, args []object.Object) (object.Object, error) {
+
+	if _, ok := functions[name]; !ok {
+		return nil, fmt.Errorf("the function %s does not exist", name)
+	}
+
+	vm.start(context.Background(), make(map[string]object.Object), false)
+	vm.object = obj
+
+	var bound *object.Function
+	for n, fn := range functions {
+		fn = vm.closure(fn, obj)
+		vm.global.Define(n, fn)
+		if n == name {
+			bound = fn
+		}
+	}
+	return bound.Call(args)
+}
+
+// execute runs our bytecode, in the current scope, until we hit a
+// return-operation or the end of the program.
+//
+// If an error occurs while an error-handler is installed we restore
+// the state it saved, and resume execution at the handler.
+func (vm *VM) execute(obj interface{}) (object.Object, error) {
+
 	ip := 0
+	for {
+		ret, err := vm.executeFrom(obj, ip)
+		if err == nil || len(vm.handlers) == 0 {
+			return ret, err
+		}
+
+		h := vm.handlers[len(vm.handlers)-1]
+		vm.handlers = vm.handlers[:len(vm.handlers)-1]
+
+		for vm.stack.Size() > h.depth {
+			_, _ = vm.stack.Pop()
+		}
+		vm.scope = h.scope
+		ip = h.ip
+	}
+}
+
+// executeFrom runs our bytecode, starting at the given offset.
+//
+// A malformed program, or a buggy function, might cause a panic.  We
+// recover from that and report it as an error, so that the caller's
+// goroutine isn't terminated.
+func (vm *VM) executeFrom(obj interface{}, ip int) (ret object.Object, err error) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			ret = nil
+			err = vm.panicError(r, ip)
+		}
+	}()
+
+	//
+	// Length of our bytecode.
+	//
 	ln := len(vm.bytecode)
 
 	//
@@ -111,253 +465,253 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 	for ip < ln {
 
 		//
-		// Get the next opcode
+		// Count the instructions we execute, if we're limited.
 		//
-		op := code.Opcode(vm.bytecode[ip])
+		if vm.steps != nil {
+			*vm.steps++
+			if *vm.steps > vm.maxSteps {
+				return nil, vm.stepError()
+			}
+		}
 
 		//
-		// Find out how long it is.
+		// Get the handler for the next opcode
 		//
-		opLen := code.Length(op)
+		op := code.Opcode(vm.bytecode[ip])
+		fn := dispatch[op]
+		if fn == nil {
+			return nil, fmt.Errorf("unhandled opcode: %v %s", op, code.String(op))
+		}
 
 		//
-		// If the opcode is more than a single byte long
-		// we read the argument here.
+		// Execute it, and move to the next instruction - unless
+		// this one terminated the script.
 		//
-		opArg := 0
-		if opLen > 1 {
-
-			//
-			// Note in the future we might have to cope
-			// with opcodes with more than a single argument,
-			// and they might be different sizes.
-			//
-			opArg = int(binary.BigEndian.Uint16(vm.bytecode[ip+1 : ip+3]))
+		var result object.Object
+		ip, result, err = fn(vm, obj, ip)
+		if err != nil {
+			return nil, err
 		}
+		if result != nil {
+			return result, nil
+		}
+	}
 
-		switch op {
-
-		// NOP
-		case code.OpNop:
-			// NOP
-
-			// Store an integer upon the stack
-		case code.OpPush:
-			vm.stack.Push(&object.Integer{Value: int64(opArg)})
-
-			// Lookup variable/field, by name
-		case code.OpConstant:
-
-			// move the contents of a constant onto the stack
-			vm.stack.Push(vm.constants[opArg])
-
-			// Lookup variable/field, by name
-		case code.OpLookup:
-
-			// Get the name.
-			name := vm.constants[opArg].Inspect()
-
-			// Lookup the value.
-			val := vm.lookup(obj, name)
-			vm.stack.Push(val)
-
-			// Set a variable by name
-		case code.OpSet:
-
-			var name object.Object
-			var val object.Object
-			var err error
-			name, err = vm.stack.Pop()
-			if err != nil {
-				return nil, err
-			}
-			val, err = vm.stack.Pop()
-			if err != nil {
-				return nil, err
-			}
-
-			vm.environment.Set(name.Inspect(), val)
-
-			// maths & comparisons
-		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod, code.OpPower, code.OpLess, code.OpLessEqual, code.OpGreater, code.OpGreaterEqual, code.OpEqual, code.OpNotEqual, code.OpMatches, code.OpNotMatches, code.OpAnd, code.OpOr:
-			err := vm.executeBinaryOperation(op)
-			if err != nil {
-				return nil, err
-			}
-
-			// Store an array
-		case code.OpArray:
-
-			elements := make([]object.Object, opArg)
-			for opArg > 0 {
-				var err error
-				elements[opArg-1], err = vm.stack.Pop()
-				if err != nil {
-					return nil, err
-				}
-				opArg--
-			}
-			arr := &object.Array{Elements: elements}
-			vm.stack.Push(arr)
-
-			// Lookup an array index
-		case code.OpArrayIndex:
-			index, err := vm.stack.Pop()
-			if err != nil {
-				return nil, err
-			}
-			left, err := vm.stack.Pop()
-			if err != nil {
-				return nil, err
-			}
-
-			err = vm.executeIndexExpression(left, index)
-			if err != nil {
-				return nil, err
-			}
-
-			// !true -> false
-		case code.OpBang:
-
-			err := vm.executeBangOperator()
-			if err != nil {
-				return nil, err
-			}
+	//
+	// If we get here we've hit the end of the bytecode, and we
+	// didn't encounter a return-instruction.
+	//
+	// That means the script is malformed..
+	//
+	// We could decide this means the script returns `false`, but
+	// I'd rather users were explicit.
+	//
+	return nil, fmt.Errorf("missing return at the end of the script")
+}
 
-			// -1
-		case code.OpMinus:
-			err := vm.executeMinusOperator()
-			if err != nil {
-				return nil, err
-			}
+// panicError converts the value recovered from a panic into an error,
+// recording the instruction which was executing and the contents of
+// the stack at the time.
+func (vm *VM) panicError(r interface{}, ip int) error {
 
-			// square root
-		case code.OpRoot:
-			err := vm.executeSquareRoot()
-			if err != nil {
-				return nil, err
-			}
+	op := "unknown instruction"
+	if ip >= 0 && ip < len(vm.bytecode) {
+		op = code.String(code.Opcode(vm.bytecode[ip]))
+	}
 
-			// Boolean literal
-		case code.OpTrue:
-			vm.stack.Push(True)
+	var entries []string
+	for _, ent := range vm.stack.Entries() {
+		if ent == nil {
+			entries = append(entries, "nil")
+			continue
+		}
+		entries = append(entries, ent.Inspect())
+	}
 
-			// Boolean literal
-		case code.OpFalse:
-			vm.stack.Push(False)
+	return fmt.Errorf("panic executing %s at offset %d: %v (stack: [%s])", op, ip, r, strings.Join(entries, ", "))
+}
 
-			// return from script
-		case code.OpReturn:
-			result, err := vm.stack.Pop()
-			return result, err
+// callBuiltin invokes the given built-in function, and pushes the
+// result upon the stack.
+//
+// A function may report failure via an error-object, in which case
+// that is returned.
+func (vm *VM) callBuiltin(name string, fn interface{}, args []object.Object) error {
 
-			// flow-control: unconditional jump
-		case code.OpJump:
+	ret, err := vm.callFunction(name, fn, args)
+	if err != nil {
+		return err
+	}
 
-			// NOTE: We reduce the offset, becaues
-			// at the end of our loop we increment
-			// it again..
+	if e, ok := ret.(*object.Error); ok {
+		return e
+	}
 
-			ip = opArg - opLen
+	vm.stack.Push(ret)
+	return nil
+}
 
-			// flow-control: jump if stack contains non-true
-		case code.OpJumpIfFalse:
+// callFunction invokes the named function, which was registered with
+// our environment, with the given arguments.
+//
+// If the function panics we recover, and return an error instead.
+func (vm *VM) callFunction(name string, fn interface{}, args []object.Object) (ret object.Object, err error) {
 
-			condition, err := vm.stack.Pop()
-			if err != nil {
-				return nil, err
-			}
+	defer func() {
+		if r := recover(); r != nil {
+			ret = nil
+			err = fmt.Errorf("panic calling function %s: %v", name, r)
+		}
+	}()
 
-			// If the condition evaluated to a non-true
-			// then we change the IP.
-			if !condition.True() {
+	switch out := fn.(type) {
+	case func(args []object.Object) object.Object:
+		return out(args), nil
+	case func(call *environment.CallInfo, args []object.Object) object.Object:
+		return out(vm.callInfo(), args), nil
+	}
+	return nil, fmt.Errorf("the function %s has an unexpected type %T", name, fn)
+}
 
-				// NOTE: We reduce the offset, becaues
-				// at the end of our loop we increment
-				// it again..
+// callInfo describes the current run, for the functions which accept a
+// CallInfo.
+//
+// Fields are looked up in the same way as they are by the script, so
+// they're converted only once, however they're accessed.
+func (vm *VM) callInfo() *environment.CallInfo {
+	ctx := vm.context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return environment.NewCallInfo(ctx, vm.object, objectFields{vm: vm, obj: vm.object})
+}
 
-				ip = opArg - opLen
-			}
+// objectFields gives the functions which accept a CallInfo access to the
+// fields of the object we're running against.
+type objectFields struct {
+	vm  *VM
+	obj interface{}
+}
 
-			// function-call: This is messy.
-		case code.OpCall:
+// Field returns the value of the named field.
+func (f objectFields) Field(name string) object.Object {
+	return f.vm.lookupObject(f.obj, name)
+}
 
-			// The OpCall instruction is followed by an
-			// argument describing the number of args the
-			// function we're calling should be invoked with.
+// FieldNames returns the names of all the fields, converting those we've
+// not converted already.
+func (f objectFields) FieldNames() []string {
+	if !f.vm.inspected {
+		f.vm.inspectObject(f.obj)
+		f.vm.inspected = true
+	}
 
-			// get the name of the function from the stack.
-			fName, err := vm.stack.Pop()
-			if err != nil {
-				return nil, err
-			}
+	names := make([]string, 0, len(f.vm.fields))
+	for name := range f.vm.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
 
-			//
-			// The argument to the call-instruction is the
-			// number of arguments to pass to the function
-			// we're to invoke.
-			//
-			// Of course these are in reverse.
-			//
-			// Create an array and pop each stack-argument
-			// off into the correct location.
-			//
-			fnArgs := make([]object.Object, opArg)
-			for opArg > 0 {
-				fnArgs[opArg-1], err = vm.stack.Pop()
-				if err != nil {
-					return nil, err
-				}
-				opArg--
-			}
+// closure returns a copy of the given function which may be invoked,
+// in the scope that is current when it is created.
+//
+// The function-body is executed by a new virtual machine, which shares
+// our constants, environment, and the object we're running against.
+func (vm *VM) closure(fn *object.Function, obj interface{}) *object.Function {
 
-			// Get the function we're to invoke.
-			fn, ok := vm.environment.GetFunction(fName.Inspect())
-			if !ok {
-				return nil, fmt.Errorf("the function %s does not exist", fName.Inspect())
-			}
+	scope := vm.scope
 
-			// Cast the function & call it
-			out := fn.(func(args []object.Object) object.Object)
-			ret := out(fnArgs)
+	bound := &object.Function{
+		Parameters: fn.Parameters,
+		Source:     fn.Source,
+		Body:       fn.Body,
+	}
 
-			// store the result back on the stack.
-			vm.stack.Push(ret)
+	bound.Call = func(args []object.Object) (object.Object, error) {
 
-			// These two opcodes are just used for internal
-			// use.  They are never generated, and they should
-			// never be executed either.
-		case code.OpCodeSingleArg, code.OpFinal:
+		if len(args) != len(fn.Parameters) {
+			return nil, fmt.Errorf("function %s expects %d argument(s), got %d", fn.Source, len(fn.Parameters), len(args))
+		}
 
-			return nil, fmt.Errorf("tried to execute fake instruction %s - this is definitely a bug", code.String(op))
+		//
+		// Arguments are local to the function-invocation.
+		//
+		env := environment.NewEnclosed(scope)
+		for i, name := range fn.Parameters {
+			env.Define(name, args[i])
+		}
 
-			// Can't happen?
-		default:
-			return nil, fmt.Errorf("unhandled opcode: %v %s", op, code.String(op))
+		// Evidence captured by the function is recorded with ours.
+		if vm.captures == nil {
+			vm.captures = make(map[string]object.Object)
 		}
 
-		ip += opLen
+		child := &VM{
+			constants:   vm.constants,
+			bytecode:    fn.Body,
+			stack:       stack.New(),
+			environment: vm.environment,
+			scope:       env,
+			global:      env,
+			fields:      vm.fields,
+			types:       vm.types,
+			methods:     vm.methods,
+			accessors:   vm.accessors,
+			coverage:    vm.coverage,
+			tracer:      vm.tracer,
+			strict:      vm.strict,
+			intDivision: vm.intDivision,
+			maxSteps:    vm.maxSteps,
+			steps:       vm.steps,
+			captures:    vm.captures,
+			context:     vm.context,
+			object:      obj,
+		}
+		return child.execute(obj)
 	}
 
-	//
-	// If we get here we've hit the end of the bytecode, and we
-	// didn't encounter a return-instruction.
-	//
-	// That means the script is malformed..
-	//
-	// We could decide this means the script returns `false`, but
-	// I'd rather users were explicit.
-	//
-	return nil, fmt.Errorf("missing return at the end of the script")
+	return bound
 }
 
 // inspectObject discovers the names/values of all structure fields, or
-// map contents.
+// map contents, along with those supplied by our accessors.
 //
 // This method is called the first time any reference is made to a field
 // value - which means we don't eat the cost unless we need it, and we
 // don't have to call reflection more than once.  (Reflection is s-l-o-w.)
 func (vm *VM) inspectObject(obj interface{}) {
+	vm.inspectFields(obj)
+
+	if obj == nil {
+		return
+	}
+	for name, fn := range vm.accessors {
+		vm.fields[name] = vm.access(obj, fn)
+	}
+}
+
+// access converts the value the given accessor supplies for the object.
+func (vm *VM) access(obj interface{}, fn func(obj interface{}) interface{}) object.Object {
+	res := fn(obj)
+	if res == nil {
+		return Null
+	}
+	if val, ok := res.(object.Object); ok {
+		return val
+	}
+
+	ret := vm.valueToObject(reflect.ValueOf(res))
+	if ret == nil {
+		return Null
+	}
+	return ret
+}
+
+// inspectFields discovers the names/values of all structure fields, or
+// map contents, for inspectObject.
+func (vm *VM) inspectFields(obj interface{}) {
 
 	//
 	// If the reference is nil we have nothing to walk.
@@ -366,6 +720,16 @@ func (vm *VM) inspectObject(obj interface{}) {
 		return
 	}
 
+	//
+	// If we were given objects there's no need for reflection.
+	//
+	if fields, ok := obj.(map[string]object.Object); ok {
+		for name, val := range fields {
+			vm.fields[name] = val
+		}
+		return
+	}
+
 	//
 	// Get the value, be it a "thing", or a pointer to a thing.
 	//
@@ -382,30 +746,12 @@ func (vm *VM) inspectObject(obj interface{}) {
 		for _, key := range val.MapKeys() {
 
 			// The name of the key.
-			name := key.Interface().(string)
+			name := fmt.Sprintf("%v", key)
 
 			// The actual thing inside it
-			field := val.MapIndex(key).Elem()
-
-			// Default
-			var ret object.Object
-			ret = &object.Null{}
-
-			switch field.Kind() {
-
-			// Hack.
-			//
-			// Probably broken.
-			case reflect.Slice:
-				ret = vm.createArrayFromSlice(field)
-			case reflect.Int, reflect.Int64:
-				ret = &object.Integer{Value: field.Int()}
-			case reflect.Float32, reflect.Float64:
-				ret = &object.Float{Value: field.Float()}
-			case reflect.String:
-				ret = &object.String{Value: field.String()}
-			case reflect.Bool:
-				ret = &object.Boolean{Value: field.Bool()}
+			ret := vm.valueToObject(val.MapIndex(key))
+			if ret == nil {
+				ret = Null
 			}
 
 			vm.fields[name] = ret
@@ -413,123 +759,205 @@ func (vm *VM) inspectObject(obj interface{}) {
 		return
 	}
 
+	//
+	// We can only walk the fields of a structure.
+	//
+	if val.Kind() != reflect.Struct {
+		return
+	}
+
 	//
 	// OK this is an object
 	//
-	for i := 0; i < val.NumField(); i++ {
+	hash := vm.createHashFromStruct(val)
+	for name, ret := range hash.(*object.Hash).Pairs {
+		vm.fields[name] = ret
+	}
+}
 
-		// Get the field
-		field := val.Field(i)
+// valueToObject converts the given value, which might be a member of a
+// structure, map, or slice, into an object.
+//
+// Maps and structures become hashes, and slices become arrays,
+// recursively, so the typical shapes of decoded JSON, and nested
+// structures, are fully available to scripts.
+//
+// If the value cannot be converted nil is returned.
+func (vm *VM) valueToObject(val reflect.Value) object.Object {
 
-		// Get the name
-		typeField := val.Type().Field(i)
-		name := typeField.Name
+	//
+	// Members of a map[string]interface{}, or []interface{}, are
+	// interfaces, so find the thing inside them.  Similarly we
+	// follow pointers to the thing they point at.
+	//
+	for val.Kind() == reflect.Interface || val.Kind() == reflect.Ptr {
+		if val.IsNil() {
+			return Null
+		}
 
-		// Default
-		var ret object.Object
-		ret = &object.Null{}
+		//
+		// A structure might contain a pointer to itself, directly
+		// or indirectly, so don't follow a pointer we're already
+		// in the middle of converting.
+		//
+		if val.Kind() == reflect.Ptr {
+			v := visit{ptr: val.Pointer(), typ: val.Type()}
+			if vm.visiting[v] {
+				return Null
+			}
+			if vm.visiting == nil {
+				vm.visiting = make(map[visit]bool)
+			}
+			vm.visiting[v] = true
+			defer delete(vm.visiting, v)
+		}
 
-		switch field.Kind() {
+		val = val.Elem()
+	}
 
-		case reflect.Slice:
-			ret = vm.createArrayFromSlice(field)
-		case reflect.Int, reflect.Int64:
-			ret = &object.Integer{Value: field.Int()}
-		case reflect.Float32, reflect.Float64:
-			ret = &object.Float{Value: field.Float()}
-		case reflect.String:
-			ret = &object.String{Value: field.String()}
-		case reflect.Bool:
-			ret = &object.Boolean{Value: field.Bool()}
+	switch val.Kind() {
+	case reflect.Struct:
+		return vm.createHashFromStruct(val)
+	case reflect.Map:
+		return vm.createHashFromMap(val)
+	case reflect.Slice, reflect.Array:
+		return vm.createArrayFromSlice(val)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return object.NewInteger(val.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if val.Uint() > math.MaxInt64 {
+			return &object.Float{Value: float64(val.Uint())}
 		}
-
-		vm.fields[name] = ret
+		return object.NewInteger(int64(val.Uint()))
+	case reflect.Float32, reflect.Float64:
+		return &object.Float{Value: val.Float()}
+	case reflect.String:
+		return &object.String{Value: val.String()}
+	case reflect.Bool:
+		return object.NewBoolean(val.Bool())
 	}
-}
 
-// createArrayFromSlice creates an object.Array value from the
-// given object/map slice.  This uses reflection and is slow/horrid
-func (vm *VM) createArrayFromSlice(field reflect.Value) object.Object {
+	return nil
+}
 
-	// Elements we've found
-	var el []object.Object
+// createHashFromStruct creates an object.Hash value from the fields of
+// the given structure.
+//
+// Fields which cannot be converted are Null.
+func (vm *VM) createHashFromStruct(val reflect.Value) object.Object {
 
-	// Find the length of the slice
-	l := field.Len()
+	hash := &object.Hash{Pairs: make(map[string]object.Object, val.NumField())}
 
-	// For each entry
-	for i := 0; i < l; i++ {
+	var embedded []*object.Hash
 
-		// Cast the array-member to an interface
-		in := field.Index(i).Interface()
+	for i := 0; i < val.NumField(); i++ {
 
-		//
-		// Now we're in horrible-land
-		//
-		// We want to work out the type of the
-		// array-member.  Of course every member
-		// will have the same type, unless we're
-		// in the case of an array of interfaces.
-		//
-		// The following code will try to cast
-		// to all "reasonable" values, which will
-		// cover either case.
-		//
-		// It is still horrible though, and that
-		// should be noted.
-		//
+		// Get the name
+		name := val.Type().Field(i).Name
 
-		// Is it a string?
-		s, ok := in.(string)
-		if ok {
-			el = append(el, &object.String{Value: s})
-			continue
+		ret := vm.valueToObject(val.Field(i))
+		if ret == nil {
+			ret = Null
 		}
 
-		// Is it a bool?
-		b, ok := in.(bool)
-		if ok {
-			el = append(el, &object.Boolean{Value: b})
-			continue
-		}
+		hash.Pairs[name] = ret
 
-		// is it a float?
-		f, ok := in.(float32)
-		if ok {
-			el = append(el, &object.Float{Value: float64(f)})
-			continue
-		}
-		ff, ok := in.(float64)
-		if ok {
-			el = append(el, &object.Float{Value: ff})
-			continue
+		// Remember embedded structures, so we can promote
+		// their fields.
+		if val.Type().Field(i).Anonymous {
+			if h, ok := ret.(*object.Hash); ok {
+				embedded = append(embedded, h)
+			}
 		}
+	}
 
-		// is it an integer?
-		d, ok := in.(int)
-		if ok {
-			el = append(el, &object.Integer{Value: int64(d)})
-			continue
-		}
-		dd, ok := in.(int32)
-		if ok {
-			el = append(el, &object.Integer{Value: int64(dd)})
-			continue
+	//
+	// The fields of embedded structures are promoted, as they are in
+	// golang, unless the outer structure has a field of the same name.
+	//
+	for _, h := range embedded {
+		for name, ret := range h.Pairs {
+			if _, found := hash.Pairs[name]; !found {
+				hash.Pairs[name] = ret
+			}
 		}
-		ddd, ok := in.(int64)
-		if ok {
-			el = append(el, &object.Integer{Value: ddd})
-			continue
+	}
+
+	return hash
+}
+
+// createHashFromMap creates an object.Hash value from the given map.
+//
+// Members which cannot be converted are Null.
+func (vm *VM) createHashFromMap(field reflect.Value) object.Object {
+
+	hash := &object.Hash{Pairs: make(map[string]object.Object, field.Len())}
+
+	for _, key := range field.MapKeys() {
+
+		ret := vm.valueToObject(field.MapIndex(key))
+		if ret == nil {
+			ret = Null
 		}
 
-		// FATAL!
-		fmt.Printf("Failed to convert array-member to object")
-		os.Exit(1)
+		// The key is formatted via its reflect.Value, as a map
+		// found via an unexported field can't be converted to an
+		// interface.
+		hash.Pairs[fmt.Sprintf("%v", key)] = ret
+	}
+
+	return hash
+}
+
+// createArrayFromSlice creates an object.Array value from the
+// given object/map slice.
+//
+// Each member is converted in turn, so slices of maps or structures
+// become arrays of hashes.  Members which cannot be converted are Null.
+func (vm *VM) createArrayFromSlice(field reflect.Value) object.Object {
+
+	// Elements we've found
+	el := make([]object.Object, field.Len())
+
+	// For each entry
+	for i := range el {
+
+		el[i] = vm.valueToObject(field.Index(i))
+		if el[i] == nil {
+			el[i] = Null
+		}
 	}
 
 	return &object.Array{Elements: el}
 }
 
+// equal compares the two values, as OpEqual would, for our fused
+// OpLookupConstantEqual instruction.
+//
+// Objects of the same type, which are by far the most common, are
+// compared directly and everything else is handled via the stack, so
+// that mismatched types, and NaN, are reported.
+func (vm *VM) equal(left object.Object, right object.Object) (bool, error) {
+
+	if l, ok := left.(object.Comparable); ok && left.Type() == right.Type() && !vm.isNaN(left) && !vm.isNaN(right) {
+		return l.Equal(right), nil
+	}
+
+	vm.stack.Push(left)
+	vm.stack.Push(right)
+
+	err := vm.executeBinaryOperation(code.OpEqual)
+	if err != nil {
+		return false, err
+	}
+
+	res, err := vm.stack.Pop()
+	if err != nil {
+		return false, err
+	}
+	return res.True(), nil
+}
+
 // Execute an operation against two arguments, i.e "foo == bar", "2 + 3", etc.
 //
 // This is a crazy-big function, because we have to cope with different operand
@@ -548,15 +976,24 @@ func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 		return err
 	}
 
+	if vm.strict && (op == code.OpAnd || op == code.OpOr) {
+		if left.Type() != object.BOOLEAN || right.Type() != object.BOOLEAN {
+			name := "&&"
+			if op == code.OpOr {
+				name = "||"
+			}
+			return fmt.Errorf("the operands of %s must be booleans, not %s and %s",
+				name, left.Type(), right.Type())
+		}
+	}
+
 	switch {
+	case op == code.OpEqual || op == code.OpNotEqual:
+		return vm.evalEqualityExpression(op, left, right)
 	case left.Type() == object.INTEGER && right.Type() == object.INTEGER:
 		return vm.evalIntegerInfixExpression(op, left, right)
-	case left.Type() == object.FLOAT && right.Type() == object.FLOAT:
+	case vm.isNumeric(left) && vm.isNumeric(right):
 		return vm.evalFloatInfixExpression(op, left, right)
-	case left.Type() == object.FLOAT && right.Type() == object.INTEGER:
-		return vm.evalFloatIntegerInfixExpression(op, left, right)
-	case left.Type() == object.INTEGER && right.Type() == object.FLOAT:
-		return vm.evalIntegerFloatInfixExpression(op, left, right)
 	case left.Type() == object.STRING && right.Type() == object.STRING:
 		return vm.evalStringInfixExpression(op, left, right)
 	case op == code.OpAnd:
@@ -583,8 +1020,16 @@ func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 			vm.stack.Push(False)
 		}
 		return nil
-	case left.Type() == object.BOOLEAN && right.Type() == object.BOOLEAN:
-		return vm.evalBooleanInfixExpression(op, left, right)
+	case op == code.OpXor:
+		// true if exactly one side is true
+		vm.stack.Push(vm.nativeBoolToBooleanObject(left.True() != right.True()))
+		return nil
+	case op == code.OpMul && left.Type() == object.STRING && right.Type() == object.INTEGER:
+		return vm.evalStringRepeat(left.(*object.String), right.(*object.Integer))
+	case op == code.OpMul && left.Type() == object.INTEGER && right.Type() == object.STRING:
+		return vm.evalStringRepeat(right.(*object.String), left.(*object.Integer))
+	case left.Type() == object.ARRAY || right.Type() == object.ARRAY:
+		return vm.evalArrayInfixExpression(op, left, right)
 	case left.Type() != right.Type():
 		return fmt.Errorf("type mismatch: %s %s %s",
 			left.Type(), code.String(op), right.Type())
@@ -594,107 +1039,85 @@ func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 	}
 }
 
-// integer OP integer
-func (vm *VM) evalIntegerInfixExpression(op code.Opcode, left, right object.Object) error {
-	leftVal := left.(*object.Integer).Value
-	rightVal := right.(*object.Integer).Value
-
-	switch op {
-	case code.OpAdd:
-		vm.stack.Push(&object.Integer{Value: leftVal + rightVal})
-	case code.OpSub:
-		vm.stack.Push(&object.Integer{Value: leftVal - rightVal})
-	case code.OpMul:
-		vm.stack.Push(&object.Integer{Value: leftVal * rightVal})
-	case code.OpDiv:
-		if rightVal == 0 {
-			return fmt.Errorf("attempted division by zero: %d / %d", leftVal, rightVal)
+// object == object, or object != object
+//
+// Objects may be compared if they are Comparable, and of the same type,
+// or if they're both numbers.  Anything else is an error.
+func (vm *VM) evalEqualityExpression(op code.Opcode, left, right object.Object) error {
+
+	l, ok := left.(object.Comparable)
+	if !ok || (left.Type() != right.Type() && !(vm.isNumeric(left) && vm.isNumeric(right))) {
+		if left.Type() != right.Type() {
+			return fmt.Errorf("type mismatch: %s %s %s",
+				left.Type(), code.String(op), right.Type())
 		}
-		vm.stack.Push(&object.Integer{Value: leftVal / rightVal})
-	case code.OpMod:
-		vm.stack.Push(&object.Integer{Value: leftVal % rightVal})
-	case code.OpPower:
-		vm.stack.Push(&object.Integer{Value: int64(math.Pow(float64(leftVal), float64(rightVal)))})
-	case code.OpLess:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal < rightVal))
-	case code.OpLessEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal <= rightVal))
-	case code.OpGreater:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal > rightVal))
-	case code.OpGreaterEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal >= rightVal))
-	case code.OpEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal == rightVal))
-	case code.OpNotEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal != rightVal))
-	default:
-		return (fmt.Errorf("unknown operator: %s %s %s", left.Type(), code.String(op), right.Type()))
+		return fmt.Errorf("unknown operator: %s %s %s",
+			left.Type(), code.String(op), right.Type())
 	}
 
-	return nil
-}
-
-// float OP float
-func (vm *VM) evalFloatInfixExpression(op code.Opcode, left, right object.Object) error {
-	leftVal := left.(*object.Float).Value
-	rightVal := right.(*object.Float).Value
-
-	switch op {
-	case code.OpAdd:
-		vm.stack.Push(&object.Float{Value: leftVal + rightVal})
-	case code.OpSub:
-		vm.stack.Push(&object.Float{Value: leftVal - rightVal})
-	case code.OpMul:
-		vm.stack.Push(&object.Float{Value: leftVal * rightVal})
-	case code.OpDiv:
-		if rightVal == 0 {
-			return fmt.Errorf("attempted division by zero: %f / %f", leftVal, rightVal)
-		}
-		vm.stack.Push(&object.Float{Value: leftVal / rightVal})
-	case code.OpMod:
-		vm.stack.Push(&object.Float{Value: float64(int(leftVal) % int(rightVal))})
-	case code.OpPower:
-		vm.stack.Push(&object.Float{Value: math.Pow(leftVal, rightVal)})
-	case code.OpLess:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal < rightVal))
-	case code.OpLessEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal <= rightVal))
-	case code.OpGreater:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal > rightVal))
-	case code.OpGreaterEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal >= rightVal))
-	case code.OpEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal == rightVal))
-	case code.OpNotEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal != rightVal))
-	default:
-		return (fmt.Errorf("unknown operator: %s %s %s", left.Type(), code.String(op), right.Type()))
+	if vm.isNaN(left) || vm.isNaN(right) {
+		return vm.nanError(op, left, right)
 	}
 
+	equal := l.Equal(right)
+	if op == code.OpNotEqual {
+		equal = !equal
+	}
+	vm.stack.Push(vm.nativeBoolToBooleanObject(equal))
 	return nil
 }
 
-// float OP int
-func (vm *VM) evalFloatIntegerInfixExpression(op code.Opcode, left, right object.Object) error {
-	leftVal := left.(*object.Float).Value
-	rightVal := float64(right.(*object.Integer).Value)
+// integer OP integer
+func (vm *VM) evalIntegerInfixExpression(op code.Opcode, left, right object.Object) error {
+	leftVal := left.(*object.Integer).Value
+	rightVal := right.(*object.Integer).Value
 
 	switch op {
 	case code.OpAdd:
-		vm.stack.Push(&object.Float{Value: leftVal + rightVal})
+		res := leftVal + rightVal
+		if (res > leftVal) != (rightVal > 0) {
+			return fmt.Errorf("integer overflow: %d + %d", leftVal, rightVal)
+		}
+		vm.stack.Push(object.NewInteger(res))
 	case code.OpSub:
-		vm.stack.Push(&object.Float{Value: leftVal - rightVal})
+		res := leftVal - rightVal
+		if (res < leftVal) != (rightVal > 0) {
+			return fmt.Errorf("integer overflow: %d - %d", leftVal, rightVal)
+		}
+		vm.stack.Push(object.NewInteger(res))
 	case code.OpMul:
-		vm.stack.Push(&object.Float{Value: leftVal * rightVal})
-	case code.OpDiv:
+		res, ok := mulInt64(leftVal, rightVal)
+		if !ok {
+			return fmt.Errorf("integer overflow: %d * %d", leftVal, rightVal)
+		}
+		vm.stack.Push(object.NewInteger(res))
+	case code.OpDiv, code.OpIntDiv:
+		sym := "/"
+		if op == code.OpIntDiv {
+			sym = "~/"
+		}
 		if rightVal == 0 {
-			return fmt.Errorf("attempted division by zero: %f / %f", leftVal, rightVal)
+			return fmt.Errorf("attempted division by zero: %d %s %d", leftVal, sym, rightVal)
 		}
-		vm.stack.Push(&object.Float{Value: leftVal / rightVal})
+		if op == code.OpDiv && !vm.intDivision {
+			vm.stack.Push(&object.Float{Value: float64(leftVal) / float64(rightVal)})
+			break
+		}
+		if leftVal == math.MinInt64 && rightVal == -1 {
+			return fmt.Errorf("integer overflow: %d %s %d", leftVal, sym, rightVal)
+		}
+		vm.stack.Push(object.NewInteger(leftVal / rightVal))
 	case code.OpMod:
-		vm.stack.Push(&object.Float{Value: float64(int(leftVal) % int(rightVal))})
+		if rightVal == 0 {
+			return fmt.Errorf("attempted modulus by zero: %d %% %d", leftVal, rightVal)
+		}
+		vm.stack.Push(object.NewInteger(leftVal % rightVal))
 	case code.OpPower:
-		vm.stack.Push(&object.Float{Value: math.Pow(leftVal, rightVal)})
+		res, ok := powInt64(leftVal, rightVal)
+		if !ok {
+			return fmt.Errorf("integer overflow: %d ** %d", leftVal, rightVal)
+		}
+		vm.stack.Push(object.NewInteger(res))
 	case code.OpLess:
 		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal < rightVal))
 	case code.OpLessEqual:
@@ -703,10 +1126,26 @@ func (vm *VM) evalFloatIntegerInfixExpression(op code.Opcode, left, right object
 		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal > rightVal))
 	case code.OpGreaterEqual:
 		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal >= rightVal))
-	case code.OpEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal == rightVal))
-	case code.OpNotEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal != rightVal))
+	case code.OpBitAnd:
+		vm.stack.Push(object.NewInteger(leftVal & rightVal))
+	case code.OpBitOr:
+		vm.stack.Push(object.NewInteger(leftVal | rightVal))
+	case code.OpBitXor:
+		vm.stack.Push(object.NewInteger(leftVal ^ rightVal))
+	case code.OpShiftLeft:
+		if rightVal < 0 {
+			return fmt.Errorf("negative shift count: %d << %d", leftVal, rightVal)
+		}
+		res, ok := shlInt64(leftVal, rightVal)
+		if !ok {
+			return fmt.Errorf("integer overflow: %d << %d", leftVal, rightVal)
+		}
+		vm.stack.Push(object.NewInteger(res))
+	case code.OpShiftRight:
+		if rightVal < 0 {
+			return fmt.Errorf("negative shift count: %d >> %d", leftVal, rightVal)
+		}
+		vm.stack.Push(object.NewInteger(leftVal >> uint64(rightVal)))
 	default:
 		return (fmt.Errorf("unknown operator: %s %s %s", left.Type(), code.String(op), right.Type()))
 	}
@@ -714,10 +1153,24 @@ func (vm *VM) evalFloatIntegerInfixExpression(op code.Opcode, left, right object
 	return nil
 }
 
-// int OP float
-func (vm *VM) evalIntegerFloatInfixExpression(op code.Opcode, left, right object.Object) error {
-	leftVal := float64(left.(*object.Integer).Value)
-	rightVal := right.(*object.Float).Value
+// float OP float
+//
+// This is used for all numeric operations which involve at least one
+// floating-point operand; integer arguments are promoted to floats
+// before the operation is carried out.
+//
+// Arithmetic follows IEEE 754, so it may result in NaN, or an infinity,
+// but comparing NaN with anything is an error.
+func (vm *VM) evalFloatInfixExpression(op code.Opcode, left, right object.Object) error {
+	leftVal := vm.toFloat(left)
+	rightVal := vm.toFloat(right)
+
+	switch op {
+	case code.OpLess, code.OpLessEqual, code.OpGreater, code.OpGreaterEqual:
+		if math.IsNaN(leftVal) || math.IsNaN(rightVal) {
+			return vm.nanError(op, left, right)
+		}
+	}
 
 	switch op {
 	case code.OpAdd:
@@ -731,8 +1184,16 @@ func (vm *VM) evalIntegerFloatInfixExpression(op code.Opcode, left, right object
 			return fmt.Errorf("attempted division by zero: %f / %f", leftVal, rightVal)
 		}
 		vm.stack.Push(&object.Float{Value: leftVal / rightVal})
+	case code.OpIntDiv:
+		if rightVal == 0 {
+			return fmt.Errorf("attempted division by zero: %f ~/ %f", leftVal, rightVal)
+		}
+		vm.stack.Push(&object.Float{Value: math.Trunc(leftVal / rightVal)})
 	case code.OpMod:
-		vm.stack.Push(&object.Float{Value: float64(int(leftVal) % int(rightVal))})
+		if rightVal == 0 {
+			return fmt.Errorf("attempted modulus by zero: %f %% %f", leftVal, rightVal)
+		}
+		vm.stack.Push(&object.Float{Value: math.Mod(leftVal, rightVal)})
 	case code.OpPower:
 		vm.stack.Push(&object.Float{Value: math.Pow(leftVal, rightVal)})
 	case code.OpLess:
@@ -743,10 +1204,6 @@ func (vm *VM) evalIntegerFloatInfixExpression(op code.Opcode, left, right object
 		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal > rightVal))
 	case code.OpGreaterEqual:
 		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal >= rightVal))
-	case code.OpEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal == rightVal))
-	case code.OpNotEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal != rightVal))
 	default:
 		return (fmt.Errorf("unknown operator: %s %s %s", left.Type(), code.String(op), right.Type()))
 	}
@@ -754,16 +1211,141 @@ func (vm *VM) evalIntegerFloatInfixExpression(op code.Opcode, left, right object
 	return nil
 }
 
+// string * integer, or integer * string
+//
+// This repeats the string, so `"-" * 3` is `"---"`.
+func (vm *VM) evalStringRepeat(str *object.String, count *object.Integer) error {
+
+	if count.Value < 0 {
+		return fmt.Errorf("negative repeat count: %d", count.Value)
+	}
+	if len(str.Value) > 0 && count.Value > int64(maxSequenceLength/len(str.Value)) {
+		return fmt.Errorf("repeated string is too large: %d * %d bytes", count.Value, len(str.Value))
+	}
+	if err := vm.charge(len(str.Value) * int(count.Value)); err != nil {
+		return err
+	}
+
+	vm.stack.Push(&object.String{Value: strings.Repeat(str.Value, int(count.Value))})
+	return nil
+}
+
+// array OP array, array * integer, or integer * array
+//
+// Arrays may be concatenated via `+`, repeated via `*`, and `-` returns
+// the elements of the left array which aren't in the right, as `in`
+// would test.  A new array is always created.
+func (vm *VM) evalArrayInfixExpression(op code.Opcode, left, right object.Object) error {
+
+	l, lok := left.(*object.Array)
+	r, rok := right.(*object.Array)
+
+	switch {
+	case op == code.OpAdd && lok && rok:
+		if len(l.Elements)+len(r.Elements) > maxSequenceLength {
+			return fmt.Errorf("concatenated array is too large: %d + %d elements", len(l.Elements), len(r.Elements))
+		}
+		if err := vm.charge(len(l.Elements) + len(r.Elements)); err != nil {
+			return err
+		}
+		elements := make([]object.Object, 0, len(l.Elements)+len(r.Elements))
+		elements = append(elements, l.Elements...)
+		elements = append(elements, r.Elements...)
+		vm.stack.Push(&object.Array{Elements: elements})
+		return nil
+
+	case op == code.OpSub && lok && rok:
+		if err := vm.charge(len(l.Elements) * len(r.Elements)); err != nil {
+			return err
+		}
+		elements := []object.Object{}
+		for _, el := range l.Elements {
+			found := false
+			for _, other := range r.Elements {
+				if object.Equal(el, other) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				elements = append(elements, el)
+			}
+		}
+		vm.stack.Push(&object.Array{Elements: elements})
+		return nil
+
+	case op == code.OpMul && (lok != rok):
+		arr, count := l, right
+		if rok {
+			arr, count = r, left
+		}
+		n, ok := count.(*object.Integer)
+		if !ok {
+			break
+		}
+		if n.Value < 0 {
+			return fmt.Errorf("negative repeat count: %d", n.Value)
+		}
+		if len(arr.Elements) > 0 && n.Value > int64(maxSequenceLength/len(arr.Elements)) {
+			return fmt.Errorf("repeated array is too large: %d * %d elements", n.Value, len(arr.Elements))
+		}
+		if err := vm.charge(len(arr.Elements) * int(n.Value)); err != nil {
+			return err
+		}
+		elements := make([]object.Object, 0, len(arr.Elements)*int(n.Value))
+		for i := int64(0); len(arr.Elements) > 0 && i < n.Value; i++ {
+			elements = append(elements, arr.Elements...)
+		}
+		vm.stack.Push(&object.Array{Elements: elements})
+		return nil
+	}
+
+	if left.Type() != right.Type() {
+		return fmt.Errorf("type mismatch: %s %s %s",
+			left.Type(), code.String(op), right.Type())
+	}
+	return fmt.Errorf("unknown operator: %s %s %s",
+		left.Type(), code.String(op), right.Type())
+}
+
+// isNumeric returns true if the given object is an integer or a float.
+func (vm *VM) isNumeric(obj object.Object) bool {
+	return obj.Type() == object.INTEGER || obj.Type() == object.FLOAT
+}
+
+// isNaN returns true if the given object is a float whose value is NaN.
+func (vm *VM) isNaN(obj object.Object) bool {
+	f, ok := obj.(*object.Float)
+	return ok && math.IsNaN(f.Value)
+}
+
+// nanError returns the error raised when NaN is compared, which is never
+// equal to, or ordered with, anything - so the comparison would always be
+// false, or true for `!=`, which would silently hide the mistake which
+// produced it.
+func (vm *VM) nanError(op code.Opcode, left, right object.Object) error {
+	return fmt.Errorf("comparison involving NaN: %s %s %s", left.Inspect(), code.String(op), right.Inspect())
+}
+
+// toFloat promotes the given numeric object to a float64.
+//
+// The caller is expected to have tested the object via isNumeric.
+func (vm *VM) toFloat(obj object.Object) float64 {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return float64(obj.Value)
+	case *object.Float:
+		return obj.Value
+	}
+	return 0
+}
+
 // string OP string
 func (vm *VM) evalStringInfixExpression(op code.Opcode, left object.Object, right object.Object) error {
 	l := left.(*object.String)
 	r := right.(*object.String)
 
 	switch op {
-	case code.OpEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(l.Value == r.Value))
-	case code.OpNotEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(l.Value != r.Value))
 	case code.OpGreaterEqual:
 		vm.stack.Push(vm.nativeBoolToBooleanObject(l.Value >= r.Value))
 	case code.OpGreater:
@@ -772,36 +1354,34 @@ func (vm *VM) evalStringInfixExpression(op code.Opcode, left object.Object, righ
 		vm.stack.Push(vm.nativeBoolToBooleanObject(l.Value <= r.Value))
 	case code.OpLess:
 		vm.stack.Push(vm.nativeBoolToBooleanObject(l.Value < r.Value))
-	case code.OpMatches:
-		args := []object.Object{l, r}
-		fn, ok := vm.environment.GetFunction("match")
-		if !ok {
-			return (fmt.Errorf("failed to lookup match-function"))
+	case code.OpMatches, code.OpNotMatches, code.OpIMatches, code.OpNotIMatches:
+
+		// The case-insensitive variants prefix the regular
+		// expression with the appropriate flag, unless the
+		// compiler has already done so.
+		if op == code.OpIMatches || op == code.OpNotIMatches {
+			if r.Regexp == nil || !strings.HasPrefix(r.Value, "(?i)") {
+				r = &object.String{Value: "(?i)" + r.Value}
+			}
 		}
-		out := fn.(func(args []object.Object) object.Object)
-		ret := out(args)
 
-		if ret.(*object.Boolean).Value {
-			vm.stack.Push(True)
-		} else {
-			vm.stack.Push(False)
-		}
-	case code.OpNotMatches:
-		args := []object.Object{l, r}
-		fn, ok := vm.environment.GetFunction("match")
-		if !ok {
-			return (fmt.Errorf("failed to lookup match-function"))
+		matched, err := vm.match(l, r)
+		if err != nil {
+			return err
 		}
-		out := fn.(func(args []object.Object) object.Object)
-		ret := out(args)
 
-		if ret.(*object.Boolean).Value {
-			vm.stack.Push(False)
-		} else {
-			vm.stack.Push(True)
+		if op == code.OpNotMatches || op == code.OpNotIMatches {
+			matched = !matched
 		}
+		vm.stack.Push(vm.nativeBoolToBooleanObject(matched))
 
 	case code.OpAdd:
+		if len(l.Value)+len(r.Value) > maxSequenceLength {
+			return fmt.Errorf("concatenated string is too large: %d + %d bytes", len(l.Value), len(r.Value))
+		}
+		if err := vm.charge(len(l.Value) + len(r.Value)); err != nil {
+			return err
+		}
 		vm.stack.Push(&object.String{Value: l.Value + r.Value})
 	default:
 		return (fmt.Errorf("unknown operator: %s %s %s", left.Type(), code.String(op), right.Type()))
@@ -810,18 +1390,104 @@ func (vm *VM) evalStringInfixExpression(op code.Opcode, left object.Object, righ
 	return nil
 }
 
-// bool OP bool
-func (vm *VM) evalBooleanInfixExpression(op code.Opcode, left object.Object, right object.Object) error {
-	// convert the bools to strings.
-	l := &object.String{Value: left.Inspect()}
-	r := &object.String{Value: right.Inspect()}
+// match returns true if the string matches the given regular expression,
+// using the `match` function of our environment.
+func (vm *VM) match(str *object.String, reg *object.String) (bool, error) {
 
-	// then reuse our implementation, which will work
-	// but might give some "interesting" results.
-	//
-	// e.g. "false < true"
-	//
-	return (vm.evalStringInfixExpression(op, l, r))
+	fn, ok := vm.environment.GetFunction("match")
+	if !ok {
+		return false, fmt.Errorf("failed to lookup match-function")
+	}
+	ret, err := vm.callFunction("match", fn, []object.Object{str, reg})
+	if err != nil {
+		return false, err
+	}
+	if e, ok := ret.(*object.Error); ok {
+		return false, e
+	}
+
+	return ret.True(), nil
+}
+
+// executeIn tests whether a value is a member of a collection.
+//
+// Sets and hashes are tested in constant time, by the value's key, while
+// arrays are scanned for an element which is equal to the value.  For
+// strings we test whether the value is a substring.
+func (vm *VM) executeIn() error {
+	collection, err := vm.stack.Pop()
+	if err != nil {
+		return err
+	}
+	val, err := vm.stack.Pop()
+	if err != nil {
+		return err
+	}
+
+	switch c := collection.(type) {
+	case *object.Set:
+		vm.stack.Push(vm.nativeBoolToBooleanObject(c.Contains(val)))
+	case *object.Hash:
+		key, ok := object.HashKey(val)
+		if ok {
+			_, ok = c.Pairs[key]
+		}
+		vm.stack.Push(vm.nativeBoolToBooleanObject(ok))
+	case *object.Array:
+		found := false
+		for _, el := range c.Elements {
+			if object.Equal(val, el) {
+				found = true
+				break
+			}
+		}
+		vm.stack.Push(vm.nativeBoolToBooleanObject(found))
+	case *object.String:
+		vm.stack.Push(vm.nativeBoolToBooleanObject(strings.Contains(c.Value, val.Inspect())))
+	default:
+		return fmt.Errorf("the 'in' operator doesn't support %s", collection.Type())
+	}
+	return nil
+}
+
+// executeBetween tests whether a value lies within a range, inclusive.
+//
+// The value is compared with each bound as `>=` and `<=` would, so the
+// same types may be compared, and the upper bound is only examined if
+// the value is not below the lower bound.
+func (vm *VM) executeBetween() error {
+	high, err := vm.stack.Pop()
+	if err != nil {
+		return err
+	}
+	low, err := vm.stack.Pop()
+	if err != nil {
+		return err
+	}
+	val, err := vm.stack.Pop()
+	if err != nil {
+		return err
+	}
+
+	vm.stack.Push(val)
+	vm.stack.Push(low)
+	err = vm.executeBinaryOperation(code.OpGreaterEqual)
+	if err != nil {
+		return err
+	}
+
+	res, err := vm.stack.Pop()
+	if err != nil {
+		return err
+	}
+	if !res.True() {
+		vm.stack.Push(False)
+		return nil
+	}
+
+	vm.stack.Push(val)
+	vm.stack.Push(high)
+	return vm.executeBinaryOperation(code.OpLessEqual)
 }
 
 // Implement the "!" (prefix) operator.
@@ -831,14 +1497,18 @@ func (vm *VM) executeBangOperator() error {
 		return err
 	}
 
-	switch operand {
-	case True:
-		vm.stack.Push(False)
-	case False:
-		vm.stack.Push(True)
-	case Null:
+	//
+	// Functions return their own boolean objects, rather than
+	// our global true/false values, so test the value here.
+	//
+	if b, ok := operand.(*object.Boolean); ok {
+		vm.stack.Push(vm.nativeBoolToBooleanObject(!b.Value))
+		return nil
+	}
+
+	if operand.Type() == object.NULL {
 		vm.stack.Push(True)
-	default:
+	} else {
 		vm.stack.Push(False)
 	}
 	return nil
@@ -854,7 +1524,10 @@ func (vm *VM) executeMinusOperator() error {
 
 	switch obj := operand.(type) {
 	case *object.Integer:
-		res = &object.Integer{Value: -obj.Value}
+		if obj.Value == math.MinInt64 {
+			return fmt.Errorf("integer overflow: -(%d)", obj.Value)
+		}
+		res = object.NewInteger(-obj.Value)
 	case *object.Float:
 		res = &object.Float{Value: -obj.Value}
 	default:
@@ -865,6 +1538,22 @@ func (vm *VM) executeMinusOperator() error {
 	return nil
 }
 
+// Implement the "~" (prefix) operator, for bitwise complement.
+func (vm *VM) executeBitNotOperator() error {
+	operand, err := vm.stack.Pop()
+	if err != nil {
+		return err
+	}
+
+	obj, ok := operand.(*object.Integer)
+	if !ok {
+		return fmt.Errorf("unsupported type for bitwise complement: %s", operand.Type())
+	}
+
+	vm.stack.Push(object.NewInteger(^obj.Value))
+	return nil
+}
+
 // The square root operation is just too cute :).
 func (vm *VM) executeSquareRoot() error {
 	operand, err := vm.stack.Pop()
@@ -886,6 +1575,67 @@ func (vm *VM) executeSquareRoot() error {
 	return nil
 }
 
+// mulInt64 multiplies two integers, returning false if the result
+// would overflow.
+func mulInt64(a, b int64) (int64, bool) {
+	if a == 0 || b == 0 {
+		return 0, true
+	}
+	res := a * b
+	if res/b != a || (a == -1 && b == math.MinInt64) || (b == -1 && a == math.MinInt64) {
+		return 0, false
+	}
+	return res, true
+}
+
+// shlInt64 shifts an integer left by the given, non-negative, count,
+// returning false if the result would overflow.
+//
+// Shifting zero always gives zero, however large the count.
+func shlInt64(a, n int64) (int64, bool) {
+	if a == 0 {
+		return 0, true
+	}
+	if n >= 64 {
+		return 0, false
+	}
+	res := a << uint64(n)
+	if res>>uint64(n) != a {
+		return 0, false
+	}
+	return res, true
+}
+
+// powInt64 raises an integer to the given power, returning false if
+// the result would overflow.
+//
+// Negative exponents produce fractional results, which are truncated
+// towards zero as they always have been.
+func powInt64(base, exp int64) (int64, bool) {
+	if exp < 0 {
+		return int64(math.Pow(float64(base), float64(exp))), true
+	}
+
+	res := int64(1)
+	for exp > 0 {
+		var ok bool
+		if exp&1 == 1 {
+			res, ok = mulInt64(res, base)
+			if !ok {
+				return 0, false
+			}
+		}
+		exp >>= 1
+		if exp > 0 {
+			base, ok = mulInt64(base, base)
+			if !ok {
+				return 0, false
+			}
+		}
+	}
+	return res, true
+}
+
 // convert a native (go) boolean to an Object
 func (vm *VM) nativeBoolToBooleanObject(input bool) *object.Boolean {
 	if input {
@@ -905,25 +1655,68 @@ func (vm *VM) lookup(obj interface{}, name string) object.Object {
 	//
 	// Look for this as a variable first, they take precedence.
 	//
-	if val, ok := vm.environment.Get(name); ok {
+	if val, ok := vm.scope.Get(name); ok {
 		return val
 	}
 
+	return vm.lookupObject(obj, name)
+}
+
+// lookupObject returns the value of the named field of the given object,
+// converting it if it hasn't been converted already.
+func (vm *VM) lookupObject(obj interface{}, name string) object.Object {
+
+	//
+	// If the object can supply its own fields then ask it.
+	//
+	if provider, ok := obj.(fieldProvider); ok {
+		if val, found := provider.GetField(name); found {
+			if val == nil {
+				return Null
+			}
+			return val
+		}
+	}
+
 	//
 	// Now we assume this is a reference to a map-key, or
 	// object member.
 	//
-	// If we've not discovered them then do so now
+	// If we've already converted it then we're done.
 	//
-	if len(vm.fields) == 0 {
-		vm.inspectObject(obj)
+	if cached, found := vm.fields[name]; found {
+		return cached
 	}
 
 	//
-	// Now perform the lookup
+	// The host may supply the field itself.
 	//
-	if cached, found := vm.fields[name]; found {
-		return cached
+	if fn, found := vm.accessors[name]; found && obj != nil {
+		val := vm.access(obj, fn)
+		vm.fields[name] = val
+		return val
+	}
+
+	//
+	// If the object is a structure we can convert just the
+	// field we're interested in.
+	//
+	if val, found := vm.lookupField(obj, name); found {
+		vm.fields[name] = val
+		return val
+	}
+
+	//
+	// Otherwise, if we've not discovered them, convert all the
+	// fields now.
+	//
+	if !vm.inspected {
+		vm.inspectObject(obj)
+		vm.inspected = true
+
+		if cached, found := vm.fields[name]; found {
+			return cached
+		}
 	}
 
 	//
@@ -932,12 +1725,155 @@ func (vm *VM) lookup(obj interface{}, name string) object.Object {
 	return Null
 }
 
+// lookupField converts the named field of the given structure, without
+// converting any of its other fields.
+//
+// The location of the field is discovered via reflection the first time
+// it is used for each structure type, and cached for the future.  We
+// return false if the object isn't a structure, or if the field could
+// not be found.
+func (vm *VM) lookupField(obj interface{}, name string) (object.Object, bool) {
+
+	if obj == nil {
+		return nil, false
+	}
+
+	val := reflect.ValueOf(obj)
+	if val.Kind() == reflect.Ptr {
+		if val.IsNil() {
+			return nil, false
+		}
+		val = val.Elem()
+	}
+	if val.Kind() != reflect.Struct {
+		return nil, false
+	}
+
+	fields, ok := vm.types[val.Type()]
+	if !ok {
+		fields = make(map[string][]int)
+		vm.types[val.Type()] = fields
+	}
+
+	index, ok := fields[name]
+	if !ok {
+		if field, found := val.Type().FieldByName(name); found {
+			index = field.Index
+		}
+		fields[name] = index
+	}
+	if index == nil {
+		return vm.lookupMethod(obj, name)
+	}
+
+	//
+	// The field might be promoted from an embedded structure, in
+	// which case we need to follow the path to it.
+	//
+	for i, n := range index {
+		if i > 0 && val.Kind() == reflect.Ptr {
+			if val.IsNil() {
+				return Null, true
+			}
+			val = val.Elem()
+		}
+		val = val.Field(n)
+	}
+
+	ret := vm.valueToObject(val)
+	if ret == nil {
+		ret = Null
+	}
+	return ret, true
+}
+
+// callMethod returns the result of calling the named method of the given
+// structure, for calls such as `Age()`, if it may be read as a field.
+//
+// The result is cached along with the fields, so the method is called
+// once per run, however it's referred to.
+func (vm *VM) callMethod(obj interface{}, name string) (object.Object, bool) {
+
+	if obj == nil || reflect.Indirect(reflect.ValueOf(obj)).Kind() != reflect.Struct {
+		return nil, false
+	}
+
+	if cached, found := vm.fields[name]; found {
+		return cached, true
+	}
+	val, found := vm.lookupMethod(obj, name)
+	if found {
+		vm.fields[name] = val
+	}
+	return val, found
+}
+
+// lookupMethod returns the result of calling the named method of the
+// given structure, if it has an exported method of that name which takes
+// no arguments and returns a single value, so that values derived from
+// its fields, such as an age from a date of birth, may be read as if they
+// were fields.
+//
+// As with fields the method is found via reflection the first time it is
+// used for each type, and cached for the future.
+func (vm *VM) lookupMethod(obj interface{}, name string) (object.Object, bool) {
+
+	val := reflect.ValueOf(obj)
+
+	methods, ok := vm.methods[val.Type()]
+	if !ok {
+		methods = make(map[string]int)
+		vm.methods[val.Type()] = methods
+	}
+
+	index, ok := methods[name]
+	if !ok {
+		index = -1
+		if method, found := val.Type().MethodByName(name); found {
+			// The receiver is the method's first input.
+			if method.Type.NumIn() == 1 && method.Type.NumOut() == 1 {
+				index = method.Index
+			}
+		}
+		methods[name] = index
+	}
+	if index < 0 {
+		return nil, false
+	}
+
+	ret := vm.valueToObject(val.Method(index).Call(nil)[0])
+	if ret == nil {
+		ret = Null
+	}
+	return ret, true
+}
+
 // executeIndexExpression lookup the array value at the given index.
 func (vm *VM) executeIndexExpression(left, index object.Object) error {
 
+	// Hashes are indexed by name.
+	if hash, ok := left.(*object.Hash); ok {
+		if index.Type() != object.STRING {
+			return fmt.Errorf("hash index must be a string, not %s", index.Type())
+		}
+		val, found := hash.Pairs[index.(*object.String).HashKey()]
+		if !found {
+			vm.stack.Push(Null)
+			return nil
+		}
+		vm.stack.Push(val)
+		return nil
+	}
+
+	// Indexing null, such as a missing member of a hash, is null.
+	if left.Type() == object.NULL {
+		vm.stack.Push(Null)
+		return nil
+	}
+
 	// Check arguments
 	if left.Type() != object.ARRAY && left.Type() != object.STRING {
-		return fmt.Errorf("the index operator can only be applied to strings and arrays, not %s", left.Type())
+		return fmt.Errorf("the index operator can only be applied to strings, arrays, and hashes, not %s", left.Type())
 	}
 	if index.Type() != object.INTEGER {
 		return fmt.Errorf("index operator must be given an integer, not %s", index.Type())
@@ -949,12 +1885,18 @@ func (vm *VM) executeIndexExpression(left, index object.Object) error {
 	// Looking at a string?
 	if left.Type() == object.STRING {
 
-		str := left.(*object.String).Inspect()
-		if idx < 0 || int(idx) > len(str) {
-			vm.stack.Push(Null)
-			return nil
+		// Strings are indexed by character, not byte.
+		if idx >= 0 {
+			n := int64(0)
+			for _, r := range left.(*object.String).Value {
+				if n == idx {
+					vm.stack.Push(&object.String{Value: string(r)})
+					return nil
+				}
+				n++
+			}
 		}
-		vm.stack.Push(&object.String{Value: string(str[idx])})
+		vm.stack.Push(Null)
 		return nil
 	}
 
@@ -0,0 +1,256 @@
+// warnings.go contains code for finding the probable mistakes in a script,
+// which are reported as warnings rather than preventing it from running.
+
+package evalfilter
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/skx/evalfilter/v2/ast"
+)
+
+// regexpProbes holds the strings we test a regular expression against to
+// find out whether it matches everything.
+var regexpProbes = []string{"", "\n", "a", "Z 9", "ünïcödé", "\x00"}
+
+// Warning describes something in a script which is probably a mistake,
+// but which doesn't prevent it from being run.
+type Warning struct {
+	// Message describes the problem.
+	Message string
+
+	// Line is the line of the script upon which it was found.
+	Line int
+
+	// Source is the name of the included script in which it was
+	// found, or the empty string for the script itself.
+	Source string
+}
+
+// String returns a human-readable description of the warning.
+func (w Warning) String() string {
+	if w.Source != "" {
+		return fmt.Sprintf("%s:%d: %s", w.Source, w.Line, w.Message)
+	}
+	return fmt.Sprintf("line %d: %s", w.Line, w.Message)
+}
+
+// Warnings returns the warnings found when the script, and any scripts
+// it includes, were prepared.
+//
+// We report comparisons between literals of different types, which
+// always fail, variables which are set but never used, assignments which
+// hide a field the script has already read, code which follows a
+// `return`, and regular expressions which match everything.
+func (e *Eval) Warnings() []Warning {
+	return append([]Warning(nil), e.warnings...)
+}
+
+// checkWarnings appends the warnings for the given program, which is
+// either our script or the named script it includes, to our list.
+func (e *Eval) checkWarnings(program *ast.Program, source string) {
+
+	var found []Warning
+	warn := func(line int, format string, args ...interface{}) {
+		found = append(found, Warning{Message: fmt.Sprintf(format, args...), Line: line, Source: source})
+	}
+
+	//
+	// The variables the script sets, each at the place it is first
+	// set, and the names of those which have been read.
+	//
+	var written []*ast.Identifier
+	declared := make(map[string]bool)
+	read := make(map[string]bool)
+
+	// The identifiers which are set, rather than read.
+	set := make(map[*ast.Identifier]bool)
+
+	var visit func(node ast.Node) bool
+
+	//
+	// write records that the given variable is set to the given
+	// value, which is read first.
+	//
+	// If a name is read before the script first sets it then it
+	// refers to a field, which is hidden by the variable from then
+	// on - unless the host has defined a variable of that name.
+	//
+	write := func(name *ast.Identifier, value ast.Expression, let bool) {
+		set[name] = true
+		if value != nil {
+			ast.Walk(value, visit)
+		}
+
+		v := variableName(name.Value)
+		if _, found := declared[v]; found {
+			return
+		}
+		if _, host := e.environment.Get(v); read[v] && !host {
+			warn(name.Token.Line, "assignment to %s shadows the field of the same name", v)
+		}
+		written = append(written, name)
+		declared[v] = let
+	}
+
+	visit = func(node ast.Node) bool {
+
+		switch n := node.(type) {
+
+		case *ast.Program:
+			if s := unreachable(n.Statements); s != nil {
+				warn(statementLine(s), "unreachable code")
+			}
+
+		case *ast.BlockStatement:
+			if s := unreachable(n.Statements); s != nil {
+				warn(statementLine(s), "unreachable code")
+			}
+
+		case *ast.LetStatement:
+			if n.Name != nil {
+				write(n.Name, n.Value, true)
+				return false
+			}
+
+		case *ast.AssignStatement:
+			if n.Name != nil {
+				write(n.Name, n.Value, false)
+				return false
+			}
+
+		case *ast.FunctionLiteral:
+			for _, p := range n.Parameters {
+				set[p] = true
+			}
+
+		case *ast.Identifier:
+			if !set[n] {
+				read[variableName(n.Value)] = true
+			}
+
+		case *ast.InfixExpression:
+			switch n.Operator {
+			case "==", "!=", "<", "<=", ">", ">=":
+				l, lok := literalType(n.Left)
+				r, rok := literalType(n.Right)
+				if lok && rok && l != r {
+					warn(n.Token.Line, "comparison of a %s and a %s always fails: %s", l, r, n.String())
+				}
+			}
+
+		case *ast.RegexpLiteral:
+			if regexpMatchesAll(n) {
+				warn(n.Token.Line, "the regular expression %s matches everything", n.String())
+			}
+		}
+		return true
+	}
+	ast.Walk(program, visit)
+
+	//
+	// Variables which persist between runs may be read by the next
+	// run, so only those declared via `let` are certainly unused.
+	//
+	for _, name := range written {
+		v := variableName(name.Value)
+		switch {
+		case read[v]:
+		case declared[v]:
+			warn(name.Token.Line, "variable %s is declared but never used", name.Value)
+		case !e.persistent:
+			warn(name.Token.Line, "variable %s is assigned but never used", name.Value)
+		}
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].Line < found[j].Line
+	})
+	e.warnings = append(e.warnings, found...)
+}
+
+// unreachable returns the first of the given statements which follows
+// one that always returns, or nil if there is no such statement.
+//
+// Named rules, and tests, are compiled separately, so they're ignored.
+func unreachable(stmts []ast.Statement) ast.Statement {
+	returned := false
+	for _, s := range stmts {
+		switch s.(type) {
+		case *ast.RuleStatement, *ast.TestStatement:
+			continue
+		}
+		if returned {
+			return s
+		}
+		returned = returns(s)
+	}
+	return nil
+}
+
+// returns is true if the given statement always returns, which is the
+// case for a `return`, and an `if` whose branches both return.
+func returns(stmt ast.Statement) bool {
+	switch s := stmt.(type) {
+	case *ast.ReturnStatement:
+		return true
+	case *ast.BlockStatement:
+		for _, st := range s.Statements {
+			if returns(st) {
+				return true
+			}
+		}
+	case *ast.ExpressionStatement:
+		if n, ok := s.Expression.(*ast.IfExpression); ok && n.Consequence != nil && n.Alternative != nil {
+			return returns(n.Consequence) && returns(n.Alternative)
+		}
+	}
+	return false
+}
+
+// variableName returns the name of the variable the given identifier
+// refers to, which for `a.b` is `a`.
+func variableName(name string) string {
+	name = strings.TrimPrefix(name, "$")
+	if i := strings.Index(name, "."); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// literalType returns the type of the given expression, if it's a literal
+// which can be compared.  Integers and floats may be compared with each
+// other, so they're both numbers.
+func literalType(expr ast.Expression) (string, bool) {
+	switch expr.(type) {
+	case *ast.IntegerLiteral, *ast.FloatLiteral:
+		return "number", true
+	case *ast.StringLiteral:
+		return "string", true
+	case *ast.BooleanLiteral:
+		return "boolean", true
+	}
+	return "", false
+}
+
+// regexpMatchesAll returns true if the given regular expression matches
+// every string, such as `/.*/`, which makes testing it pointless.
+func regexpMatchesAll(node *ast.RegexpLiteral) bool {
+	val := node.Value
+	if node.Flags != "" {
+		val = "(?" + node.Flags + ")" + val
+	}
+	r, err := regexp.Compile(val)
+	if err != nil {
+		return false
+	}
+	for _, probe := range regexpProbes {
+		if !r.MatchString(probe) {
+			return false
+		}
+	}
+	return true
+}